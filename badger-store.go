@@ -0,0 +1,147 @@
+package redwood
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// badgerStore is the Badger DB behind the host's small record stores (its outbox and its
+// mailbox).  Each record is stored as JSON under a key that starts with the store's name.
+type badgerStore struct {
+	*ctx.Context
+	db         *badger.DB
+	dbMu       sync.RWMutex // Held for writing while the DB is opened or closed
+	name       string
+	dbFilename string
+	dbOptions  tree.DBTreeOptions
+	address    types.Address
+	chGCDone   <-chan struct{}
+}
+
+func newBadgerStore(name string, dbFilename string, address types.Address, dbOptions tree.DBTreeOptions) *badgerStore {
+	return &badgerStore{
+		Context:    &ctx.Context{},
+		name:       name,
+		dbFilename: dbFilename,
+		dbOptions:  dbOptions,
+		address:    address,
+	}
+}
+
+func (s *badgerStore) Start() error {
+	return s.CtxStart(
+		// on startup
+		func() error {
+			s.SetLogLabel(s.address.Pretty() + " " + s.name + ":badger")
+			if s.dbOptions.InMemory {
+				s.Infof(0, "opening in-memory badger %v", s.name)
+			} else {
+				s.Infof(0, "opening badger %v at %v", s.name, s.dbFilename)
+			}
+			db, err := badger.Open(s.dbOptions.BadgerOptions(s.dbFilename))
+			if err != nil {
+				return err
+			}
+			s.dbMu.Lock()
+			s.db = db
+			s.dbMu.Unlock()
+			s.chGCDone = startValueLogGC(s.Context.Done(), s.dbOptions, func() {
+				collectValueLogGarbage(s, s.name, s.dbOptions, func(discardRatio float64) (int, error) {
+					return tree.CollectValueLogGarbage(s.db, discardRatio)
+				})
+			})
+			return nil
+		},
+		nil,
+		nil,
+		// on shutdown
+		func() {
+			if s.chGCDone != nil {
+				<-s.chGCDone
+			}
+			// The host's loops may still be reading the store as it shuts down
+			s.dbMu.Lock()
+			defer s.dbMu.Unlock()
+			s.db.Close()
+			s.db = nil
+		},
+	)
+}
+
+var ErrStoreClosed = errors.New("store is closed")
+
+func (s *badgerStore) view(fn func(txn *badger.Txn) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+	if s.db == nil {
+		return errors.WithStack(ErrStoreClosed)
+	}
+	return s.db.View(fn)
+}
+
+func (s *badgerStore) update(fn func(txn *badger.Txn) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+	if s.db == nil {
+		return errors.WithStack(ErrStoreClosed)
+	}
+	return s.db.Update(fn)
+}
+
+// key returns the key of a record in the store.  Each part narrows down the records that
+// a prefix scan will turn up, so the most general part goes first.
+func (s *badgerStore) key(parts ...[]byte) []byte {
+	key := []byte(s.name + ":")
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
+
+func (s *badgerStore) putRecord(txn *badger.Txn, key []byte, record interface{}) error {
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return txn.Set(key, bs)
+}
+
+// scanRecords calls fn with the key and value of each record whose key starts with the
+// given prefix, in key order, until fn returns an error.  The slices are only valid until
+// fn returns.
+func (s *badgerStore) scanRecords(txn *badger.Txn, prefix []byte, fn func(key, val []byte) error) error {
+	badgerIter := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer badgerIter.Close()
+
+	for badgerIter.Seek(prefix); badgerIter.ValidForPrefix(prefix); badgerIter.Next() {
+		item := badgerIter.Item()
+		err := item.Value(func(val []byte) error {
+			return fn(item.Key(), val)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countRecords returns how many records' keys start with the given prefix.
+func (s *badgerStore) countRecords(txn *badger.Txn, prefix []byte) int {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	badgerIter := txn.NewIterator(opts)
+	defer badgerIter.Close()
+
+	var n int
+	for badgerIter.Seek(prefix); badgerIter.ValidForPrefix(prefix); badgerIter.Next() {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package redwood
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+// TxBloomFilter is a compact, lossy set of tx IDs.  A subscriber sends one listing the
+// txs that it already has, so that the provider can leave them out of the history that it
+// sends (see SubscribeMsg).  MayContain never says no to a tx that was added, but it says
+// yes to roughly TxBloomFilterFalsePositiveRate of the txs that weren't.
+type TxBloomFilter struct {
+	bits      []byte
+	numHashes int
+}
+
+// TxBloomFilterFalsePositiveRate is the rate that filters are sized for.  At 1%, a filter
+// takes up a little over a byte per tx.
+const TxBloomFilterFalsePositiveRate = 0.01
+
+// Filters from peers that claim to use more hashes than this are refused, since checking
+// them would cost more than it could ever save
+const maxTxBloomFilterHashes = 32
+
+// NewTxBloomFilter returns an empty filter sized to hold numTxs txs.
+func NewTxBloomFilter(numTxs int) *TxBloomFilter {
+	if numTxs < 1 {
+		numTxs = 1
+	}
+	numBits := math.Ceil(-float64(numTxs) * math.Log(TxBloomFilterFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	numHashes := int(math.Round(numBits / float64(numTxs) * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return &TxBloomFilter{
+		bits:      make([]byte, (int(numBits)+7)/8),
+		numHashes: numHashes,
+	}
+}
+
+func (f *TxBloomFilter) Add(txID types.ID) {
+	f.forEachBit(txID, func(byteIdx int, mask byte) bool {
+		f.bits[byteIdx] |= mask
+		return true
+	})
+}
+
+func (f *TxBloomFilter) MayContain(txID types.ID) bool {
+	if f == nil {
+		return false
+	}
+	contains := true
+	f.forEachBit(txID, func(byteIdx int, mask byte) bool {
+		contains = f.bits[byteIdx]&mask != 0
+		return contains
+	})
+	return contains
+}
+
+// forEachBit calls fn with each of the bits that stand for the given tx, until fn returns
+// false.  The bits are picked by double hashing, which is as good as using numHashes
+// independent hashes.
+func (f *TxBloomFilter) forEachBit(txID types.ID, fn func(byteIdx int, mask byte) bool) {
+	numBits := uint64(len(f.bits)) * 8
+	if numBits == 0 {
+		return
+	}
+	hash := sha256.Sum256(txID[:])
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16])
+	for i := 0; i < f.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % numBits
+		if !fn(int(bit/8), 1<<(bit%8)) {
+			return
+		}
+	}
+}
+
+// MarshalText encodes the filter as its number of hashes and its base64-encoded bits,
+// separated by a colon.  It's used for the filter's JSON form as well as for the body of
+// the HTTP transport's subscription requests.
+func (f TxBloomFilter) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(f.numHashes) + ":" + base64.RawURLEncoding.EncodeToString(f.bits)), nil
+}
+
+func (f *TxBloomFilter) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), ":", 2)
+	if len(parts) != 2 {
+		return errors.New("bad tx bloom filter")
+	}
+	numHashes, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return errors.Wrap(err, "bad tx bloom filter")
+	} else if numHashes < 1 || numHashes > maxTxBloomFilterHashes {
+		return errors.Errorf("bad tx bloom filter: %v hashes", numHashes)
+	}
+	bits, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Wrap(err, "bad tx bloom filter")
+	}
+	f.numHashes = numHashes
+	f.bits = bits
+	return nil
+}
@@ -0,0 +1,54 @@
+package redwood
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestTxBloomFilter(t *testing.T) {
+	const numTxs = 1000
+	filter := NewTxBloomFilter(numTxs)
+	var added []types.ID
+	for i := 0; i < numTxs; i++ {
+		txID := types.RandomID()
+		filter.Add(txID)
+		added = append(added, txID)
+	}
+
+	// No false negatives, and about as many false positives as the filter was sized for
+	for _, txID := range added {
+		require.True(t, filter.MayContain(txID))
+	}
+	var falsePositives int
+	for i := 0; i < numTxs; i++ {
+		if filter.MayContain(types.RandomID()) {
+			falsePositives++
+		}
+	}
+	require.Less(t, float64(falsePositives), numTxs*3*TxBloomFilterFalsePositiveRate)
+
+	t.Run("survives a round trip through JSON", func(t *testing.T) {
+		bs, err := json.Marshal(SubscribeMsg{StateURI: "localhost/test", KnownTxs: filter})
+		require.NoError(t, err)
+
+		var subMsg SubscribeMsg
+		err = json.Unmarshal(bs, &subMsg)
+		require.NoError(t, err)
+		require.Equal(t, filter, subMsg.KnownTxs)
+	})
+
+	t.Run("a nil filter holds nothing", func(t *testing.T) {
+		var filter *TxBloomFilter
+		require.False(t, filter.MayContain(added[0]))
+	})
+
+	t.Run("filters with absurd numbers of hashes are refused", func(t *testing.T) {
+		var filter TxBloomFilter
+		require.Error(t, filter.UnmarshalText([]byte("1000000:AAAA")))
+		require.Error(t, filter.UnmarshalText([]byte("0:AAAA")))
+	})
+}
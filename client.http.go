@@ -186,6 +186,8 @@ func (c *httpClient) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
 	return &tx, nil
 }
 
+// Get returns the state at the given keypath, along with the leaves of the stateURI's
+// DAG.  A tx that builds on the returned state should use the leaves as its parents.
 func (c *httpClient) Get(stateURI string, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
 	client := c.client()
 	url := c.peerReachableAddress + "/" + string(keypath)
@@ -204,7 +206,7 @@ func (c *httpClient) Get(stateURI string, version *types.ID, keypath tree.Keypat
 		req.Header.Set("Version", version.Hex())
 	}
 	if rng != nil {
-		req.Header.Set("Range", fmt.Sprintf("json=%d:%d", rng[0], rng[1]))
+		req.Header.Set("Range", fmt.Sprintf("json=%d:%d", rng.Start(), rng.End()))
 	}
 
 	resp, err := client.Do(req)
@@ -225,20 +227,20 @@ func (c *httpClient) Get(stateURI string, version *types.ID, keypath tree.Keypat
 		}
 	}
 
-	var parents []types.ID
-	if parentsHeader := resp.Header.Get("Parents"); parentsHeader != "" {
-		parentStrs := strings.Split(parentsHeader, ",")
-		for _, pstr := range parentStrs {
-			pstr = strings.TrimSpace(pstr)
-			pid, err := types.IDFromHex(pstr)
+	var leaves []types.ID
+	if leavesHeader := resp.Header.Get("Leaves"); leavesHeader != "" {
+		leafStrs := strings.Split(leavesHeader, ",")
+		for _, leafStr := range leafStrs {
+			leafStr = strings.TrimSpace(leafStr)
+			leafID, err := types.IDFromHex(leafStr)
 			if err != nil {
-				return nil, 0, nil, errors.New("bad parents header")
+				return nil, 0, nil, errors.New("bad leaves header")
 			}
-			parents = append(parents, pid)
+			leaves = append(leaves, leafID)
 		}
 	}
 
-	return resp.Body, int64(contentLength), parents, nil
+	return resp.Body, int64(contentLength), leaves, nil
 }
 
 func (c *httpClient) Put(tx *Tx) error {
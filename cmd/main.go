@@ -4,9 +4,11 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"time"
 
 	rw "github.com/brynbellomy/redwood"
 	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/types"
 )
 
 type app struct {
@@ -30,7 +32,13 @@ func main() {
 		panic(err)
 	}
 
-	signingKeypair, err := rw.SigningKeypairFromHDMnemonic(config.HDMnemonicPhrase, rw.DefaultHDDerivationPath)
+	// Every node in the network has to derive addresses the same way
+	addressDerivation, err := rw.AddressDerivationByName(config.AddressDerivation)
+	if err != nil {
+		panic(err)
+	}
+
+	signingKeypair, err := rw.SigningKeypairFromHDMnemonicWithAddressDerivation(config.HDMnemonicPhrase, rw.DefaultHDDerivationPath, addressDerivation)
 	if err != nil {
 		panic(err)
 	}
@@ -40,12 +48,72 @@ func main() {
 		panic(err)
 	}
 
-	txStore := rw.NewBadgerTxStore(config.TxDBRoot(), signingKeypair.Address())
-	refStore := rw.NewRefStore(config.RefDataRoot())
+	txStore := rw.NewBadgerTxStoreWithOptions(config.TxDBRoot(), signingKeypair.Address(), config.DBOptions())
+	refStore := rw.NewRefStore(config.RefDataRoot(), config.RefTempDir)
+	err = refStore.CleanTemp(rw.REF_TEMP_MAX_AGE)
+	if err != nil {
+		panic(err)
+	}
 	peerStore := rw.NewPeerStore(signingKeypair.Address())
-	metacontroller := rw.NewMetacontroller(signingKeypair.Address(), config.StateDBRoot(), txStore, refStore)
+	outbox := rw.NewBadgerOutbox(config.OutboxDBRoot(), signingKeypair.Address(), config.DBOptions(), rw.OutboxOptions{
+		TTL:              time.Duration(config.OutboxTTL),
+		MinRetryInterval: time.Duration(config.OutboxMinRetryInterval),
+		MaxRetryInterval: time.Duration(config.OutboxMaxRetryInterval),
+		MaxEntries:       config.OutboxMaxEntries,
+	})
+
+	parseAddresses := func(hexAddrs []string) []types.Address {
+		var addrs []types.Address
+		for _, hexAddr := range hexAddrs {
+			addr, err := types.AddressFromHex(hexAddr)
+			if err != nil {
+				panic(err)
+			}
+			addrs = append(addrs, addr)
+		}
+		return addrs
+	}
+
+	var mailbox rw.Mailbox
+	if config.EnableMailbox {
+		mailbox = rw.NewBadgerMailbox(config.MailboxDBRoot(), signingKeypair.Address(), config.DBOptions(), rw.MailboxOptions{
+			TTL:                     time.Duration(config.MailboxTTL),
+			ForwardInterval:         time.Duration(config.MailboxForwardInterval),
+			MaxMessageSize:          config.MailboxMaxMessageSize,
+			MaxMessagesPerRecipient: config.MailboxMaxPerRecipient,
+		})
+	}
+	mailboxRelays := parseAddresses(config.MailboxRelays)
+
+	var trustPolicy rw.TrustPolicy
+	if len(config.TxAllowlist) > 0 {
+		trustPolicy = rw.NewAllowlistTrustPolicy(parseAddresses(config.TxAllowlist))
+	} else if len(config.TxDenylist) > 0 {
+		trustPolicy = rw.NewDenylistTrustPolicy(parseAddresses(config.TxDenylist))
+	}
+	mempoolOverflow := rw.MempoolRejectNew
+	if config.EvictStuckTxs {
+		mempoolOverflow = rw.MempoolEvictOldest
+	}
+	metacontroller := rw.NewMetacontrollerWithDBOptions(signingKeypair.Address(), config.StateDBRoot(), txStore, refStore, rw.TxLimits{
+		MaxPatches:    config.MaxPatchesPerTx,
+		MaxSize:       config.MaxTxSize,
+		MaxRecipients: config.MaxTxRecipients,
+
+		ContentAddressedIDs: config.ContentAddressedTxIDs,
+
+		MaxMempoolSize:  config.MaxMempoolSize,
+		MempoolOverflow: mempoolOverflow,
+		MempoolTxTTL:    time.Duration(config.MempoolTxTTL),
+
+		AddressDerivation: addressDerivation,
+	}, config.DBOptions())
 
-	libp2pTransport, err := rw.NewLibp2pTransport(signingKeypair.Address(), config.P2PListenPort, metacontroller, refStore, peerStore)
+	libp2pTransport, err := rw.NewLibp2pTransport(signingKeypair.Address(), config.P2PListenPort, config.BootstrapPeers, rw.Libp2pRelayConfig{
+		RelayPeers:      config.RelayPeers,
+		EnableHop:       config.EnableRelayHop,
+		EnableAutoRelay: config.EnableAutoRelay,
+	}, metacontroller, refStore, peerStore)
 	if err != nil {
 		panic(err)
 	}
@@ -67,6 +135,13 @@ func main() {
 		cookieSecret,
 		tlsCertFilename,
 		tlsKeyFilename,
+		rw.HTTPLimits{
+			PutsPerSecond:             config.HTTPPutsPerSecond,
+			PutBurst:                  config.HTTPPutBurst,
+			SubscriptionsPerSecond:    config.HTTPSubscriptionsPerSecond,
+			SubscriptionBurst:         config.HTTPSubscriptionBurst,
+			MaxSubscriptionsPerClient: config.HTTPMaxSubscriptionsPerClient,
+		},
 	)
 	if err != nil {
 		panic(err)
@@ -74,7 +149,17 @@ func main() {
 
 	transports := []rw.Transport{libp2pTransport, httpTransport}
 
-	host, err := rw.NewHost(signingKeypair, encryptingKeypair, transports, metacontroller, refStore, peerStore)
+	host, err := rw.NewHost(signingKeypair, encryptingKeypair, transports, metacontroller, refStore, peerStore, rw.HostConfig{
+		Outbox:        outbox,
+		Mailbox:       mailbox,
+		MailboxRelays: mailboxRelays,
+		TrustPolicy:   trustPolicy,
+
+		FindProviderTimeout:        time.Duration(config.FindProviderTimeout),
+		PrefetchRefsOnSubscribe:    config.PrefetchRefsOnSubscribe,
+		BloomHistorySync:           config.BloomHistorySync,
+		MaxConcurrentVerifications: config.VerificationConcurrency,
+	})
 	if err != nil {
 		panic(err)
 	}
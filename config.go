@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/brynbellomy/redwood/tree"
 )
 
 type Config struct {
@@ -25,17 +27,64 @@ type NodeConfig struct {
 	P2PListenAddr           string   `yaml:"P2PListenAddr"`
 	P2PListenPort           uint     `yaml:"P2PListenPort"`
 	BootstrapPeers          []string `yaml:"BootstrapPeers"`
+	RelayPeers              []string `yaml:"RelayPeers"`
+	EnableRelayHop          bool     `yaml:"EnableRelayHop"`
+	EnableAutoRelay         bool     `yaml:"EnableAutoRelay"`
 	RPCListenNetwork        string   `yaml:"RPCListenNetwork"`
 	RPCListenHost           string   `yaml:"RPCListenHost"`
 	HTTPListenHost          string   `yaml:"HTTPListenHost"`
 	HTTPCookieSecret        string   `yaml:"HTTPCookieSecret"`
 	HDMnemonicPhrase        string   `yaml:"HDMnemonicPhrase"`
+	AddressDerivation       string   `yaml:"AddressDerivation"`
 	ContentAnnounceInterval Duration `yaml:"ContentAnnounceInterval"`
 	ContentRequestInterval  Duration `yaml:"ContentRequestInterval"`
 	FindProviderTimeout     Duration `yaml:"FindProviderTimeout"`
+	PrefetchRefsOnSubscribe bool     `yaml:"PrefetchRefsOnSubscribe"`
+	BloomHistorySync        bool     `yaml:"BloomHistorySync"`
+	VerificationConcurrency int      `yaml:"VerificationConcurrency"`
+	MaxPatchesPerTx         int      `yaml:"MaxPatchesPerTx"`
+	MaxTxSize               int      `yaml:"MaxTxSize"`
+	MaxTxRecipients         int      `yaml:"MaxTxRecipients"`
+	ContentAddressedTxIDs   bool     `yaml:"ContentAddressedTxIDs"`
+	MaxMempoolSize          int      `yaml:"MaxMempoolSize"`
+	EvictStuckTxs           bool     `yaml:"EvictStuckTxs"`
+	MempoolTxTTL            Duration `yaml:"MempoolTxTTL"`
+	InMemoryDBs             bool     `yaml:"InMemoryDBs"`
+	DBValueLogFileSize      int64    `yaml:"DBValueLogFileSize"`
+	DBMaxTableSize          int64    `yaml:"DBMaxTableSize"`
+	DBGCInterval            Duration `yaml:"DBGCInterval"`
 	DefaultStateURI         string   `yaml:"DefaultStateURI"`
 	StateURIs               []string `yaml:"StateURIs"`
 	DataRoot                string   `yaml:"DataRoot"`
+	RefTempDir              string   `yaml:"RefTempDir"`
+
+	// Per-client limits on the HTTP transport (see HTTPLimits)
+	HTTPPutsPerSecond             float64 `yaml:"HTTPPutsPerSecond"`
+	HTTPPutBurst                  int     `yaml:"HTTPPutBurst"`
+	HTTPSubscriptionsPerSecond    float64 `yaml:"HTTPSubscriptionsPerSecond"`
+	HTTPSubscriptionBurst         int     `yaml:"HTTPSubscriptionBurst"`
+	HTTPMaxSubscriptionsPerClient int     `yaml:"HTTPMaxSubscriptionsPerClient"`
+
+	// Retries of undelivered private txs (see OutboxOptions)
+	OutboxTTL              Duration `yaml:"OutboxTTL"`
+	OutboxMinRetryInterval Duration `yaml:"OutboxMinRetryInterval"`
+	OutboxMaxRetryInterval Duration `yaml:"OutboxMaxRetryInterval"`
+	OutboxMaxEntries       int      `yaml:"OutboxMaxEntries"`
+
+	// Store-and-forward of private txs (see Mailbox).  A node holds txs for others if
+	// EnableMailbox is set, and leaves its own undelivered txs with the MailboxRelays.
+	EnableMailbox          bool     `yaml:"EnableMailbox"`
+	MailboxTTL             Duration `yaml:"MailboxTTL"`
+	MailboxForwardInterval Duration `yaml:"MailboxForwardInterval"`
+	MailboxMaxMessageSize  int      `yaml:"MailboxMaxMessageSize"`
+	MailboxMaxPerRecipient int      `yaml:"MailboxMaxPerRecipient"`
+	MailboxRelays          []string `yaml:"MailboxRelays"`
+
+	// Which addresses' txs we take at all (see TrustPolicy).  If TxAllowlist isn't empty,
+	// only txs from the addresses on it are accepted.  Otherwise, txs from the addresses
+	// on TxDenylist are refused.
+	TxAllowlist []string `yaml:"TxAllowlist"`
+	TxDenylist  []string `yaml:"TxDenylist"`
 }
 
 type RPCClientConfig struct {
@@ -78,11 +127,40 @@ var DefaultConfig = func() Config {
 			HTTPListenHost:          ":8080",
 			HTTPCookieSecret:        string(httpCookieSecret),
 			HDMnemonicPhrase:        hdMnemonicPhrase,
+			AddressDerivation:       "ethereum",
 			ContentAnnounceInterval: Duration(15 * time.Second),
 			ContentRequestInterval:  Duration(15 * time.Second),
 			FindProviderTimeout:     Duration(10 * time.Second),
+			VerificationConcurrency: 8,
+			MaxPatchesPerTx:         DefaultTxLimits.MaxPatches,
+			MaxTxSize:               DefaultTxLimits.MaxSize,
+			MaxTxRecipients:         DefaultTxLimits.MaxRecipients,
+			MaxMempoolSize:          DefaultTxLimits.MaxMempoolSize,
+			MempoolTxTTL:            Duration(DefaultTxLimits.MempoolTxTTL),
+			DBGCInterval:            Duration(10 * time.Minute),
 			StateURIs:               []string{},
 			DataRoot:                dataRoot,
+
+			HTTPPutsPerSecond:             DefaultHTTPLimits.PutsPerSecond,
+			HTTPPutBurst:                  DefaultHTTPLimits.PutBurst,
+			HTTPSubscriptionsPerSecond:    DefaultHTTPLimits.SubscriptionsPerSecond,
+			HTTPSubscriptionBurst:         DefaultHTTPLimits.SubscriptionBurst,
+			HTTPMaxSubscriptionsPerClient: DefaultHTTPLimits.MaxSubscriptionsPerClient,
+
+			OutboxTTL:              Duration(DefaultOutboxOptions.TTL),
+			OutboxMinRetryInterval: Duration(DefaultOutboxOptions.MinRetryInterval),
+			OutboxMaxRetryInterval: Duration(DefaultOutboxOptions.MaxRetryInterval),
+			OutboxMaxEntries:       DefaultOutboxOptions.MaxEntries,
+
+			MailboxTTL:             Duration(DefaultMailboxOptions.TTL),
+			MailboxForwardInterval: Duration(DefaultMailboxOptions.ForwardInterval),
+			MailboxMaxMessageSize:  DefaultMailboxOptions.MaxMessageSize,
+			MailboxMaxPerRecipient: DefaultMailboxOptions.MaxMessagesPerRecipient,
+			MailboxRelays:          []string{},
+
+			TxAllowlist: []string{},
+			TxDenylist:  []string{},
+
 			BootstrapPeers: []string{
 				"/dns4/jupiter.axon.science/tcp/1337/p2p/16Uiu2HAm4cL1W1yHcsQuDp9R19qeyAewekCdqyVM39WMykjVL2mt",
 				"/dns4/saturn.axon.science/tcp/1337/p2p/16Uiu2HAkvBf1UUPvSFFyGWd5bECPc58qrMbiis2JW8q1AZG8zUgH",
@@ -200,6 +278,24 @@ func (c *Config) TxDBRoot() string {
 	return filepath.Join(c.DataRoot, "txs")
 }
 
+func (c *Config) OutboxDBRoot() string {
+	return filepath.Join(c.DataRoot, "outbox")
+}
+
+func (c *Config) MailboxDBRoot() string {
+	return filepath.Join(c.DataRoot, "mailbox")
+}
+
+// DBOptions returns the options for the node's Badger DBs.
+func (c *Config) DBOptions() tree.DBTreeOptions {
+	return tree.DBTreeOptions{
+		InMemory:         c.InMemoryDBs,
+		ValueLogFileSize: c.DBValueLogFileSize,
+		MaxTableSize:     c.DBMaxTableSize,
+		GCInterval:       time.Duration(c.DBGCInterval),
+	}
+}
+
 func (c *Config) StateDBRoot() string {
 	return filepath.Join(c.DataRoot, "states")
 }
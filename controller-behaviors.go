@@ -3,22 +3,89 @@ package redwood
 import (
 	"bytes"
 	"sort"
+	"sync"
 
 	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
+// Resolver applies a tx's patches to the part of the state tree beneath the resolver's
+// keypath.  Besides applying the patches, a resolver may write any derived state it likes
+// (counts, timestamps, and so on) to the node it's given.  Those writes end up in the tx's
+// diff just like the patches do, but they aren't added to the tx, and they aren't checked
+// by the validators, so they have to be deterministic: every peer that receives the tx
+// derives them for itself.
 type Resolver interface {
 	ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) error
 	InternalState() map[string]interface{}
 }
 
+// OrderedResolver is implemented by resolvers that need to know where each tx falls in
+// the DAG's total order (see TxOrder), for instance to make concurrent txs converge to
+// the same state on every node.  The controller calls ResolveStateInOrder on them in
+// place of ResolveState.
+type OrderedResolver interface {
+	Resolver
+	ResolveStateInOrder(state tree.Node, sender types.Address, order TxOrder, patches []Patch) error
+}
+
+// DryRunResolver is implemented by resolvers whose ResolveState has no effect beyond the
+// state that it's given, so that txs can be tried out against them (see
+// Controller.DryRunTx).  Txs that would pass through any other resolver can't be dry run,
+// since there'd be no undoing whatever the resolver (the JS one, say) remembered of them.
+// An OrderedResolver also has to be a ScratchCopier to be dry run.
+type DryRunResolver interface {
+	Resolver
+	CanDryRun() bool
+}
+
+// ScratchCopier is implemented by OrderedResolvers that can hand out a copy of themselves
+// for a dry run, so that the tx can be ordered against the real records of past txs
+// without adding to them.
+type ScratchCopier interface {
+	ScratchCopy() OrderedResolver
+}
+
+func canDryRun(resolver Resolver) bool {
+	r, is := resolver.(DryRunResolver)
+	if !is || !r.CanDryRun() {
+		return false
+	}
+	if _, is := resolver.(OrderedResolver); is {
+		_, is = resolver.(ScratchCopier)
+		return is
+	}
+	return true
+}
+
+// TxOrder places a tx in a total order over the DAG that every node agrees on.  Txs are
+// ordered by height (the length of the longest path back to the genesis tx), and
+// concurrent txs of the same height by ID, so a tx always comes after its ancestors.
+type TxOrder struct {
+	Height uint64
+	ID     types.ID
+}
+
+// Before returns true if o comes before other in the total order.
+func (o TxOrder) Before(other TxOrder) bool {
+	if o.Height != other.Height {
+		return o.Height < other.Height
+	}
+	return bytes.Compare(o.ID[:], other.ID[:]) < 0
+}
+
+// Validator is the single interface implemented by every validator.  The controller
+// hands each validator the state at the validator's keypath and a copy of the tx whose
+// patches have been trimmed to be relative to that keypath.
 type Validator interface {
 	ValidateTx(state tree.Node, tx *Tx) error
 }
 
+// Indexer returns the components of the key under which a node is indexed.  Indexers
+// returning more than one component produce compound indexes, which can be queried by any
+// prefix of their components (see tree.EncodeIndexKey).
 type Indexer interface {
-	IndexKeyForNode(state tree.Node) (tree.Keypath, error)
+	IndexKeyForNode(state tree.Node) ([]tree.Keypath, error)
 }
 
 type ResolverConstructor func(config tree.Node, internalState map[string]interface{}) (Resolver, error)
@@ -26,13 +93,15 @@ type ValidatorConstructor func(config tree.Node) (Validator, error)
 type IndexerConstructor func(config tree.Node) (Indexer, error)
 
 var resolverRegistry map[string]ResolverConstructor
+var resolverRegistryMu sync.RWMutex
 var validatorRegistry map[string]ValidatorConstructor
 var indexerRegistry map[string]IndexerConstructor
+var indexerRegistryMu sync.RWMutex
 
 func init() {
 	validatorRegistry = map[string]ValidatorConstructor{
 		"validator/permissions": NewPermissionsValidator,
-		// "stack":       NewStackValidator,
+		"validator/stack":       NewStackValidator,
 	}
 	resolverRegistry = map[string]ResolverConstructor{
 		"resolver/dumb": NewDumbResolver,
@@ -41,16 +110,54 @@ func init() {
 		//"resolver/stack": NewStackResolver,
 	}
 	indexerRegistry = map[string]IndexerConstructor{
-		"indexer/keypath": NewKeypathIndexer,
+		"indexer/keypath":  NewKeypathIndexer,
+		"indexer/compound": NewCompoundIndexer,
 	}
 }
 
+// RegisterResolver makes a custom resolver type available to state trees, which can
+// install it at any keypath under a "Merge-Type" key.  Registering a content type that
+// already exists replaces it.
+func RegisterResolver(contentType string, ctor ResolverConstructor) {
+	resolverRegistryMu.Lock()
+	defer resolverRegistryMu.Unlock()
+	resolverRegistry[contentType] = ctor
+}
+
+func resolverConstructor(contentType string) (ResolverConstructor, bool) {
+	resolverRegistryMu.RLock()
+	defer resolverRegistryMu.RUnlock()
+	ctor, exists := resolverRegistry[contentType]
+	return ctor, exists
+}
+
+// RegisterIndexer makes a custom indexer type available to state trees, which can declare
+// indices of that type under an "Index-Type" key.  Registering a content type that already
+// exists replaces it.
+func RegisterIndexer(contentType string, ctor IndexerConstructor) {
+	indexerRegistryMu.Lock()
+	defer indexerRegistryMu.Unlock()
+	indexerRegistry[contentType] = ctor
+}
+
+func indexerConstructor(contentType string) (IndexerConstructor, bool) {
+	indexerRegistryMu.RLock()
+	defer indexerRegistryMu.RUnlock()
+	ctor, exists := indexerRegistry[contentType]
+	return ctor, exists
+}
+
+// behaviorTree keeps track of the resolvers, validators, and indexers declared in a state
+// tree.  Its resolver and validator keypaths are kept ordered most specific first (see
+// sortKeypathsMostSpecificFirst), which is the order in which the controller hands them
+// a tx's patches.
 type behaviorTree struct {
 	validatorKeypaths []tree.Keypath
 	validators        map[string]Validator
 	resolverKeypaths  []tree.Keypath
 	resolvers         map[string]Resolver
 	indexers          map[string]map[string]Indexer
+	indexersMu        sync.RWMutex // Lets queries look up indexers without waiting on tx processing
 }
 
 func newBehaviorTree() *behaviorTree {
@@ -64,8 +171,7 @@ func newBehaviorTree() *behaviorTree {
 func (t *behaviorTree) addResolver(keypath tree.Keypath, resolver Resolver) {
 	if _, exists := t.resolvers[string(keypath)]; !exists {
 		t.resolverKeypaths = append(t.resolverKeypaths, keypath)
-		// @@TODO: sucks
-		sort.Slice(t.resolverKeypaths, func(i, j int) bool { return bytes.Compare(t.resolverKeypaths[i], t.resolverKeypaths[j]) < 0 })
+		sortKeypathsMostSpecificFirst(t.resolverKeypaths)
 	}
 	t.resolvers[string(keypath)] = resolver
 }
@@ -89,8 +195,7 @@ func (t *behaviorTree) removeResolver(keypath tree.Keypath) {
 func (t *behaviorTree) addValidator(keypath tree.Keypath, validator Validator) {
 	if _, exists := t.validators[string(keypath)]; !exists {
 		t.validatorKeypaths = append(t.validatorKeypaths, keypath)
-		// @@TODO: sucks
-		sort.Slice(t.validatorKeypaths, func(i, j int) bool { return bytes.Compare(t.validatorKeypaths[i], t.validatorKeypaths[j]) < 0 })
+		sortKeypathsMostSpecificFirst(t.validatorKeypaths)
 	}
 	t.validators[string(keypath)] = validator
 }
@@ -112,6 +217,8 @@ func (t *behaviorTree) removeValidator(keypath tree.Keypath) {
 }
 
 func (t *behaviorTree) addIndexer(keypath tree.Keypath, indexName tree.Keypath, indexer Indexer) {
+	t.indexersMu.Lock()
+	defer t.indexersMu.Unlock()
 	if _, exists := t.indexers[string(keypath)]; !exists {
 		t.indexers[string(keypath)] = make(map[string]Indexer)
 	}
@@ -119,15 +226,44 @@ func (t *behaviorTree) addIndexer(keypath tree.Keypath, indexName tree.Keypath,
 }
 
 func (t *behaviorTree) removeIndexer(keypath tree.Keypath, indexName tree.Keypath) {
+	t.indexersMu.Lock()
+	defer t.indexersMu.Unlock()
 	if _, exists := t.indexers[string(keypath)]; !exists {
 		return
 	}
 	delete(t.indexers[string(keypath)], string(indexName))
 }
 
+func (t *behaviorTree) removeIndexers(keypath tree.Keypath) {
+	t.indexersMu.Lock()
+	defer t.indexersMu.Unlock()
+	delete(t.indexers, string(keypath))
+}
+
+// indexer returns the indexer declared for the given index, or nil if there isn't one.
+func (t *behaviorTree) indexer(keypath tree.Keypath, indexName tree.Keypath) Indexer {
+	t.indexersMu.RLock()
+	defer t.indexersMu.RUnlock()
+	return t.indexers[string(keypath)][string(indexName)]
+}
+
+// allIndexers returns a copy of the tree's indexers, keyed by keypath and then by index
+// name, that stays the same as indexers are added and removed.
+func (t *behaviorTree) allIndexers() map[string]map[string]Indexer {
+	t.indexersMu.RLock()
+	defer t.indexersMu.RUnlock()
+	indexers := make(map[string]map[string]Indexer, len(t.indexers))
+	for keypath, byName := range t.indexers {
+		indexers[keypath] = make(map[string]Indexer, len(byName))
+		for indexName, indexer := range byName {
+			indexers[keypath][indexName] = indexer
+		}
+	}
+	return indexers
+}
+
 func (t *behaviorTree) nearestResolverForKeypath(keypath tree.Keypath) (Resolver, tree.Keypath) {
-	for i := len(t.resolverKeypaths) - 1; i >= 0; i-- {
-		kp := t.resolverKeypaths[i]
+	for _, kp := range t.resolverKeypaths {
 		if keypath.StartsWith(kp) {
 			return t.resolvers[string(kp)], kp
 		}
@@ -136,11 +272,24 @@ func (t *behaviorTree) nearestResolverForKeypath(keypath tree.Keypath) (Resolver
 }
 
 func (t *behaviorTree) nearestValidatorForKeypath(keypath tree.Keypath) (Validator, tree.Keypath) {
-	for i := len(t.validatorKeypaths) - 1; i >= 0; i-- {
-		kp := t.validatorKeypaths[i]
+	for _, kp := range t.validatorKeypaths {
 		if keypath.StartsWith(kp) {
 			return t.validators[string(kp)], kp
 		}
 	}
 	return nil, nil
 }
+
+// sortKeypathsMostSpecificFirst orders keypaths so that every keypath comes before all of
+// its ancestors: deeper keypaths come first, and keypaths of the same depth are ordered
+// bytewise so that the result doesn't depend on the order they were added in.  Walking
+// the keypaths in this order, a nested behavior (say, at "a/b") gets the first pick of a
+// tx's patches, and its ancestors (at "a", then the root) only see the patches it left.
+func sortKeypathsMostSpecificFirst(keypaths []tree.Keypath) {
+	sort.Slice(keypaths, func(i, j int) bool {
+		if ni, nj := keypaths[i].NumParts(), keypaths[j].NumParts(); ni != nj {
+			return ni > nj
+		}
+		return bytes.Compare(keypaths[i], keypaths[j]) < 0
+	})
+}
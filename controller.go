@@ -1,9 +1,14 @@
 package redwood
 
 import (
+	"context"
+	"encoding/json"
+	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -17,81 +22,253 @@ type Controller interface {
 	Start() error
 
 	AddTx(tx *Tx) error
+	AddTxAndWait(ctx context.Context, tx *Tx) error
+	DryRunTx(tx *Tx) (tree.Node, error)
 	HaveTx(txID types.ID) bool
+	MempoolLen() int
 
 	StateAtVersion(version *types.ID) tree.Node
+	Snapshot() (Snapshot, error)
 	QueryIndex(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, rng *tree.Range) (tree.Node, error)
+	QueryIndexPage(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, cursor tree.Keypath, limit int) (IndexPage, error)
 	Leaves() map[types.ID]struct{}
 	BehaviorTree() *behaviorTree
 	SetBehaviorTree(tree *behaviorTree)
+	SetTxRejectedHandler(handler TxRejectedHandler)
+	SetFetchingParentsChecker(checker FetchingParentsChecker)
 
 	OnDownloadedRef()
 }
 
+// TxLimits bounds the txs that a controller will accept.  A zero value for any of the
+// limits disables it.
+type TxLimits struct {
+	MaxPatches    int // The maximum number of patches in a single tx
+	MaxSize       int // The maximum size (in bytes) of a JSON-serialized tx
+	MaxRecipients int // The maximum number of recipients of a private tx
+
+	// ContentAddressedIDs requires every tx but the genesis tx to carry its ContentID, so
+	// that two different txs can never share an ID.  It's off by default because existing
+	// clients choose their own (random) tx IDs.
+	ContentAddressedIDs bool
+
+	// MaxMempoolSize is the maximum number of txs that can be waiting in the mempool (most
+	// of which are waiting on their parents or on refs).  MempoolOverflow decides what
+	// happens to the txs that arrive once it's full.
+	MaxMempoolSize  int
+	MempoolOverflow MempoolOverflowPolicy
+
+	// MempoolTxTTL is how long a tx can wait in the mempool before it's dropped.  Txs whose
+	// parents are still being fetched aren't dropped until the fetch is over.
+	MempoolTxTTL time.Duration
+
+	// AddressDerivation is how the addresses of txs' signers are derived from their keys.
+	// It has to match the rest of the network's.  If it's nil, it's Ethereum's.
+	AddressDerivation AddressDerivation
+}
+
+var DefaultTxLimits = TxLimits{
+	MaxPatches:     1000,
+	MaxSize:        10 * 1024 * 1024,
+	MaxRecipients:  100,
+	MaxMempoolSize: 10000,
+	MempoolTxTTL:   10 * time.Minute,
+}
+
+type MempoolOverflowPolicy int
+
+const (
+	// MempoolRejectNew refuses txs with ErrMempoolFull until there's room for them.
+	MempoolRejectNew MempoolOverflowPolicy = iota
+	// MempoolEvictOldest accepts every tx, and makes room for them by dropping the txs
+	// that have been stuck in the mempool the longest.  Dropped txs are forgotten, so
+	// they're accepted again if they're received again.
+	MempoolEvictOldest
+)
+
+// IndexPage is a page of entries returned by QueryIndexPage.
+type IndexPage struct {
+	Entries []IndexEntry
+	// NextCursor fetches the following page when passed to QueryIndexPage.  It's nil
+	// when there are no more entries.
+	NextCursor tree.Keypath
+}
+
+type IndexEntry struct {
+	Key   tree.Keypath
+	Value interface{}
+}
+
 type ReceivedRefsHandler func(refs []types.Hash)
 type TxProcessedHandler func(c Controller, tx *Tx, state *tree.DBNode) error
 
+// TxRejectedHandler is called when a controller permanently rejects a tx, with the reason
+// for the rejection.  Txs that are only waiting on their parents or on refs aren't
+// rejected, unless they're dropped from the mempool (see TxLimits).
+type TxRejectedHandler func(tx *Tx, err error)
+
+// FetchingParentsChecker reports whether any of a tx's missing parents are still being
+// fetched from our peers.
+type FetchingParentsChecker func(tx *Tx) bool
+
 type controller struct {
 	*ctx.Context
 
-	address  types.Address
-	stateURI string
-	mu       sync.RWMutex
+	address         types.Address
+	stateURI        string
+	stateDBRootPath string
+	dbOptions       tree.DBTreeOptions
+	mu              sync.RWMutex
 
-	txs     map[types.ID]*Tx
-	txStore TxStore
+	txStore  TxStore
+	txLimits TxLimits
 
 	behaviorTree *behaviorTree
 
-	states  *tree.DBTree
-	indices *tree.DBTree
-	leaves  map[types.ID]struct{}
-
-	chMempool     chan *Tx
-	mempool       []*Tx
-	onTxProcessed TxProcessedHandler
+	states     *tree.DBTree
+	chGCDone   <-chan struct{}
+	snapshotMu sync.RWMutex // Held while the state and the leaves are changed together
+	applyMu    sync.Mutex   // Held while a tx is run past the behavior tree, for real or not
+	indices    *tree.DBTree
+	indicesMu  sync.Mutex
+	leaves     map[types.ID]struct{}
+	txHeights  map[types.ID]uint64
+
+	chMempool         chan *Tx
+	chMempoolDone     chan struct{}
+	mempool           []mempoolEntry
+	mempoolLen        int // Includes the txs that are still in chMempool
+	mempoolLenMu      sync.Mutex
+	onTxProcessed     TxProcessedHandler
+	onTxRejected      TxRejectedHandler
+	isFetchingParents FetchingParentsChecker
+
+	txResultChs   map[types.ID][]chan error
+	txResultChsMu sync.Mutex
 
 	chOnDownloadedRef chan struct{}
 }
 
-func NewController(address types.Address, stateURI string, stateDBRootPath string, txStore TxStore, txProcessedHandler TxProcessedHandler) (Controller, error) {
-	stateURIClean := strings.NewReplacer(":", "_", "/", "_").Replace(stateURI)
-	states, err := tree.NewDBTree(filepath.Join(stateDBRootPath, stateURIClean))
-	if err != nil {
-		return nil, err
-	}
+func NewController(address types.Address, stateURI string, stateDBRootPath string, txStore TxStore, txLimits TxLimits, txProcessedHandler TxProcessedHandler) (Controller, error) {
+	return NewControllerWithDBOptions(address, stateURI, stateDBRootPath, txStore, txLimits, tree.DBTreeOptions{}, txProcessedHandler)
+}
 
-	indices, err := tree.NewDBTree(filepath.Join(stateDBRootPath, stateURIClean+"_indices"))
-	if err != nil {
-		return nil, err
+// NewControllerWithDBOptions is like NewController, but opens the controller's state and
+// index DBs with the given options.  An in-memory controller never touches
+// stateDBRootPath, and starts from scratch every time it's started.
+func NewControllerWithDBOptions(address types.Address, stateURI string, stateDBRootPath string, txStore TxStore, txLimits TxLimits, dbOptions tree.DBTreeOptions, txProcessedHandler TxProcessedHandler) (Controller, error) {
+	if !dbOptions.InMemory {
+		statesPath, _ := StateDBPaths(stateDBRootPath, stateURI)
+		err := os.MkdirAll(filepath.Dir(statesPath), 0700)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		err = migrateLegacyStateDBs(stateDBRootPath, stateURI)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	c := &controller{
 		Context:           &ctx.Context{},
 		address:           address,
 		stateURI:          stateURI,
+		stateDBRootPath:   stateDBRootPath,
+		dbOptions:         dbOptions,
 		mu:                sync.RWMutex{},
-		txs:               make(map[types.ID]*Tx),
 		txStore:           txStore,
+		txLimits:          txLimits,
 		behaviorTree:      newBehaviorTree(),
-		states:            states,
-		indices:           indices,
 		leaves:            make(map[types.ID]struct{}),
-		chMempool:         make(chan *Tx, 100),
+		txHeights:         make(map[types.ID]uint64),
+		chMempool:         make(chan *Tx, mempoolChanSize(txLimits)),
+		txResultChs:       make(map[types.ID][]chan error),
 		chOnDownloadedRef: make(chan struct{}),
 		onTxProcessed:     txProcessedHandler,
 	}
 	return c, nil
 }
 
+func (c *controller) collectValueLogGarbage() {
+	collectValueLogGarbage(c, "state", c.dbOptions, c.states.CollectValueLogGarbage)
+	collectValueLogGarbage(c, "index", c.dbOptions, c.indices.CollectValueLogGarbage)
+}
+
+// StateDBPaths returns where a controller keeps the databases for the given stateURI.
+// Each stateURI gets its own directory beneath the root, named after the hash of the
+// stateURI so that no two stateURIs can ever share one:
+//
+//	<stateDBRootPath>/<hex hash of the stateURI>/states    the state tree and its versions
+//	<stateDBRootPath>/<hex hash of the stateURI>/indices   the indices built over the state tree
+func StateDBPaths(stateDBRootPath, stateURI string) (statesPath, indicesPath string) {
+	dir := filepath.Join(stateDBRootPath, types.HashBytes([]byte(stateURI)).Hex())
+	return filepath.Join(dir, "states"), filepath.Join(dir, "indices")
+}
+
+// OpenStateDBReadOnly opens the state database of the given stateURI without the ability
+// to write to it, for inspecting a node's state while its controller isn't running.
+func OpenStateDBReadOnly(stateDBRootPath, stateURI string) (*tree.DBTree, error) {
+	statesPath, _ := StateDBPaths(stateDBRootPath, stateURI)
+	return tree.OpenDBTreeReadOnly(statesPath)
+}
+
+// migrateLegacyStateDBs moves a stateURI's databases out of the old layout, which named
+// them after the stateURI with ':' and '/' replaced by '_' (and so could collide), and
+// into the one described by StateDBPaths.  The stateURI's directory must already exist.
+func migrateLegacyStateDBs(stateDBRootPath, stateURI string) error {
+	legacyStatesPath := filepath.Join(stateDBRootPath, strings.NewReplacer(":", "_", "/", "_").Replace(stateURI))
+	legacyIndicesPath := legacyStatesPath + "_indices"
+	statesPath, indicesPath := StateDBPaths(stateDBRootPath, stateURI)
+
+	if _, err := os.Stat(legacyStatesPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	} else if _, err := os.Stat(statesPath); err == nil {
+		// Already migrated (the legacy DB belongs to another stateURI that collided with this one)
+		return nil
+	}
+
+	err := os.Rename(legacyStatesPath, statesPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(legacyIndicesPath, indicesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Start opens the controller's databases and begins processing txs.  A controller that has
+// been stopped may be started again, and picks up from the state that it last committed.
 func (c *controller) Start() error {
 	return c.CtxStart(
 		// on startup,
 		func() error {
 			c.SetLogLabel(c.address.Pretty() + " controller")
 
-			c.behaviorTree.addResolver(tree.Keypath(nil), &dumbResolver{})
+			statesPath, indicesPath := StateDBPaths(c.stateDBRootPath, c.stateURI)
+			states, err := tree.NewDBTreeWithOptions(statesPath, c.dbOptions)
+			if err != nil {
+				return err
+			}
+			indices, err := tree.NewDBTreeWithOptions(indicesPath, c.dbOptions)
+			if err != nil {
+				states.Close()
+				return err
+			}
+			c.states = states
+			c.indices = indices
+
+			// Don't clobber a resolver that was configured before a restart
+			if _, exists := c.behaviorTree.resolvers[""]; !exists {
+				c.behaviorTree.addResolver(tree.Keypath(nil), &dumbResolver{})
+			}
+			c.chMempoolDone = make(chan struct{})
 			go c.mempoolLoop()
+			c.chGCDone = startValueLogGC(c.Context.Done(), c.dbOptions, c.collectValueLogGarbage)
 
 			return nil
 		},
@@ -99,9 +276,33 @@ func (c *controller) Start() error {
 		nil,
 		// on shutdown
 		func() {
-			err := c.states.Close()
-			if err != nil {
-				c.Errorf("error closing state db: %v", err)
+			if c.chGCDone != nil {
+				<-c.chGCDone
+			}
+			// The mempool loop has to be finished with the DBs before they're closed, and
+			// it mustn't still be running if we're restarted
+			if c.chMempoolDone != nil {
+				<-c.chMempoolDone
+			}
+
+			c.applyMu.Lock()
+			defer c.applyMu.Unlock()
+
+			c.snapshotMu.Lock()
+			if c.states != nil {
+				err := c.states.Close()
+				if err != nil {
+					c.Errorf("error closing state db: %v", err)
+				}
+				c.states = nil
+			}
+			c.snapshotMu.Unlock()
+			if c.indices != nil {
+				err := c.indices.Close()
+				if err != nil {
+					c.Errorf("error closing index db: %v", err)
+				}
+				c.indices = nil
 			}
 		},
 	)
@@ -111,12 +312,64 @@ func (c *controller) OnDownloadedRef() {
 	c.chOnDownloadedRef <- struct{}{}
 }
 
+// StateAtVersion returns a read-only snapshot of the state.  The snapshot is isolated
+// from the mempool: a tx is applied in a single DB transaction that's only committed once
+// the whole tx has been processed, so a snapshot either has all of a tx's patches or none
+// of them, and it never changes after it's been taken.  The indices are updated just after
+// the state is committed, so QueryIndex can briefly lag behind the state.  The caller has
+// to Close the snapshot.
 func (c *controller) StateAtVersion(version *types.ID) tree.Node {
 	return c.states.StateAtVersion(version, false)
 }
 
+// Snapshot is a read-only view of the state, pinned to the moment that it was taken.  It
+// doesn't change as new txs are applied, so it can be used for reads that span several
+// keypaths and have to agree with each other.  It has to be closed once it's no longer
+// needed, since it holds onto the DB's old versions of the keys it covers.
+type Snapshot interface {
+	tree.Node
+
+	// Leaves returns the leaves of the tx DAG as of the snapshot, i.e., the txs whose
+	// patches are the last ones it reflects.
+	Leaves() map[types.ID]struct{}
+}
+
+type snapshot struct {
+	*tree.DBNode
+	leaves map[types.ID]struct{}
+}
+
+func (s *snapshot) Leaves() map[types.ID]struct{} {
+	return s.leaves
+}
+
+// Snapshot returns a view of the state as of the last tx to have been applied.
+func (c *controller) Snapshot() (Snapshot, error) {
+	c.snapshotMu.RLock()
+	defer c.snapshotMu.RUnlock()
+
+	if c.states == nil {
+		return nil, errors.WithStack(ErrControllerNotRunning)
+	}
+
+	leaves := make(map[types.ID]struct{}, len(c.leaves))
+	for txID := range c.leaves {
+		leaves[txID] = struct{}{}
+	}
+	return &snapshot{DBNode: c.states.StateAtVersion(nil, false), leaves: leaves}, nil
+}
+
+// Leaves returns a copy of the current leaves of the tx DAG, since the mempool keeps
+// changing them as txs are applied.
 func (c *controller) Leaves() map[types.ID]struct{} {
-	return c.leaves
+	c.snapshotMu.RLock()
+	defer c.snapshotMu.RUnlock()
+
+	leaves := make(map[types.ID]struct{}, len(c.leaves))
+	for txID := range c.leaves {
+		leaves[txID] = struct{}{}
+	}
+	return leaves
 }
 
 func (c *controller) BehaviorTree() *behaviorTree {
@@ -127,30 +380,230 @@ func (c *controller) SetBehaviorTree(tree *behaviorTree) {
 	c.behaviorTree = tree
 }
 
+func (c *controller) SetTxRejectedHandler(handler TxRejectedHandler) {
+	c.onTxRejected = handler
+}
+
+func (c *controller) SetFetchingParentsChecker(checker FetchingParentsChecker) {
+	c.isFetchingParents = checker
+}
+
 func (c *controller) AddTx(tx *Tx) error {
+	_, err := c.addTx(tx)
+	return err
+}
+
+// AddTxAndWait is like AddTx, but it blocks until the tx has either been applied to the
+// state or rejected, and returns the reason for the rejection.  Txs that are waiting on
+// their parents or on refs stay in the mempool, so the wait is bounded by ctx.
+func (c *controller) AddTxAndWait(ctx context.Context, tx *Tx) error {
+	// Start listening before the tx enters the mempool so that we can't miss its result
+	chResult := c.awaitTxResult(tx.ID)
+	defer c.stopAwaitingTxResult(tx.ID, chResult)
+
+	added, err := c.addTx(tx)
+	if err != nil {
+		return err
+	} else if !added {
+		// We've seen this tx before.  If it was already applied, we're done.
+		// Otherwise it's still in the mempool and we wait for it below.
+		existing, err := c.txStore.FetchTx(c.stateURI, tx.ID)
+		if err != nil {
+			return err
+		} else if existing.Valid {
+			return nil
+		}
+	}
+
+	select {
+	case err := <-chResult:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.Context.Done():
+		return c.Context.Err()
+	}
+}
+
+func (c *controller) addTx(tx *Tx) (bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Ignore duplicates
 	exists, err := c.txStore.TxExists(c.stateURI, tx.ID)
 	if err != nil {
-		return err
+		return false, err
 	} else if exists {
+		// With content-addressed IDs, a tx that reuses a known ID with different content
+		// is an error rather than a duplicate
+		if c.txLimits.ContentAddressedIDs {
+			existing, err := c.txStore.FetchTx(c.stateURI, tx.ID)
+			if err != nil {
+				return false, err
+			} else if existing.Hash() != tx.Hash() {
+				return false, errors.Wrapf(ErrTxIDCollision, "tx %v", tx.ID.Hex())
+			}
+		}
 		c.Infof(0, "already know tx %v, skipping", tx.ID.Pretty())
-		return nil
+		return false, nil
 	}
 
 	c.Infof(0, "new tx %v", tx.ID.Pretty())
 
+	if !c.reserveMempoolSpace() {
+		return false, errors.Wrapf(ErrMempoolFull, "tx %v", tx.ID.Hex())
+	}
+
+	// The mempool marks the tx valid once it's applied, and holds on to it until then, so
+	// it works on its own deep copy, and leaves the caller free to keep using (and
+	// changing) theirs
+	txCopy := tx.Copy()
+	tx = &txCopy
+
 	// Store the tx (so we can ignore txs we've seen before)
 	tx.Valid = false
 	err = c.txStore.AddTx(tx)
 	if err != nil {
-		return err
+		c.releaseMempoolSpace(1)
+		return false, err
 	}
 
 	c.addToMempool(tx)
-	return nil
+	return true, nil
+}
+
+func (c *controller) awaitTxResult(txID types.ID) chan error {
+	c.txResultChsMu.Lock()
+	defer c.txResultChsMu.Unlock()
+
+	// Buffered so that the mempool loop never blocks on a caller that has given up
+	ch := make(chan error, 1)
+	c.txResultChs[txID] = append(c.txResultChs[txID], ch)
+	return ch
+}
+
+func (c *controller) stopAwaitingTxResult(txID types.ID, ch chan error) {
+	c.txResultChsMu.Lock()
+	defer c.txResultChsMu.Unlock()
+
+	chs := c.txResultChs[txID]
+	for i := range chs {
+		if chs[i] == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(c.txResultChs, txID)
+	} else {
+		c.txResultChs[txID] = chs
+	}
+}
+
+func (c *controller) notifyTxResult(txID types.ID, err error) {
+	c.txResultChsMu.Lock()
+	defer c.txResultChsMu.Unlock()
+
+	for _, ch := range c.txResultChs[txID] {
+		ch <- err
+	}
+	delete(c.txResultChs, txID)
+}
+
+// mempoolChanSize is large enough that, when the mempool is bounded, sending a tx that's
+// been given a place in it never blocks for long.
+func mempoolChanSize(txLimits TxLimits) int {
+	if txLimits.MaxMempoolSize > 0 {
+		return txLimits.MaxMempoolSize
+	}
+	return 100
+}
+
+// reserveMempoolSpace counts a new tx toward the mempool's size, or reports that the
+// mempool is full and the tx should be rejected.
+func (c *controller) reserveMempoolSpace() bool {
+	c.mempoolLenMu.Lock()
+	defer c.mempoolLenMu.Unlock()
+
+	if c.txLimits.MaxMempoolSize > 0 && c.txLimits.MempoolOverflow == MempoolRejectNew &&
+		c.mempoolLen >= c.txLimits.MaxMempoolSize {
+		return false
+	}
+	c.mempoolLen++
+	return true
+}
+
+func (c *controller) releaseMempoolSpace(n int) {
+	c.mempoolLenMu.Lock()
+	defer c.mempoolLenMu.Unlock()
+	c.mempoolLen -= n
+}
+
+// MempoolLen returns the number of txs that are waiting to be processed.
+func (c *controller) MempoolLen() int {
+	c.mempoolLenMu.Lock()
+	defer c.mempoolLenMu.Unlock()
+	return c.mempoolLen
+}
+
+type mempoolEntry struct {
+	tx    *Tx
+	added time.Time
+}
+
+// evictStuckTxs drops the oldest txs in the mempool until it's back within its limit.
+// It's only called right after processing the mempool, so every tx left in it is stuck
+// waiting on its parents or on refs.
+func (c *controller) evictStuckTxs() {
+	numEvicted := len(c.mempool) - c.txLimits.MaxMempoolSize
+	if c.txLimits.MaxMempoolSize <= 0 || numEvicted <= 0 {
+		return
+	}
+
+	for _, entry := range c.mempool[:numEvicted] {
+		c.dropMempoolTx(entry.tx, ErrMempoolFull)
+	}
+	c.mempool = append([]mempoolEntry(nil), c.mempool[numEvicted:]...)
+	c.releaseMempoolSpace(numEvicted)
+}
+
+// expireStuckTxs drops the txs that have been in the mempool for longer than its TTL.
+func (c *controller) expireStuckTxs() {
+	if c.txLimits.MempoolTxTTL <= 0 {
+		return
+	}
+
+	var newMempool []mempoolEntry
+	for _, entry := range c.mempool {
+		if time.Since(entry.added) < c.txLimits.MempoolTxTTL {
+			newMempool = append(newMempool, entry)
+			continue
+		}
+		// Give the tx's parents a chance to arrive before giving up on them
+		if c.isFetchingParents != nil && c.isFetchingParents(entry.tx) {
+			newMempool = append(newMempool, entry)
+			continue
+		}
+		c.dropMempoolTx(entry.tx, ErrMempoolTxExpired)
+	}
+	c.releaseMempoolSpace(len(c.mempool) - len(newMempool))
+	c.mempool = newMempool
+}
+
+// dropMempoolTx forgets a tx that's stuck in the mempool, so that it's accepted again if
+// a peer sends it to us again.
+func (c *controller) dropMempoolTx(tx *Tx, reason error) {
+	err := errors.Wrapf(reason, "tx %v", tx.ID.Hex())
+	c.Warnf("dropping tx %v from mempool: %v", tx.ID.Pretty(), reason)
+
+	removeErr := c.txStore.RemoveTx(c.stateURI, tx.ID)
+	if removeErr != nil {
+		c.Errorf("error removing dropped tx %v: %v", tx.ID.Pretty(), removeErr)
+	}
+	c.notifyTxResult(tx.ID, err)
+	if c.onTxRejected != nil {
+		c.onTxRejected(tx, err)
+	}
 }
 
 func (c *controller) addToMempool(tx *Tx) {
@@ -161,15 +614,29 @@ func (c *controller) addToMempool(tx *Tx) {
 }
 
 func (c *controller) mempoolLoop() {
+	defer close(c.chMempoolDone)
+
+	// Stuck txs are only expired every so often, rather than every time the mempool is
+	// processed, so that a busy mempool doesn't also have to keep checking them
+	var chExpire <-chan time.Time
+	if c.txLimits.MempoolTxTTL > 0 {
+		ticker := time.NewTicker(c.txLimits.MempoolTxTTL / 2)
+		defer ticker.Stop()
+		chExpire = ticker.C
+	}
+
 	for {
 		select {
 		case <-c.Context.Done():
 			return
 		case tx := <-c.chMempool:
-			c.mempool = append(c.mempool, tx)
+			c.mempool = append(c.mempool, mempoolEntry{tx: tx, added: time.Now()})
 			c.processMempool()
+			c.evictStuckTxs()
 		case <-c.chOnDownloadedRef:
 			c.processMempool()
+		case <-chExpire:
+			c.expireStuckTxs()
 		}
 	}
 }
@@ -177,20 +644,27 @@ func (c *controller) mempoolLoop() {
 func (c *controller) processMempool() {
 	for {
 		var anySucceeded bool
-		var newMempool []*Tx
+		var newMempool []mempoolEntry
 
-		for _, tx := range c.mempool {
+		for _, entry := range c.mempool {
+			tx := entry.tx
 			err := c.processMempoolTx(tx)
-			if errors.Cause(err) == ErrNoParentYet || errors.Cause(err) == ErrMissingCriticalRefs {
+			if errors.Is(err, ErrNoParentYet) || errors.Is(err, ErrMissingCriticalRefs) {
 				c.Infof(0, "readding to mempool %v (%v)", tx.ID.Pretty(), err)
-				newMempool = append(newMempool, tx)
+				newMempool = append(newMempool, entry)
 			} else if err != nil {
 				c.Errorf("invalid tx %+v: %v", err, PrettyJSON(tx))
+				c.notifyTxResult(tx.ID, err)
+				if c.onTxRejected != nil {
+					c.onTxRejected(tx, err)
+				}
 			} else {
 				anySucceeded = true
 				c.Infof(0, "tx added to chain (%v)", tx.ID.Pretty())
+				c.notifyTxResult(tx.ID, nil)
 			}
 		}
+		c.releaseMempoolSpace(len(c.mempool) - len(newMempool))
 		c.mempool = newMempool
 		if !anySucceeded {
 			return
@@ -198,24 +672,125 @@ func (c *controller) processMempool() {
 	}
 }
 
+// DryRunTx checks the tx in the same way that the mempool would, and returns the state
+// that would result from applying it to the current state.  The tx isn't stored and the
+// leaves don't change: the returned state is an in-memory copy that's never saved.  Its
+// Diff holds the keypaths that the tx would touch.  A tx that would pass through a
+// resolver that doesn't support dry runs (see DryRunResolver) is refused with
+// ErrDryRunUnsupported.
+func (c *controller) DryRunTx(tx *Tx) (tree.Node, error) {
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
+
+	if c.states == nil {
+		return nil, errors.WithStack(ErrControllerNotRunning)
+	}
+
+	if c.HaveTx(tx.ID) {
+		return nil, errors.Wrapf(ErrTxAlreadyExists, "tx %v", tx.ID.Hex())
+	}
+
+	err := c.validateTxIntrinsics(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	state := c.states.StateAtVersion(nil, true)
+	defer state.Close()
+
+	err = c.applyTx(state, tx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The DB transaction behind the state can't outlive applyMu
+	val, exists, err := state.Value(nil, nil)
+	if err != nil && !errors.Is(err, types.Err404) {
+		return nil, err
+	}
+	stateCopy := tree.NewMemoryNode()
+	if exists {
+		err = stateCopy.Set(nil, nil, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stateCopy.ResetDiff()
+	stateCopy.Diff().AddMany(state.Diff().AddedList)
+	stateCopy.Diff().RemoveMany(state.Diff().RemovedList)
+	return stateCopy, nil
+}
+
 func (c *controller) processMempoolTx(tx *Tx) error {
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
+
 	err := c.validateTxIntrinsics(tx)
 	if err != nil {
 		return err
 	}
 
+	// Readers keep seeing the last committed state until this is saved below
 	state := c.states.StateAtVersion(nil, true)
 	defer state.Close()
 
+	err = c.applyTx(state, tx, false)
+	if err != nil {
+		return err
+	}
+
+	err = c.onTxProcessed(c, tx, state)
+	if err != nil {
+		return err
+	}
+
+	// Keep a view of the state from before this tx so that the indices can drop the
+	// entries it changes
+	oldState := c.states.StateAtVersion(nil, false)
+	defer oldState.Close()
+
+	err = c.commitState(state, tx)
+	if err != nil {
+		return err
+	}
+
+	c.updateIndices(oldState, state.Diff())
+
+	if tx.Checkpoint {
+		err = c.states.CopyVersion(tx.ID, tree.CurrentVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mark the tx valid and save it to the DB
+	tx.Valid = true
+	err = c.txStore.AddTx(tx)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// applyTx runs the tx past the validators, and has the resolvers apply it to the given
+// state.  On a dry run, nothing outside of the state is changed.
+func (c *controller) applyTx(state *tree.DBNode, tx *Tx, dryRun bool) error {
 	//
 	// Validate the tx's extrinsics
 	//
 	{
 		// @@TODO: sort patches and use ordering to cut down on number of ops
 
-		patches := tx.Patches
-		for i := len(c.behaviorTree.validatorKeypaths) - 1; i >= 0; i-- {
-			validatorKeypath := c.behaviorTree.validatorKeypaths[i]
+		// Key rotations are part of the protocol rather than of any one stateURI's rules, so
+		// they're checked here instead of by the validators
+		patches, formerAddresses, err := validateKeyRotations(state, tx, c.txLimits.AddressDerivation)
+		if err != nil {
+			return err
+		}
+
+		// Each validator (most specific first) takes the patches beneath its keypath, and
+		// leaves the rest to its ancestors
+		for _, validatorKeypath := range c.behaviorTree.validatorKeypaths {
 
 			var unprocessedPatches []Patch
 			var patchesTrimmed []Patch
@@ -225,6 +800,7 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 						Keypath: patch.Keypath.RelativeTo(validatorKeypath),
 						Range:   patch.Range,
 						Val:     patch.Val,
+						Delete:  patch.Delete,
 					})
 				} else {
 					unprocessedPatches = append(unprocessedPatches, patch)
@@ -233,9 +809,10 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 
 			txCopy := *tx
 			txCopy.Patches = patchesTrimmed
-			err := c.behaviorTree.validators[string(validatorKeypath)].ValidateTx(state.AtKeypath(validatorKeypath, nil), &txCopy)
+			txCopy.formerAddresses = formerAddresses
+			err := validateTx(c.behaviorTree.validators[string(validatorKeypath)], state.AtKeypath(validatorKeypath, nil), &txCopy)
 			if err != nil {
-				return err
+				return errors.Wrapf(err, "validator at '%v' rejected tx %v", validatorKeypath, tx.ID.Hex())
 			}
 
 			patches = unprocessedPatches
@@ -248,9 +825,11 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 	{
 		// @@TODO: sort patches and use ordering to cut down on number of ops
 
+		// Likewise, each resolver (most specific first) resolves the patches beneath its
+		// keypath, and leaves the rest to its ancestors
+
 		patches := tx.Patches
-		for i := len(c.behaviorTree.resolverKeypaths) - 1; i >= 0; i-- {
-			resolverKeypath := c.behaviorTree.resolverKeypaths[i]
+		for _, resolverKeypath := range c.behaviorTree.resolverKeypaths {
 
 			var unprocessedPatches []Patch
 			var patchesTrimmed []Patch
@@ -260,6 +839,7 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 						Keypath: patch.Keypath.RelativeTo(resolverKeypath),
 						Range:   patch.Range,
 						Val:     patch.Val,
+						Delete:  patch.Delete,
 					})
 				} else {
 					unprocessedPatches = append(unprocessedPatches, patch)
@@ -270,9 +850,14 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 				continue
 			}
 
+			resolver := c.behaviorTree.resolvers[string(resolverKeypath)]
+			if dryRun && !canDryRun(resolver) {
+				return errors.Wrapf(ErrDryRunUnsupported, "resolver at '%v'", resolverKeypath)
+			}
+
 			stateToResolve := state.AtKeypath(resolverKeypath, nil)
 			resolverConfig, err := state.CopyToMemory(resolverKeypath.Push(MergeTypeKeypath), nil)
-			if err != nil && errors.Cause(err) != types.Err404 {
+			if err != nil && !errors.Is(err, types.Err404) {
 				return err
 			}
 			if resolverConfig != nil {
@@ -284,9 +869,28 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 				state.Diff().SetEnabled(true)
 			}
 
-			err = c.behaviorTree.resolvers[string(resolverKeypath)].ResolveState(stateToResolve, tx.From, tx.ID, tx.Parents, patchesTrimmed)
-			if err != nil {
-				return err
+			if orderedResolver, is := resolver.(OrderedResolver); is {
+				var height uint64
+				if dryRun {
+					// A dry run leaves the resolver's records of past txs alone, and works
+					// on a scratch copy of them instead
+					orderedResolver = orderedResolver.(ScratchCopier).ScratchCopy()
+					height, err = c.heightAbove(tx.Parents)
+				} else {
+					height, err = c.txHeight(tx)
+				}
+				if err != nil {
+					return err
+				}
+				err = resolveStateInOrder(orderedResolver, stateToResolve, tx.From, TxOrder{Height: height, ID: tx.ID}, patchesTrimmed)
+				if err != nil {
+					return errors.Wrapf(err, "resolver at '%v' failed on tx %v", resolverKeypath, tx.ID.Hex())
+				}
+			} else {
+				err = resolveState(resolver, stateToResolve, tx.From, tx.ID, tx.Parents, patchesTrimmed)
+				if err != nil {
+					return errors.Wrapf(err, "resolver at '%v' failed on tx %v", resolverKeypath, tx.ID.Hex())
+				}
 			}
 
 			if resolverConfig != nil {
@@ -306,23 +910,20 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 		}
 	}
 
-	err = c.onTxProcessed(c, tx, state)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	err = state.Save()
+// commitState saves the state that the tx has been applied to and makes the tx a leaf, all
+// at once as far as snapshots are concerned.
+func (c *controller) commitState(state *tree.DBNode, tx *Tx) error {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	err := state.Save()
 	if err != nil {
 		return err
 	}
 
-	if tx.Checkpoint {
-		err = c.states.CopyVersion(tx.ID, tree.CurrentVersion)
-		if err != nil {
-			return err
-		}
-	}
-
 	// Unmark parents as leaves
 	for _, parentID := range tx.Parents {
 		delete(c.leaves, parentID)
@@ -330,104 +931,380 @@ func (c *controller) processMempoolTx(tx *Tx) error {
 
 	// Mark this tx as a leaf
 	c.leaves[tx.ID] = struct{}{}
+	return nil
+}
 
-	// Mark the tx valid and save it to the DB
-	tx.Valid = true
-	err = c.txStore.AddTx(tx)
-	if err != nil {
-		return err
+// validateTx, resolveState, and resolveStateInOrder call into validators and resolvers,
+// which may be running arbitrary user code.  A panic in one of them is turned into an
+// ErrBehaviorPanicked error so that it only invalidates the tx, rather than taking down
+// the mempool loop (and the node along with it).
+
+func validateTx(validator Validator, state tree.Node, tx *Tx) (err error) {
+	defer recoverBehaviorPanic("validator", &err)
+	return validator.ValidateTx(state, tx)
+}
+
+func resolveState(resolver Resolver, state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) (err error) {
+	defer recoverBehaviorPanic("resolver", &err)
+	return resolver.ResolveState(state, sender, txID, parents, patches)
+}
+
+func resolveStateInOrder(resolver OrderedResolver, state tree.Node, sender types.Address, order TxOrder, patches []Patch) (err error) {
+	defer recoverBehaviorPanic("resolver", &err)
+	return resolver.ResolveStateInOrder(state, sender, order, patches)
+}
+
+func recoverBehaviorPanic(kind string, err *error) {
+	if r := recover(); r != nil {
+		*err = errors.Wrapf(ErrBehaviorPanicked, "%v panicked: %v\n%s", kind, r, debug.Stack())
 	}
-	return nil
 }
 
 var (
-	ErrNoParentYet         = errors.New("no parent yet")
-	ErrMissingCriticalRefs = errors.New("missing critical refs")
-	ErrInvalidSignature    = errors.New("invalid signature")
-	ErrTxMissingParents    = errors.New("tx must have parents")
+	ErrNoParentYet           = errors.New("no parent yet")
+	ErrMissingCriticalRefs   = errors.New("missing critical refs")
+	ErrInvalidSignature      = errors.New("invalid signature")
+	ErrTxMissingParents      = errors.New("tx must have parents")
+	ErrTxTooManyPatches      = errors.New("tx has too many patches")
+	ErrTxTooLarge            = errors.New("tx is too large")
+	ErrTxTooManyRecipients   = errors.New("tx has too many recipients")
+	ErrGenesisNotFromCreator = errors.New("genesis tx is not from the stateURI's creator")
+	ErrTxCycle               = errors.New("tx is its own ancestor")
+	ErrTxIDNotContentID      = errors.New("tx ID doesn't match its content")
+	ErrTxIDCollision         = errors.New("tx ID is already used by a different tx")
+	ErrBehaviorPanicked      = errors.New("resolver or validator panicked")
+	ErrMempoolFull           = errors.New("mempool is full")
+	ErrMempoolTxExpired      = errors.New("tx waited too long in the mempool")
+	ErrControllerNotRunning  = errors.New("controller isn't running")
+	ErrTxAlreadyExists       = errors.New("tx already exists")
+	ErrDryRunUnsupported     = errors.New("tx can't be dry run")
 )
 
 func (c *controller) validateTxIntrinsics(tx *Tx) error {
+	// Check the limits first, before spending any effort on an oversized tx
+	if c.txLimits.MaxPatches > 0 && len(tx.Patches) > c.txLimits.MaxPatches {
+		return errors.Wrapf(ErrTxTooManyPatches, "%v patches (max %v)", len(tx.Patches), c.txLimits.MaxPatches)
+	} else if c.txLimits.MaxRecipients > 0 && len(tx.Recipients) > c.txLimits.MaxRecipients {
+		return errors.Wrapf(ErrTxTooManyRecipients, "%v recipients (max %v)", len(tx.Recipients), c.txLimits.MaxRecipients)
+	} else if c.txLimits.MaxSize > 0 {
+		bs, err := json.Marshal(tx)
+		if err != nil {
+			return errors.WithStack(err)
+		} else if len(bs) > c.txLimits.MaxSize {
+			return errors.Wrapf(ErrTxTooLarge, "%v bytes (max %v)", len(bs), c.txLimits.MaxSize)
+		}
+	}
+
 	if len(tx.Parents) == 0 && tx.ID != GenesisTxID {
 		return ErrTxMissingParents
 	}
 
+	if c.txLimits.ContentAddressedIDs && tx.ID != GenesisTxID {
+		if contentID := tx.ContentID(); tx.ID != contentID {
+			return errors.Wrapf(ErrTxIDNotContentID, "%v expected, %v received", contentID.Hex(), tx.ID.Hex())
+		}
+	}
+
+	createsCycle, err := c.createsCycle(tx)
+	if err != nil {
+		return err
+	} else if createsCycle {
+		return errors.Wrapf(ErrTxCycle, "tx %v", tx.ID.Hex())
+	}
+
 	for _, parentID := range tx.Parents {
 		parentTx, err := c.txStore.FetchTx(c.stateURI, parentID)
-		if errors.Cause(err) == types.Err404 {
+		if errors.Is(err, types.Err404) {
 			return errors.Wrapf(ErrNoParentYet, "parent tx not found: %v", parentID.Hex())
 		} else if err != nil {
 			return err
-		} else if !parentTx.Valid && parentID != GenesisTxID {
+		} else if !parentTx.Valid {
 			return errors.Wrapf(ErrNoParentYet, "parent tx not valid: %v", parentID.Hex())
 		}
 	}
 
-	if tx.ID != GenesisTxID {
-		sigPubKey, err := RecoverSigningPubkey(tx.Hash(), tx.Sig)
-		if err != nil {
-			return errors.Wrap(ErrInvalidSignature, err.Error())
-		} else if sigPubKey.VerifySignature(tx.Hash(), tx.Sig) == false {
-			return errors.Wrapf(ErrInvalidSignature, "cannot be verified")
-		} else if sigPubKey.Address() != tx.From {
-			return errors.Wrapf(ErrInvalidSignature, "address doesn't match (%v expected, %v received)", tx.From.Hex(), sigPubKey.Address().Hex())
+	sigPubKey, err := RecoverSigningPubkey(tx.Hash(), tx.Sig, c.txLimits.AddressDerivation)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSignature, err.Error())
+	} else if sigPubKey.VerifySignature(tx.Hash(), tx.Sig) == false {
+		return errors.Wrapf(ErrInvalidSignature, "cannot be verified")
+	} else if sigPubKey.Address() != tx.From {
+		return errors.Wrapf(ErrInvalidSignature, "address doesn't match (%v expected, %v received)", tx.From.Hex(), sigPubKey.Address().Hex())
+	}
+
+	// The genesis tx decides what the state starts out as, so when the stateURI names its
+	// creator, nobody else may sign it
+	if tx.ID == GenesisTxID {
+		if creator, ok := StateURICreator(c.stateURI); ok && creator != tx.From {
+			return errors.Wrapf(ErrGenesisNotFromCreator, "%v expected, %v received", creator.Hex(), tx.From.Hex())
 		}
 	}
 
 	return nil
 }
 
+// createsCycle returns true if the tx is among its own ancestors.  Only the txs that
+// haven't been applied yet need to be walked: an applied tx's ancestors were all applied
+// before it, so none of them can be waiting on this one.
+func (c *controller) createsCycle(tx *Tx) (bool, error) {
+	seen := make(map[types.ID]struct{})
+	stack := append([]types.ID(nil), tx.Parents...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if id == tx.ID {
+			return true, nil
+		} else if _, exists := seen[id]; exists {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		ancestor, err := c.txStore.FetchTx(c.stateURI, id)
+		if errors.Is(err, types.Err404) {
+			continue
+		} else if err != nil {
+			return false, err
+		} else if ancestor.Valid {
+			continue
+		}
+		stack = append(stack, ancestor.Parents...)
+	}
+	return false, nil
+}
+
+// txHeight returns the length of the longest path from the genesis tx to the given tx,
+// whose parents must all have been applied.  Heights are remembered once computed, so only
+// the first call after a restart has to walk back through the txStore.
+func (c *controller) txHeight(tx *Tx) (uint64, error) {
+	if height, exists := c.txHeights[tx.ID]; exists {
+		return height, nil
+	}
+
+	height, err := c.heightAbove(tx.Parents)
+	if err != nil {
+		return 0, err
+	}
+	c.txHeights[tx.ID] = height
+	return height, nil
+}
+
+// heightAbove returns the height of a tx with the given parents.
+func (c *controller) heightAbove(parentIDs []types.ID) (uint64, error) {
+	var height uint64
+	for _, parentID := range parentIDs {
+		parentHeight, exists := c.txHeights[parentID]
+		if !exists {
+			parent, err := c.txStore.FetchTx(c.stateURI, parentID)
+			if err != nil {
+				return 0, err
+			}
+			parentHeight, err = c.txHeight(parent)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if parentHeight+1 > height {
+			height = parentHeight + 1
+		}
+	}
+	return height, nil
+}
+
 func (c *controller) HaveTx(txID types.ID) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	_, have := c.txs[txID]
-	return have
+	exists, err := c.txStore.TxExists(c.stateURI, txID)
+	if err != nil {
+		c.Errorf("error checking for tx %v: %v", txID.Pretty(), err)
+		return false
+	}
+	return exists
 }
 
 func (c *controller) QueryIndex(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, rng *tree.Range) (node tree.Node, err error) {
 	defer withStack(&err)
 
-	indexNode := c.indices.IndexAtVersion(version, keypath, indexName, false)
+	indexer := c.indexer(keypath, indexName)
 
-	exists, err := indexNode.Exists(queryParam)
+	c.indicesMu.Lock()
+	defer c.indicesMu.Unlock()
+
+	indexNode, err := c.indexAtVersion(version, keypath, indexName, indexer)
 	if err != nil {
 		return nil, err
+	}
 
+	exists, err := indexNode.Exists(queryParam)
+	if err != nil {
+		indexNode.Close()
+		return nil, err
 	} else if !exists {
 		indexNode.Close()
-		indexNode = c.indices.IndexAtVersion(version, keypath, indexName, true)
+		return nil, types.Err404
+	}
+	return indexNode.AtKeypath(queryParam, rng), nil
+}
 
-		indices, exists := c.behaviorTree.indexers[string(keypath)]
-		if !exists {
-			return nil, types.Err404
+// QueryIndexPage returns up to limit of the entries found directly beneath queryParam in an
+// index, ordered by the byte-wise ordering of their keys.  For a one-dimensional index (or a
+// compound index queried by its full key), the entries are the indexed nodes themselves.
+// For a compound index queried by a prefix of its key, they're the buckets for the next
+// component of the key.  To fetch the following page, pass the returned NextCursor back in
+// as the cursor.
+func (c *controller) QueryIndexPage(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, cursor tree.Keypath, limit int) (page IndexPage, err error) {
+	defer withStack(&err)
+
+	if limit <= 0 {
+		return IndexPage{}, errors.Errorf("invalid page limit %v", limit)
+	}
+
+	indexer := c.indexer(keypath, indexName)
+
+	c.indicesMu.Lock()
+	defer c.indicesMu.Unlock()
+
+	indexNode, err := c.indexAtVersion(version, keypath, indexName, indexer)
+	if err != nil {
+		return IndexPage{}, err
+	}
+	defer indexNode.Close()
+
+	exists, err := indexNode.Exists(queryParam)
+	if err != nil {
+		return IndexPage{}, err
+	} else if !exists {
+		return IndexPage{}, types.Err404
+	}
+
+	bucket := indexNode.AtKeypath(queryParam, nil).(*tree.DBNode)
+	keys, hasMore := bucket.SubkeysAfter(cursor, limit)
+	for _, key := range keys {
+		val, _, err := bucket.Value(key, nil)
+		if err != nil {
+			return IndexPage{}, err
 		}
-		indexer, exists := indices[string(indexName)]
-		if !exists {
-			return nil, types.Err404
+		page.Entries = append(page.Entries, IndexEntry{Key: key, Value: val})
+	}
+	if hasMore {
+		page.NextCursor = keys[len(keys)-1]
+	}
+	return page, nil
+}
+
+// indexer returns the indexer declared for the given index, or nil if there isn't one.
+func (c *controller) indexer(keypath tree.Keypath, indexName tree.Keypath) Indexer {
+	return c.behaviorTree.indexer(keypath, indexName)
+}
+
+// indexAtVersion returns the requested index, building it first (with the given indexer) if
+// it has never been queried.  From then on, it's kept up to date as txs are processed (see
+// updateIndices).
+func (c *controller) indexAtVersion(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, indexer Indexer) (*tree.DBNode, error) {
+	indexNode := c.indices.IndexAtVersion(version, keypath, indexName, false)
+	exists, err := indexNode.Exists(nil)
+	if err != nil {
+		indexNode.Close()
+		return nil, err
+	} else if exists {
+		return indexNode, nil
+	}
+	indexNode.Close()
+
+	if indexer == nil {
+		return nil, types.Err404
+	}
+
+	if version == nil {
+		version = &tree.CurrentVersion
+	}
+
+	state := c.states.StateAtVersion(version, false)
+	defer state.Close()
+
+	err = c.indices.BuildIndex(version, state.AtKeypath(keypath, nil).(*tree.DBNode), indexName, indexer)
+	if err != nil {
+		return nil, err
+	}
+	return c.indices.IndexAtVersion(version, keypath, indexName, false), nil
+}
+
+// updateIndices incrementally updates any existing indices over the parts of the state
+// tree touched by a tx.  Indices that can't be updated in place are deleted, and will be
+// rebuilt the next time they're queried.
+func (c *controller) updateIndices(oldState *tree.DBNode, diff *tree.Diff) {
+	c.indicesMu.Lock()
+	defer c.indicesMu.Unlock()
+
+	newState := c.states.StateAtVersion(nil, false)
+	defer newState.Close()
+
+	for keypathStr, indexers := range c.behaviorTree.allIndexers() {
+		indexedKeypath := tree.Keypath(keypathStr)
+
+		childKeys, replaced := changedChildKeys(indexedKeypath, diff)
+		if len(childKeys) == 0 && !replaced {
+			continue
 		}
 
-		if version == nil {
-			version = &tree.CurrentVersion
+		nodeType, _, _, err := newState.AtKeypath(indexedKeypath, nil).NodeInfo()
+		if err != nil && !errors.Is(err, types.Err404) {
+			c.Errorf("error updating indices at %v: %v", indexedKeypath, err)
+			continue
 		}
+		// Slices are renumbered within each index bucket, so they can't be patched in place
+		rebuild := replaced || nodeType != tree.NodeTypeMap
 
-		nodeToIndex := c.states.StateAtVersion(version, false).AtKeypath(keypath, nil).(*tree.DBNode)
+		for indexNameStr, indexer := range indexers {
+			indexName := tree.Keypath(indexNameStr)
 
-		err := c.indices.BuildIndex(version, nodeToIndex, indexName, indexer)
-		if err != nil {
-			return nil, err
-		}
+			index := c.indices.IndexAtVersion(nil, indexedKeypath, indexName, false)
+			exists, err := index.Exists(nil)
+			index.Close()
+			if err != nil {
+				c.Errorf("error updating index %v at %v: %v", indexName, indexedKeypath, err)
+				continue
+			} else if !exists {
+				// It hasn't been built yet, so there's nothing to update
+				continue
+			}
 
-		indexNode = c.indices.IndexAtVersion(version, keypath, indexName, false)
+			if !rebuild {
+				oldNode := oldState.AtKeypath(indexedKeypath, nil).(*tree.DBNode)
+				newNode := newState.AtKeypath(indexedKeypath, nil).(*tree.DBNode)
+				err = c.indices.UpdateIndex(nil, oldNode, newNode, indexName, indexer, childKeys)
+				if err == nil {
+					continue
+				}
+				c.Errorf("error updating index %v at %v, deleting it: %v", indexName, indexedKeypath, err)
+			}
 
-		exists, err = indexNode.Exists(queryParam)
-		if err != nil {
-			return nil, err
-		} else if !exists {
-			return nil, types.Err404
+			err = c.indices.DeleteIndex(nil, indexedKeypath, indexName)
+			if err != nil {
+				c.Errorf("error deleting index %v at %v: %v", indexName, indexedKeypath, err)
+			}
 		}
 	}
+}
 
-	return indexNode.AtKeypath(queryParam, rng), nil
+// changedChildKeys returns the keys of the immediate children of the given keypath that
+// were added, changed, or removed according to the diff.  If the node at the keypath (or
+// one of its ancestors) was itself replaced, replaced is true.
+func changedChildKeys(keypath tree.Keypath, diff *tree.Diff) (childKeys []tree.Keypath, replaced bool) {
+	seen := make(map[string]struct{})
+	for _, changed := range []map[string]struct{}{diff.Added, diff.Removed} {
+		for kpStr := range changed {
+			kp := tree.Keypath(kpStr)
+			if keypath.StartsWith(kp) {
+				replaced = true
+			} else if kp.StartsWith(keypath) {
+				childKey := kp.RelativeTo(keypath).Part(0)
+				if _, exists := seen[string(childKey)]; !exists {
+					seen[string(childKey)] = struct{}{}
+					childKeys = append(childKeys, childKey.Copy())
+				}
+			}
+		}
+	}
+	return childKeys, replaced
 }
 
 //func (c *controller) getAncestors(hashes map[Hash]bool) map[Hash]bool {
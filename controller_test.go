@@ -0,0 +1,1401 @@
+package redwood
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// testDBOptions keeps the Badger DBs opened by tests small.  Badger's default block cache
+// alone allocates over a hundred megabytes per DB up front, which adds up quickly over a
+// whole test run.
+var testDBOptions = tree.DBTreeOptions{
+	MaxTableSize:     4 << 20,
+	ValueLogFileSize: 4 << 20,
+	MaxCacheSize:     4 << 20,
+}
+
+func newTestController(t *testing.T) Controller {
+	t.Helper()
+	return newTestControllerWithLimits(t, DefaultTxLimits)
+}
+
+func newTestControllerWithLimits(t *testing.T, txLimits TxLimits) Controller {
+	t.Helper()
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-controller")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, testDBOptions)
+	err = txStore.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { txStore.Ctx().CtxStop("test finished", nil) })
+
+	c, err := NewControllerWithDBOptions(types.Address{}, "localhost/test", dbRoot, txStore, txLimits, testDBOptions, func(c Controller, tx *Tx, state *tree.DBNode) error { return nil })
+	require.NoError(t, err)
+	err = c.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Ctx().CtxStop("test finished", nil) })
+	return c
+}
+
+// signTestTx signs the tx with a freshly generated keypair and sets its From to match.
+func signTestTx(t *testing.T, tx *Tx) *Tx {
+	t.Helper()
+
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	tx.From = signingKeypair.Address()
+	tx.Sig, err = signingKeypair.SignHash(tx.Hash())
+	require.NoError(t, err)
+	return tx
+}
+
+func newTestLimitsTx(t *testing.T, numPatches, numRecipients int) *Tx {
+	tx := &Tx{ID: GenesisTxID, URL: "localhost/test"}
+	for i := 0; i < numPatches; i++ {
+		tx.Patches = append(tx.Patches, Patch{Keypath: tree.Keypath("foo"), Val: i})
+	}
+	for i := 0; i < numRecipients; i++ {
+		tx.Recipients = append(tx.Recipients, types.Address{byte(i + 1)})
+	}
+	return signTestTx(t, tx)
+}
+
+func TestController_ValidateTxIntrinsics_MaxPatches(t *testing.T) {
+	c := &controller{txLimits: TxLimits{MaxPatches: 3}}
+
+	err := c.validateTxIntrinsics(newTestLimitsTx(t, 3, 0))
+	require.NoError(t, err)
+
+	err = c.validateTxIntrinsics(newTestLimitsTx(t, 4, 0))
+	require.Equal(t, ErrTxTooManyPatches, errors.Cause(err))
+}
+
+func TestController_ValidateTxIntrinsics_MaxRecipients(t *testing.T) {
+	c := &controller{txLimits: TxLimits{MaxRecipients: 2}}
+
+	err := c.validateTxIntrinsics(newTestLimitsTx(t, 1, 2))
+	require.NoError(t, err)
+
+	err = c.validateTxIntrinsics(newTestLimitsTx(t, 1, 3))
+	require.Equal(t, ErrTxTooManyRecipients, errors.Cause(err))
+}
+
+func TestController_ValidateTxIntrinsics_MaxSize(t *testing.T) {
+	tx := newTestLimitsTx(t, 2, 1)
+	bs, err := json.Marshal(tx)
+	require.NoError(t, err)
+
+	c := &controller{txLimits: TxLimits{MaxSize: len(bs)}}
+	err = c.validateTxIntrinsics(tx)
+	require.NoError(t, err)
+
+	c = &controller{txLimits: TxLimits{MaxSize: len(bs) - 1}}
+	err = c.validateTxIntrinsics(tx)
+	require.Equal(t, ErrTxTooLarge, errors.Cause(err))
+}
+
+func TestController_ValidateTxIntrinsics_ZeroLimitsAreUnlimited(t *testing.T) {
+	c := &controller{txLimits: TxLimits{}}
+
+	err := c.validateTxIntrinsics(newTestLimitsTx(t, 5000, 500))
+	require.NoError(t, err)
+}
+
+func TestController_ValidateTxIntrinsics_Genesis(t *testing.T) {
+	creator, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	forger, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	stateURI := creator.Address().Hex() + "/chat"
+	c := &controller{stateURI: stateURI}
+
+	newGenesis := func(from types.Address, signer *SigningKeypair) *Tx {
+		tx := &Tx{ID: GenesisTxID, From: from, URL: stateURI, Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}}}
+		if signer != nil {
+			tx.Sig, err = signer.SignHash(tx.Hash())
+			require.NoError(t, err)
+		}
+		return tx
+	}
+
+	t.Run("signed by the creator", func(t *testing.T) {
+		err := c.validateTxIntrinsics(newGenesis(creator.Address(), creator))
+		require.NoError(t, err)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		err := c.validateTxIntrinsics(newGenesis(creator.Address(), nil))
+		require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+	})
+
+	t.Run("claims to be from the creator", func(t *testing.T) {
+		err := c.validateTxIntrinsics(newGenesis(creator.Address(), forger))
+		require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+	})
+
+	t.Run("signed by someone else", func(t *testing.T) {
+		err := c.validateTxIntrinsics(newGenesis(forger.Address(), forger))
+		require.Equal(t, ErrGenesisNotFromCreator, errors.Cause(err))
+	})
+
+	t.Run("stateURI without a creator", func(t *testing.T) {
+		c := &controller{stateURI: "localhost/chat"}
+		err := c.validateTxIntrinsics(newGenesis(forger.Address(), forger))
+		require.NoError(t, err)
+	})
+}
+
+func TestController_TxRejectedHandler(t *testing.T) {
+	c := newTestController(t)
+
+	type rejection struct {
+		tx  *Tx
+		err error
+	}
+	chRejected := make(chan rejection, 10)
+	c.SetTxRejectedHandler(func(tx *Tx, err error) {
+		chRejected <- rejection{tx, err}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}))
+	require.NoError(t, err)
+
+	// A tx that's only waiting on its parent isn't rejected
+	err = c.AddTx(signTestTx(t, &Tx{
+		ID:      types.IDFromString("orphan"),
+		Parents: []types.ID{types.IDFromString("nobody")},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "orphan"}},
+	}))
+	require.NoError(t, err)
+
+	// Tamper with a tx after it's been signed
+	forged := signTestTx(t, &Tx{
+		ID:      types.IDFromString("forged"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+	})
+	forged.Patches[0].Val = "forged"
+	err = c.AddTxAndWait(ctx, forged)
+	require.True(t, errors.Is(err, ErrInvalidSignature))
+
+	select {
+	case r := <-chRejected:
+		require.Equal(t, forged.ID, r.tx.ID)
+		require.True(t, errors.Is(r.err, ErrInvalidSignature))
+	case <-ctx.Done():
+		t.Fatal("tx rejected handler wasn't called")
+	}
+	require.Len(t, chRejected, 0)
+}
+
+func TestController_QueryIndex_Compound(t *testing.T) {
+	c := newTestController(t)
+
+	msg1 := map[string]interface{}{"sender": "alice", "timestamp": float64(100), "text": "hi"}
+	msg2 := map[string]interface{}{"sender": "bob", "timestamp": float64(100), "text": "hey"}
+	msg3 := map[string]interface{}{"sender": "alice", "timestamp": float64(200), "text": "sup"}
+
+	err := c.(*controller).processMempoolTx(signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: tree.Keypath("messages"),
+			Val:     map[string]interface{}{"m1": msg1, "m2": msg2, "m3": msg3},
+		}},
+	}))
+	require.NoError(t, err)
+
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{"keypaths": []interface{}{"sender", "timestamp"}})
+	require.NoError(t, err)
+	indexer, err := NewCompoundIndexer(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addIndexer(tree.Keypath("messages"), tree.Keypath("by-sender-time"), indexer)
+
+	// Query by the first part of the key
+	node, err := c.QueryIndex(nil, tree.Keypath("messages"), tree.Keypath("by-sender-time"), tree.Keypath("alice"), nil)
+	require.NoError(t, err)
+	val, exists, err := node.Value(nil, nil)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, map[string]interface{}{
+		"100": map[string]interface{}{"m1": msg1},
+		"200": map[string]interface{}{"m3": msg3},
+	}, val)
+
+	// Query by the full key
+	node, err = c.QueryIndex(nil, tree.Keypath("messages"), tree.Keypath("by-sender-time"), tree.Keypath("bob/100"), nil)
+	require.NoError(t, err)
+	val, exists, err = node.Value(nil, nil)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, map[string]interface{}{"m2": msg2}, val)
+}
+
+func TestController_QueryIndexDoesntWaitOnTxProcessing(t *testing.T) {
+	c := newTestController(t)
+
+	msg := map[string]interface{}{"sender": "alice", "text": "hi"}
+	err := c.(*controller).processMempoolTx(signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("messages"), Val: map[string]interface{}{"m1": msg}}},
+	}))
+	require.NoError(t, err)
+
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{"keypath": "sender"})
+	require.NoError(t, err)
+	indexer, err := NewKeypathIndexer(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addIndexer(tree.Keypath("messages"), tree.Keypath("by-sender"), indexer)
+
+	// Stand in for a tx that's taking a long time to apply
+	c.(*controller).applyMu.Lock()
+	defer c.(*controller).applyMu.Unlock()
+
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		node, err := c.QueryIndex(nil, tree.Keypath("messages"), tree.Keypath("by-sender"), tree.Keypath("alice"), nil)
+		require.NoError(t, err)
+		val, _, err := node.Value(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"m1": msg}, val)
+	}()
+
+	select {
+	case <-chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query waited on tx processing")
+	}
+}
+
+func TestController_QueryIndex_UpdatedByNewTxs(t *testing.T) {
+	c := newTestController(t)
+
+	msg1 := map[string]interface{}{"sender": "alice", "text": "hi"}
+	msg2 := map[string]interface{}{"sender": "bob", "text": "hey"}
+
+	err := c.(*controller).processMempoolTx(signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("messages"), Val: map[string]interface{}{"m1": msg1, "m2": msg2}}},
+	}))
+	require.NoError(t, err)
+
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{"keypath": "sender"})
+	require.NoError(t, err)
+	indexer, err := NewKeypathIndexer(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addIndexer(tree.Keypath("messages"), tree.Keypath("by-sender"), indexer)
+
+	queryIndex := func(sender string) interface{} {
+		node, err := c.QueryIndex(nil, tree.Keypath("messages"), tree.Keypath("by-sender"), tree.Keypath(sender), nil)
+		if errors.Is(err, types.Err404) {
+			return nil
+		}
+		require.NoError(t, err)
+		val, _, err := node.Value(nil, nil)
+		require.NoError(t, err)
+		return val
+	}
+
+	require.Equal(t, map[string]interface{}{"m1": msg1}, queryIndex("alice"))
+
+	// Add a new message from alice, and change the sender of bob's message to carol
+	msg3 := map[string]interface{}{"sender": "alice", "text": "sup"}
+	msg2b := map[string]interface{}{"sender": "carol", "text": "hey"}
+	err = c.(*controller).processMempoolTx(signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("messages/m3"), Val: msg3},
+			{Keypath: tree.Keypath("messages/m2"), Val: msg2b},
+		},
+	}))
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]interface{}{"m1": msg1, "m3": msg3}, queryIndex("alice"))
+	require.Equal(t, map[string]interface{}{"m2": msg2b}, queryIndex("carol"))
+	require.Nil(t, queryIndex("bob"))
+}
+
+func TestController_QueryIndexPage(t *testing.T) {
+	c := newTestController(t)
+
+	messages := make(map[string]interface{})
+	for i := 0; i < 7; i++ {
+		messages[fmt.Sprintf("alice-%v", i)] = map[string]interface{}{"sender": "alice", "text": fmt.Sprintf("hi %v", i)}
+	}
+	messages["bob-0"] = map[string]interface{}{"sender": "bob", "text": "hey"}
+
+	err := c.(*controller).processMempoolTx(signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("messages"), Val: messages}},
+	}))
+	require.NoError(t, err)
+
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{"keypath": "sender"})
+	require.NoError(t, err)
+	indexer, err := NewKeypathIndexer(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addIndexer(tree.Keypath("messages"), tree.Keypath("by-sender"), indexer)
+
+	var keys []string
+	var cursor tree.Keypath
+	var numPages int
+	for {
+		page, err := c.QueryIndexPage(nil, tree.Keypath("messages"), tree.Keypath("by-sender"), tree.Keypath("alice"), cursor, 3)
+		require.NoError(t, err)
+		numPages++
+
+		if page.NextCursor != nil {
+			require.Len(t, page.Entries, 3)
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, string(entry.Key))
+			require.Equal(t, messages[string(entry.Key)], entry.Value)
+		}
+
+		if page.NextCursor == nil {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	require.Equal(t, 3, numPages)
+	require.Equal(t, []string{"alice-0", "alice-1", "alice-2", "alice-3", "alice-4", "alice-5", "alice-6"}, keys)
+
+	_, err = c.QueryIndexPage(nil, tree.Keypath("messages"), tree.Keypath("by-sender"), tree.Keypath("carol"), nil, 3)
+	require.Equal(t, types.Err404, errors.Cause(err))
+
+	_, err = c.QueryIndexPage(nil, tree.Keypath("messages"), tree.Keypath("by-sender"), tree.Keypath("alice"), nil, 0)
+	require.Error(t, err)
+}
+
+func TestController_MempoolOverflow(t *testing.T) {
+	// Every one of these txs is stuck in the mempool waiting on a parent that never arrives
+	orphan := func(i int) *Tx {
+		return signTestTx(t, &Tx{
+			ID:      types.IDFromString(fmt.Sprintf("orphan-%v", i)),
+			Parents: []types.ID{types.IDFromString("missing")},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "orphan"}},
+		})
+	}
+
+	// flood adds the txs from a goroutine so that the test fails rather than hangs if
+	// AddTx blocks
+	flood := func(t *testing.T, c Controller, txs []*Tx) []error {
+		chErrs := make(chan []error)
+		go func() {
+			var errs []error
+			for _, tx := range txs {
+				errs = append(errs, c.AddTx(tx))
+			}
+			chErrs <- errs
+		}()
+		select {
+		case errs := <-chErrs:
+			return errs
+		case <-time.After(10 * time.Second):
+			t.Fatal("AddTx blocked")
+			return nil
+		}
+	}
+
+	t.Run("reject new", func(t *testing.T) {
+		c := newTestControllerWithLimits(t, TxLimits{MaxMempoolSize: 10, MempoolOverflow: MempoolRejectNew})
+
+		var txs []*Tx
+		for i := 0; i < 15; i++ {
+			txs = append(txs, orphan(i))
+		}
+		errs := flood(t, c, txs)
+
+		for i, err := range errs {
+			if i < 10 {
+				require.NoError(t, err)
+				require.True(t, c.HaveTx(txs[i].ID))
+			} else {
+				require.True(t, errors.Is(err, ErrMempoolFull))
+				// Rejected txs aren't stored, so they're accepted once there's room
+				require.False(t, c.HaveTx(txs[i].ID))
+			}
+		}
+	})
+
+	t.Run("evict oldest", func(t *testing.T) {
+		c := newTestControllerWithLimits(t, TxLimits{MaxMempoolSize: 10, MempoolOverflow: MempoolEvictOldest})
+
+		var txs []*Tx
+		for i := 0; i < 15; i++ {
+			txs = append(txs, orphan(i))
+		}
+
+		// Callers waiting on an evicted tx find out that it was evicted
+		chResult := make(chan error, 1)
+		go func() { chResult <- c.AddTxAndWait(context.Background(), txs[0]) }()
+		require.Eventually(t, func() bool { return c.HaveTx(txs[0].ID) }, 5*time.Second, 10*time.Millisecond)
+
+		errs := flood(t, c, txs[1:])
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+
+		select {
+		case err := <-chResult:
+			require.True(t, errors.Is(err, ErrMempoolFull))
+		case <-time.After(5 * time.Second):
+			t.Fatal("evicted tx's waiter wasn't notified")
+		}
+
+		// The oldest txs are forgotten, and the newest are still waiting on their parent
+		require.Eventually(t, func() bool {
+			for i, tx := range txs {
+				if c.HaveTx(tx.ID) != (i >= 5) {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestController_StuckTxsExpire(t *testing.T) {
+	limits := DefaultTxLimits
+	limits.MempoolTxTTL = 200 * time.Millisecond
+	c := newTestControllerWithLimits(t, limits)
+
+	chRejected := make(chan error, 10)
+	c.SetTxRejectedHandler(func(tx *Tx, err error) { chRejected <- err })
+
+	var fetchingParents bool
+	var fetchingParentsMu sync.Mutex
+	c.SetFetchingParentsChecker(func(tx *Tx) bool {
+		fetchingParentsMu.Lock()
+		defer fetchingParentsMu.Unlock()
+		return fetchingParents
+	})
+	setFetchingParents := func(fetching bool) {
+		fetchingParentsMu.Lock()
+		defer fetchingParentsMu.Unlock()
+		fetchingParents = fetching
+	}
+
+	orphan := func(id string) *Tx {
+		return signTestTx(t, &Tx{
+			ID:      types.IDFromString(id),
+			Parents: []types.ID{types.IDFromString("missing")},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: id}},
+		})
+	}
+
+	t.Run("parents never arrive", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		tx := orphan("orphan")
+		err := c.AddTxAndWait(ctx, tx)
+		require.True(t, errors.Is(err, ErrMempoolTxExpired))
+		require.True(t, errors.Is(<-chRejected, ErrMempoolTxExpired))
+
+		// Expired txs are forgotten, so that they're accepted if they're received again
+		require.False(t, c.HaveTx(tx.ID))
+	})
+
+	t.Run("parents still being fetched", func(t *testing.T) {
+		setFetchingParents(true)
+
+		tx := orphan("orphan-fetching")
+		err := c.AddTx(tx)
+		require.NoError(t, err)
+
+		time.Sleep(5 * limits.MempoolTxTTL)
+		require.True(t, c.HaveTx(tx.ID))
+		require.Len(t, chRejected, 0)
+
+		// Once the fetch is over, the tx can expire
+		setFetchingParents(false)
+		select {
+		case err := <-chRejected:
+			require.True(t, errors.Is(err, ErrMempoolTxExpired))
+		case <-time.After(5 * time.Second):
+			t.Fatal("tx didn't expire")
+		}
+		require.False(t, c.HaveTx(tx.ID))
+	})
+}
+
+func TestController_AddTxAndWait_AlreadyApplied(t *testing.T) {
+	c := newTestController(t)
+
+	tx := signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}}})
+	err := c.AddTxAndWait(context.Background(), tx)
+	require.NoError(t, err)
+
+	// Waiting on a tx that's already been applied returns immediately
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = c.AddTxAndWait(ctx, &Tx{ID: GenesisTxID, URL: "localhost/test"})
+	require.NoError(t, err)
+}
+
+func TestController_RejectsTxCycles(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test"}))
+	require.NoError(t, err)
+
+	t.Run("tx is its own parent", func(t *testing.T) {
+		tx := signTestTx(t, &Tx{
+			ID:      types.IDFromString("self"),
+			Parents: []types.ID{GenesisTxID, types.IDFromString("self")},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("self"), Val: true}},
+		})
+		err := c.AddTxAndWait(ctx, tx)
+		require.Equal(t, ErrTxCycle, errors.Cause(err))
+	})
+
+	t.Run("tx is its parent's parent", func(t *testing.T) {
+		a := signTestTx(t, &Tx{
+			ID:      types.IDFromString("a"),
+			Parents: []types.ID{GenesisTxID, types.IDFromString("b")},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("a"), Val: true}},
+		})
+		b := signTestTx(t, &Tx{
+			ID:      types.IDFromString("b"),
+			Parents: []types.ID{a.ID},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("b"), Val: true}},
+		})
+
+		// a waits in the mempool for b, which can only be rejected
+		err := c.AddTx(a)
+		require.NoError(t, err)
+		err = c.AddTxAndWait(ctx, b)
+		require.Equal(t, ErrTxCycle, errors.Cause(err))
+	})
+
+	// The rest of the DAG is unaffected
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("ok"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("ok"), Val: true}},
+	}))
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err := state.Value(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"ok": true}, val)
+}
+
+func TestController_ContentAddressedIDs(t *testing.T) {
+	txLimits := DefaultTxLimits
+	txLimits.ContentAddressedIDs = true
+	c := newTestControllerWithLimits(t, txLimits)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The genesis tx keeps its well-known ID
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test"}))
+	require.NoError(t, err)
+
+	newTx := func(id types.ID, val interface{}) *Tx {
+		tx := &Tx{
+			ID:      id,
+			Parents: []types.ID{GenesisTxID},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: val}},
+		}
+		if id == (types.ID{}) {
+			tx.ID = tx.ContentID()
+		}
+		return signTestTx(t, tx)
+	}
+
+	t.Run("user-supplied ID", func(t *testing.T) {
+		err := c.AddTxAndWait(ctx, newTx(types.IDFromString("one"), 1.0))
+		require.Equal(t, ErrTxIDNotContentID, errors.Cause(err))
+	})
+
+	t.Run("same ID, different content", func(t *testing.T) {
+		tx1 := newTx(types.ID{}, 2.0)
+		err := c.AddTxAndWait(ctx, tx1)
+		require.NoError(t, err)
+
+		tx2 := newTx(tx1.ID, 3.0)
+		err = c.AddTxAndWait(ctx, tx2)
+		require.Equal(t, ErrTxIDCollision, errors.Cause(err))
+
+		// Resending the same tx is still just a duplicate
+		err = c.AddTxAndWait(ctx, tx1)
+		require.NoError(t, err)
+	})
+
+}
+
+func TestController_StateDBsDontCollide(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "redwood-test-controller")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, testDBOptions)
+	err = txStore.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { txStore.Ctx().CtxStop("test finished", nil) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Both of these used to be stored at <dbRoot>/a_b
+	stateURIs := []string{"a:b", "a/b"}
+	var controllers []Controller
+	for _, stateURI := range stateURIs {
+		c, err := NewControllerWithDBOptions(types.Address{}, stateURI, dbRoot, txStore, DefaultTxLimits, testDBOptions, func(c Controller, tx *Tx, state *tree.DBNode) error { return nil })
+		require.NoError(t, err)
+		err = c.Start()
+		require.NoError(t, err)
+		controllers = append(controllers, c)
+
+		err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+			ID:      GenesisTxID,
+			URL:     stateURI,
+			Patches: []Patch{{Keypath: tree.Keypath("stateURI"), Val: stateURI}},
+		}))
+		require.NoError(t, err)
+	}
+
+	statesPath0, _ := StateDBPaths(dbRoot, stateURIs[0])
+	statesPath1, _ := StateDBPaths(dbRoot, stateURIs[1])
+	require.NotEqual(t, statesPath0, statesPath1)
+
+	for i, c := range controllers {
+		state := c.StateAtVersion(nil)
+		val, _, err := state.Value(nil, nil)
+		state.Close()
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"stateURI": stateURIs[i]}, val)
+	}
+
+	// Once its controller has stopped, a state DB can be opened read-only
+	var wg sync.WaitGroup
+	wg.Add(1)
+	controllers[0].Ctx().CtxStop("test finished", &wg)
+	wg.Wait()
+	controllers[1].Ctx().CtxStop("test finished", nil)
+
+	states, err := OpenStateDBReadOnly(dbRoot, stateURIs[0])
+	require.NoError(t, err)
+	defer states.Close()
+
+	val, _, err := states.Value(nil, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"stateURI": stateURIs[0]}, val)
+
+	state := states.StateAtVersion(nil, true)
+	defer state.Close()
+	err = state.Set(tree.Keypath("foo"), nil, "bar")
+	if err == nil {
+		err = state.Save()
+	}
+	require.Error(t, err)
+}
+
+func TestController_StopAndRestart(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.Ctx().CtxStop("restarting", &wg)
+	wg.Wait()
+
+	// Badger only lets one handle open a DB for writing, so these only succeed if the
+	// controller released both of its DBs
+	statesPath, indicesPath := StateDBPaths(c.(*controller).stateDBRootPath, "localhost/test")
+	for _, path := range []string{statesPath, indicesPath} {
+		db, err := tree.NewDBTreeWithOptions(path, testDBOptions)
+		require.NoError(t, err)
+		err = db.Close()
+		require.NoError(t, err)
+	}
+
+	err = c.Start()
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	val, _, err := state.Value(nil, nil)
+	state.Close()
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"foo": "bar"}, val)
+
+	// The restarted controller keeps accepting txs
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("two"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("baz"), Val: "quux"}},
+	}))
+	require.NoError(t, err)
+
+	state = c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err = state.Value(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"foo": "bar", "baz": "quux"}, val)
+}
+
+// recordingResolver records the patches that it's asked to resolve, along with its name
+// in the order that it was called, and then applies them like the dumbResolver.
+type recordingResolver struct {
+	name    string
+	calls   *[]string
+	patches []Patch
+}
+
+func (r *recordingResolver) InternalState() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (r *recordingResolver) ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) error {
+	*r.calls = append(*r.calls, r.name)
+	r.patches = append(r.patches, patches...)
+	return (&dumbResolver{}).ResolveState(state, sender, txID, parents, patches)
+}
+
+func TestController_NestedResolversAreAppliedMostSpecificFirst(t *testing.T) {
+	c := newTestController(t)
+
+	var calls []string
+	root := &recordingResolver{name: "root", calls: &calls}
+	a := &recordingResolver{name: "a", calls: &calls}
+	ab := &recordingResolver{name: "a/b", calls: &calls}
+	ac := &recordingResolver{name: "a/c", calls: &calls}
+
+	// Add them in an order that isn't the one they're applied in
+	bt := c.BehaviorTree()
+	bt.addResolver(tree.Keypath("a"), a)
+	bt.addResolver(nil, root)
+	bt.addResolver(tree.Keypath("a/c"), ac)
+	bt.addResolver(tree.Keypath("a/b"), ab)
+	require.Equal(t, []tree.Keypath{tree.Keypath("a/b"), tree.Keypath("a/c"), tree.Keypath("a"), nil}, bt.resolverKeypaths)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("x"), Val: "root"},
+			{Keypath: tree.Keypath("a/x"), Val: "a"},
+			{Keypath: tree.Keypath("a/b/x"), Val: "a/b"},
+		},
+	}))
+	require.NoError(t, err)
+
+	// a/c had no patches, so it isn't called
+	require.Equal(t, []string{"a/b", "a", "root"}, calls)
+	require.Equal(t, []Patch{{Keypath: tree.Keypath("x"), Val: "a/b"}}, ab.patches)
+	require.Equal(t, []Patch{{Keypath: tree.Keypath("x"), Val: "a"}}, a.patches)
+	require.Equal(t, []Patch{{Keypath: tree.Keypath("x"), Val: "root"}}, root.patches)
+
+	resolver, keypath := bt.nearestResolverForKeypath(tree.Keypath("a/b/x/y"))
+	require.Equal(t, ab, resolver)
+	require.Equal(t, tree.Keypath("a/b"), keypath)
+}
+
+// countingResolver applies the patches it's given, and also keeps a count of them under
+// "count", which no tx ever writes itself.
+type countingResolver struct{}
+
+func (countingResolver) InternalState() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (countingResolver) ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) error {
+	err := (&dumbResolver{}).ResolveState(state, sender, txID, parents, patches)
+	if err != nil {
+		return err
+	}
+	count, _, err := state.UintValue(tree.Keypath("count"))
+	if err != nil && !errors.Is(err, types.Err404) {
+		return err
+	}
+	return state.Set(tree.Keypath("count"), nil, count+uint64(len(patches)))
+}
+
+func TestController_ResolversCanWriteDerivedState(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "redwood-test-controller")
+	require.NoError(t, err)
+	defer os.RemoveAll(dbRoot)
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, testDBOptions)
+	err = txStore.Start()
+	require.NoError(t, err)
+	defer txStore.Ctx().CtxStop("test finished", nil)
+
+	// This is the handler that the host uses to find out what a tx changed
+	var changed [][]string
+	c, err := NewControllerWithDBOptions(types.Address{}, "localhost/test", dbRoot, txStore, DefaultTxLimits, testDBOptions, func(c Controller, tx *Tx, state *tree.DBNode) error {
+		var keypaths []string
+		for kp := range state.Diff().Added {
+			keypaths = append(keypaths, kp)
+		}
+		changed = append(changed, keypaths)
+		return nil
+	})
+	require.NoError(t, err)
+	err = c.Start()
+	require.NoError(t, err)
+	defer c.Ctx().CtxStop("test finished", nil)
+
+	c.BehaviorTree().addResolver(tree.Keypath("chat"), countingResolver{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	txs := []*Tx{
+		{ID: GenesisTxID, Patches: []Patch{{Keypath: tree.Keypath("chat/messages"), Val: []interface{}{}}}},
+		{ID: types.IDFromString("one"), Parents: []types.ID{GenesisTxID}, Patches: []Patch{{Keypath: tree.Keypath("chat/messages"), Range: &tree.Range{0, 0}, Val: []interface{}{"hi"}}}},
+		{ID: types.IDFromString("two"), Parents: []types.ID{types.IDFromString("one")}, Patches: []Patch{{Keypath: tree.Keypath("chat/messages"), Range: &tree.Range{1, 1}, Val: []interface{}{"hello"}}}},
+	}
+	for _, tx := range txs {
+		tx.URL = "localhost/test"
+		err = c.AddTxAndWait(ctx, signTestTx(t, tx))
+		require.NoError(t, err)
+	}
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	count, _, err := state.UintValue(tree.Keypath("chat/count"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+
+	// The derived write shows up in the diff of every tx
+	require.Len(t, changed, len(txs))
+	for _, keypaths := range changed {
+		require.Contains(t, keypaths, "chat/count")
+	}
+
+	// The txs that get broadcast only carry their own patches, and a peer that receives
+	// them derives the same state with its own copy of the resolver
+	peer := newTestController(t)
+	peer.BehaviorTree().addResolver(tree.Keypath("chat"), countingResolver{})
+	for _, tx := range txs {
+		require.Len(t, tx.Patches, 1)
+		txCopy := *tx
+		err = peer.AddTxAndWait(ctx, &txCopy)
+		require.NoError(t, err)
+	}
+
+	peerState := peer.StateAtVersion(nil)
+	defer peerState.Close()
+	count, _, err = peerState.UintValue(tree.Keypath("chat/count"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+}
+
+func TestController_ConcurrentTxsConvergeRegardlessOfReceiveOrder(t *testing.T) {
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("x"), Val: "genesis"}},
+	})
+	// Two siblings, each unaware of the other
+	a := signTestTx(t, &Tx{
+		ID:      types.IDFromString("a"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("x"), Val: "a"},
+			{Keypath: tree.Keypath("obj"), Val: map[string]interface{}{"p": "a", "q": "a"}},
+		},
+	})
+	b := signTestTx(t, &Tx{
+		ID:      types.IDFromString("b"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("x"), Val: "b"},
+			{Keypath: tree.Keypath("obj/p"), Val: "b"},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var states []interface{}
+	for _, order := range [][]*Tx{{genesis, a, b}, {genesis, b, a}} {
+		c := newTestController(t)
+		for _, tx := range order {
+			txCopy := *tx
+			err := c.AddTxAndWait(ctx, &txCopy)
+			require.NoError(t, err)
+		}
+
+		state := c.StateAtVersion(nil)
+		val, _, err := state.Value(nil, nil)
+		state.Close()
+		require.NoError(t, err)
+		states = append(states, val)
+	}
+
+	// b comes after a in the total order, so its writes win, including the one nested
+	// beneath a's
+	expected := map[string]interface{}{
+		"x":   "b",
+		"obj": map[string]interface{}{"p": "b", "q": "a"},
+	}
+	require.Equal(t, expected, states[0])
+	require.Equal(t, expected, states[1])
+}
+
+type panickingResolver struct{}
+
+func (panickingResolver) InternalState() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (panickingResolver) ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) error {
+	panic("resolver blew up")
+}
+
+type panickingValidator struct{}
+
+func (panickingValidator) ValidateTx(state tree.Node, tx *Tx) error {
+	if len(tx.Patches) > 0 {
+		panic("validator blew up")
+	}
+	return nil
+}
+
+func TestController_PanickingBehaviorsRejectTheTx(t *testing.T) {
+	c := newTestController(t)
+
+	bt := c.BehaviorTree()
+	bt.addResolver(tree.Keypath("resolver"), panickingResolver{})
+	bt.addValidator(tree.Keypath("validator"), panickingValidator{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("x"), Val: "genesis"}},
+	}))
+	require.NoError(t, err)
+
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("resolver"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("resolver/x"), Val: "boom"}},
+	}))
+	require.True(t, errors.Is(err, ErrBehaviorPanicked))
+	require.Contains(t, err.Error(), "resolver blew up")
+	require.Contains(t, err.Error(), "panickingResolver")
+
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("validator"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("validator/x"), Val: "boom"}},
+	}))
+	require.True(t, errors.Is(err, ErrBehaviorPanicked))
+	require.Contains(t, err.Error(), "validator blew up")
+	require.Contains(t, err.Error(), "panickingValidator")
+
+	// The mempool keeps going
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("fine"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("x"), Val: "fine"}},
+	}))
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err := state.Value(tree.Keypath("x"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "fine", val)
+	require.Equal(t, map[types.ID]struct{}{types.IDFromString("fine"): {}}, c.Leaves())
+}
+
+func TestController_BehaviorErrorsNameTheKeypath(t *testing.T) {
+	c := newTestController(t)
+
+	owner, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	chRejected := make(chan error, 2)
+	c.SetTxRejectedHandler(func(tx *Tx, err error) { chRejected <- err })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = c.AddTxAndWait(ctx, signTestTxWith(t, owner, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("docs/readme"), Val: "hi"}},
+	}))
+	require.NoError(t, err)
+
+	// Only the owner may write beneath docs
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{
+		owner.Address().Hex(): map[string]interface{}{"^.*$": map[string]interface{}{"write": true}},
+	})
+	require.NoError(t, err)
+	validator, err := NewPermissionsValidator(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addValidator(tree.Keypath("docs"), validator)
+
+	tx := signTestTx(t, &Tx{
+		ID:      types.IDFromString("denied"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("docs/readme"), Val: "defaced"}},
+	})
+	err = c.AddTxAndWait(ctx, tx)
+	require.Equal(t, types.Err403, errors.Cause(err))
+	require.Contains(t, err.Error(), "validator at 'docs'")
+	require.Contains(t, err.Error(), tx.ID.Hex())
+	require.Contains(t, err.Error(), tx.From.Hex())
+
+	// The tx rejected handler gets the same error
+	select {
+	case rejectedErr := <-chRejected:
+		require.Equal(t, err.Error(), rejectedErr.Error())
+	case <-ctx.Done():
+		t.Fatal("tx wasn't rejected")
+	}
+
+	t.Run("resolvers", func(t *testing.T) {
+		c.BehaviorTree().addResolver(tree.Keypath("notes"), panickingResolver{})
+
+		tx := signTestTxWith(t, owner, &Tx{
+			ID:      types.IDFromString("resolver fails"),
+			Parents: []types.ID{GenesisTxID},
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("notes/x"), Val: "boom"}},
+		})
+		err := c.AddTxAndWait(ctx, tx)
+		require.True(t, errors.Is(err, ErrBehaviorPanicked))
+		require.Contains(t, err.Error(), "resolver at 'notes'")
+		require.Contains(t, err.Error(), tx.ID.Hex())
+	})
+}
+
+func TestController_DeletePatches(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{Keypath: nil, Val: map[string]interface{}{
+			"foo":  map[string]interface{}{"keep": "yes", "drop": "no"},
+			"list": []interface{}{"a", "b", "c", "d"},
+		}}},
+	}))
+	require.NoError(t, err)
+
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("delete"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("foo/drop"), Delete: true},
+			{Keypath: tree.Keypath("list"), Range: &tree.Range{1, 3}, Delete: true},
+			// Deleting something that isn't there is a no-op
+			{Keypath: tree.Keypath("foo/nope"), Delete: true},
+			{Keypath: tree.Keypath("nope"), Range: &tree.Range{0, 1}, Delete: true},
+		},
+	}))
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err := state.Value(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"foo":  map[string]interface{}{"keep": "yes"},
+		"list": []interface{}{"a", "d"},
+	}, val)
+}
+
+func TestController_MempoolTxsArentSharedWithTheCaller(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The child waits in the mempool until its parent arrives
+	val := map[string]interface{}{"list": []interface{}{"original"}}
+	child := signTestTx(t, &Tx{
+		ID:      types.IDFromString("child"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: val}},
+	})
+	err := c.AddTx(child)
+	require.NoError(t, err)
+
+	val["list"].([]interface{})[0] = "changed"
+	child.Patches[0].Keypath[0] = 'X'
+
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: nil, Val: map[string]interface{}{}}},
+	}))
+	require.NoError(t, err)
+
+	var got interface{}
+	require.Eventually(t, func() bool {
+		state := c.StateAtVersion(nil)
+		defer state.Close()
+		got, _, err = state.Value(tree.Keypath("foo"), nil)
+		return err == nil && got != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]interface{}{"list": []interface{}{"original"}}, got)
+}
+
+func TestController_ReadsAreIsolatedFromTxsInProgress(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const numKeys = 20
+	patchesSettingAllKeysTo := func(i int) []Patch {
+		patches := make([]Patch, numKeys)
+		for k := range patches {
+			patches[k] = Patch{Keypath: tree.Keypath(fmt.Sprintf("key-%v", k)), Val: float64(i)}
+		}
+		return patches
+	}
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test", Patches: patchesSettingAllKeysTo(0)}))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	readerErrs := make(chan error, 1)
+	var numReads int
+	go func() {
+		defer close(readerErrs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			state := c.StateAtVersion(nil)
+			val, _, err := state.Value(nil, nil)
+			state.Close()
+			if err != nil {
+				readerErrs <- err
+				return
+			}
+			asMap := val.(map[string]interface{})
+			for k := 1; k < numKeys; k++ {
+				if asMap[fmt.Sprintf("key-%v", k)] != asMap["key-0"] {
+					readerErrs <- errors.Errorf("saw a partially applied tx: %v", asMap)
+					return
+				}
+			}
+			numReads++
+		}
+	}()
+
+	parent := GenesisTxID
+	for i := 1; i <= 50; i++ {
+		tx := signTestTx(t, &Tx{
+			ID:      types.IDFromString(fmt.Sprintf("tx-%v", i)),
+			Parents: []types.ID{parent},
+			URL:     "localhost/test",
+			Patches: patchesSettingAllKeysTo(i),
+		})
+		err := c.AddTxAndWait(ctx, tx)
+		require.NoError(t, err)
+		parent = tx.ID
+	}
+	close(done)
+
+	for err := range readerErrs {
+		require.NoError(t, err)
+	}
+	require.NotZero(t, numReads)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err := state.Value(tree.Keypath(fmt.Sprintf("key-%v", numKeys-1)), nil)
+	require.NoError(t, err)
+	require.Equal(t, float64(50), val)
+}
+
+func TestController_Snapshot(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: nil, Val: map[string]interface{}{"foo": "one", "bar": "one"}}},
+	}))
+	require.NoError(t, err)
+
+	snap, err := c.Snapshot()
+	require.NoError(t, err)
+
+	tx := signTestTx(t, &Tx{
+		ID:      types.IDFromString("two"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("foo"), Val: "two"},
+			{Keypath: tree.Keypath("bar"), Val: "two"},
+		},
+	})
+	err = c.AddTxAndWait(ctx, tx)
+	require.NoError(t, err)
+
+	// The snapshot still shows the state from before the tx
+	val, _, err := snap.Value(tree.Keypath("foo"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "one", val)
+	val, _, err = snap.Value(tree.Keypath("bar"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "one", val)
+	require.Equal(t, map[types.ID]struct{}{GenesisTxID: {}}, snap.Leaves())
+	snap.Close()
+
+	// A new one shows the state after it
+	snap, err = c.Snapshot()
+	require.NoError(t, err)
+	val, _, err = snap.Value(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"foo": "two", "bar": "two"}, val)
+	require.Equal(t, map[types.ID]struct{}{tx.ID: {}}, snap.Leaves())
+	snap.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.Ctx().CtxStop("test", &wg)
+	wg.Wait()
+
+	_, err = c.Snapshot()
+	require.True(t, errors.Is(err, ErrControllerNotRunning))
+}
+
+func TestController_DryRunTxOnStoppedController(t *testing.T) {
+	c := newTestController(t)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.Ctx().CtxStop("test", &wg)
+	wg.Wait()
+
+	_, err := c.DryRunTx(signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}))
+	require.True(t, errors.Is(err, ErrControllerNotRunning))
+}
+
+func TestController_InMemory(t *testing.T) {
+	dbRoot := filepath.Join(os.TempDir(), fmt.Sprintf("redwood-test-in-memory-%v", rand.Int()))
+	dbOptions := tree.DBTreeOptions{InMemory: true}
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, dbOptions)
+	err := txStore.Start()
+	require.NoError(t, err)
+	defer txStore.Ctx().CtxStop("test finished", nil)
+
+	c, err := NewControllerWithDBOptions(types.Address{}, "localhost/test", dbRoot, txStore, DefaultTxLimits, dbOptions, func(c Controller, tx *Tx, state *tree.DBNode) error { return nil })
+	require.NoError(t, err)
+	err = c.Start()
+	require.NoError(t, err)
+	defer c.Ctx().CtxStop("test finished", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx := signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}}})
+	err = c.AddTxAndWait(ctx, tx)
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	val, _, err := state.Value(tree.Keypath("foo"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "bar", val)
+
+	stored, err := txStore.FetchTx("localhost/test", tx.ID)
+	require.NoError(t, err)
+	require.Equal(t, tx.Hash(), stored.Hash())
+	require.True(t, stored.Valid)
+
+	// Nothing was written to disk
+	_, err = os.Stat(dbRoot)
+	require.True(t, os.IsNotExist(err))
+}
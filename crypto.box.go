@@ -100,6 +100,10 @@ func (privkey *encryptingPrivateKey) SealMessageFor(recipientPubKey EncryptingPu
 }
 
 func (privkey *encryptingPrivateKey) OpenMessageFrom(senderPublicKey EncryptingPublicKey, msgEncrypted []byte) ([]byte, error) {
+	if len(msgEncrypted) < ENCRYPTING_NONCE_LENGTH {
+		return nil, ErrCannotDecrypt
+	}
+
 	// The shared key can be used to speed up processing when using the same
 	// pair of keys repeatedly.
 	var sharedDecryptKey [ENCRYPTING_KEY_LENGTH]byte
@@ -1,7 +1,10 @@
 package redwood
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -18,6 +21,7 @@ type (
 	SigningKeypair struct {
 		SigningPrivateKey
 		SigningPublicKey
+		addressDerivation AddressDerivation
 	}
 
 	SigningPrivateKey interface {
@@ -39,6 +43,7 @@ type (
 
 	signingPublicKey struct {
 		*ecdsa.PublicKey
+		addressDerivation AddressDerivation
 	}
 )
 
@@ -48,10 +53,7 @@ func (pubkey *signingPublicKey) VerifySignature(hash types.Hash, signature []byt
 }
 
 func (pubkey *signingPublicKey) Address() types.Address {
-	ethAddr := crypto.PubkeyToAddress(*pubkey.PublicKey)
-	var a types.Address
-	copy(a[:], ethAddr[:])
-	return a
+	return pubkey.addressDerivation.orDefault()(pubkey.Bytes())
 }
 
 func (pubkey *signingPublicKey) Bytes() []byte {
@@ -62,6 +64,47 @@ func (pubkey *signingPublicKey) String() string {
 	return hex.EncodeToString(pubkey.Bytes())
 }
 
+// AddressDerivation computes the address that belongs to a signing public key, given in
+// its uncompressed form (see SigningPublicKey.Bytes).  Addresses are how nodes recognize
+// each other and check who signed a tx, so every node in a network has to use the same
+// one.  A nil AddressDerivation is EthereumAddressDerivation.
+type AddressDerivation func(pubkey []byte) types.Address
+
+func (derive AddressDerivation) orDefault() AddressDerivation {
+	if derive == nil {
+		return EthereumAddressDerivation
+	}
+	return derive
+}
+
+// EthereumAddressDerivation takes the last 20 bytes of the Keccak-256 hash of the key,
+// like Ethereum does.  It's the default.
+func EthereumAddressDerivation(pubkey []byte) types.Address {
+	// Skip the 0x04 byte that marks the key as uncompressed
+	return types.AddressFromBytes(crypto.Keccak256(pubkey[1:])[12:])
+}
+
+// SHA256AddressDerivation takes the last 20 bytes of the SHA-256 hash of the key.
+func SHA256AddressDerivation(pubkey []byte) types.Address {
+	hash := sha256.Sum256(pubkey[1:])
+	return types.AddressFromBytes(hash[12:])
+}
+
+var addressDerivations = map[string]AddressDerivation{
+	"ethereum": EthereumAddressDerivation,
+	"sha256":   SHA256AddressDerivation,
+}
+
+// AddressDerivationByName returns one of the built-in address derivations: "ethereum" or
+// "sha256".
+func AddressDerivationByName(name string) (AddressDerivation, error) {
+	derive, exists := addressDerivations[name]
+	if !exists {
+		return nil, errors.Errorf("unknown address derivation '%v'", name)
+	}
+	return derive, nil
+}
+
 func (privkey *signingPrivateKey) SignHash(hash types.Hash) ([]byte, error) {
 	sig, err := crypto.Sign(hash[:], privkey.PrivateKey)
 	if err != nil {
@@ -78,15 +121,27 @@ func (privkey *signingPrivateKey) String() string {
 	return hex.EncodeToString(privkey.Bytes())
 }
 
+func newSigningKeypair(pk *ecdsa.PrivateKey, addressDerivation AddressDerivation) *SigningKeypair {
+	return &SigningKeypair{
+		SigningPrivateKey: &signingPrivateKey{pk},
+		SigningPublicKey:  &signingPublicKey{&pk.PublicKey, addressDerivation},
+		addressDerivation: addressDerivation,
+	}
+}
+
 func GenerateSigningKeypair() (*SigningKeypair, error) {
+	return GenerateSigningKeypairWithAddressDerivation(nil)
+}
+
+// GenerateSigningKeypairWithAddressDerivation is like GenerateSigningKeypair, but the
+// keypair's address (and the addresses of the keys that it recovers from signatures) are
+// derived with the given AddressDerivation.
+func GenerateSigningKeypairWithAddressDerivation(addressDerivation AddressDerivation) (*SigningKeypair, error) {
 	pk, err := crypto.GenerateKey()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &SigningKeypair{
-		SigningPrivateKey: &signingPrivateKey{pk},
-		SigningPublicKey:  &signingPublicKey{&pk.PublicKey},
-	}, nil
+	return newSigningKeypair(pk, addressDerivation), nil
 }
 
 func SigningKeypairFromHex(s string) (*SigningKeypair, error) {
@@ -94,18 +149,58 @@ func SigningKeypairFromHex(s string) (*SigningKeypair, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &SigningKeypair{
-		SigningPrivateKey: &signingPrivateKey{pk},
-		SigningPublicKey:  &signingPublicKey{&pk.PublicKey},
-	}, nil
+	return newSigningKeypair(pk, nil), nil
 }
 
-func RecoverSigningPubkey(hash types.Hash, signature []byte) (SigningPublicKey, error) {
+// AddressDerivation returns the AddressDerivation that the keypair was created with.
+func (k *SigningKeypair) AddressDerivation() AddressDerivation {
+	return k.addressDerivation.orDefault()
+}
+
+// RecoverSigningPubkey recovers the public key that made the given signature.  Its
+// address is derived with the given AddressDerivation, which should be the one that the
+// rest of the network uses.
+func RecoverSigningPubkey(hash types.Hash, signature []byte, addressDerivation AddressDerivation) (SigningPublicKey, error) {
 	ecdsaPubkey, err := crypto.SigToPub(hash[:], signature)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &signingPublicKey{ecdsaPubkey}, nil
+	return &signingPublicKey{ecdsaPubkey, addressDerivation}, nil
+}
+
+// signedMessagePrefix begins every message hashed by HashMessage.  No tx hashes to
+// something that starts with it, so a signed message can't be passed off as a signed tx
+// (or the other way around).
+const signedMessagePrefix = "\x19Redwood Signed Message:\n"
+
+// HashMessage hashes msg for signing under the given domain, which names what the
+// signature is for (such as "login").  A signature over a message in one domain doesn't
+// verify in any other.
+func HashMessage(domain string, msg []byte) types.Hash {
+	var buf bytes.Buffer
+	buf.WriteString(signedMessagePrefix)
+	// Length-prefix the domain, or else ("log", "in") and ("login", "") would hash the same
+	var domainLen [binary.MaxVarintLen64]byte
+	buf.Write(domainLen[:binary.PutUvarint(domainLen[:], uint64(len(domain)))])
+	buf.WriteString(domain)
+	buf.Write(msg)
+	return types.HashBytes(buf.Bytes())
+}
+
+// SignMessage signs an arbitrary message under the given domain.  See HashMessage.
+func (k *SigningKeypair) SignMessage(domain string, msg []byte) ([]byte, error) {
+	if domain == "" {
+		return nil, errors.New("domain is required")
+	}
+	return k.SignHash(HashMessage(domain, msg))
+}
+
+// VerifyMessage reports whether sig is pubkey's signature over msg under the given domain.
+func VerifyMessage(pubkey SigningPublicKey, domain string, msg []byte, sig []byte) bool {
+	if domain == "" || len(sig) != crypto.SignatureLength {
+		return false
+	}
+	return pubkey.VerifySignature(HashMessage(domain, msg), sig)
 }
 
 func GenerateMnemonic() (string, error) {
@@ -123,6 +218,12 @@ func GenerateMnemonic() (string, error) {
 var DefaultHDDerivationPath = "m/44'/60'/0'/0/0"
 
 func SigningKeypairFromHDMnemonic(mnemonic string, derivationPath string) (*SigningKeypair, error) {
+	return SigningKeypairFromHDMnemonicWithAddressDerivation(mnemonic, derivationPath, nil)
+}
+
+// SigningKeypairFromHDMnemonicWithAddressDerivation is like SigningKeypairFromHDMnemonic,
+// but the keypair's address is derived with the given AddressDerivation.
+func SigningKeypairFromHDMnemonicWithAddressDerivation(mnemonic string, derivationPath string, addressDerivation AddressDerivation) (*SigningKeypair, error) {
 	if mnemonic == "" {
 		return nil, errors.New("mnemonic is required")
 	} else if !bip39.IsMnemonicValid(mnemonic) {
@@ -144,10 +245,7 @@ func SigningKeypairFromHDMnemonic(mnemonic string, derivationPath string) (*Sign
 	if err != nil {
 		return nil, err
 	}
-	return &SigningKeypair{
-		SigningPrivateKey: &signingPrivateKey{privKey},
-		SigningPublicKey:  &signingPublicKey{&privKey.PublicKey},
-	}, nil
+	return newSigningKeypair(privKey, addressDerivation), nil
 }
 
 // DerivePrivateKey derives the private key of the derivation path.
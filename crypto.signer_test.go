@@ -1,9 +1,15 @@
 package redwood
 
 import (
+	"context"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
 )
 
 func TestSigningKeypairFromHDMnemonic(t *testing.T) {
@@ -13,3 +19,114 @@ func TestSigningKeypairFromHDMnemonic(t *testing.T) {
 
 	require.Equal(t, "1c6e8d3d4e32f3c8e0bf1295a397ed5cda700888f8d289d602b15fdfd05a3f82", keypair.SigningPrivateKey.String())
 }
+
+func TestSigningKeypair_SignMessage(t *testing.T) {
+	keypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	msg := []byte("challenge 1234")
+	sig, err := keypair.SignMessage("login", msg)
+	require.NoError(t, err)
+
+	require.True(t, VerifyMessage(keypair.SigningPublicKey, "login", msg, sig))
+	require.False(t, VerifyMessage(keypair.SigningPublicKey, "login", []byte("challenge 1235"), sig))
+
+	other, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	require.False(t, VerifyMessage(other.SigningPublicKey, "login", msg, sig))
+
+	t.Run("signatures don't verify under another domain", func(t *testing.T) {
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "invite", msg, sig))
+		// Moving bytes between the domain and the message doesn't help
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "log", append([]byte("in"), msg...), sig))
+	})
+
+	t.Run("message signatures aren't tx signatures", func(t *testing.T) {
+		tx := &Tx{ID: GenesisTxID, URL: "localhost/test"}
+		txHash := tx.Hash()
+		txSig, err := keypair.SignHash(txHash)
+		require.NoError(t, err)
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "tx", txHash[:], txSig))
+
+		sig, err := keypair.SignMessage("tx", txHash[:])
+		require.NoError(t, err)
+		require.False(t, keypair.VerifySignature(txHash, sig))
+	})
+
+	t.Run("a domain is required", func(t *testing.T) {
+		_, err := keypair.SignMessage("", msg)
+		require.Error(t, err)
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "", msg, sig))
+	})
+
+	t.Run("malformed signatures don't verify", func(t *testing.T) {
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "login", msg, nil))
+		require.False(t, VerifyMessage(keypair.SigningPublicKey, "login", msg, sig[:10]))
+	})
+}
+
+func TestEthereumAddressDerivation(t *testing.T) {
+	keypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	ethAddr := crypto.PubkeyToAddress(*keypair.SigningPublicKey.(*signingPublicKey).PublicKey)
+	require.Equal(t, types.Address(ethAddr), keypair.Address())
+}
+
+func TestSigningKeypairWithAddressDerivation(t *testing.T) {
+	derive, err := AddressDerivationByName("sha256")
+	require.NoError(t, err)
+	keypair, err := GenerateSigningKeypairWithAddressDerivation(derive)
+	require.NoError(t, err)
+
+	addr := keypair.Address()
+	ethAddr := EthereumAddressDerivation(keypair.SigningPublicKey.Bytes())
+	require.NotEqual(t, ethAddr, addr)
+	require.Equal(t, SHA256AddressDerivation(keypair.SigningPublicKey.Bytes()), addr)
+
+	// Other keypairs are unaffected
+	other, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	require.Equal(t, EthereumAddressDerivation(other.SigningPublicKey.Bytes()), other.Address())
+
+	txLimits := DefaultTxLimits
+	txLimits.AddressDerivation = keypair.AddressDerivation()
+	m, _ := newTestMetacontrollerWithTxLimits(t, txLimits)
+
+	t.Run("txs from the derived address validate", func(t *testing.T) {
+		tx := &Tx{
+			ID:      GenesisTxID,
+			From:    addr,
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+		}
+		tx.Sig, err = keypair.SignHash(tx.Hash())
+		require.NoError(t, err)
+
+		err = m.AddTxAndWait(context.Background(), tx)
+		require.NoError(t, err)
+
+		// So do the signatures of peers proving that they hold the address's keys
+		pubkey, err := RecoverSigningPubkey(tx.Hash(), tx.Sig, keypair.AddressDerivation())
+		require.NoError(t, err)
+		require.Equal(t, addr, pubkey.Address())
+	})
+
+	t.Run("txs from the Ethereum address don't", func(t *testing.T) {
+		tx := &Tx{
+			ID:      types.IDFromString("other"),
+			Parents: []types.ID{GenesisTxID},
+			From:    ethAddr,
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+		}
+		tx.Sig, err = keypair.SignHash(tx.Hash())
+		require.NoError(t, err)
+
+		err = m.AddTxAndWait(context.Background(), tx)
+		require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+	})
+
+	_, err = AddressDerivationByName("md5")
+	require.Error(t, err)
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,6 +21,34 @@ type Ctx interface {
 	BaseContext() *Context
 }
 
+// LifecycleState describes where a Context is in its lifecycle.
+type LifecycleState int32
+
+const (
+	LifecycleState_Idle     LifecycleState = iota // CtxStart() hasn't been called
+	LifecycleState_Starting                       // onStartup() is running
+	LifecycleState_Running                        // started up and not yet stopping
+	LifecycleState_Stopping                       // CtxStop() has been called, but not everything has exited
+	LifecycleState_Stopped                        // fully stopped (CtxWait() would return immediately)
+)
+
+func (s LifecycleState) String() string {
+	switch s {
+	case LifecycleState_Idle:
+		return "idle"
+	case LifecycleState_Starting:
+		return "starting"
+	case LifecycleState_Running:
+		return "running"
+	case LifecycleState_Stopping:
+		return "stopping"
+	case LifecycleState_Stopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("LifecycleState(%d)", int32(s))
+	}
+}
+
 type childCtx struct {
 	CtxID   []byte
 	Ctx     Ctx
@@ -39,6 +68,8 @@ type Context struct {
 	stopComplete  sync.WaitGroup
 	stopMutex     sync.Mutex
 	stopReason    string
+	stopErr       error
+	state         int32
 	parent        *Context
 	children      []childCtx
 	childrenMutex sync.RWMutex
@@ -53,8 +84,12 @@ func (c *Context) Ctx() *Context {
 	return c
 }
 
-// CtxStopping allows callers to wait until this context is stopping.
+// CtxStopping allows callers to wait until this context is stopping.  If the
+// context hasn't been started yet, the returned channel is nil (and never fires).
 func (c *Context) CtxStopping() <-chan struct{} {
+	if c.Context == nil {
+		return nil
+	}
 	return c.Context.Done()
 }
 
@@ -72,6 +107,12 @@ func (c *Context) CtxStart(
 		panic("plan.Context already running")
 	}
 
+	c.setState(LifecycleState_Starting)
+	c.stopMutex.Lock()
+	c.stopReason = ""
+	c.stopErr = nil
+	c.stopMutex.Unlock()
+
 	c.onAboutToStop = onAboutToStop
 	c.onChildAboutToStop = onChildAboutToStop
 	c.FaultLimit = 1
@@ -82,6 +123,11 @@ func (c *Context) CtxStart(
 		err = onStartup()
 	}
 
+	if err == nil {
+		// Don't clobber the state if onStartup() kicked off a stop
+		atomic.CompareAndSwapInt32(&c.state, int32(LifecycleState_Starting), int32(LifecycleState_Running))
+	}
+
 	// Even if onStopping == nil, we still need this call since the resulting c.stopComplete.Add(1) ensures
 	// that this context's CtxStop() has actually somethong to wait on.
 	Go(c, func(inCtx Ctx) {
@@ -100,6 +146,9 @@ func (c *Context) CtxStart(
 
 	if err != nil {
 		c.Errorf("CtxStart failed: %v", err)
+		c.stopMutex.Lock()
+		c.stopErr = err
+		c.stopMutex.Unlock()
 		c.CtxStop("CtxStart failed", nil)
 		c.CtxWait()
 	}
@@ -141,8 +190,12 @@ func (c *Context) CtxStop(
 	if ctxCancel := c.ctxCancel; c.CtxRunning() && ctxCancel != nil {
 		c.ctxCancel = nil
 		c.stopReason = inReason
+		c.setState(LifecycleState_Stopping)
 		c.Infof(2, "CtxStop (%s)", c.stopReason)
 
+		// Mark the Context stopped once everything has exited, even if no one calls CtxWait()
+		go c.CtxWait()
+
 		// Hand it over to client-level execution to finish stopping/cleanup.
 		if onAboutToStop := c.onAboutToStop; onAboutToStop != nil {
 			c.onAboutToStop = nil
@@ -176,6 +229,7 @@ func (c *Context) CtxStop(
 // THREADSAFE
 func (c *Context) CtxWait() {
 	c.stopComplete.Wait()
+	atomic.CompareAndSwapInt32(&c.state, int32(LifecycleState_Stopping), int32(LifecycleState_Stopped))
 }
 
 // CtxStopChildren initiates a stop on each child and blocks until complete.
@@ -258,6 +312,28 @@ func (c *Context) CtxStopReason() string {
 	return c.stopReason
 }
 
+// CtxStopErr returns the error that caused this Context to stop, if any: either the
+// error returned by onStartup() or the fault that reached the fault limit.  It returns
+// nil if the Context hasn't stopped or was stopped deliberately.
+//
+// THREADSAFE
+func (c *Context) CtxStopErr() error {
+	c.stopMutex.Lock()
+	defer c.stopMutex.Unlock()
+	return c.stopErr
+}
+
+// State returns where this Context is in its lifecycle.
+//
+// THREADSAFE
+func (c *Context) State() LifecycleState {
+	return LifecycleState(atomic.LoadInt32(&c.state))
+}
+
+func (c *Context) setState(inState LifecycleState) {
+	atomic.StoreInt32(&c.state, int32(inState))
+}
+
 // CtxStatus returns an error if this Context has not yet started, is stopping, or has stopped.
 //
 // THREADSAFE
@@ -323,6 +399,12 @@ func (c *Context) CtxOnFault(inErr error, inDesc string) {
 		return
 	}
 
+	c.stopMutex.Lock()
+	if c.stopErr == nil && c.CtxRunning() {
+		c.stopErr = inErr
+	}
+	c.stopMutex.Unlock()
+
 	c.CtxStop("fault limit reached", nil)
 }
 
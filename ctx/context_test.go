@@ -0,0 +1,66 @@
+package ctx
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContext_LifecycleState(t *testing.T) {
+	c := &Context{}
+	require.Equal(t, LifecycleState_Idle, c.State())
+
+	var stateDuringStartup LifecycleState
+	err := c.CtxStart(
+		func() error {
+			stateDuringStartup = c.State()
+			return nil
+		},
+		nil,
+		nil,
+		nil,
+	)
+	require.NoError(t, err)
+	require.Equal(t, LifecycleState_Starting, stateDuringStartup)
+	require.Equal(t, LifecycleState_Running, c.State())
+
+	// Hold up the shutdown so that we can observe the stopping state
+	chRelease := make(chan struct{})
+	c.CtxGo(func() { <-chRelease })
+
+	c.CtxStop("test finished", nil)
+	require.Equal(t, LifecycleState_Stopping, c.State())
+
+	close(chRelease)
+	c.CtxWait()
+	require.Equal(t, LifecycleState_Stopped, c.State())
+	require.Equal(t, "test finished", c.CtxStopReason())
+	require.NoError(t, c.CtxStopErr())
+}
+
+func TestContext_LifecycleState_StartupError(t *testing.T) {
+	c := &Context{}
+	startupErr := errors.New("couldn't open db")
+
+	err := c.CtxStart(func() error { return startupErr }, nil, nil, nil)
+	require.Equal(t, startupErr, err)
+
+	c.CtxWait()
+	require.Equal(t, LifecycleState_Stopped, c.State())
+	require.Equal(t, startupErr, c.CtxStopErr())
+}
+
+func TestContext_LifecycleState_FaultLimit(t *testing.T) {
+	c := &Context{}
+	err := c.CtxStart(nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	fault := errors.New("disk on fire")
+	c.CtxOnFault(fault, "writing record")
+
+	c.CtxWait()
+	require.Equal(t, LifecycleState_Stopped, c.State())
+	require.Equal(t, fault, c.CtxStopErr())
+	require.Equal(t, "fault limit reached", c.CtxStopReason())
+}
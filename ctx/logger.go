@@ -2,6 +2,8 @@ package ctx
 
 import (
 	"fmt"
+	"os"
+	"sync"
 
 	"github.com/plan-systems/klog"
 )
@@ -20,6 +22,7 @@ type Logger interface {
 	SetLogLabel(inLabel string)
 	GetLogLabel() string
 	GetLogPrefix() string
+	SetLogSink(inSink LogSink)
 	LogV(inVerboseLevel int32) bool
 	Info(inVerboseLevel int32, args ...interface{})
 	Infof(inVerboseLevel int32, inFormat string, args ...interface{})
@@ -30,12 +33,68 @@ type Logger interface {
 	Fatalf(inFormat string, args ...interface{})
 }
 
+// LogSink receives log records in place of the default (klog) output, so that an app
+// embedding these components can route their logs into its own logging pipeline.
+type LogSink interface {
+	// LogV returns true if INFO records at the given verbose level should be emitted.
+	LogV(inVerboseLevel int32) bool
+	Log(inRecord LogRecord)
+}
+
+// LogRecord is a single log entry passed to a LogSink.
+type LogRecord struct {
+	Severity     LogSeverity
+	VerboseLevel int32  // Only meaningful for INFO records
+	Label        string // The label set via SetLogLabel() (without any decoration)
+	Message      string // The formatted message (without the label prefix)
+}
+
+type LogSeverity int
+
+const (
+	LogSeverity_Info LogSeverity = iota
+	LogSeverity_Warning
+	LogSeverity_Error
+	LogSeverity_Fatal
+)
+
+func (s LogSeverity) String() string {
+	switch s {
+	case LogSeverity_Info:
+		return "info"
+	case LogSeverity_Warning:
+		return "warning"
+	case LogSeverity_Error:
+		return "error"
+	case LogSeverity_Fatal:
+		return "fatal"
+	default:
+		return fmt.Sprintf("LogSeverity(%d)", int(s))
+	}
+}
+
+var (
+	gLogSink   LogSink
+	gLogSinkMu sync.RWMutex
+)
+
+// SetLogSink sets the LogSink used by every logger that hasn't been given its own.  Passing
+// nil restores the default klog output.
+//
+// THREADSAFE
+func SetLogSink(inSink LogSink) {
+	gLogSinkMu.Lock()
+	defer gLogSinkMu.Unlock()
+	gLogSink = inSink
+}
+
 //
 // logger is an aid to logging and provides convenience functions
 type logger struct {
 	hasPrefix bool
 	logPrefix string
 	logLabel  string
+	sink      LogSink
 }
 
 func NewLogger(label string) Logger {
@@ -72,8 +131,26 @@ func (l *logger) GetLogPrefix() string {
 	return l.logPrefix
 }
 
+// SetLogSink overrides the package-wide LogSink (see SetLogSink()) for this logger alone.
+// Passing nil reverts to the package-wide LogSink.
+func (l *logger) SetLogSink(inSink LogSink) {
+	l.sink = inSink
+}
+
+func (l *logger) logSink() LogSink {
+	if l.sink != nil {
+		return l.sink
+	}
+	gLogSinkMu.RLock()
+	defer gLogSinkMu.RUnlock()
+	return gLogSink
+}
+
 // LogV returns true if logging is currently enabled for log verbose level.
 func (l *logger) LogV(inVerboseLevel int32) bool {
+	if sink := l.logSink(); sink != nil {
+		return sink.LogV(inVerboseLevel)
+	}
 	return bool(klog.V(klog.Level(inVerboseLevel)))
 }
 
@@ -85,17 +162,8 @@ func (l *logger) LogV(inVerboseLevel int32) bool {
 //   1. Enabled during testing and development. Use for high-level changes in state, mode, or connection.
 //   2. Enabled during low-level debugging and troubleshooting.
 func (l *logger) Info(inVerboseLevel int32, args ...interface{}) {
-	logIt := true
-	if inVerboseLevel > 0 {
-		logIt = bool(klog.V(klog.Level(inVerboseLevel)))
-	}
-
-	if logIt {
-		if l.hasPrefix {
-			klog.InfoDepth(1, l.logPrefix, fmt.Sprint(args...))
-		} else {
-			klog.InfoDepth(1, args...)
-		}
+	if inVerboseLevel <= 0 || l.LogV(inVerboseLevel) {
+		l.output(LogSeverity_Info, inVerboseLevel, fmt.Sprint(args...))
 	}
 }
 
@@ -104,17 +172,8 @@ func (l *logger) Info(inVerboseLevel int32, args ...interface{}) {
 //
 // See comments above for Info() for guidelines for inVerboseLevel.
 func (l *logger) Infof(inVerboseLevel int32, inFormat string, args ...interface{}) {
-	logIt := true
-	if inVerboseLevel > 0 {
-		logIt = bool(klog.V(klog.Level(inVerboseLevel)))
-	}
-
-	if logIt {
-		if l.hasPrefix {
-			klog.InfoDepth(1, l.logPrefix, fmt.Sprintf(inFormat, args...))
-		} else {
-			klog.InfoDepth(1, fmt.Sprintf(inFormat, args...))
-		}
+	if inVerboseLevel <= 0 || l.LogV(inVerboseLevel) {
+		l.output(LogSeverity_Info, inVerboseLevel, fmt.Sprintf(inFormat, args...))
 	}
 }
 
@@ -124,13 +183,7 @@ func (l *logger) Infof(inVerboseLevel int32, inFormat string, args ...interface{
 // Warnings are reserved for situations that indicate an inconsistency or an error that
 // won't result in a departure of specifications, correctness, or expected behavior.
 func (l *logger) Warn(args ...interface{}) {
-	{
-		if l.hasPrefix {
-			klog.WarningDepth(1, l.logPrefix, fmt.Sprint(args...))
-		} else {
-			klog.WarningDepth(1, args...)
-		}
-	}
+	l.output(LogSeverity_Warning, 0, fmt.Sprint(args...))
 }
 
 // Warnf logs to the WARNING and INFO logs.
@@ -138,13 +191,7 @@ func (l *logger) Warn(args ...interface{}) {
 //
 // See comments above for Warn() for guidelines on errors vs warnings.
 func (l *logger) Warnf(inFormat string, args ...interface{}) {
-	{
-		if l.hasPrefix {
-			klog.WarningDepth(1, l.logPrefix, fmt.Sprintf(inFormat, args...))
-		} else {
-			klog.WarningDepth(1, fmt.Sprintf(inFormat, args...))
-		}
-	}
+	l.output(LogSeverity_Warning, 0, fmt.Sprintf(inFormat, args...))
 }
 
 // Error logs to the ERROR, WARNING, and INFO logs.
@@ -154,13 +201,7 @@ func (l *logger) Warnf(inFormat string, args ...interface{}) {
 // corruption of data or resources, or an issue that if not addressed could spiral into deeper issues.
 // Logging an error reflects that correctness or expected behavior is either broken or under threat.
 func (l *logger) Error(args ...interface{}) {
-	{
-		if l.hasPrefix {
-			klog.ErrorDepth(1, l.logPrefix, fmt.Sprint(args...))
-		} else {
-			klog.ErrorDepth(1, args...)
-		}
-	}
+	l.output(LogSeverity_Error, 0, fmt.Sprint(args...))
 }
 
 // Errorf logs to the ERROR, WARNING, and INFO logs.
@@ -168,23 +209,41 @@ func (l *logger) Error(args ...interface{}) {
 //
 // See comments above for Error() for guidelines on errors vs warnings.
 func (l *logger) Errorf(inFormat string, args ...interface{}) {
-	{
-		if l.hasPrefix {
-			klog.ErrorDepth(1, l.logPrefix, fmt.Sprintf(inFormat, args...))
-		} else {
-			klog.ErrorDepth(1, fmt.Sprintf(inFormat, args...))
-		}
-	}
+	l.output(LogSeverity_Error, 0, fmt.Sprintf(inFormat, args...))
 }
 
 // Fatalf logs to the FATAL, ERROR, WARNING, and INFO logs,
 // Arguments are handled like fmt.Printf(); a newline is appended if missing.
 func (l *logger) Fatalf(inFormat string, args ...interface{}) {
-	{
-		if l.hasPrefix {
-			klog.FatalDepth(1, l.logPrefix, fmt.Sprintf(inFormat, args...))
-		} else {
-			klog.FatalDepth(1, fmt.Sprintf(inFormat, args...))
+	l.output(LogSeverity_Fatal, 0, fmt.Sprintf(inFormat, args...))
+}
+
+// output hands the message to the LogSink if there is one, and to klog otherwise.
+// Fatal messages exit the process either way.
+func (l *logger) output(inSeverity LogSeverity, inVerboseLevel int32, inMsg string) {
+	if sink := l.logSink(); sink != nil {
+		sink.Log(LogRecord{
+			Severity:     inSeverity,
+			VerboseLevel: inVerboseLevel,
+			Label:        l.logLabel,
+			Message:      inMsg,
+		})
+		if inSeverity == LogSeverity_Fatal {
+			os.Exit(255)
 		}
+		return
+	}
+
+	// Skip this frame and the public method that called it, so klog reports the caller's file and line
+	const depth = 2
+	switch inSeverity {
+	case LogSeverity_Info:
+		klog.InfoDepth(depth, l.logPrefix, inMsg)
+	case LogSeverity_Warning:
+		klog.WarningDepth(depth, l.logPrefix, inMsg)
+	case LogSeverity_Error:
+		klog.ErrorDepth(depth, l.logPrefix, inMsg)
+	case LogSeverity_Fatal:
+		klog.FatalDepth(depth, l.logPrefix, inMsg)
 	}
 }
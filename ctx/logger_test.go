@@ -0,0 +1,66 @@
+package ctx
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type captureSink struct {
+	maxVerboseLevel int32
+	mu              sync.Mutex
+	records         []LogRecord
+}
+
+func (s *captureSink) LogV(inVerboseLevel int32) bool {
+	return inVerboseLevel <= s.maxVerboseLevel
+}
+
+func (s *captureSink) Log(inRecord LogRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, inRecord)
+}
+
+func TestLogger_SetLogSink(t *testing.T) {
+	sink := &captureSink{maxVerboseLevel: 1}
+
+	l := NewLogger("controller")
+	l.SetLogSink(sink)
+
+	l.Infof(0, "new tx %v", "abc")
+	l.Info(1, "readding to mempool")
+	l.Infof(2, "too verbose to log")
+	l.Warnf("missing ref %v", "deadbeef")
+	l.Error("invalid tx: ", "bad signature")
+
+	require.Equal(t, []LogRecord{
+		{Severity: LogSeverity_Info, VerboseLevel: 0, Label: "controller", Message: "new tx abc"},
+		{Severity: LogSeverity_Info, VerboseLevel: 1, Label: "controller", Message: "readding to mempool"},
+		{Severity: LogSeverity_Warning, Label: "controller", Message: "missing ref deadbeef"},
+		{Severity: LogSeverity_Error, Label: "controller", Message: "invalid tx: bad signature"},
+	}, sink.records)
+	require.True(t, l.LogV(1))
+	require.False(t, l.LogV(2))
+}
+
+func TestLogger_PackageLogSink(t *testing.T) {
+	sink := &captureSink{}
+	SetLogSink(sink)
+	defer SetLogSink(nil)
+
+	// Contexts pick up the package-wide sink without any setup of their own
+	c := &Context{}
+	c.SetLogLabel("host")
+	c.Errorf("error connecting to peer: %v", "timeout")
+
+	// ...unless they've been given their own
+	ownSink := &captureSink{}
+	l := NewLogger("transport")
+	l.SetLogSink(ownSink)
+	l.Warn("relay unreachable")
+
+	require.Equal(t, []LogRecord{{Severity: LogSeverity_Error, Label: "host", Message: "error connecting to peer: timeout"}}, sink.records)
+	require.Equal(t, []LogRecord{{Severity: LogSeverity_Warning, Label: "transport", Message: "relay unreachable"}}, ownSink.records)
+}
@@ -0,0 +1,48 @@
+package redwood
+
+import (
+	"time"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
+)
+
+// startValueLogGC calls gc every interval until done is closed.  The returned channel is
+// closed once it has stopped, after which the DBs that gc touches can safely be closed.
+// gc is never called if the DBs are in memory or the interval is zero.
+func startValueLogGC(done <-chan struct{}, options tree.DBTreeOptions, gc func()) <-chan struct{} {
+	stopped := make(chan struct{})
+	if options.InMemory || options.GCInterval <= 0 {
+		close(stopped)
+		return stopped
+	}
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(options.GCInterval)
+		defer ticker.Stop()
+		valueLogGCLoop(done, ticker.C, gc)
+	}()
+	return stopped
+}
+
+func valueLogGCLoop(done <-chan struct{}, tick <-chan time.Time, gc func()) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+			gc()
+		}
+	}
+}
+
+// collectValueLogGarbage garbage collects a DB's value log, and logs how much it reclaimed.
+func collectValueLogGarbage(logger ctx.Logger, name string, options tree.DBTreeOptions, collect func(discardRatio float64) (int, error)) {
+	rewritten, err := collect(options.GCDiscardRatio)
+	if err != nil {
+		logger.Errorf("error garbage collecting the %v DB: %v", name, err)
+	} else if rewritten > 0 {
+		logger.Infof(0, "garbage collected the %v DB (rewrote %v value log files)", name, rewritten)
+	}
+}
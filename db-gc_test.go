@@ -0,0 +1,134 @@
+package redwood
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestValueLogGCLoop(t *testing.T) {
+	done := make(chan struct{})
+	tick := make(chan time.Time)
+	ran := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		valueLogGCLoop(done, tick, func() { ran <- struct{}{} })
+	}()
+
+	// GC runs once per tick, and only on a tick
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ran:
+			t.Fatal("GC ran without a tick")
+		default:
+		}
+		tick <- time.Now()
+		select {
+		case <-ran:
+		case <-time.After(5 * time.Second):
+			t.Fatal("GC didn't run")
+		}
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GC loop didn't stop")
+	}
+}
+
+func TestStartValueLogGC(t *testing.T) {
+	t.Run("runs on the configured interval until done", func(t *testing.T) {
+		done := make(chan struct{})
+		var mu sync.Mutex
+		var runs []time.Time
+		chGCDone := startValueLogGC(done, tree.DBTreeOptions{GCInterval: 20 * time.Millisecond}, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			runs = append(runs, time.Now())
+		})
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(runs) >= 3
+		}, 5*time.Second, 5*time.Millisecond)
+
+		close(done)
+		select {
+		case <-chGCDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("GC didn't stop")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for i := 1; i < len(runs); i++ {
+			require.True(t, runs[i].Sub(runs[i-1]) >= 10*time.Millisecond)
+		}
+		numRuns := len(runs)
+		time.Sleep(50 * time.Millisecond)
+		require.Len(t, runs, numRuns)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		for _, options := range []tree.DBTreeOptions{{}, {InMemory: true, GCInterval: time.Millisecond}} {
+			chGCDone := startValueLogGC(make(chan struct{}), options, func() { t.Fatal("GC ran") })
+			select {
+			case <-chGCDone:
+			default:
+				t.Fatal("GC was started")
+			}
+		}
+	})
+}
+
+func TestController_ValueLogGCStopsOnShutdown(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "redwood-test-gc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dbRoot)
+	dbOptions := tree.DBTreeOptions{GCInterval: time.Millisecond}
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, dbOptions)
+	err = txStore.Start()
+	require.NoError(t, err)
+
+	c, err := NewControllerWithDBOptions(types.Address{}, "localhost/test", dbRoot, txStore, DefaultTxLimits, dbOptions, func(c Controller, tx *Tx, state *tree.DBNode) error { return nil })
+	require.NoError(t, err)
+	err = c.Start()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = c.AddTxAndWait(ctx, signTestTx(t, &Tx{ID: GenesisTxID, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}}}))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	c.Ctx().CtxStop("test finished", &wg)
+	txStore.Ctx().CtxStop("test finished", &wg)
+	wg.Wait()
+
+	select {
+	case <-c.(*controller).chGCDone:
+	default:
+		t.Fatal("controller's GC is still running")
+	}
+	select {
+	case <-txStore.(*badgerTxStore).chGCDone:
+	default:
+		t.Fatal("tx store's GC is still running")
+	}
+}
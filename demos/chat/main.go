@@ -60,14 +60,14 @@ func main() {
 	// Both consumers subscribe to the channel URI
 	ctx, _ := context.WithTimeout(context.Background(), 120*time.Second)
 	go func() {
-		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/chat")
+		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/chat", nil)
 		if !anySucceeded {
 			panic("host2 could not subscribe")
 		}
 	}()
 
 	go func() {
-		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/chat")
+		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/chat", nil)
 		if !anySucceeded {
 			panic("host1 could not subscribe")
 		}
@@ -88,7 +88,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	indexHTMLHash, err := host1.AddRef(indexHTML, "text/html")
+	indexHTMLHash, _, err := host1.AddRef(indexHTML, "text/html")
 	if err != nil {
 		panic(err)
 	}
@@ -96,7 +96,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	memeHash, err := host1.AddRef(meme, "image/jpg")
+	memeHash, _, err := host1.AddRef(meme, "image/jpg")
 	if err != nil {
 		panic(err)
 	}
@@ -108,7 +108,7 @@ func sendTxs(host1, host2 rw.Host) {
 
 	sendTx := func(tx rw.Tx) {
 		host := hostsByAddress[tx.From]
-		err := host.SendTx(context.Background(), tx)
+		_, err := host.SendTx(context.Background(), tx)
 		if err != nil {
 			host.Errorf("%+v", err)
 		}
@@ -1,6 +1,7 @@
 package demoutils
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	rw "github.com/brynbellomy/redwood"
@@ -32,25 +33,25 @@ func MakeHost(signingKeypairHex string, port uint, cookieSecretStr, tlsCertFilen
 
 	txStore := rw.NewBadgerTxStore(txDBRoot, signingKeypair.Address())
 	// txStore := remotestore.NewClient("0.0.0.0:4567", signingKeypair.Address(), signingKeypair.SigningPrivateKey)
-	refStore := rw.NewRefStore(refStoreRoot)
+	refStore := rw.NewRefStore(refStoreRoot, "")
 	peerStore := rw.NewPeerStore(signingKeypair.Address())
-	metacontroller := rw.NewMetacontroller(signingKeypair.Address(), stateDBRoot, txStore, refStore)
+	metacontroller := rw.NewMetacontroller(signingKeypair.Address(), stateDBRoot, txStore, refStore, rw.DefaultTxLimits)
 
-	p2ptransport, err := rw.NewLibp2pTransport(signingKeypair.Address(), port, metacontroller, refStore, peerStore)
+	p2ptransport, err := rw.NewLibp2pTransport(signingKeypair.Address(), port, nil, rw.Libp2pRelayConfig{}, metacontroller, refStore, peerStore)
 	if err != nil {
 		panic(err)
 	}
 
 	var cookieSecret [32]byte
 	copy(cookieSecret[:], []byte(cookieSecretStr))
-	httptransport, err := rw.NewHTTPTransport(signingKeypair.Address(), port+1, "localhost:21231", metacontroller, refStore, peerStore, signingKeypair, cookieSecret, tlsCertFilename, tlsKeyFilename)
+	httptransport, err := rw.NewHTTPTransport(signingKeypair.Address(), fmt.Sprintf(":%v", port+1), "localhost:21231", metacontroller, refStore, peerStore, signingKeypair, cookieSecret, tlsCertFilename, tlsKeyFilename, rw.DefaultHTTPLimits)
 	if err != nil {
 		panic(err)
 	}
 
 	transports := []rw.Transport{p2ptransport, httptransport}
 
-	h, err := rw.NewHost(signingKeypair, encryptingKeypair, port, transports, metacontroller, refStore, peerStore)
+	h, err := rw.NewHost(signingKeypair, encryptingKeypair, transports, metacontroller, refStore, peerStore, rw.HostConfig{})
 	if err != nil {
 		panic(err)
 	}
@@ -68,30 +68,30 @@ func main() {
 	// Both consumers subscribe to the URL
 	ctx, _ := context.WithTimeout(context.Background(), 120*time.Second)
 	go func() {
-		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/gitdemo")
+		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/gitdemo", nil)
 		if !anySucceeded {
 			panic("host2 could not subscribe")
 		}
-		anySucceeded, _ = host2.Subscribe(ctx, "localhost:21231/git")
+		anySucceeded, _ = host2.Subscribe(ctx, "localhost:21231/git", nil)
 		if !anySucceeded {
 			panic("host2 could not subscribe")
 		}
-		anySucceeded, _ = host2.Subscribe(ctx, "localhost:21231/git-reflog")
+		anySucceeded, _ = host2.Subscribe(ctx, "localhost:21231/git-reflog", nil)
 		if !anySucceeded {
 			panic("host2 could not subscribe")
 		}
 	}()
 
 	go func() {
-		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/gitdemo")
+		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/gitdemo", nil)
 		if !anySucceeded {
 			panic("host1 could not subscribe")
 		}
-		anySucceeded, _ = host1.Subscribe(ctx, "localhost:21231/git")
+		anySucceeded, _ = host1.Subscribe(ctx, "localhost:21231/git", nil)
 		if !anySucceeded {
 			panic("host1 could not subscribe")
 		}
-		anySucceeded, _ = host1.Subscribe(ctx, "localhost:21231/git-reflog")
+		anySucceeded, _ = host1.Subscribe(ctx, "localhost:21231/git-reflog", nil)
 		if !anySucceeded {
 			panic("host1 could not subscribe")
 		}
@@ -111,7 +111,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	indexHTMLHash, err := host1.AddRef(indexHTML, "text/html")
+	indexHTMLHash, _, err := host1.AddRef(indexHTML, "text/html")
 	if err != nil {
 		panic(err)
 	}
@@ -119,7 +119,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	scriptJSHash, err := host1.AddRef(scriptJS, "application/javascript")
+	scriptJSHash, _, err := host1.AddRef(scriptJS, "application/javascript")
 	if err != nil {
 		panic(err)
 	}
@@ -127,7 +127,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	readmeHash, err := host1.AddRef(readme, "text/markdown")
+	readmeHash, _, err := host1.AddRef(readme, "text/markdown")
 	if err != nil {
 		panic(err)
 	}
@@ -135,7 +135,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	redwoodJpgHash, err := host1.AddRef(redwoodJpg, "image/jpeg")
+	redwoodJpgHash, _, err := host1.AddRef(redwoodJpg, "image/jpeg")
 	if err != nil {
 		panic(err)
 	}
@@ -148,7 +148,7 @@ func sendTxs(host1, host2 rw.Host) {
 
 	sendTx := func(tx rw.Tx) {
 		host := hostsByAddress[tx.From]
-		err := host.SendTx(context.Background(), tx)
+		_, err := host.SendTx(context.Background(), tx)
 		if err != nil {
 			host.Errorf("%+v", err)
 		}
@@ -59,14 +59,14 @@ func main() {
 	// Both consumers subscribe to the URL
 	ctx, _ := context.WithTimeout(context.Background(), 120*time.Second)
 	go func() {
-		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/editor")
+		anySucceeded, _ := host2.Subscribe(ctx, "localhost:21231/editor", nil)
 		if !anySucceeded {
 			panic("host2 could not subscribe")
 		}
 	}()
 
 	go func() {
-		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/editor")
+		anySucceeded, _ := host1.Subscribe(ctx, "localhost:21231/editor", nil)
 		if !anySucceeded {
 			panic("host1 could not subscribe")
 		}
@@ -86,7 +86,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	sync9Hash, err := host1.AddRef(sync9, "application/js")
+	sync9Hash, _, err := host1.AddRef(sync9, "application/js")
 	if err != nil {
 		panic(err)
 	}
@@ -94,7 +94,7 @@ func sendTxs(host1, host2 rw.Host) {
 	if err != nil {
 		panic(err)
 	}
-	indexHTMLHash, err := host1.AddRef(indexHTML, "text/html")
+	indexHTMLHash, _, err := host1.AddRef(indexHTML, "text/html")
 	if err != nil {
 		panic(err)
 	}
@@ -107,7 +107,7 @@ func sendTxs(host1, host2 rw.Host) {
 
 	sendTx := func(tx rw.Tx) {
 		host := hostsByAddress[tx.From]
-		err := host.SendTx(context.Background(), tx)
+		_, err := host.SendTx(context.Background(), tx)
 		if err != nil {
 			host.Errorf("%+v", err)
 		}
@@ -0,0 +1,43 @@
+package redwood
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+// IsNotFound returns true if err means that the thing asked for doesn't exist on this
+// node: a keypath, a stateURI, a tx, or a ref.
+func IsNotFound(err error) bool {
+	return isAnyOf(err, types.Err404, ErrNoController, os.ErrNotExist)
+}
+
+// IsRetryable returns true if err is likely to go away if the operation is tried again
+// later: the node may be waiting on a tx's parents or on refs to arrive, may not have
+// found any peers yet, or may have timed out.
+func IsRetryable(err error) bool {
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	return isAnyOf(err, ErrNoParentYet, ErrMissingCriticalRefs, ErrNoPeersForURL, context.DeadlineExceeded)
+}
+
+// IsProtocolError returns true if err means that a peer broke the protocol, for instance
+// by sending a malformed message or a ref whose content doesn't match its hash.
+func IsProtocolError(err error) bool {
+	return isAnyOf(err, ErrProtocol, ErrRefHashMismatch, ErrPeerIDMismatch)
+}
+
+// isAnyOf returns true if err, or any error that it wraps, is one of the given targets.
+func isAnyOf(err error, targets ...error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	goerrors "errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestErrorClassification(t *testing.T) {
+	m, refStore := newTestMetacontroller(t)
+	h := &host{
+		Context:             &ctx.Context{},
+		controller:          m,
+		refStore:            refStore,
+		transports:          map[string]Transport{"silent": &silentTransport{}},
+		subscriptionsOut:    make(map[string]map[peerTuple]*subscriptionOut),
+		findProviderTimeout: 10 * time.Millisecond,
+	}
+	err := h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+	missingRef := types.HashBytes([]byte("nobody has this"))
+	ctxWait, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = m.AddTxAndWait(ctxWait, signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: nil,
+			Val: map[string]interface{}{
+				"name":  "redwood",
+				"video": map[string]interface{}{"Content-Type": "link", "value": "ref:" + missingRef.Hex()},
+			},
+		}},
+	}))
+	require.NoError(t, err)
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := m.StateAtVersion("localhost/nope", nil)
+		require.True(t, IsNotFound(err))
+
+		_, err = h.Get(context.Background(), "localhost/test", tree.Keypath("nope"), nil)
+		require.True(t, IsNotFound(err))
+
+		_, _, err = refStore.Object(missingRef)
+		require.True(t, IsNotFound(err))
+
+		require.False(t, IsRetryable(err))
+		require.False(t, IsProtocolError(err))
+	})
+
+	t.Run("retryable", func(t *testing.T) {
+		_, errs := h.Subscribe(context.Background(), "localhost/test", nil)
+		require.Len(t, errs, 1)
+		require.True(t, IsRetryable(errs[0]))
+
+		_, err := h.Get(context.Background(), "localhost/test", tree.Keypath("video"), nil)
+		require.True(t, IsRetryable(err))
+
+		ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+		defer cancel()
+		<-ctxTimeout.Done()
+		require.True(t, IsRetryable(errors.WithStack(ctxTimeout.Err())))
+
+		require.False(t, IsNotFound(errs[0]))
+		require.False(t, IsProtocolError(errs[0]))
+	})
+
+	t.Run("protocol errors", func(t *testing.T) {
+		partial, err := refStore.OpenPartialObject(missingRef)
+		require.NoError(t, err)
+		_, err = partial.WriteAt([]byte("not what was asked for"), 0)
+		require.NoError(t, err)
+		require.NoError(t, partial.Close())
+
+		err = refStore.StorePartialObject(missingRef, "video/mp4")
+		require.True(t, IsProtocolError(err))
+
+		// A provider that can't honor the requested offset sends the ref from the start
+		tpt := newRefServingTransport(t, "ref-serving")
+		ref, _, err := tpt.provider.refStore.StoreObject(ioutil.NopCloser(bytes.NewBufferString("short")), "text/plain")
+		require.NoError(t, err)
+		swarm := newRefSwarm(0, REF_PIECE_SIZE)
+		_, err = h.fetchRefRange(context.Background(), ref, refRange{100, REF_PIECE_SIZE}, &refServingPeer{t: tpt}, swarm, partial)
+		require.True(t, IsProtocolError(err))
+
+		require.False(t, IsNotFound(err))
+		require.False(t, IsRetryable(err))
+	})
+
+	t.Run("wrapping", func(t *testing.T) {
+		// Standard library and github.com/pkg/errors wrapping, in any combination
+		err := fmt.Errorf("outer: %w", errors.Wrap(fmt.Errorf("inner: %w", types.Err404), "middle"))
+		require.True(t, IsNotFound(err))
+		err = errors.Wrap(fmt.Errorf("inner: %w", errors.WithStack(ErrNoParentYet)), "outer")
+		require.True(t, IsRetryable(err))
+
+		require.False(t, IsNotFound(nil))
+		require.False(t, IsRetryable(nil))
+		require.False(t, IsProtocolError(nil))
+		require.False(t, IsNotFound(errors.New("not found")))
+	})
+
+	t.Run("standard library errors.Is", func(t *testing.T) {
+		_, err := m.StateAtVersion("localhost/nope", nil)
+		require.True(t, goerrors.Is(fmt.Errorf("outer: %w", err), ErrNoController))
+
+		_, err = h.Get(context.Background(), "localhost/test", tree.Keypath("nope"), nil)
+		require.True(t, goerrors.Is(fmt.Errorf("outer: %w", err), types.Err404))
+		require.Contains(t, fmt.Sprintf("%+v", err), "errors_test.go")
+
+		_, err = h.Get(context.Background(), "localhost/test", tree.Keypath("video"), nil)
+		require.True(t, goerrors.Is(fmt.Errorf("outer: %w", err), ErrMissingCriticalRefs))
+
+		_, errs := h.Subscribe(context.Background(), "localhost/test", nil)
+		require.Len(t, errs, 1)
+		require.True(t, goerrors.Is(fmt.Errorf("outer: %w", errs[0]), ErrNoPeersForURL))
+
+		_, _, err = refStore.Object(missingRef)
+		require.True(t, goerrors.Is(fmt.Errorf("outer: %w", err), os.ErrNotExist))
+		var pathErr *os.PathError
+		require.True(t, goerrors.As(err, &pathErr))
+
+		err = errors.Wrap(fmt.Errorf("middle: %w", errors.WithStack(ErrRefHashMismatch)), "outer")
+		require.True(t, goerrors.Is(err, ErrRefHashMismatch))
+		require.Contains(t, fmt.Sprintf("%+v", err), "errors_test.go")
+	})
+}
@@ -515,26 +515,17 @@ func pushRef(destRefName string, commitId *git.Oid, client redwood.HTTPClient) e
 
 	stateURI := StateURI + "-reflog"
 
-	resp, _, parents, err := client.Get(stateURI, nil, branchKeypath, nil, true)
+	resp, _, leaves, err := client.Get(stateURI, nil, branchKeypath, nil, true)
 	if err != nil {
 		return err
 	}
-	defer resp.Close()
-
-	bs, err := ioutil.ReadAll(resp)
-	if err != nil {
-		panic(err)
-	}
-	currentCommit := string(bs)
-	if currentCommit == "" {
-		parents = []types.ID{redwood.GenesisTxID}
-	}
+	resp.Close()
 
 	tx := &redwood.Tx{
 		ID:      types.RandomID(),
 		URL:     StateURI + "-reflog",
 		From:    sigkeys.Address(),
-		Parents: parents,
+		Parents: leaves,
 		Patches: []redwood.Patch{{
 			Keypath: branchKeypath,
 			Val:     commitId.String(),
@@ -809,7 +800,7 @@ func walkLinks(n tree.Node, fn func(linkType nelson.LinkType, linkStr string, ke
 		parentKeypath, key := node.Keypath().Pop()
 		if key.Equals(nelson.ContentTypeKey) {
 			contentType, err := nelson.GetContentType(n.AtKeypath(parentKeypath, nil))
-			if err != nil && errors.Cause(err) != types.Err404 {
+			if err != nil && !errors.Is(err, types.Err404) {
 				return err
 			} else if contentType != "link" {
 				continue
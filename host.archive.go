@@ -0,0 +1,228 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/nelson"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// An archive holds the history of a single stateURI.  It's a stream of length-prefixed
+// JSON entries (using the same framing as the wire protocol): a header naming the
+// stateURI, followed by refs and txs in an order that can be replayed as-is.  Each tx
+// comes after its parents, and each ref comes before the first tx that links to it.
+type archiveEntry struct {
+	Type        archiveEntryType `json:"type"`
+	StateURI    string           `json:"stateURI,omitempty"`
+	Tx          *Tx              `json:"tx,omitempty"`
+	RefHash     types.Hash       `json:"refHash"`
+	ContentType string           `json:"contentType,omitempty"`
+	RefData     []byte           `json:"refData,omitempty"`
+}
+
+type archiveEntryType string
+
+const (
+	archiveEntryType_Header archiveEntryType = "header"
+	archiveEntryType_Ref    archiveEntryType = "ref"
+	archiveEntryType_Tx     archiveEntryType = "tx"
+)
+
+var (
+	ErrInvalidArchive = errors.New("invalid archive")
+)
+
+// ExportStateURI writes the valid txs for the given stateURI, along with the refs that
+// they link to, to w.  Refs that this host doesn't have are left out of the archive, so
+// the importing host will have to fetch them from the network.
+func (h *host) ExportStateURI(stateURI string, w io.Writer) error {
+	var known bool
+	for _, uri := range h.controller.KnownStateURIs() {
+		if uri == stateURI {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return errors.Wrapf(ErrNoController, stateURI)
+	}
+
+	err := writeArchiveEntry(w, archiveEntry{Type: archiveEntryType_Header, StateURI: stateURI})
+	if err != nil {
+		return err
+	}
+
+	iter := h.controller.FetchTxs(stateURI)
+	defer iter.Cancel()
+
+	writtenRefs := make(map[types.Hash]bool)
+	for {
+		tx := iter.Next()
+		if iter.Error() != nil {
+			return iter.Error()
+		} else if tx == nil {
+			return nil
+		} else if !tx.Valid {
+			// Rejected txs (and those still waiting in the mempool) wouldn't survive
+			// the import
+			continue
+		}
+
+		for _, refHash := range refsLinkedByTx(tx) {
+			if writtenRefs[refHash] {
+				continue
+			}
+			writtenRefs[refHash] = true
+
+			if !h.refStore.HaveObject(refHash) {
+				h.Warnf("exporting %v: missing ref %v, skipping", stateURI, refHash.Hex())
+				continue
+			}
+			err := h.exportRef(w, refHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := writeArchiveEntry(w, archiveEntry{Type: archiveEntryType_Tx, Tx: tx})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *host) exportRef(w io.Writer, refHash types.Hash) error {
+	contentType, err := h.refStore.ContentType(refHash)
+	if err != nil {
+		return err
+	}
+
+	reader, _, err := h.refStore.Object(refHash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return writeArchiveEntry(w, archiveEntry{Type: archiveEntryType_Ref, RefHash: refHash, ContentType: contentType, RefData: data})
+}
+
+// ImportStateURI replays an archive written by ExportStateURI, validating each tx in
+// turn, and returns the archive's stateURI.  Txs and refs that this host already has are
+// skipped, so importing the same archive twice is harmless.
+func (h *host) ImportStateURI(ctx context.Context, r io.Reader) (string, error) {
+	header, err := readArchiveEntry(r)
+	if err == io.EOF {
+		return "", errors.Wrap(ErrInvalidArchive, "archive is empty")
+	} else if err != nil {
+		return "", err
+	} else if header.Type != archiveEntryType_Header || header.StateURI == "" {
+		return "", errors.Wrap(ErrInvalidArchive, "missing header")
+	}
+	stateURI := header.StateURI
+
+	for {
+		entry, err := readArchiveEntry(r)
+		if err == io.EOF {
+			return stateURI, nil
+		} else if err != nil {
+			return "", err
+		}
+
+		switch entry.Type {
+		case archiveEntryType_Ref:
+			if h.refStore.HaveObject(entry.RefHash) {
+				continue
+			}
+			refHash, _, err := h.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(entry.RefData)), entry.ContentType)
+			if err != nil {
+				return "", err
+			} else if refHash != entry.RefHash {
+				return "", errors.Wrapf(ErrInvalidArchive, "ref %v has the wrong contents (hashes to %v)", entry.RefHash.Hex(), refHash.Hex())
+			}
+
+		case archiveEntryType_Tx:
+			if entry.Tx == nil || entry.Tx.URL != stateURI {
+				return "", errors.Wrapf(ErrInvalidArchive, "tx does not belong to %v", stateURI)
+			}
+			tx := entry.Tx.TrimProvenance()
+			err := h.controller.AddTxAndWait(ctx, &tx)
+			if err != nil {
+				return "", errors.Wrapf(err, "importing tx %v", entry.Tx.ID.Pretty())
+			}
+
+		default:
+			return "", errors.Wrapf(ErrInvalidArchive, "unknown entry type '%v'", entry.Type)
+		}
+	}
+}
+
+// refsLinkedByTx returns the hashes of the refs that the tx's patches link to.
+func refsLinkedByTx(tx *Tx) []types.Hash {
+	var refs []types.Hash
+	for _, patch := range tx.Patches {
+		walkContentTypes(patch.Val, []string{"link"}, func(contentType string, keypath []string, val map[string]interface{}) error {
+			linkStr, exists := getString(val, []string{"value"})
+			if !exists {
+				return nil
+			}
+			linkType, linkValue := nelson.DetermineLinkType(linkStr)
+			if linkType != nelson.LinkTypeRef {
+				return nil
+			}
+			refHash, err := types.HashFromHex(linkValue)
+			if err != nil {
+				return nil
+			}
+			refs = append(refs, refHash)
+			return nil
+		})
+	}
+	return refs
+}
+
+func writeArchiveEntry(w io.Writer, entry archiveEntry) error {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = WriteUint64(w, uint64(len(bs)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bs)
+	return errors.WithStack(err)
+}
+
+func readArchiveEntry(r io.Reader) (archiveEntry, error) {
+	size, err := ReadUint64(r)
+	if err == io.EOF {
+		return archiveEntry{}, err
+	} else if err != nil {
+		return archiveEntry{}, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+
+	// Don't trust the size enough to allocate it all up front
+	buf := &bytes.Buffer{}
+	_, err = io.CopyN(buf, r, int64(size))
+	if err != nil {
+		return archiveEntry{}, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+
+	var entry archiveEntry
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		return archiveEntry{}, errors.Wrap(ErrInvalidArchive, err.Error())
+	}
+	return entry, nil
+}
@@ -1,15 +1,21 @@
 package redwood
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"encoding/binary"
 	"io"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/nelson"
+	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
@@ -18,10 +24,20 @@ type Host interface {
 	Ctx() *ctx.Context
 	Start() error
 
-	// Get(ctx context.Context, url string) (interface{}, error)
-	Subscribe(ctx context.Context, stateURI string) (bool, []error)
-	SendTx(ctx context.Context, tx Tx) error
-	AddRef(reader io.ReadCloser, contentType string) (types.Hash, error)
+	Get(ctx context.Context, stateURI string, keypath tree.Keypath, rng *tree.Range) (interface{}, error)
+	Subscribe(ctx context.Context, stateURI string, keypath tree.Keypath) (bool, []error)
+	Txs(stateURI string) TxIterator
+	ExportStateURI(stateURI string, w io.Writer) error
+	ImportStateURI(ctx context.Context, r io.Reader) (string, error)
+	SendTx(ctx context.Context, tx Tx) (map[types.Address]error, error)
+	SendTxAndWait(ctx context.Context, tx Tx) error
+	SendTxBatch(ctx context.Context, txs []Tx) (map[types.ID]error, error)
+	DryRunTx(ctx context.Context, tx Tx) (tree.Node, error)
+	AddRef(reader io.ReadCloser, contentType string) (types.Hash, int64, error)
+	Refs() ([]RefInfo, error)
+	RefStats() (count int, totalBytes int64, err error)
+	SubscriptionsOut() []SubscriptionInfo
+	Peers() []PeerInfo
 	AddPeer(ctx context.Context, transportName string, reachableAt StringSet) error
 	Transport(name string) Transport
 	Controller() Metacontroller
@@ -36,43 +52,114 @@ type host struct {
 	signingKeypair    *SigningKeypair
 	encryptingKeypair *EncryptingKeypair
 
-	subscriptionsOut map[string]map[peerTuple]*subscriptionOut // map[stateURI][peerTuple]
-	peerSeenTxs      map[peerTuple]map[types.ID]bool
-	peerSeenTxsMu    sync.RWMutex
+	subscriptionsOut   map[string]map[peerTuple]*subscriptionOut // map[stateURI][peerTuple]
+	subscriptionsOutMu sync.RWMutex
 
-	peerStore PeerStore
-	refStore  RefStore
+	peerSeenTxs   map[peerTuple]map[types.ID]bool
+	peerSeenTxsMu sync.RWMutex
+
+	recentlyBroadcastTxs   map[types.ID]time.Time
+	recentlyBroadcastTxsMu sync.Mutex
+
+	parentBackfills   map[types.ID]struct{}
+	parentBackfillsMu sync.Mutex
+
+	peerStore   PeerStore
+	refStore    RefStore
+	outbox      Outbox
+	trustPolicy TrustPolicy
+
+	mailbox             Mailbox
+	mailboxRelays       []types.Address
+	mailboxForwarding   map[types.Address]struct{} // The recipients whose messages are being forwarded
+	mailboxForwardingMu sync.Mutex
+
+	findProviderTimeout     time.Duration
+	prefetchRefsOnSubscribe bool
+	bloomHistorySync        bool
+
+	// Holds a token for each credential exchange that peersWithAddress is running, across
+	// all of its calls.  Nil means no limit.
+	verificationSlots chan struct{}
 
 	missingRefs   map[types.Hash]struct{}
 	chMissingRefs chan []types.Hash
 	chFetchRefs   chan struct{}
+	refAnnouncer  *refAnnouncer
 }
 
 var (
 	ErrUnsignedTx = errors.New("unsigned tx")
 	ErrProtocol   = errors.New("protocol error")
 	ErrPeerIsSelf = errors.New("peer is self")
+
+	ErrUnknownStateURI = errors.New("tx is for a stateURI we don't know about")
+	ErrNotARecipient   = errors.New("private tx isn't addressed to us")
+
+	ErrRecipientUnreachable = errors.New("could not reach recipient")
+
+	ErrRefNotFound   = errors.New("no providers of ref found")
+	ErrRefIncomplete = errors.New("ref's providers dropped out before sending all of it")
+
+	ErrChallengeMismatch   = errors.New("response is for a different challenge")
+	ErrChallengeExpired    = errors.New("challenge has expired")
+	ErrUnauthenticatedPeer = errors.New("peer didn't prove that it holds its address")
 )
 
-func NewHost(signingKeypair *SigningKeypair, encryptingKeypair *EncryptingKeypair, transports []Transport, controller Metacontroller, refStore RefStore, peerStore PeerStore) (Host, error) {
+// HostConfig holds the optional parts of a Host.  The zero value is a host with no outbox,
+// no mailbox, no trust policy, and no limit on concurrent credential exchanges.
+type HostConfig struct {
+	Outbox        Outbox          // Holds private txs until their recipients can be reached
+	Mailbox       Mailbox         // If set, the host stores and forwards txs for offline peers
+	MailboxRelays []types.Address // The relays to deposit undeliverable private txs with
+	TrustPolicy   TrustPolicy     // Decides which senders' txs are accepted
+
+	FindProviderTimeout        time.Duration // How long to search for providers of a ref
+	PrefetchRefsOnSubscribe    bool          // Fetch a state's refs as soon as it's subscribed to
+	BloomHistorySync           bool          // Tell providers which txs we already hold when fetching history
+	MaxConcurrentVerifications int           // The most credential exchanges run at once
+}
+
+func NewHost(signingKeypair *SigningKeypair, encryptingKeypair *EncryptingKeypair, transports []Transport, controller Metacontroller, refStore RefStore, peerStore PeerStore, config HostConfig) (Host, error) {
+	if config.Outbox != nil {
+		err := config.Outbox.Options().check()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	transportsMap := make(map[string]Transport)
 	for _, tpt := range transports {
 		transportsMap[tpt.Name()] = tpt
 	}
 	h := &host{
-		Context:           &ctx.Context{},
-		transports:        transportsMap,
-		controller:        controller,
-		signingKeypair:    signingKeypair,
-		encryptingKeypair: encryptingKeypair,
-		subscriptionsOut:  make(map[string]map[peerTuple]*subscriptionOut),
-		peerSeenTxs:       make(map[peerTuple]map[types.ID]bool),
-		peerStore:         peerStore,
-		refStore:          refStore,
-		missingRefs:       make(map[types.Hash]struct{}),
-		chMissingRefs:     make(chan []types.Hash, 100),
-		chFetchRefs:       make(chan struct{}),
+		Context:                 &ctx.Context{},
+		transports:              transportsMap,
+		controller:              controller,
+		signingKeypair:          signingKeypair,
+		encryptingKeypair:       encryptingKeypair,
+		subscriptionsOut:        make(map[string]map[peerTuple]*subscriptionOut),
+		peerSeenTxs:             make(map[peerTuple]map[types.ID]bool),
+		recentlyBroadcastTxs:    make(map[types.ID]time.Time),
+		parentBackfills:         make(map[types.ID]struct{}),
+		peerStore:               peerStore,
+		refStore:                refStore,
+		outbox:                  config.Outbox,
+		trustPolicy:             config.TrustPolicy,
+		mailbox:                 config.Mailbox,
+		mailboxRelays:           config.MailboxRelays,
+		mailboxForwarding:       make(map[types.Address]struct{}),
+		missingRefs:             make(map[types.Hash]struct{}),
+		chMissingRefs:           make(chan []types.Hash, 100),
+		chFetchRefs:             make(chan struct{}),
+		findProviderTimeout:     config.FindProviderTimeout,
+		prefetchRefsOnSubscribe: config.PrefetchRefsOnSubscribe,
+		bloomHistorySync:        config.BloomHistorySync,
 	}
+	if config.MaxConcurrentVerifications > 0 {
+		h.verificationSlots = make(chan struct{}, config.MaxConcurrentVerifications)
+	}
+	h.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, h.announceRefs)
 	return h, nil
 }
 
@@ -88,6 +175,7 @@ func (h *host) Start() error {
 
 			// Set up the controller
 			h.controller.SetReceivedRefsHandler(h.onReceivedRefs)
+			h.controller.SetFetchingParentsChecker(h.isBackfillingParents)
 
 			h.CtxAddChild(h.controller.Ctx(), nil)
 			err := h.controller.Start()
@@ -103,6 +191,9 @@ func (h *host) Start() error {
 				transport.SetAckHandler(h.onAckReceived)
 				transport.SetVerifyAddressHandler(h.onVerifyAddressReceived)
 				transport.SetFetchRefHandler(h.onFetchRefReceived)
+				if debuggable, is := transport.(interface{ SetDebugInfoHandler(DebugInfoHandler) }); is {
+					debuggable.SetDebugInfoHandler(h.debugInfo)
+				}
 				h.CtxAddChild(transport.Ctx(), nil)
 
 				err := transport.Start()
@@ -111,6 +202,26 @@ func (h *host) Start() error {
 				}
 			}
 
+			// Set up the outbox
+			if h.outbox != nil {
+				h.CtxAddChild(h.outbox.Ctx(), nil)
+				err := h.outbox.Start()
+				if err != nil {
+					return err
+				}
+				go h.retryOutboxLoop()
+			}
+
+			// Set up the mailbox, if we're a store-and-forward relay
+			if h.mailbox != nil {
+				h.CtxAddChild(h.mailbox.Ctx(), nil)
+				err := h.mailbox.Start()
+				if err != nil {
+					return err
+				}
+				go h.forwardMailboxLoop()
+			}
+
 			go h.fetchRefsLoop()
 
 			return nil
@@ -122,6 +233,38 @@ func (h *host) Start() error {
 	)
 }
 
+// Get returns the current value at the given keypath of a stateURI, with any NelSON frames
+// and links resolved.  Links to refs resolve to an io.ReadCloser, which the caller must
+// close.  If any of the refs that the value links to haven't been fetched yet, Get returns
+// ErrMissingCriticalRefs.
+func (h *host) Get(ctx context.Context, stateURI string, keypath tree.Keypath, rng *tree.Range) (interface{}, error) {
+	state, err := h.controller.StateAtVersion(stateURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer state.Close()
+
+	state, err = state.CopyToMemory(keypath, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	state, anyMissing, err := nelson.Resolve(state, h.controller)
+	if err != nil {
+		return nil, err
+	} else if anyMissing {
+		return nil, errors.Wrapf(ErrMissingCriticalRefs, "%v/%v", stateURI, keypath)
+	}
+
+	val, exists, err := nelson.GetValueRecursive(state, nil, nil)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, errors.Wrapf(types.Err404, "%v/%v", stateURI, keypath)
+	}
+	return val, nil
+}
+
 func (h *host) Transport(name string) Transport {
 	return h.transports[name]
 }
@@ -134,25 +277,266 @@ func (h *host) Address() types.Address {
 	return h.signingKeypair.Address()
 }
 
+// isSelf returns true if the given peer is actually this host, either because it claims
+// our address or because its transport recognizes it as one of our own identities.
+func (h *host) isSelf(peer Peer) bool {
+	if addr := peer.Address(); addr != (types.Address{}) && addr == h.Address() {
+		return true
+	}
+	if tpt, is := peer.Transport().(selfRecognizingTransport); is {
+		return tpt.IsSelf(peer)
+	}
+	return false
+}
+
 func (h *host) onTxReceived(tx Tx, peer Peer) {
 	h.Infof(0, "tx %v received", tx.ID.Pretty())
+
+	// Only the txs we take are ACKed, so that a rejected tx isn't counted as delivered
+	err := h.addReceivedTx(tx, peer)
+	if err != nil {
+		h.Errorf("rejecting tx %v: %v", tx.ID.Pretty(), err)
+		return
+	}
+
+	err = peer.WriteMsg(Msg{Type: MsgType_Ack, Payload: tx.ID})
+	if err != nil {
+		h.Errorf("error ACKing peer: %v", err)
+	}
+}
+
+// addReceivedTx adds a tx sent to us by the given peer and rebroadcasts it.  If we're
+// missing any of the tx's parents, we ask the peer for them rather than leaving the tx to
+// wait in the mempool until they arrive some other way.  It returns an error if the tx is
+// refused by the trust policy or is for a stateURI that we don't take txs for.
+func (h *host) addReceivedTx(tx Tx, peer Peer) error {
 	h.markTxSeenByPeer(peer, tx.ID)
+	tx = tx.TrimProvenance()
 
-	if !h.controller.HaveTx(tx.URL, tx.ID) {
-		err := h.controller.AddTx(&tx)
+	err := h.checkTrustPolicy(tx, peer)
+	if err != nil {
+		return err
+	}
+
+	err = h.checkReceivedTxStateURI(tx)
+	if err != nil {
+		return err
+	}
+
+	if h.controller.HaveTx(tx.URL, tx.ID) {
+		return nil
+	}
+
+	var missingParents []types.ID
+	for _, parentID := range tx.Parents {
+		if !h.controller.HaveTx(tx.URL, parentID) {
+			missingParents = append(missingParents, parentID)
+		}
+	}
+	// Claim the parents before the tx enters the mempool, so that it can't expire before
+	// we've tried to fetch them
+	missingParents = h.claimParentBackfills(missingParents)
+
+	err = h.controller.AddTx(&tx)
+	if err != nil {
+		h.Errorf("error adding tx to controller: %v", err)
+	}
+
+	_, err = h.broadcastTx(context.TODO(), tx)
+	if err != nil {
+		h.Errorf("error rebroadcasting tx: %v", err)
+	}
+
+	if len(missingParents) > 0 {
+		go h.backfillParents(tx, missingParents, peer)
+	}
+	return nil
+}
+
+// checkTrustPolicy asks the host's TrustPolicy whether to take the given tx from the given
+// peer at all.  A host without one trusts everyone.
+func (h *host) checkTrustPolicy(tx Tx, peer Peer) error {
+	if h.trustPolicy == nil {
+		return nil
+	}
+	return h.trustPolicy.CheckTx(tx, peer.Address())
+}
+
+// checkReceivedTxStateURI returns an error wrapping ErrUnknownStateURI unless the given
+// tx belongs to a stateURI that we already hold or have a live subscription to (one that
+// the peer rejected, or that has since ended, doesn't count).  A genesis tx is always
+// accepted, as it's the tx that creates a new stateURI, and so is an unencrypted private
+// tx addressed to us, since that's how we learn of its stateURI.  Private txs addressed to
+// others are rejected with ErrNotARecipient, and so are those whose sender isn't one of
+// their recipients, or whose stateURI isn't the one that their recipients share.
+func (h *host) checkReceivedTxStateURI(tx Tx) error {
+	if tx.IsPrivate() {
+		if !tx.IsAddressedTo(h.Address()) {
+			return errors.WithStack(ErrNotARecipient)
+		} else if !tx.IsAddressedTo(tx.From) {
+			return errors.Wrapf(ErrNotARecipient, "sender %v", tx.From.Hex())
+		}
+		return errors.WithStack(checkPrivateRootKey(&tx))
+	} else if tx.ID == GenesisTxID {
+		return nil
+	}
+
+	_, err := h.controller.ControllerForStateURI(tx.URL)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNoController) {
+		return err
+	}
+
+	h.subscriptionsOutMu.RLock()
+	defer h.subscriptionsOutMu.RUnlock()
+	for _, sub := range h.subscriptionsOut[tx.URL] {
+		if !sub.closed() {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrUnknownStateURI, "%v", tx.URL)
+}
+
+// claimParentBackfills returns the given parents that aren't already being backfilled,
+// and marks them as being backfilled.  Several children of the same parent often arrive
+// together, and the parent only needs to be fetched once.
+func (h *host) claimParentBackfills(parentIDs []types.ID) []types.ID {
+	h.parentBackfillsMu.Lock()
+	defer h.parentBackfillsMu.Unlock()
+
+	var claimed []types.ID
+	for _, parentID := range parentIDs {
+		if _, inProgress := h.parentBackfills[parentID]; inProgress {
+			continue
+		}
+		h.parentBackfills[parentID] = struct{}{}
+		claimed = append(claimed, parentID)
+	}
+	return claimed
+}
+
+// isBackfillingParents reports whether any of the tx's parents are being backfilled.
+func (h *host) isBackfillingParents(tx *Tx) bool {
+	h.parentBackfillsMu.Lock()
+	defer h.parentBackfillsMu.Unlock()
+
+	for _, parentID := range tx.Parents {
+		if _, inProgress := h.parentBackfills[parentID]; inProgress {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillParents fetches the given parents of a tx, along with any of their ancestors
+// that we're missing, from the peer that sent us the tx.  The parents must have been
+// claimed with claimParentBackfills.
+func (h *host) backfillParents(tx Tx, parentIDs []types.ID, sender Peer) {
+	for _, parentID := range parentIDs {
+		h.Infof(0, "backfilling parent %v of tx %v", parentID.Pretty(), tx.ID.Pretty())
+		err := h.fetchHistoryFromPeer(tx.URL, parentID, sender)
 		if err != nil {
-			h.Errorf("error adding tx to controller: %v", err)
+			h.Errorf("error backfilling parent %v of tx %v: %v", parentID.Pretty(), tx.ID.Pretty(), err)
 		}
 
-		err = h.broadcastTx(context.TODO(), tx)
+		h.parentBackfillsMu.Lock()
+		delete(h.parentBackfills, parentID)
+		h.parentBackfillsMu.Unlock()
+	}
+}
+
+// fetchHistoryFromPeer asks the given peer for toVersion and whichever of its ancestors
+// we're missing, and adds them as they arrive.  Peers that reached out to us (such as
+// HTTP clients) can't be reached in turn, so in that case we ask a provider of the
+// stateURI instead.
+func (h *host) fetchHistoryFromPeer(stateURI string, toVersion types.ID, sender Peer) error {
+	// The sender may be on the other end of a stream that's already in use (such as a
+	// subscription), so the request goes over a new one
+	reachableAt := sender.ReachableAt()
+	if len(reachableAt) == 0 {
+		return h.fetchHistoryFromProviders(stateURI, toVersion)
+	}
+	peer, err := sender.Transport().GetPeerByConnStrings(h.Ctx(), reachableAt)
+	if err != nil {
+		return err
+	}
+	return h.fetchHistory(stateURI, toVersion, peer)
+}
+
+// fetchHistoryFromProviders fetches toVersion and its missing ancestors from the first
+// provider of the stateURI (over any transport) that's able to send them.
+func (h *host) fetchHistoryFromProviders(stateURI string, toVersion types.ID) error {
+	ctx, cancel := context.WithTimeout(h.Ctx(), h.findProviderTimeout)
+	defer cancel()
+
+	for _, tpt := range h.transports {
+		ch, err := tpt.ForEachProviderOfStateURI(ctx, stateURI)
 		if err != nil {
-			h.Errorf("error rebroadcasting tx: %v", err)
+			h.Errorf("error finding providers of %v over %v: %v", stateURI, tpt.Name(), err)
+			continue
+		}
+
+	ProviderLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				break ProviderLoop
+			case peer, open := <-ch:
+				if !open {
+					break ProviderLoop
+				} else if h.isSelf(peer) {
+					continue
+				}
+
+				err := h.fetchHistory(stateURI, toVersion, peer)
+				if err != nil {
+					h.Errorf("error fetching history from provider: %v", err)
+					continue
+				}
+				return nil
+			}
 		}
 	}
+	return errors.Wrapf(ErrNoPeersForURL, "no provider of %v could send %v", stateURI, toVersion.Pretty())
+}
 
-	err := peer.WriteMsg(Msg{Type: MsgType_Ack, Payload: tx.ID})
+func (h *host) fetchHistory(stateURI string, toVersion types.ID, peer Peer) error {
+	err := peer.EnsureConnected(h.Ctx())
 	if err != nil {
-		h.Errorf("error ACKing peer: %v", err)
+		return err
+	}
+	defer peer.CloseConn()
+
+	// Tell the peer what we already have, so that it only sends what we're missing
+	var parents []types.ID
+	leaves, err := h.controller.Leaves(stateURI)
+	if err != nil && !errors.Is(err, ErrNoController) {
+		return err
+	}
+	for leafID := range leaves {
+		parents = append(parents, leafID)
+	}
+
+	err = peer.WriteMsg(Msg{Type: MsgType_FetchHistory, Payload: FetchHistoryMsg{StateURI: stateURI, Parents: parents, ToVersion: toVersion}})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := peer.ReadMsg()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if msg.Type != MsgType_Put {
+			return errors.Wrapf(ErrProtocol, "expected put message, got %v", msg.Type)
+		}
+		tx := msg.Payload.(Tx)
+		err = h.addReceivedTx(tx, peer)
+		if err != nil {
+			h.Errorf("rejecting tx %v: %v", tx.ID.Pretty(), err)
+		}
 	}
 }
 
@@ -160,14 +544,18 @@ func (h *host) onPrivateTxReceived(encryptedTx EncryptedTx, peer Peer) {
 	h.Infof(0, "private tx %v received", encryptedTx.TxID.Pretty())
 	h.markTxSeenByPeer(peer, encryptedTx.TxID)
 
+	if encryptedTx.Recipient != (types.Address{}) && encryptedTx.Recipient != h.Address() {
+		h.onMailboxMessageReceived(encryptedTx, peer)
+		return
+	}
+
 	bs, err := h.encryptingKeypair.OpenMessageFrom(EncryptingPublicKeyFromBytes(encryptedTx.SenderPublicKey), encryptedTx.EncryptedPayload)
 	if err != nil {
 		h.Errorf("error decrypting tx: %v", err)
 		return
 	}
 
-	var tx Tx
-	err = json.Unmarshal(bs, &tx)
+	tx, err := decodePrivateTx(bs)
 	if err != nil {
 		h.Errorf("error decoding tx: %v", err)
 		return
@@ -177,6 +565,13 @@ func (h *host) onPrivateTxReceived(encryptedTx EncryptedTx, peer Peer) {
 		h.Errorf("private tx id does not match")
 		return
 	}
+	tx = tx.TrimProvenance()
+
+	err = h.checkTrustPolicy(tx, peer)
+	if err != nil {
+		h.Errorf("rejecting private tx %v: %v", tx.ID.Pretty(), err)
+		return
+	}
 
 	if !h.controller.HaveTx(tx.URL, tx.ID) {
 		// Add to controller
@@ -186,7 +581,7 @@ func (h *host) onPrivateTxReceived(encryptedTx EncryptedTx, peer Peer) {
 		}
 
 		// Broadcast to subscribed peers
-		err = h.broadcastTx(context.TODO(), tx)
+		_, err = h.broadcastTx(context.TODO(), tx)
 		if err != nil {
 			h.Errorf("error rebroadcasting tx: %v", err)
 		}
@@ -201,6 +596,7 @@ func (h *host) onPrivateTxReceived(encryptedTx EncryptedTx, peer Peer) {
 func (h *host) onAckReceived(txID types.ID, peer Peer) {
 	h.Infof(0, "ack received for %v", txID.Hex())
 	h.markTxSeenByPeer(peer, txID)
+	h.onMailboxAckReceived(txID, peer)
 }
 
 func (h *host) markTxSeenByPeer(peer Peer, txID types.ID) {
@@ -215,6 +611,28 @@ func (h *host) markTxSeenByPeer(peer Peer, txID types.ID) {
 	}
 }
 
+const RECENTLY_BROADCAST_WINDOW = 30 * time.Second
+
+// markTxRecentlyBroadcast records that the tx is being broadcast, returning false if it
+// already was within the last RECENTLY_BROADCAST_WINDOW.
+func (h *host) markTxRecentlyBroadcast(txID types.ID) bool {
+	h.recentlyBroadcastTxsMu.Lock()
+	defer h.recentlyBroadcastTxsMu.Unlock()
+
+	now := time.Now()
+	for id, when := range h.recentlyBroadcastTxs {
+		if now.Sub(when) > RECENTLY_BROADCAST_WINDOW {
+			delete(h.recentlyBroadcastTxs, id)
+		}
+	}
+
+	if _, exists := h.recentlyBroadcastTxs[txID]; exists {
+		return false
+	}
+	h.recentlyBroadcastTxs[txID] = now
+	return true
+}
+
 func (h *host) txSeenByPeer(peer Peer, txID types.ID) bool {
 	if peer.Address() == (types.Address{}) {
 		return false
@@ -256,7 +674,49 @@ func (h *host) AddPeer(ctx context.Context, transportName string, reachableAt St
 	return nil
 }
 
-func (h *host) onFetchHistoryRequestReceived(stateURI string, parents []types.ID, toVersion types.ID, peer Peer) error {
+// onFetchHistoryRequestReceived sends the requesting peer the txs of the given stateURI
+// that touch keypath.  If toVersion is set, only toVersion and its ancestors are sent,
+// oldest first.  Either way, the given parents and their ancestors are skipped, since the
+// peer already has them.
+//
+// Otherwise, the txs in knownTxs are skipped too.  Since a Bloom filter can wrongly claim
+// to hold a tx, the current leaves are always sent: if the peer finds that it's missing
+// the parents of one, it backfills them like it would any other missing parents.
+func (h *host) onFetchHistoryRequestReceived(stateURI string, keypath tree.Keypath, parents []types.ID, knownTxs *TxBloomFilter, toVersion types.ID, peer Peer) error {
+	parentTxs, err := h.txsAndAncestors(stateURI, parents, nil)
+	if err != nil {
+		return err
+	}
+	known := make(map[types.ID]struct{}, len(parentTxs))
+	for _, tx := range parentTxs {
+		known[tx.ID] = struct{}{}
+	}
+
+	if toVersion != (types.ID{}) {
+		txs, err := h.txsAndAncestors(stateURI, []types.ID{toVersion}, known)
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			if !tx.TouchesKeypath(keypath) {
+				continue
+			}
+			err := peer.WriteMsg(Msg{Type: MsgType_Put, Payload: *tx})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var leaves map[types.ID]struct{}
+	if knownTxs != nil {
+		leaves, err = h.controller.Leaves(stateURI)
+		if err != nil {
+			return err
+		}
+	}
+
 	iter := h.controller.FetchTxs(stateURI)
 	defer iter.Cancel()
 
@@ -266,6 +726,10 @@ func (h *host) onFetchHistoryRequestReceived(stateURI string, parents []types.ID
 			return iter.Error()
 		} else if tx == nil {
 			return nil
+		} else if _, isKnown := known[tx.ID]; isKnown || !tx.TouchesKeypath(keypath) {
+			continue
+		} else if _, isLeaf := leaves[tx.ID]; !isLeaf && knownTxs.MayContain(tx.ID) {
+			continue
 		}
 
 		err := peer.WriteMsg(Msg{Type: MsgType_Put, Payload: *tx})
@@ -276,22 +740,116 @@ func (h *host) onFetchHistoryRequestReceived(stateURI string, parents []types.ID
 	return nil
 }
 
-func (h *host) Subscribe(ctx context.Context, stateURI string) (bool, []error) {
+// txsAndAncestors returns the given txs and all of their ancestors, with every tx after
+// its parents.  It doesn't descend past the txs in stopAt, and skips txs that this node
+// doesn't have.
+func (h *host) txsAndAncestors(stateURI string, txIDs []types.ID, stopAt map[types.ID]struct{}) ([]*Tx, error) {
+	type frame struct {
+		tx         *Tx
+		nextParent int
+	}
+	var (
+		txs     []*Tx
+		stack   []frame
+		visited = make(map[types.ID]struct{})
+	)
+	push := func(txID types.ID) error {
+		if _, seen := visited[txID]; seen {
+			return nil
+		} else if _, stop := stopAt[txID]; stop {
+			return nil
+		}
+		visited[txID] = struct{}{}
+
+		tx, err := h.controller.FetchTx(stateURI, txID)
+		if errors.Is(err, types.Err404) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		stack = append(stack, frame{tx: tx})
+		return nil
+	}
+
+	for _, txID := range txIDs {
+		err := push(txID)
+		if err != nil {
+			return nil, err
+		}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.nextParent < len(top.tx.Parents) {
+				parentID := top.tx.Parents[top.nextParent]
+				top.nextParent++
+				err := push(parentID)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			txs = append(txs, top.tx)
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return txs, nil
+}
+
+// Subscribe asks a provider of the given stateURI to send us its txs.  If keypath is
+// non-empty, the provider only sends the txs that touch it.  Note that those txs can have
+// parents that were filtered out, which will keep them in the mempool until the parents
+// arrive some other way.
+func (h *host) Subscribe(ctx context.Context, stateURI string, keypath tree.Keypath) (bool, []error) {
 	var anySucceeded bool
 	var errs []error
 	for _, transport := range h.transports {
-		err := h.subscribeWithTransport(ctx, transport, stateURI)
+		err := h.subscribeWithTransport(ctx, transport, stateURI, keypath)
 		if err != nil {
 			errs = append(errs, err)
 		} else {
 			anySucceeded = true
 		}
 	}
+
+	if anySucceeded && h.prefetchRefsOnSubscribe {
+		err := h.prefetchRefs(stateURI)
+		if err != nil {
+			h.Errorf("error prefetching refs for %v: %v", stateURI, err)
+		}
+	}
 	return anySucceeded, errs
 }
 
-func (h *host) subscribeWithTransport(ctx context.Context, transport Transport, stateURI string) error {
-	ctxFind, cancelFind := context.WithCancel(ctx)
+// prefetchRefs walks the current state of the given stateURI and queues every ref that it
+// links to for fetching, rather than waiting for the controller to notice that they're
+// missing.
+func (h *host) prefetchRefs(stateURI string) error {
+	state, err := h.controller.StateAtVersion(stateURI, nil)
+	if errors.Is(err, ErrNoController) {
+		// We don't hold any of the state yet, so there's nothing to prefetch
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	allRefs, err := refsInState(state)
+	if err != nil {
+		return err
+	}
+
+	var refs []types.Hash
+	for _, hash := range allRefs {
+		if !h.refStore.HaveObject(hash) {
+			refs = append(refs, hash)
+		}
+	}
+
+	h.onReceivedRefs(refs)
+	return nil
+}
+
+func (h *host) subscribeWithTransport(ctx context.Context, transport Transport, stateURI string, keypath tree.Keypath) error {
+	ctxFind, cancelFind := context.WithTimeout(ctx, h.findProviderTimeout)
 	defer cancelFind()
 	ch, err := transport.ForEachProviderOfStateURI(ctxFind, stateURI)
 	if err != nil {
@@ -299,45 +857,103 @@ func (h *host) subscribeWithTransport(ctx context.Context, transport Transport,
 	}
 
 	var peer Peer
+	var numProviders, numSelf int
 
 	// @@TODO: subscribe to more than one peer?
-	for p := range ch {
-		err := p.EnsureConnected(ctx)
-		if err != nil {
-			h.Errorf("error connecting to peer: %v", err)
-			continue
+FindLoop:
+	for {
+		select {
+		case <-ctxFind.Done():
+			// Don't rely on the transport to close the channel when the context is canceled
+			return errors.Wrapf(ErrNoPeersForURL, "provider discovery for %v over %v timed out (%v providers found)", stateURI, transport.Name(), numProviders)
+
+		case p, open := <-ch:
+			if !open {
+				break FindLoop
+			}
+			numProviders++
+
+			if h.isSelf(p) {
+				numSelf++
+				continue
+			}
+
+			err := p.EnsureConnected(ctxFind)
+			if err != nil {
+				h.Errorf("error connecting to peer: %v", err)
+				continue
+			}
+			peer = p
+			cancelFind()
+			break FindLoop
 		}
-		peer = p
-		cancelFind()
-		break
 	}
 
-	if peer == nil {
-		return errors.WithStack(ErrNoPeersForURL)
+	if peer == nil && numProviders > 0 && numSelf == numProviders {
+		return errors.Wrapf(ErrPeerIsSelf, "the only provider of %v over %v is ourselves", stateURI, transport.Name())
+	} else if peer == nil {
+		return errors.Wrapf(ErrNoPeersForURL, "no reachable providers of %v over %v (%v providers found)", stateURI, transport.Name(), numProviders)
 	}
+	h.Infof(0, "subscribing to %v over %v (%v providers found)", stateURI, transport.Name(), numProviders)
 
-	err = peer.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: stateURI})
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	return h.subscribeToPeer(peer, stateURI, keypath)
+}
 
-	if _, exists := h.subscriptionsOut[stateURI]; !exists {
-		h.subscriptionsOut[stateURI] = make(map[peerTuple]*subscriptionOut)
+func (h *host) subscribeToPeer(peer Peer, stateURI string, keypath tree.Keypath) error {
+	if h.isSelf(peer) {
+		return errors.WithStack(ErrPeerIsSelf)
 	}
-	tuples := peerTuples(peer)
-	for _, tuple := range tuples {
+
+	subMsg := SubscribeMsg{StateURI: stateURI, Keypath: string(keypath)}
+	if h.bloomHistorySync {
+		knownTxs, err := h.knownTxsFilter(stateURI)
+		if err != nil {
+			return err
+		}
+		subMsg.KnownTxs = knownTxs
+	}
+
+	err := peer.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: subMsg})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	h.subscriptionsOutMu.Lock()
+	defer h.subscriptionsOutMu.Unlock()
+
+	if _, exists := h.subscriptionsOut[stateURI]; !exists {
+		h.subscriptionsOut[stateURI] = make(map[peerTuple]*subscriptionOut)
+	}
+	tuples := peerTuples(peer)
+	for _, tuple := range tuples {
 		if _, exists := h.subscriptionsOut[stateURI][tuple]; exists {
 			return nil
 		}
 	}
 
-	sub := &subscriptionOut{peer, make(chan struct{})}
+	sub := &subscriptionOut{peer, keypath, time.Now(), make(chan struct{})}
 	for _, tuple := range tuples {
 		h.subscriptionsOut[stateURI][tuple] = sub
 	}
 
 	go func() {
-		defer peer.CloseConn()
+		// Once the subscription is over (or if the peer never accepted it), forget it, so
+		// that it isn't reported or counted as live, and so that we can subscribe again
+		defer func() {
+			peer.CloseConn()
+
+			h.subscriptionsOutMu.Lock()
+			defer h.subscriptionsOutMu.Unlock()
+			for _, tuple := range tuples {
+				if h.subscriptionsOut[stateURI][tuple] == sub {
+					delete(h.subscriptionsOut[stateURI], tuple)
+				}
+			}
+			if len(h.subscriptionsOut[stateURI]) == 0 {
+				delete(h.subscriptionsOut, stateURI)
+			}
+		}()
+
 		for {
 			select {
 			case <-sub.chDone:
@@ -351,11 +967,16 @@ func (h *host) subscribeWithTransport(ctx context.Context, transport Transport,
 				return
 			}
 
-			if msg.Type != MsgType_Put {
-				panic("protocol error")
+			if msg.Type == MsgType_Error {
+				h.Errorf("subscription to %v rejected by peer: %v", stateURI, msg.Payload)
+				return
 			}
 
-			tx := msg.Payload.(Tx)
+			tx, is := msg.Payload.(Tx)
+			if msg.Type != MsgType_Put || !is {
+				h.Errorf("closing subscription to %v: %v", stateURI, errors.Wrapf(ErrProtocol, "unexpected message type %v", msg.Type))
+				return
+			}
 			h.onTxReceived(tx, peer)
 
 			// @@TODO: ACK the PUT
@@ -365,66 +986,231 @@ func (h *host) subscribeWithTransport(ctx context.Context, transport Transport,
 	return nil
 }
 
+// knownTxsFilter returns a Bloom filter of the txs that we have for the given stateURI,
+// or nil if we don't have any.
+func (h *host) knownTxsFilter(stateURI string) (*TxBloomFilter, error) {
+	iter := h.controller.FetchTxs(stateURI)
+	defer iter.Cancel()
+
+	var txIDs []types.ID
+	for {
+		tx := iter.Next()
+		if iter.Error() != nil {
+			return nil, iter.Error()
+		} else if tx == nil {
+			break
+		}
+		txIDs = append(txIDs, tx.ID)
+	}
+	if len(txIDs) == 0 {
+		return nil, nil
+	}
+
+	filter := NewTxBloomFilter(len(txIDs))
+	for _, txID := range txIDs {
+		filter.Add(txID)
+	}
+	return filter, nil
+}
+
+// requestPeerCredentials runs the initiator's side of the verify address handshake (see
+// VerifyAddressResponse), which leaves both us and the peer with each other's verified
+// credentials.
 func (h *host) requestPeerCredentials(ctx context.Context, peer Peer, transport Transport) (SigningPublicKey, EncryptingPublicKey, error) {
 	err := peer.EnsureConnected(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer peer.CloseConn()
 
 	challengeMsg, err := types.GenerateChallengeMsg()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddress, Payload: types.ChallengeMsg(challengeMsg)})
+	err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddress, Payload: challengeMsg})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	msg, err := peer.ReadMsg()
+	resp, err := readVerifyAddressResponse(peer)
 	if err != nil {
 		return nil, nil, err
-	} else if msg.Type != MsgType_VerifyAddressResponse {
-		return nil, nil, errors.WithStack(ErrProtocol)
 	}
 
-	resp, ok := msg.Payload.(VerifyAddressResponse)
-	if !ok {
-		return nil, nil, errors.WithStack(ErrProtocol)
+	sigpubkey, err := verifyChallengeResponse(challengeMsg, resp, peer, time.Now(), h.signingKeypair.AddressDerivation())
+	if err != nil {
+		return nil, nil, err
+	} else if len(resp.CounterChallenge) == 0 {
+		return nil, nil, errors.Wrapf(ErrProtocol, "peer didn't send a counter-challenge")
+	} else if resp.CounterChallenge.IsExpired(time.Now()) {
+		return nil, nil, errors.Wrapf(ErrChallengeExpired, "peer sent an expired counter-challenge")
 	}
 
-	sigpubkey, err := RecoverSigningPubkey(types.HashBytes(challengeMsg), resp.Signature)
+	err = peer.SetAddress(sigpubkey.Address())
 	if err != nil {
 		return nil, nil, err
 	}
 
-	encpubkey := EncryptingPublicKeyFromBytes(resp.EncryptingPublicKey)
+	// Now that we know who we're talking to, prove who we are
+	encpubkeyBytes := h.encryptingKeypair.EncryptingPublicKey.Bytes()
+	sig, err := h.answerChallenge(resp.CounterChallenge, encpubkeyBytes, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddressResponse, Payload: VerifyAddressResponse{
+		Signature:           sig,
+		EncryptingPublicKey: encpubkeyBytes,
+		Challenge:           resp.CounterChallenge,
+	}})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	peer.SetAddress(sigpubkey.Address())
+	// The peer signs our challenge again along with its encrypting key, which shows that
+	// the key is its own
+	resp, err = readVerifyAddressResponse(peer)
+	if err != nil {
+		return nil, nil, err
+	} else if len(resp.EncryptingPublicKey) == 0 {
+		return nil, nil, errors.Wrapf(ErrProtocol, "peer didn't send its encrypting key")
+	}
+	keyOwner, err := verifyChallengeResponse(challengeMsg, resp, peer, time.Now(), h.signingKeypair.AddressDerivation())
+	if err != nil {
+		return nil, nil, err
+	} else if keyOwner.Address() != sigpubkey.Address() {
+		return nil, nil, errors.Wrapf(ErrUnauthenticatedPeer, "encrypting key wasn't signed by %v", sigpubkey.Address().Hex())
+	}
+	encpubkey := EncryptingPublicKeyFromBytes(resp.EncryptingPublicKey)
 
 	h.peerStore.AddVerifiedCredentials(transport.Name(), peer.ReachableAt(), peer.Address(), sigpubkey, encpubkey)
+	h.onPeerVerified(peer.Address())
 
 	return sigpubkey, encpubkey, nil
 }
 
+// readVerifyAddressResponse reads the next message of the verify address handshake.  An
+// error message from the peer means that it refused to go on with it.
+func readVerifyAddressResponse(peer Peer) (VerifyAddressResponse, error) {
+	msg, err := peer.ReadMsg()
+	if err != nil {
+		return VerifyAddressResponse{}, err
+	} else if msg.Type == MsgType_Error {
+		return VerifyAddressResponse{}, errors.Wrapf(ErrUnauthenticatedPeer, "refused by peer: %v", msg.Payload)
+	} else if msg.Type != MsgType_VerifyAddressResponse {
+		return VerifyAddressResponse{}, errors.WithStack(ErrProtocol)
+	}
+
+	resp, ok := msg.Payload.(VerifyAddressResponse)
+	if !ok {
+		return VerifyAddressResponse{}, errors.WithStack(ErrProtocol)
+	}
+	return resp, nil
+}
+
+// onVerifyAddressReceived runs the responder's side of the verify address handshake (see
+// VerifyAddressResponse).  We only share our encrypting key once the initiator has proven
+// that it holds its own address.
 func (h *host) onVerifyAddressReceived(challengeMsg types.ChallengeMsg, peer Peer) error {
 	defer peer.CloseConn()
 
-	sig, err := h.signingKeypair.SignHash(types.HashBytes(challengeMsg))
+	sig, err := h.answerChallenge(challengeMsg, nil, peer)
+	if err != nil {
+		return err
+	}
+	counterChallengeMsg, err := types.GenerateChallengeMsg()
+	if err != nil {
+		return err
+	}
+	err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddressResponse, Payload: VerifyAddressResponse{
+		Signature:        sig,
+		Challenge:        challengeMsg,
+		CounterChallenge: counterChallengeMsg,
+	}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := readVerifyAddressResponse(peer)
+	if err != nil {
+		return err
+	}
+
+	sigpubkey, err := verifyChallengeResponse(counterChallengeMsg, resp, peer, time.Now(), h.signingKeypair.AddressDerivation())
+	if err == nil {
+		err = peer.SetAddress(sigpubkey.Address())
+	}
+	if err != nil {
+		err = errors.Wrap(ErrUnauthenticatedPeer, err.Error())
+		peer.WriteMsg(Msg{Type: MsgType_Error, Payload: err.Error()})
+		return err
+	}
+	encpubkey := EncryptingPublicKeyFromBytes(resp.EncryptingPublicKey)
+
+	h.peerStore.AddVerifiedCredentials(peer.Transport().Name(), peer.ReachableAt(), peer.Address(), sigpubkey, encpubkey)
+	h.onPeerVerified(peer.Address())
+
+	encpubkeyBytes := h.encryptingKeypair.EncryptingPublicKey.Bytes()
+	sig, err = h.answerChallenge(challengeMsg, encpubkeyBytes, peer)
 	if err != nil {
 		return err
 	}
 	return peer.WriteMsg(Msg{Type: MsgType_VerifyAddressResponse, Payload: VerifyAddressResponse{
 		Signature:           sig,
-		EncryptingPublicKey: h.encryptingKeypair.EncryptingPublicKey.Bytes(),
+		EncryptingPublicKey: encpubkeyBytes,
+		Challenge:           challengeMsg,
 	}})
 }
 
+const verifyAddressDomain = "verify address"
+
+// verifyAddressMessage is what each side of the verify address handshake signs to answer
+// the other's challenge.  Besides the challenge, it covers the signer's encrypting key
+// (once the signer is ready to share it) and the connection that the answer is given over
+// (see channelBindingTransport), so that a node in the middle can't pass off another
+// node's answers as its own.
+func verifyAddressMessage(challengeMsg types.ChallengeMsg, encpubkey []byte, channelBinding []byte) []byte {
+	var buf bytes.Buffer
+	for _, part := range [][]byte{challengeMsg, encpubkey, channelBinding} {
+		var partLen [binary.MaxVarintLen64]byte
+		buf.Write(partLen[:binary.PutUvarint(partLen[:], uint64(len(part)))])
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
+
+// answerChallenge signs a challenge that the peer sent us.
+func (h *host) answerChallenge(challengeMsg types.ChallengeMsg, encpubkey []byte, peer Peer) ([]byte, error) {
+	return h.signingKeypair.SignMessage(verifyAddressDomain, verifyAddressMessage(challengeMsg, encpubkey, peerChannelBinding(peer)))
+}
+
+// verifyChallengeResponse recovers the signing key that answered the given challenge (the
+// one that we sent and are waiting on an answer to) over the connection to the peer.  It
+// fails if the challenge expired before it was answered, or if the response says that it
+// was meant for some other challenge.  Older nodes don't say which challenge they're
+// answering, but since the key is recovered from the challenge that we sent, a response
+// that was meant for another challenge (as it would be if it were being replayed), given
+// over some other connection, or whose encrypting key was swapped out, won't recover the
+// signer's key.
+func verifyChallengeResponse(challengeMsg types.ChallengeMsg, resp VerifyAddressResponse, peer Peer, now time.Time, addressDerivation AddressDerivation) (SigningPublicKey, error) {
+	if len(resp.Challenge) > 0 && !bytes.Equal(resp.Challenge, challengeMsg) {
+		return nil, errors.WithStack(ErrChallengeMismatch)
+	} else if challengeMsg.IsExpired(now) {
+		return nil, errors.WithStack(ErrChallengeExpired)
+	}
+	msg := verifyAddressMessage(challengeMsg, resp.EncryptingPublicKey, ownChannelBinding(peer))
+	return RecoverSigningPubkey(HashMessage(verifyAddressDomain, msg), resp.Signature, addressDerivation)
+}
+
 type peersWithAddressResult struct {
 	Peer
 	EncryptingPublicKey
 }
 
+// peersWithAddress finds the peers that can prove that they hold the given address.  Peers
+// that already have are sent first, followed by the ones that the transports turn up as
+// they pass a credential exchange.  Callers that only need one peer should cancel the
+// context once they have it, which stops any exchanges that haven't started yet.
 func (h *host) peersWithAddress(ctx context.Context, address types.Address) (<-chan peersWithAddressResult, error) {
 	if address == h.Address() {
 		return nil, errors.WithStack(ErrPeerIsSelf)
@@ -449,13 +1235,22 @@ func (h *host) peersWithAddress(ctx context.Context, address types.Address) (<-c
 					h.Errorf("error calling transport.GetPeer: %v", err)
 					continue
 				}
-				ch <- peersWithAddressResult{peer, storedPeer.encpubkey}
+				select {
+				case ch <- peersWithAddressResult{peer, storedPeer.encpubkey}:
+				case <-ctx.Done():
+					return
+				}
 				for _, tuple := range storedPeer.Tuples() {
 					alreadySent.Store(tuple, struct{}{})
 				}
 			}
 		}
 
+		// A popular address can be claimed by a great many peers, so the credential
+		// exchanges (over every transport, and for every address) are limited to a few at
+		// a time
+		verificationSlots := h.verificationSlots
+
 		var transportsWg sync.WaitGroup
 		for _, transport := range h.transports {
 
@@ -473,20 +1268,47 @@ func (h *host) peersWithAddress(ctx context.Context, address types.Address) (<-c
 				}
 
 				var peersWg sync.WaitGroup
+				defer peersWg.Wait()
 			PeerLoop:
-				for peer := range chPeers {
+				for {
+					var peer Peer
+					var open bool
+					select {
+					case peer, open = <-chPeers:
+						if !open {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+
 					for _, tuple := range peerTuples(peer) {
 						if _, sent := alreadySent.Load(tuple); sent {
 							continue PeerLoop
 						}
 					}
 
+					if verificationSlots != nil {
+						select {
+						case verificationSlots <- struct{}{}:
+						case <-ctx.Done():
+							return
+						}
+						// The wait for a slot might have outlasted the caller's interest
+						if ctx.Err() != nil {
+							<-verificationSlots
+							return
+						}
+					}
+
 					peersWg.Add(1)
-					peer := peer
 					go func() {
 						defer peersWg.Done()
+						if verificationSlots != nil {
+							defer func() { <-verificationSlots }()
+						}
 
-						err = peer.EnsureConnected(context.TODO())
+						err := peer.EnsureConnected(ctx)
 						if err != nil {
 							h.Errorf("error ensuring peer is connected: %v", err)
 							return
@@ -505,10 +1327,12 @@ func (h *host) peersWithAddress(ctx context.Context, address types.Address) (<-c
 						for _, tuple := range peerTuples(peer) {
 							alreadySent.Store(tuple, struct{}{})
 						}
-						ch <- peersWithAddressResult{peer, encryptingPubkey}
+						select {
+						case ch <- peersWithAddressResult{peer, encryptingPubkey}:
+						case <-ctx.Done():
+						}
 					}()
 				}
-				peersWg.Wait()
 			}()
 		}
 
@@ -517,68 +1341,104 @@ func (h *host) peersWithAddress(ctx context.Context, address types.Address) (<-c
 	return ch, nil
 }
 
-func (h *host) broadcastPrivateTxToRecipient(ctx context.Context, txID types.ID, marshalledTx []byte, recipientAddr types.Address) error {
-	chPeers, err := h.peersWithAddress(ctx, recipientAddr)
+// writeToPeerWithAddress calls write with each of the peers with the given address in
+// turn, until one of the calls succeeds.  Once one does, it stops looking for more peers.
+// Success only means that the message was written to the peer, not that the peer has
+// acted on it.
+func (h *host) writeToPeerWithAddress(ctx context.Context, address types.Address, write func(p peersWithAddressResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chPeers, err := h.peersWithAddress(ctx, address)
 	if err != nil {
 		return err
 	}
 
-	var anySucceeded bool
-	var wg sync.WaitGroup
 	for p := range chPeers {
-		wg.Add(1)
-
-		p := p
-		go func() {
-			defer wg.Done()
-
-			err = p.Peer.EnsureConnected(context.TODO())
-			if err != nil {
-				return
-			}
-			defer p.Peer.CloseConn()
+		err := p.Peer.EnsureConnected(ctx)
+		if err != nil {
+			continue
+		}
+		err = write(p)
+		p.Peer.CloseConn()
+		if err != nil {
+			h.Errorf("error writing to peer with address %v: %v", address.Hex(), err)
+			continue
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrRecipientUnreachable, address.Hex())
+}
 
-			msgEncrypted, err := h.encryptingKeypair.SealMessageFor(p.EncryptingPublicKey, marshalledTx)
-			if err != nil {
-				return
-			}
+func (h *host) broadcastPrivateTxToRecipient(ctx context.Context, txID types.ID, marshalledTx []byte, recipientAddr types.Address) error {
+	return h.writeToPeerWithAddress(ctx, recipientAddr, func(p peersWithAddressResult) error {
+		msgEncrypted, err := h.encryptingKeypair.SealMessageFor(p.EncryptingPublicKey, marshalledTx)
+		if err != nil {
+			return err
+		}
+		// @@TODO: wait for ack?
+		return p.Peer.WriteMsg(Msg{
+			Type: MsgType_Private,
+			Payload: EncryptedTx{
+				TxID:             txID,
+				EncryptedPayload: msgEncrypted,
+				SenderPublicKey:  h.encryptingKeypair.EncryptingPublicKey.Bytes(),
+				Recipient:        recipientAddr,
+			},
+		})
+	})
+}
 
-			err = p.Peer.WriteMsg(Msg{
-				Type: MsgType_Private,
-				Payload: EncryptedTx{
-					TxID:             txID,
-					EncryptedPayload: msgEncrypted,
-					SenderPublicKey:  h.encryptingKeypair.EncryptingPublicKey.Bytes(),
-				},
-			})
-			if err != nil {
-				return
-			}
-			// @@TODO: wait for ack?
-			anySucceeded = true
-		}()
-	}
-	wg.Wait()
+// sendTxToRecipient sends an unencrypted private tx to one of the peers with the
+// recipient's address.
+func (h *host) sendTxToRecipient(ctx context.Context, tx Tx, recipientAddr types.Address) error {
+	return h.writeToPeerWithAddress(ctx, recipientAddr, func(p peersWithAddressResult) error {
+		return p.Peer.WriteMsg(Msg{Type: MsgType_Put, Payload: tx})
+	})
+}
 
-	if !anySucceeded {
-		return errors.Errorf("could not reach recipient %v", recipientAddr.Hex())
+// deliverPrivateTx sends a private tx to one of its recipients.  marshalledTx is the tx's
+// encoded payload, which is only needed if the tx is encrypted.
+func (h *host) deliverPrivateTx(ctx context.Context, tx Tx, marshalledTx []byte, recipientAddr types.Address) error {
+	if tx.Unencrypted {
+		return h.sendTxToRecipient(ctx, tx, recipientAddr)
 	}
-	return nil
+	return h.broadcastPrivateTxToRecipient(ctx, tx.ID, marshalledTx, recipientAddr)
 }
 
-func (h *host) broadcastTx(ctx context.Context, tx Tx) error {
+// broadcastTx sends the tx to its recipients if it's private, or to the subscribers to its
+// stateURI otherwise.  For a private tx, the returned map holds the outcome of writing it
+// to each recipient other than us.  If the tx was broadcast moments ago, it isn't sent
+// again, and the map is empty.
+func (h *host) broadcastTx(ctx context.Context, tx Tx) (map[types.Address]error, error) {
 	// @@TODO: should we also send all PUTs to some set of authoritative peers (like a central server)?
 
 	if len(tx.Sig) == 0 {
-		return errors.WithStack(ErrUnsignedTx)
+		return nil, errors.WithStack(ErrUnsignedTx)
+	}
+
+	// A tx can reach us from several peers at once in a densely connected network.  The
+	// per-peer seen set only stops us from echoing it back to whoever sent it, so we also
+	// avoid sending it out again if we just did.
+	if !h.markTxRecentlyBroadcast(tx.ID) {
+		h.Infof(0, "tx %v was broadcast recently, skipping", tx.ID.Pretty())
+		return map[types.Address]error{}, nil
 	}
 
+	tx = tx.AddRelayHop(h.Address(), time.Now())
+
 	if tx.IsPrivate() {
-		marshalledTx, err := json.Marshal(tx)
-		if err != nil {
-			return errors.WithStack(err)
+		var marshalledTx []byte
+		if !tx.Unencrypted {
+			var err error
+			marshalledTx, err = encodePrivateTx(tx)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
 		}
 
+		recipientErrs := make(map[types.Address]error)
+		var recipientErrsMu sync.Mutex
 		var wg sync.WaitGroup
 		for _, recipientAddr := range tx.Recipients {
 			if recipientAddr == h.Address() {
@@ -586,20 +1446,26 @@ func (h *host) broadcastTx(ctx context.Context, tx Tx) error {
 			}
 
 			wg.Add(1)
+			recipientAddr := recipientAddr
 			go func() {
 				defer wg.Done()
 
-				err := h.broadcastPrivateTxToRecipient(ctx, tx.ID, marshalledTx, recipientAddr)
+				err := h.deliverPrivateTx(ctx, tx, marshalledTx, recipientAddr)
 				if err != nil {
 					h.Errorf(err.Error())
 				}
+
+				recipientErrsMu.Lock()
+				defer recipientErrsMu.Unlock()
+				recipientErrs[recipientAddr] = err
 			}()
 		}
 		wg.Wait()
+		return recipientErrs, nil
 
 	} else {
-		// @@TODO: do we need to trim the tx's patches' keypaths so that they don't include
-		// the keypath that the subscription is listening to?
+		// Subscribers to a keypath only get the txs that touch it.  We don't trim the
+		// other patches out of those txs, since that would invalidate their signatures.
 
 		var wg sync.WaitGroup
 		for _, transport := range h.transports {
@@ -618,15 +1484,17 @@ func (h *host) broadcastTx(ctx context.Context, tx Tx) error {
 				}
 
 				var peerWg sync.WaitGroup
-				for peer := range ch {
-					if h.txSeenByPeer(peer, tx.ID) {
+				for sub := range ch {
+					peer := sub.Peer
+					if !tx.TouchesKeypath(sub.Keypath) || h.isSelf(peer) {
+						continue
+					} else if h.txSeenByPeer(peer, tx.ID) {
 						h.Errorf("tx already seen by peer %v %v", peer.Transport().Name(), peer.Address())
 						continue
 					}
 					h.Errorf("tx NOT already seen by peer %v %v", peer.Transport().Name(), peer.Address())
 
 					peerWg.Add(1)
-					peer := peer
 					go func() {
 						defer peerWg.Done()
 
@@ -648,30 +1516,180 @@ func (h *host) broadcastTx(ctx context.Context, tx Tx) error {
 		}
 		wg.Wait()
 	}
-	return nil
+	return nil, nil
+}
+
+// Txs returns the txs that this host has for the given stateURI, each after all of its
+// parents.
+func (h *host) Txs(stateURI string) TxIterator {
+	return h.controller.FetchTxs(stateURI)
+}
+
+// SendTx signs (if necessary), adds, and broadcasts the tx.  A tx without an ID is given
+// its ContentID.  For a private tx, the returned map holds the outcome of sending it to
+// each of its other recipients: a nil error means that the tx was written to one of the
+// recipient's peers, though not that the recipient has accepted it.  If the host has an
+// outbox, the recipients that couldn't be reached are retried from it, and if it knows of
+// any mailbox relays, the tx is left with them as well.
+func (h *host) SendTx(ctx context.Context, tx Tx) (map[types.Address]error, error) {
+	return h.sendTx(ctx, tx, false)
+}
+
+// SendTxAndWait is like SendTx, but it only returns once the tx has been validated and
+// applied to the local state (or rejected, in which case it returns the validation error
+// and the tx is not broadcast).
+func (h *host) SendTxAndWait(ctx context.Context, tx Tx) error {
+	_, err := h.sendTx(ctx, tx, true)
+	return err
 }
 
-func (h *host) SendTx(ctx context.Context, tx Tx) error {
+// SendTxBatch signs (if necessary) and adds every tx in the batch, and only returns once
+// each of them has been applied to the local state or rejected.  The txs may be given in
+// any order: those whose parents haven't landed yet wait in the mempool until they do.
+// Every tx that was applied is broadcast, even if others in the batch were rejected, so
+// that this node never holds txs that its peers don't.  The returned map holds the
+// outcome for each tx, and the error is the first failure in batch order (if any).
+func (h *host) SendTxBatch(ctx context.Context, txs []Tx) (map[types.ID]error, error) {
+	txs = append([]Tx(nil), txs...)
+	for i := range txs {
+		if len(txs[i].Sig) == 0 {
+			err := h.SignTx(&txs[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type txResult struct {
+		txID types.ID
+		err  error
+	}
+	chResults := make(chan txResult, len(txs))
+	for i := range txs {
+		h.Info(0, "adding tx ", txs[i].ID.Pretty())
+		tx := txs[i]
+		go func() {
+			err := h.controller.AddTxAndWait(ctx, &tx)
+			if err != nil {
+				err = errors.Wrapf(err, "tx %v", tx.ID.Pretty())
+			}
+			chResults <- txResult{tx.ID, err}
+		}()
+	}
+
+	// A tx whose parent was rejected will never leave the mempool, so once a tx fails, the
+	// txs in the batch that descend from it fail too rather than waiting for ctx to expire
+	children := make(map[types.ID][]types.ID)
+	for _, tx := range txs {
+		for _, parentID := range tx.Parents {
+			children[parentID] = append(children[parentID], tx.ID)
+		}
+	}
+	results := make(map[types.ID]error, len(txs))
+	var failDescendants func(txID types.ID)
+	failDescendants = func(txID types.ID) {
+		for _, childID := range children[txID] {
+			if _, done := results[childID]; done {
+				continue
+			}
+			results[childID] = errors.Errorf("tx %v: parent %v was rejected", childID.Pretty(), txID.Pretty())
+			failDescendants(childID)
+		}
+	}
+
+WaitLoop:
+	for len(results) < len(txs) {
+		select {
+		case result := <-chResults:
+			if _, done := results[result.txID]; done {
+				continue
+			}
+			results[result.txID] = result.err
+			if result.err != nil {
+				failDescendants(result.txID)
+			}
+		case <-ctx.Done():
+			for _, tx := range txs {
+				if _, done := results[tx.ID]; !done {
+					results[tx.ID] = errors.Wrapf(ctx.Err(), "tx %v", tx.ID.Pretty())
+				}
+			}
+			break WaitLoop
+		}
+	}
+
+	var firstErr error
+	for _, tx := range txs {
+		if err := results[tx.ID]; err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		recipientErrs, err := h.broadcastTx(h.Ctx(), tx)
+		if err != nil {
+			results[tx.ID] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		h.queueUndeliveredTx(tx, recipientErrs)
+		h.depositUndeliveredTx(tx, recipientErrs)
+	}
+	return results, firstErr
+}
+
+func (h *host) sendTx(ctx context.Context, tx Tx, wait bool) (map[types.Address]error, error) {
+	if tx.ID == (types.ID{}) {
+		tx.ID = tx.ContentID()
+	}
+
 	h.Info(0, "adding tx ", tx.ID.Pretty())
 
 	if len(tx.Sig) == 0 {
 		err := h.SignTx(&tx)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	err := h.controller.AddTx(&tx)
+	var err error
+	if wait {
+		err = h.controller.AddTxAndWait(ctx, &tx)
+	} else {
+		err = h.controller.AddTx(&tx)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = h.broadcastTx(h.Ctx(), tx)
+	recipientErrs, err := h.broadcastTx(h.Ctx(), tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	h.queueUndeliveredTx(tx, recipientErrs)
+	h.depositUndeliveredTx(tx, recipientErrs)
+	return recipientErrs, nil
+}
 
-	return nil
+// DryRunTx signs the tx (if necessary) and checks whether it would be accepted, without
+// adding it to the DAG or broadcasting it.  It returns an in-memory copy of the state that
+// the tx would result in, or the reason that it would be rejected.
+func (h *host) DryRunTx(ctx context.Context, tx Tx) (tree.Node, error) {
+	if tx.ID == (types.ID{}) {
+		tx.ID = tx.ContentID()
+	}
+	if len(tx.Sig) == 0 {
+		err := h.SignTx(&tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.controller.DryRunTx(&tx)
 }
 
 func (h *host) SignTx(tx *Tx) error {
@@ -680,10 +1698,100 @@ func (h *host) SignTx(tx *Tx) error {
 	return err
 }
 
-func (h *host) AddRef(reader io.ReadCloser, contentType string) (types.Hash, error) {
+// AddRef stores the contents of reader as a ref, and returns its hash and its size (for
+// setting the Content-Length of the frames that link to it).
+func (h *host) AddRef(reader io.ReadCloser, contentType string) (types.Hash, int64, error) {
 	return h.refStore.StoreObject(reader, contentType)
 }
 
+// SubscriptionsOut lists this host's subscriptions to other peers, ordered by stateURI
+// and then by when they were made.
+func (h *host) SubscriptionsOut() []SubscriptionInfo {
+	h.subscriptionsOutMu.RLock()
+	defer h.subscriptionsOutMu.RUnlock()
+
+	var infos []SubscriptionInfo
+	for stateURI, subs := range h.subscriptionsOut {
+		// A subscription is listed once for each of the places its peer is reachable at
+		seen := make(map[*subscriptionOut]struct{})
+		for _, sub := range subs {
+			if _, exists := seen[sub]; exists {
+				continue
+			}
+			seen[sub] = struct{}{}
+
+			infos = append(infos, SubscriptionInfo{
+				StateURI:    stateURI,
+				Keypath:     string(sub.keypath),
+				PeerAddress: sub.peer.Address(),
+				Transport:   sub.peer.Transport().Name(),
+				ReachableAt: sub.peer.ReachableAt().Slice(),
+				Since:       sub.since,
+			})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].StateURI != infos[j].StateURI {
+			return infos[i].StateURI < infos[j].StateURI
+		}
+		return infos[i].Since.Before(infos[j].Since)
+	})
+	return infos
+}
+
+// Peers lists the peers that this host knows about.
+func (h *host) Peers() []PeerInfo {
+	return h.peerStore.Peers()
+}
+
+func (h *host) debugInfo() DebugInfo {
+	return DebugInfo{
+		Address:       h.Address(),
+		Subscriptions: h.SubscriptionsOut(),
+		Peers:         h.Peers(),
+	}
+}
+
+// Refs lists the refs held by this host, along with their sizes and content types.  A
+// ref that was stored without a content type is listed with an empty one.
+func (h *host) Refs() ([]RefInfo, error) {
+	hashes, err := h.refStore.AllHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]RefInfo, 0, len(hashes))
+	for _, hash := range hashes {
+		objectReader, size, err := h.refStore.Object(hash)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed since we listed it
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		objectReader.Close()
+
+		contentType, err := h.refStore.ContentType(hash)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, RefInfo{Hash: hash, ContentType: contentType, Size: size})
+	}
+	return refs, nil
+}
+
+// RefStats returns the number of refs held by this host and their total size in bytes.
+func (h *host) RefStats() (count int, totalBytes int64, err error) {
+	refs, err := h.Refs()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, ref := range refs {
+		totalBytes += ref.Size
+	}
+	return len(refs), totalBytes, nil
+}
+
 func (h *host) fetchRefsLoop() {
 	tick := time.NewTicker(10 * time.Second) // @@TODO: make configurable
 	defer tick.Stop()
@@ -721,9 +1829,10 @@ func (h *host) onReceivedRefs(refs []types.Hash) {
 }
 
 func (h *host) fetchMissingRefs() {
-	var fetchedAny bool
+	// Set from the fetching goroutines below
+	var fetchedAny int32
 	defer func() {
-		if fetchedAny {
+		if atomic.LoadInt32(&fetchedAny) != 0 {
 			h.controller.OnDownloadedRef()
 		}
 	}()
@@ -740,11 +1849,17 @@ func (h *host) fetchMissingRefs() {
 		ref := ref
 		go func() {
 			defer wg.Done()
-			success := h.fetchRef(ref)
-			if success {
-				fetchedAny = true
-				succeeded.Store(ref, struct{}{})
+			err := h.fetchRef(ref)
+			if errors.Cause(err) == ErrRefNotFound {
+				// It's kept in missingRefs for when a provider turns up
+				h.Warnf("ref %v: %v", ref.String(), err)
+				return
+			} else if err != nil {
+				h.Errorf("error fetching ref %v: %v", ref.String(), err)
+				return
 			}
+			atomic.StoreInt32(&fetchedAny, 1)
+			succeeded.Store(ref, struct{}{})
 		}()
 	}
 	wg.Wait()
@@ -755,139 +1870,271 @@ func (h *host) fetchMissingRefs() {
 	})
 }
 
-func (h *host) fetchRef(ref types.Hash) bool {
+// fetchRef downloads a ref from every provider that can be found, in parallel, with
+// each one serving different ranges of it (see refSwarm).  Whatever has been received is
+// kept in the RefStore as a partial ref, so if every provider drops out, the next attempt
+// picks up from the end of the longest run of bytes received from the start.
+//
+// If no providers are found, it returns ErrRefNotFound when the search for them ran its
+// course, the context's error when it timed out (see FindProviderTimeout), and the
+// transports' errors when every one of them failed to search.
+func (h *host) fetchRef(ref types.Hash) error {
 	chPeers := make(chan Peer)
 	ctx, cancel := context.WithCancel(h.Ctx())
 	defer cancel()
 
+	// The search for providers is cut off after a while (if the host has a timeout), but
+	// the ones that have been found by then are given as long as they need
+	ctxFind, cancelFind := ctx, context.CancelFunc(func() {})
+	if h.findProviderTimeout > 0 {
+		ctxFind, cancelFind = context.WithTimeout(ctx, h.findProviderTimeout)
+	}
+	defer cancelFind()
+
+	var (
+		wg           sync.WaitGroup
+		searchErrs   []error
+		searchErrsMu sync.Mutex
+	)
 	for _, transport := range h.transports {
 		transport := transport
+		wg.Add(1)
 		go func() {
-			ch, err := transport.ForEachProviderOfRef(ctx, ref)
+			defer wg.Done()
+			ch, err := transport.ForEachProviderOfRef(ctxFind, ref)
 			if err != nil {
-				h.Errorf("error finding providers of ref %v from transport %v: %v", ref.String(), transport.Name(), err)
+				searchErrsMu.Lock()
+				searchErrs = append(searchErrs, errors.Wrapf(err, "finding providers over %v", transport.Name()))
+				searchErrsMu.Unlock()
 				return
 			}
 			for peer := range ch {
 				select {
 				case chPeers <- peer:
-				case <-ctx.Done():
+				case <-ctxFind.Done():
 					return
 				}
 			}
 		}()
 	}
+	// Give up once every transport has run out of providers
+	go func() {
+		wg.Wait()
+		close(chPeers)
+	}()
 
-	for peer := range chPeers {
-		err := peer.EnsureConnected(ctx)
-		if err != nil {
-			h.Errorf("error connecting to peer: %v", err)
-			continue
+	start, err := h.refStore.PartialObjectSize(ref)
+	if err != nil {
+		return err
+	}
+	partial, err := h.refStore.OpenPartialObject(ref)
+	if err != nil {
+		return err
+	}
+	defer partial.Close()
+
+	swarm := newRefSwarm(start, REF_PIECE_SIZE)
+	go func() {
+		<-ctx.Done()
+		swarm.abort()
+	}()
+
+	var workers sync.WaitGroup
+	var numProviders int
+PeerLoop:
+	for {
+		select {
+		case peer, open := <-chPeers:
+			if !open {
+				break PeerLoop
+			}
+			numProviders++
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				h.fetchRefRangesFromPeer(ctx, ref, peer, swarm, partial)
+			}()
+
+		case <-swarm.Done():
+			break PeerLoop
 		}
+	}
+	workers.Wait()
 
-		err = peer.WriteMsg(Msg{Type: MsgType_FetchRef, Payload: ref})
+	if !swarm.complete() {
+		// Ranges received past a gap are thrown away, so that the next attempt can pick
+		// up where the gap starts
+		err := partial.Truncate(swarm.receivedPrefix())
 		if err != nil {
-			h.Errorf("error writing to peer: %v", err)
-			continue
+			return err
 		}
 
-		var msg Msg
-		msg, err = peer.ReadMsg()
-		if err != nil {
-			h.Errorf("error reading from peer: %v", err)
-			continue
-		} else if msg.Type != MsgType_FetchRefResponse {
-			h.Errorf("protocol probs")
-			continue
+		searchErrsMu.Lock()
+		defer searchErrsMu.Unlock()
+		if numProviders > 0 {
+			return errors.Wrapf(ErrRefIncomplete, "%v bytes received", swarm.receivedPrefix())
+		} else if len(h.transports) > 0 && len(searchErrs) == len(h.transports) {
+			return searchErrs[0]
+		} else if ctxFind.Err() != nil {
+			return errors.Wrap(ctxFind.Err(), "searching for providers")
 		}
+		return errors.WithStack(ErrRefNotFound)
+	}
 
-		resp, is := msg.Payload.(FetchRefResponse)
-		if !is {
-			h.Errorf("protocol probs")
-			continue
-		} else if resp.Header == nil {
-			h.Errorf("protocol probs")
-			continue
+	err = partial.Close()
+	if err != nil {
+		return err
+	}
+	err = h.refStore.StorePartialObject(ref, swarm.refContentType())
+	if err != nil {
+		return err
+	}
+	h.Infof(0, "stored ref %v", ref)
+
+	// Every ref we fetch is referenced by a state we hold, so it's worth announcing,
+	// but we batch the announcements so that a large sync doesn't flood the network
+	h.refAnnouncer.Enqueue(ref)
+	return nil
+}
+
+// fetchRefRangesFromPeer fetches ranges of a ref from a single provider until there are
+// none left, or until the provider fails to deliver one.
+func (h *host) fetchRefRangesFromPeer(ctx context.Context, ref types.Hash, peer Peer, swarm *refSwarm, partial PartialObject) {
+	for {
+		rng, ok := swarm.next()
+		if !ok {
+			return
 		}
 
-		pr, pw := io.Pipe()
-		go func() {
-			var err error
-			defer func() { pw.CloseWithError(err) }()
+		n, err := h.fetchRefRange(ctx, ref, rng, peer, swarm, partial)
+		swarm.finish(rng, n)
+		if err != nil {
+			h.Errorf("error fetching ref %v (bytes %v-%v): %v", ref.String(), rng.Offset, rng.end(), err)
+			return
+		}
+	}
+}
 
-			for {
-				select {
-				case <-ctx.Done():
-					err = ctx.Err()
-					return
-				default:
-				}
+// fetchRefRange requests a single range of a ref from a provider and writes it into the
+// partial ref.  It returns the number of bytes received from the start of the range,
+// which may be fewer than were asked for if the provider drops out.
+func (h *host) fetchRefRange(ctx context.Context, ref types.Hash, rng refRange, peer Peer, swarm *refSwarm, partial PartialObject) (int64, error) {
+	err := peer.EnsureConnected(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "error connecting to peer")
+	}
+	defer peer.CloseConn()
 
-				var msg Msg
-				msg, err = peer.ReadMsg()
-				if err != nil {
-					return
-				} else if msg.Type != MsgType_FetchRefResponse {
-					err = errors.New("protocol probs")
-					return
-				}
+	err = peer.WriteMsg(Msg{Type: MsgType_FetchRef, Payload: FetchRefMsg{Ref: ref, Offset: rng.Offset, Length: rng.Length}})
+	if err != nil {
+		return 0, errors.Wrap(err, "error writing to peer")
+	}
 
-				resp, is := msg.Payload.(FetchRefResponse)
-				if !is {
-					err = errors.New("protocol probs")
-					return
-				} else if resp.Body == nil {
-					err = errors.New("protocol probs")
-					return
-				} else if resp.Body.End {
-					return
-				}
+	msg, err := peer.ReadMsg()
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading from peer")
+	}
+	resp, is := msg.Payload.(FetchRefResponse)
+	if msg.Type != MsgType_FetchRefResponse || !is || resp.Header == nil {
+		return 0, errors.Wrap(ErrProtocol, "expected fetch ref response header")
+	} else if resp.Header.Offset != rng.Offset {
+		return 0, errors.Wrapf(ErrProtocol, "asked for ref from offset %v, but provider is sending from %v", rng.Offset, resp.Header.Offset)
+	}
+	swarm.setHeader(*resp.Header)
 
-				var n int
-				n, err = pw.Write(resp.Body.Data)
-				if err != nil {
-					return
-				} else if n < len(resp.Body.Data) {
-					err = io.ErrUnexpectedEOF
-					return
-				}
-			}
-		}()
+	expected := rng.Length
+	if rng.end() > resp.Header.Size {
+		expected = resp.Header.Size - rng.Offset
+	}
+
+	var n int64
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		default:
+		}
 
-		hash, err := h.refStore.StoreObject(pr, "application/octet-stream")
+		msg, err := peer.ReadMsg()
 		if err != nil {
-			h.Errorf("protocol probs: %v", err)
-			continue
+			return n, errors.Wrap(err, "error reading from peer")
+		}
+		resp, is := msg.Payload.(FetchRefResponse)
+		if msg.Type != MsgType_FetchRefResponse || !is || resp.Body == nil {
+			return n, errors.Wrap(ErrProtocol, "expected fetch ref response body")
+		} else if resp.Body.End {
+			break
 		}
-		h.Infof(0, "stored ref %v", hash)
-		// @@TODO: check stored refHash against the one we requested
 
-		for _, transport := range h.transports {
-			err = transport.AnnounceRef(hash)
+		data := resp.Body.Data
+		if int64(len(data)) > expected-n {
+			data = data[:expected-n]
+		}
+		written, err := partial.WriteAt(data, rng.Offset+n)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if n < expected {
+		return n, errors.Wrapf(ErrProtocol, "provider sent %v bytes, expected %v", n, expected)
+	}
+	return n, nil
+}
+
+func (h *host) announceRefs(refHashes []types.Hash) {
+	for _, transport := range h.transports {
+		for _, refHash := range refHashes {
+			err := transport.AnnounceRef(refHash)
 			if err != nil {
-				h.Errorf("error announcing ref %v over transport %v: %v", hash.String(), transport.Name(), err)
+				h.Errorf("error announcing ref %v over transport %v: %v", refHash.String(), transport.Name(), err)
 				// this is a non-critical error, don't bail out
 			}
 		}
-		return true
 	}
-	return false
 }
 
 const (
-	REF_CHUNK_SIZE = 1024 // @@TODO: tunable buffer size?
+	REF_CHUNK_SIZE      = 1024 // @@TODO: tunable buffer size?
+	REF_PIECE_SIZE      = 64 * REF_CHUNK_SIZE
+	REF_ANNOUNCE_WINDOW = 2 * time.Second
 )
 
-func (h *host) onFetchRefReceived(refHash types.Hash, peer Peer) {
+func (h *host) onFetchRefReceived(refHash types.Hash, offset, length int64, peer Peer) {
 	defer peer.CloseConn()
 
-	objectReader, _, err := h.refStore.Object(refHash)
+	objectReader, size, err := h.refStore.Object(refHash)
 	// @@TODO: handle the case where we don't have the ref more gracefully
 	if err != nil {
 		panic(err)
 	}
+	defer objectReader.Close()
+
+	contentType, err := h.refStore.ContentType(refHash)
+	if err != nil {
+		h.Errorf("[ref server] %+v", err)
+		return
+	}
+
+	// If we can't start from the requested offset, we send the whole ref, and the header
+	// tells the fetcher to start over
+	if seeker, isSeeker := objectReader.(io.Seeker); !isSeeker || offset < 0 || offset > size {
+		offset = 0
+	} else if offset > 0 {
+		_, err = seeker.Seek(offset, io.SeekStart)
+		if err != nil {
+			h.Errorf("[ref server] %+v", errors.WithStack(err))
+			return
+		}
+	}
 
-	err = peer.WriteMsg(Msg{Type: MsgType_FetchRefResponse, Payload: FetchRefResponse{Header: &FetchRefResponseHeader{}}})
+	var reader io.Reader = objectReader
+	if length > 0 {
+		reader = io.LimitReader(objectReader, length)
+	}
+
+	err = peer.WriteMsg(Msg{Type: MsgType_FetchRefResponse, Payload: FetchRefResponse{Header: &FetchRefResponseHeader{Offset: offset, Size: size, ContentType: contentType}}})
 	if err != nil {
 		h.Errorf("[ref server] %+v", errors.WithStack(err))
 		return
@@ -895,7 +2142,7 @@ func (h *host) onFetchRefReceived(refHash types.Hash, peer Peer) {
 
 	buf := make([]byte, REF_CHUNK_SIZE)
 	for {
-		n, err := io.ReadFull(objectReader, buf)
+		n, err := io.ReadFull(reader, buf)
 		if err == io.EOF {
 			break
 		} else if err == io.ErrUnexpectedEOF {
@@ -918,3 +2165,120 @@ func (h *host) onFetchRefReceived(refHash types.Hash, peer Peer) {
 		return
 	}
 }
+
+// queueUndeliveredTx adds a private tx to the outbox for each of the recipients that it
+// couldn't be delivered to.
+func (h *host) queueUndeliveredTx(tx Tx, recipientErrs map[types.Address]error) {
+	if h.outbox == nil {
+		return
+	}
+
+	now := time.Now()
+	for recipientAddr, err := range recipientErrs {
+		if errors.Cause(err) != ErrRecipientUnreachable {
+			continue
+		}
+
+		err := h.outbox.PutEntry(newOutboxEntry(tx, recipientAddr, now, h.outbox.Options()))
+		if err != nil {
+			h.Errorf("error adding tx %v to outbox: %v", tx.ID.Pretty(), err)
+			continue
+		}
+		h.Infof(0, "queued tx %v for %v", tx.ID.Pretty(), recipientAddr.Hex())
+	}
+}
+
+func (h *host) retryOutboxLoop() {
+	tick := time.NewTicker(h.outbox.Options().MinRetryInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-h.Ctx().Done():
+			return
+		case <-h.outbox.Ctx().Done():
+			return
+		case <-tick.C:
+			h.retryOutbox()
+		}
+	}
+}
+
+// OUTBOX_RETRY_BATCH is the most outbox entries that are retried at once.  Any others that
+// are due wait for the next round.
+const OUTBOX_RETRY_BATCH = 1000
+
+// retryOutbox tries once more to deliver each of the outbox's entries that are due, and
+// drops the ones that have expired.  Each recipient's entries are tried in turn, and once
+// the recipient turns out to be unreachable, the rest of its entries are put off without
+// looking for it again.
+func (h *host) retryOutbox() {
+	options := h.outbox.Options()
+	now := time.Now()
+
+	entries, err := h.outbox.DueEntries(now, OUTBOX_RETRY_BATCH)
+	if err != nil {
+		h.Errorf("error reading outbox: %v", err)
+		return
+	}
+
+	entriesByRecipient := make(map[types.Address][]OutboxEntry)
+	for _, entry := range entries {
+		if entry.isExpired(now, options) {
+			h.Warnf("giving up on delivering tx %v to %v", entry.Tx.ID.Pretty(), entry.Recipient.Hex())
+			err := h.outbox.RemoveEntry(entry.Recipient, entry.Tx.ID)
+			if err != nil {
+				h.Errorf("error removing tx %v from outbox: %v", entry.Tx.ID.Pretty(), err)
+			}
+			continue
+		}
+		entriesByRecipient[entry.Recipient] = append(entriesByRecipient[entry.Recipient], entry)
+	}
+
+	var wg sync.WaitGroup
+	for _, entries := range entriesByRecipient {
+		wg.Add(1)
+		entries := entries
+		go func() {
+			defer wg.Done()
+
+			var unreachable bool
+			for _, entry := range entries {
+				var err error
+				if unreachable {
+					err = errors.WithStack(ErrRecipientUnreachable)
+				} else {
+					err = h.retryOutboxEntry(entry)
+					unreachable = errors.Cause(err) == ErrRecipientUnreachable
+				}
+
+				if err != nil {
+					entry.attemptFailed(time.Now(), options)
+					err = h.outbox.PutEntry(entry)
+				} else {
+					h.Infof(0, "wrote tx %v to %v", entry.Tx.ID.Pretty(), entry.Recipient.Hex())
+					err = h.outbox.RemoveEntry(entry.Recipient, entry.Tx.ID)
+				}
+				if err != nil {
+					h.Errorf("error updating outbox: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *host) retryOutboxEntry(entry OutboxEntry) error {
+	tx := entry.Tx.AddRelayHop(h.Address(), time.Now())
+
+	var marshalledTx []byte
+	if !tx.Unencrypted {
+		var err error
+		marshalledTx, err = encodePrivateTx(tx)
+		if err != nil {
+			h.Errorf("error encoding tx %v: %v", tx.ID.Pretty(), err)
+			return err
+		}
+	}
+	return h.deliverPrivateTx(h.Ctx(), tx, marshalledTx, entry.Recipient)
+}
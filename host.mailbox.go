@@ -0,0 +1,311 @@
+package redwood
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+// A host with a mailbox acts as a store-and-forward relay for private txs.  Senders
+// deposit the encrypted txs that they couldn't deliver with the relays they know of (see
+// depositUndeliveredTx), and the relay forwards them to their recipients once they come
+// online.  The relay only ever handles the EncryptedTx, so it can't read what it carries.
+
+var ErrNoEncryptingKey = errors.New("no encrypting key known for recipient")
+
+// onMailboxMessageReceived holds an encrypted tx that's addressed to someone else until it
+// can be forwarded to them.  Deposits are only taken from peers that have proven which
+// address they hold, and only if they've signed what they're depositing.
+func (h *host) onMailboxMessageReceived(encryptedTx EncryptedTx, peer Peer) {
+	if h.mailbox == nil {
+		h.Errorf("rejecting private tx %v for %v: not a mailbox relay", encryptedTx.TxID.Pretty(), encryptedTx.Recipient.Hex())
+		return
+	}
+
+	sender := peer.Address()
+	if sender == (types.Address{}) {
+		h.Errorf("rejecting private tx %v for %v: %v", encryptedTx.TxID.Pretty(), encryptedTx.Recipient.Hex(), ErrUnauthenticatedPeer)
+		return
+	}
+	err := encryptedTx.verifySender(sender, h.signingKeypair.AddressDerivation())
+	if err != nil {
+		h.Errorf("rejecting private tx %v for %v: %v", encryptedTx.TxID.Pretty(), encryptedTx.Recipient.Hex(), err)
+		return
+	}
+
+	err = h.mailbox.PutMessage(MailboxMessage{EncryptedTx: encryptedTx, Received: time.Now()})
+	if err != nil {
+		h.Errorf("error adding private tx %v to mailbox: %v", encryptedTx.TxID.Pretty(), err)
+		return
+	}
+	h.Infof(0, "holding private tx %v from %v for %v", encryptedTx.TxID.Pretty(), sender.Hex(), encryptedTx.Recipient.Hex())
+
+	err = peer.WriteMsg(Msg{Type: MsgType_Ack, Payload: encryptedTx.TxID})
+	if err != nil {
+		h.Errorf("error ACKing peer: %v", err)
+	}
+
+	// The recipient may be online already
+	go h.forwardMailboxTo(encryptedTx.Recipient)
+}
+
+// onMailboxAckReceived drops the messages with the given tx ID that we were holding for
+// the peer, now that it has them.
+func (h *host) onMailboxAckReceived(txID types.ID, peer Peer) {
+	recipient := peer.Address()
+	if h.mailbox == nil || recipient == (types.Address{}) {
+		return
+	}
+
+	msgs, err := h.mailbox.MessagesFor(recipient)
+	if err != nil {
+		h.Errorf("error reading mailbox: %v", err)
+		return
+	}
+	for _, msg := range msgs {
+		if msg.EncryptedTx.TxID != txID {
+			continue
+		}
+		err := h.mailbox.RemoveMessage(recipient, msg.EncryptedTx.Hash())
+		if err != nil {
+			h.Errorf("error removing private tx %v from mailbox: %v", txID.Pretty(), err)
+			continue
+		}
+		h.Infof(0, "%v received private tx %v, removed it from mailbox", recipient.Hex(), txID.Pretty())
+	}
+}
+
+// onPeerVerified is called whenever a peer proves that it holds an address.
+func (h *host) onPeerVerified(address types.Address) {
+	if h.mailbox != nil {
+		go h.forwardMailboxTo(address)
+	}
+}
+
+func (h *host) forwardMailboxLoop() {
+	tick := time.NewTicker(h.mailbox.Options().ForwardInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-h.Ctx().Done():
+			return
+		case <-h.mailbox.Ctx().Done():
+			return
+		case <-tick.C:
+			h.forwardMailbox()
+		}
+	}
+}
+
+// forwardMailbox drops the messages in the mailbox that have expired, and tries again to
+// forward the rest to their recipients.
+func (h *host) forwardMailbox() {
+	msgs, err := h.mailbox.Messages()
+	if err != nil {
+		h.Errorf("error reading mailbox: %v", err)
+		return
+	}
+
+	options := h.mailbox.Options()
+	now := time.Now()
+
+	recipients := make(map[types.Address]struct{})
+	for _, msg := range msgs {
+		if msg.isExpired(now, options) {
+			h.dropExpiredMailboxMessage(msg)
+			continue
+		}
+		recipients[msg.EncryptedTx.Recipient] = struct{}{}
+	}
+
+	var wg sync.WaitGroup
+	for recipient := range recipients {
+		wg.Add(1)
+		recipient := recipient
+		go func() {
+			defer wg.Done()
+			h.forwardMailboxTo(recipient)
+		}()
+	}
+	wg.Wait()
+}
+
+// forwardMailboxTo sends the messages in the mailbox for the given recipient to it, if it
+// can be reached.  They stay in the mailbox until the recipient ACKs them (see
+// onMailboxAckReceived).
+func (h *host) forwardMailboxTo(recipient types.Address) {
+	h.mailboxForwardingMu.Lock()
+	if _, exists := h.mailboxForwarding[recipient]; exists {
+		h.mailboxForwardingMu.Unlock()
+		return
+	}
+	h.mailboxForwarding[recipient] = struct{}{}
+	h.mailboxForwardingMu.Unlock()
+
+	defer func() {
+		h.mailboxForwardingMu.Lock()
+		defer h.mailboxForwardingMu.Unlock()
+		delete(h.mailboxForwarding, recipient)
+	}()
+
+	msgs, err := h.mailbox.MessagesFor(recipient)
+	if err != nil {
+		h.Errorf("error reading mailbox: %v", err)
+		return
+	}
+
+	options := h.mailbox.Options()
+	now := time.Now()
+
+	var pending []MailboxMessage
+	for _, msg := range msgs {
+		if msg.isExpired(now, options) {
+			h.dropExpiredMailboxMessage(msg)
+			continue
+		}
+		pending = append(pending, msg)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	chPeers, err := h.peersWithAddress(h.Ctx(), recipient)
+	if err != nil {
+		h.Errorf("error finding peers with address %v: %v", recipient.Hex(), err)
+		return
+	}
+
+	forwarded := make(map[types.Hash]bool)
+	for p := range chPeers {
+		err := p.Peer.EnsureConnected(context.TODO())
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range pending {
+			hash := msg.EncryptedTx.Hash()
+			if forwarded[hash] {
+				continue
+			}
+			err := p.Peer.WriteMsg(Msg{Type: MsgType_Private, Payload: msg.EncryptedTx})
+			if err != nil {
+				h.Errorf("error forwarding private tx %v: %v", msg.EncryptedTx.TxID.Pretty(), err)
+				break
+			}
+			forwarded[hash] = true
+			h.Infof(0, "forwarded private tx %v to %v", msg.EncryptedTx.TxID.Pretty(), recipient.Hex())
+		}
+		p.Peer.CloseConn()
+	}
+}
+
+func (h *host) dropExpiredMailboxMessage(msg MailboxMessage) {
+	h.Warnf("giving up on forwarding private tx %v to %v", msg.EncryptedTx.TxID.Pretty(), msg.EncryptedTx.Recipient.Hex())
+	err := h.mailbox.RemoveMessage(msg.EncryptedTx.Recipient, msg.EncryptedTx.Hash())
+	if err != nil {
+		h.Errorf("error removing private tx %v from mailbox: %v", msg.EncryptedTx.TxID.Pretty(), err)
+	}
+}
+
+// depositUndeliveredTx leaves an encrypted private tx with our mailbox relays for each of
+// the recipients that it couldn't be delivered to.  Unencrypted txs aren't deposited,
+// since the relays would be able to read them.
+func (h *host) depositUndeliveredTx(tx Tx, recipientErrs map[types.Address]error) {
+	if len(h.mailboxRelays) == 0 || tx.Unencrypted {
+		return
+	}
+
+	var marshalledTx []byte
+	for recipientAddr, deliveryErr := range recipientErrs {
+		if errors.Cause(deliveryErr) != ErrRecipientUnreachable {
+			continue
+		}
+
+		if marshalledTx == nil {
+			var err error
+			marshalledTx, err = encodePrivateTx(tx)
+			if err != nil {
+				h.Errorf("error encoding tx %v: %v", tx.ID.Pretty(), err)
+				return
+			}
+		}
+
+		err := h.depositWithMailboxRelays(h.Ctx(), tx.ID, marshalledTx, recipientAddr)
+		if err != nil {
+			h.Errorf("error depositing tx %v for %v: %v", tx.ID.Pretty(), recipientAddr.Hex(), err)
+			continue
+		}
+		h.Infof(0, "deposited tx %v for %v with mailbox relays", tx.ID.Pretty(), recipientAddr.Hex())
+	}
+}
+
+func (h *host) depositWithMailboxRelays(ctx context.Context, txID types.ID, marshalledTx []byte, recipientAddr types.Address) error {
+	// The recipient is offline, so we can only seal the tx for them if we've verified
+	// their credentials before
+	encpubkey := h.encryptingPublicKeyOf(recipientAddr)
+	if encpubkey == nil {
+		return errors.Wrapf(ErrNoEncryptingKey, recipientAddr.Hex())
+	}
+
+	msgEncrypted, err := h.encryptingKeypair.SealMessageFor(encpubkey, marshalledTx)
+	if err != nil {
+		return err
+	}
+	encryptedTx := EncryptedTx{
+		TxID:             txID,
+		EncryptedPayload: msgEncrypted,
+		SenderPublicKey:  h.encryptingKeypair.EncryptingPublicKey.Bytes(),
+		Recipient:        recipientAddr,
+	}
+	// The relays only take deposits that they can tell came from us
+	err = encryptedTx.sign(h.signingKeypair)
+	if err != nil {
+		return err
+	}
+	msg := Msg{Type: MsgType_Private, Payload: encryptedTx}
+
+	var anyAccepted bool
+	for _, relayAddr := range h.mailboxRelays {
+		chPeers, err := h.peersWithAddress(ctx, relayAddr)
+		if err != nil {
+			h.Errorf("error finding mailbox relay %v: %v", relayAddr.Hex(), err)
+			continue
+		}
+
+		for p := range chPeers {
+			err := p.Peer.EnsureConnected(context.TODO())
+			if err != nil {
+				continue
+			}
+
+			err = p.Peer.WriteMsg(msg)
+			p.Peer.CloseConn()
+			if err != nil {
+				h.Errorf("error depositing tx with mailbox relay %v: %v", relayAddr.Hex(), err)
+				continue
+			}
+			anyAccepted = true
+		}
+	}
+
+	if !anyAccepted {
+		return errors.Errorf("no mailbox relay could be reached")
+	}
+	return nil
+}
+
+// encryptingPublicKeyOf returns the encrypting key of a peer with the given address that
+// we've verified, or nil if there isn't one.
+func (h *host) encryptingPublicKeyOf(address types.Address) EncryptingPublicKey {
+	for _, storedPeer := range h.peerStore.PeersWithAddress(address) {
+		if storedPeer.encpubkey != nil {
+			return storedPeer.encpubkey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,3146 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// announceCountingTransport records the refs announced over the transport it wraps.
+type announceCountingTransport struct {
+	Transport
+
+	mu        sync.Mutex
+	announced []types.Hash
+}
+
+func (t *announceCountingTransport) AnnounceRef(refHash types.Hash) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.announced = append(t.announced, refHash)
+	return nil
+}
+
+func (t *announceCountingTransport) numAnnounced() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.announced)
+}
+
+// silentTransport never finds any providers, and never closes its provider channels
+// either.
+type silentTransport struct {
+	Transport
+}
+
+func (t *silentTransport) Name() string { return "silent" }
+
+func (t *silentTransport) ForEachProviderOfStateURI(ctx context.Context, stateURI string) (<-chan Peer, error) {
+	return make(chan Peer), nil
+}
+
+func newTestRefStore(t *testing.T) RefStore {
+	root, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return NewRefStore(root, "")
+}
+
+func TestHost_FetchRefAnnouncementsAreBatched(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptFetcher := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptFetcher.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostProvider := &host{Context: &ctx.Context{}, refStore: newTestRefStore(t)}
+	tptProvider.SetFetchRefHandler(hostProvider.onFetchRefReceived)
+
+	const numRefs = 3
+	var refHashes []types.Hash
+	for i := 0; i < numRefs; i++ {
+		blob := []byte{byte(i), 0xde, 0xad, 0xbe, 0xef}
+		refHash, _, err := hostProvider.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(blob)), "application/octet-stream")
+		require.NoError(t, err)
+		refHashes = append(refHashes, refHash)
+	}
+
+	require.Eventually(t, func() bool {
+		return tptProvider.dht.RoutingTable().Size() > 0 && tptFetcher.dht.RoutingTable().Size() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, refHash := range refHashes {
+		err := tptProvider.AnnounceRef(refHash)
+		require.NoError(t, err)
+	}
+
+	counter := &announceCountingTransport{Transport: tptFetcher}
+	hostFetcher := &host{
+		Context:    &ctx.Context{},
+		transports: map[string]Transport{"libp2p": counter},
+		refStore:   newTestRefStore(t),
+	}
+	hostFetcher.refAnnouncer = newRefAnnouncer(100*time.Millisecond, hostFetcher.announceRefs)
+	err = hostFetcher.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+
+	// Fetch each ref several times in quick succession
+	const fetchesPerRef = 5
+	for i := 0; i < fetchesPerRef; i++ {
+		for _, refHash := range refHashes {
+			err := hostFetcher.fetchRef(refHash)
+			require.NoError(t, err)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return counter.numAnnounced() == numRefs
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Give any straggling announcements a chance to show up
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, numRefs, counter.numAnnounced())
+	require.ElementsMatch(t, refHashes, counter.announced)
+}
+
+func TestHost_SubscribeTimesOutWhenNoProvidersAreFound(t *testing.T) {
+	h := &host{
+		Context:             &ctx.Context{},
+		transports:          map[string]Transport{"silent": &silentTransport{}},
+		subscriptionsOut:    make(map[string]map[peerTuple]*subscriptionOut),
+		findProviderTimeout: 100 * time.Millisecond,
+	}
+	err := h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+
+	chDone := make(chan struct{})
+	var anySucceeded bool
+	var errs []error
+	go func() {
+		defer close(chDone)
+		anySucceeded, errs = h.Subscribe(context.Background(), "localhost/foo", nil)
+	}()
+
+	select {
+	case <-chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe blocked")
+	}
+
+	require.False(t, anySucceeded)
+	require.Len(t, errs, 1)
+	require.Equal(t, ErrNoPeersForURL, errors.Cause(errs[0]))
+	require.Contains(t, errs[0].Error(), "timed out")
+	require.Contains(t, errs[0].Error(), "0 providers found")
+}
+
+func TestHost_Get(t *testing.T) {
+	m, refStore := newTestMetacontroller(t)
+	h := &host{Context: &ctx.Context{}, controller: m}
+
+	refHash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("ref contents"))), "text/plain")
+	require.NoError(t, err)
+
+	err = m.AddTx(signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: nil,
+			Val: map[string]interface{}{
+				"name":  "redwood",
+				"stats": map[string]interface{}{"stars": float64(3), "forks": float64(1)},
+				"tags":  []interface{}{"p2p", "crdt"},
+				"alias": map[string]interface{}{
+					"Content-Type": "link",
+					"value":        "state:localhost/test/stats",
+				},
+				"readme": map[string]interface{}{
+					"Content-Type": "link",
+					"value":        "ref:" + refHash.Hex(),
+				},
+			},
+		}},
+	}))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := h.Get(context.Background(), "localhost/test", tree.Keypath("name"), nil)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("value", func(t *testing.T) {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("name"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "redwood", val)
+
+		val, err = h.Get(context.Background(), "localhost/test", tree.Keypath("name"), &tree.Range{0, 3})
+		require.NoError(t, err)
+		require.Equal(t, "red", val)
+	})
+
+	t.Run("map", func(t *testing.T) {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("stats"), nil)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"stars": float64(3), "forks": float64(1)}, val)
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("tags"), nil)
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"p2p", "crdt"}, val)
+
+		val, err = h.Get(context.Background(), "localhost/test", tree.Keypath("tags"), &tree.Range{1, 2})
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"crdt"}, val)
+	})
+
+	t.Run("state link", func(t *testing.T) {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("alias"), nil)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"stars": float64(3), "forks": float64(1)}, val)
+	})
+
+	t.Run("ref link", func(t *testing.T) {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("readme"), nil)
+		require.NoError(t, err)
+
+		reader, is := val.(io.ReadCloser)
+		require.True(t, is)
+		defer reader.Close()
+		bs, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "ref contents", string(bs))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := h.Get(context.Background(), "localhost/test", tree.Keypath("nope"), nil)
+		require.Equal(t, types.Err404, errors.Cause(err))
+	})
+}
+
+func TestHost_SubscribeToKeypathOnlyReceivesMatchingTxs(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptSubscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSubscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostProvider := newTestHost(t, tptProvider)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The provider rejects subscriptions to stateURIs that it doesn't have yet
+	err = hostProvider.controller.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("users"), Val: map[string]interface{}{"alice": true}}},
+	}))
+	require.NoError(t, err)
+
+	received := subscribeRaw(t, tptProvider, tptSubscriber, "localhost/test", tree.Keypath("messages"))
+
+	usersTx := Tx{
+		ID:      types.RandomID(),
+		URL:     "localhost/test",
+		Sig:     types.Signature{0x1},
+		Patches: []Patch{{Keypath: tree.Keypath("users/bob"), Val: true}},
+	}
+	messagesTx := Tx{
+		ID:      types.RandomID(),
+		URL:     "localhost/test",
+		Sig:     types.Signature{0x1},
+		Patches: []Patch{{Keypath: tree.Keypath("messages/0"), Val: "hi"}},
+	}
+	_, err = hostProvider.broadcastTx(context.Background(), usersTx)
+	require.NoError(t, err)
+	_, err = hostProvider.broadcastTx(context.Background(), messagesTx)
+	require.NoError(t, err)
+
+	// Txs arrive in order over the same stream, so once the messages tx shows up, we know
+	// that neither the genesis tx nor the users tx was sent ahead of it
+	require.Eventually(t, func() bool { return len(received()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []types.ID{messagesTx.ID}, received())
+}
+
+func TestHost_RejectedSubscriptionIsForgotten(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptSubscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSubscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostProvider := newTestHost(t, tptProvider)
+	hostSubscriber := newTestHost(t, tptSubscriber)
+	providerID := tptProvider.libp2pHost.ID()
+
+	// The provider doesn't have the stateURI yet, so it rejects the subscription
+	peer := &libp2pPeer{t: tptSubscriber, pinfo: tptSubscriber.libp2pHost.Peerstore().PeerInfo(providerID)}
+	err = hostSubscriber.subscribeToPeer(peer, "localhost/test", nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(hostSubscriber.SubscriptionsOut()) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// Once it does, we can subscribe again
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = hostProvider.controller.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}))
+	require.NoError(t, err)
+
+	peer = &libp2pPeer{t: tptSubscriber, pinfo: tptSubscriber.libp2pHost.Peerstore().PeerInfo(providerID)}
+	err = hostSubscriber.subscribeToPeer(peer, "localhost/test", nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return hostSubscriber.controller.HaveTx("localhost/test", GenesisTxID) }, 5*time.Second, 100*time.Millisecond)
+	require.Len(t, hostSubscriber.SubscriptionsOut(), 1)
+}
+
+func TestHost_SubscriptionsToOnePeerShareAConnection(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptSubscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSubscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostProvider := newTestHost(t, tptProvider)
+	hostSubscriber := newTestHost(t, tptSubscriber)
+
+	stateURIs := []string{"localhost/one", "localhost/two", "localhost/three"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, stateURI := range stateURIs {
+		err := hostProvider.controller.AddTxAndWait(ctx, signTestTx(t, &Tx{
+			ID:      GenesisTxID,
+			URL:     stateURI,
+			Patches: []Patch{{Keypath: tree.Keypath("name"), Val: stateURI}},
+		}))
+		require.NoError(t, err)
+	}
+
+	providerID := tptProvider.libp2pHost.ID()
+	for _, stateURI := range stateURIs {
+		peer := &libp2pPeer{t: tptSubscriber, pinfo: tptSubscriber.libp2pHost.Peerstore().PeerInfo(providerID)}
+		err := hostSubscriber.subscribeToPeer(peer, stateURI, nil)
+		require.NoError(t, err)
+	}
+
+	for _, stateURI := range stateURIs {
+		stateURI := stateURI
+		require.Eventually(t, func() bool { return hostSubscriber.controller.HaveTx(stateURI, GenesisTxID) }, 5*time.Second, 100*time.Millisecond)
+	}
+
+	conns := tptSubscriber.libp2pHost.Network().ConnsToPeer(providerID)
+	require.Len(t, conns, 1)
+	require.GreaterOrEqual(t, len(conns[0].GetStreams()), len(stateURIs))
+}
+
+func TestHost_RelayedTxsRecordTheirProvenance(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	err := mn.LinkAll()
+	require.NoError(t, err)
+	err = mn.ConnectAllButSelf()
+	require.NoError(t, err)
+
+	// a -> b -> c
+	var hosts []*host
+	for _, tpt := range transports {
+		hosts = append(hosts, newTestHost(t, tpt))
+	}
+	a, b, c := hosts[0], hosts[1], hosts[2]
+
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, h := range hosts {
+		txCopy := *genesis
+		err := h.controller.AddTxAndWait(ctx, &txCopy)
+		require.NoError(t, err)
+	}
+
+	for i := 1; i < len(hosts); i++ {
+		pinfo := transports[i].libp2pHost.Peerstore().PeerInfo(transports[i-1].libp2pHost.ID())
+		err := hosts[i].subscribeToPeer(&libp2pPeer{t: transports[i], pinfo: pinfo}, "localhost/test", nil)
+		require.NoError(t, err)
+		tpt := transports[i-1]
+		require.Eventually(t, func() bool {
+			tpt.subscriptionsInMu.RLock()
+			defer tpt.subscriptionsInMu.RUnlock()
+			return len(tpt.subscriptionsIn["localhost/test"]) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	before := time.Now()
+	tx := *signTestTx(t, &Tx{
+		ID:      types.IDFromString("tx"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	_, err = a.SendTx(context.Background(), tx)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return c.controller.HaveTx("localhost/test", tx.ID) }, 5*time.Second, 10*time.Millisecond)
+
+	received, err := c.controller.FetchTx("localhost/test", tx.ID)
+	require.NoError(t, err)
+	require.Equal(t, tx.Hash(), received.Hash())
+	require.Len(t, received.Provenance, 2)
+	require.Equal(t, a.Address(), received.Provenance[0].Address)
+	require.Equal(t, b.Address(), received.Provenance[1].Address)
+	require.False(t, received.Provenance[0].At.Before(before))
+	require.False(t, received.Provenance[1].At.Before(received.Provenance[0].At))
+
+	// The origin doesn't record itself as a relay of its own tx
+	sent, err := a.controller.FetchTx("localhost/test", tx.ID)
+	require.NoError(t, err)
+	require.Empty(t, sent.Provenance)
+}
+
+func TestHost_ReceivedTxsProvenanceIsTrimmed(t *testing.T) {
+	h := newTestHost(t)
+	peer := newStubPeer(&silentTransport{}, types.Address{0xa}, "alice")
+	defer peer.close()
+
+	tx := *signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	for i := 0; i < 10*MaxProvenanceLen; i++ {
+		tx.Provenance = append(tx.Provenance, RelayHop{Address: types.Address{byte(i)}, At: time.Now()})
+	}
+	h.onTxReceived(tx, peer)
+
+	require.Eventually(t, func() bool { return h.controller.HaveTx("localhost/test", tx.ID) }, 5*time.Second, 10*time.Millisecond)
+	received, err := h.controller.FetchTx("localhost/test", tx.ID)
+	require.NoError(t, err)
+	require.Len(t, received.Provenance, MaxProvenanceLen)
+	for i, hop := range received.Provenance {
+		require.Equal(t, tx.Provenance[len(tx.Provenance)-MaxProvenanceLen+i].Address, hop.Address)
+	}
+}
+
+func TestHost_ReceivedTxIsNotRebroadcastTwice(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	tptProvider, tptSubscriber, tptSender := transports[0], transports[1], transports[2]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSubscriber.libp2pHost.ID())
+	require.NoError(t, err)
+	_, err = mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSender.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostProvider := newTestHost(t, tptProvider)
+
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = hostProvider.controller.AddTxAndWait(ctx, genesis)
+	require.NoError(t, err)
+
+	received := subscribeRaw(t, tptProvider, tptSubscriber, "localhost/test", nil)
+
+	sender := &libp2pPeer{t: tptProvider, pinfo: tptProvider.libp2pHost.Peerstore().PeerInfo(tptSender.libp2pHost.ID())}
+	tx := *signTestTx(t, &Tx{
+		ID:      types.IDFromString("tx"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	markerTx := Tx{
+		ID:      types.RandomID(),
+		URL:     "localhost/test",
+		Parents: []types.ID{GenesisTxID},
+		Sig:     types.Signature{0x1},
+	}
+
+	hostProvider.onTxReceived(tx, sender)
+	require.True(t, hostProvider.controller.HaveTx("localhost/test", tx.ID))
+	hostProvider.onTxReceived(tx, sender)
+	hostProvider.onTxReceived(markerTx, sender)
+
+	// Txs arrive in order over the same stream, so a second copy of the first tx would
+	// have shown up before the marker tx
+	require.Eventually(t, func() bool { return len(received()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []types.ID{GenesisTxID, tx.ID, markerTx.ID}, received())
+}
+
+func TestHost_RingOfSubscribersBroadcastsEachTxOnce(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	err := mn.LinkAll()
+	require.NoError(t, err)
+	err = mn.ConnectAllButSelf()
+	require.NoError(t, err)
+
+	// Each host subscribes to both of the others
+	var hosts []*host
+	var counters []*putCountingTransport
+	for _, tpt := range transports {
+		counter := &putCountingTransport{libp2pTransport: tpt, numPuts: make(map[types.ID]int)}
+		counters = append(counters, counter)
+		hosts = append(hosts, newTestHost(t, counter))
+	}
+
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, h := range hosts {
+		txCopy := *genesis
+		err := h.controller.AddTxAndWait(ctx, &txCopy)
+		require.NoError(t, err)
+	}
+
+	for i := range hosts {
+		for j := range hosts {
+			if i == j {
+				continue
+			}
+			pinfo := transports[i].libp2pHost.Peerstore().PeerInfo(transports[j].libp2pHost.ID())
+			err := hosts[i].subscribeToPeer(&libp2pPeer{t: transports[i], pinfo: pinfo}, "localhost/test", nil)
+			require.NoError(t, err)
+		}
+	}
+	for _, tpt := range transports {
+		tpt := tpt
+		require.Eventually(t, func() bool {
+			tpt.subscriptionsInMu.RLock()
+			defer tpt.subscriptionsInMu.RUnlock()
+			return len(tpt.subscriptionsIn["localhost/test"]) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	tx := *signTestTx(t, &Tx{
+		ID:      types.IDFromString("tx"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	_, err = hosts[0].SendTx(context.Background(), tx)
+	require.NoError(t, err)
+
+	// Reading the state can take longer than an Eventually tick, so we poll by hand
+	deadline := time.Now().Add(5 * time.Second)
+	for _, h := range hosts {
+		for {
+			val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+			if err == nil && val == "bar" {
+				break
+			}
+			require.True(t, time.Now().Before(deadline), "hosts never converged")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Give any echoes time to arrive before counting
+	time.Sleep(200 * time.Millisecond)
+
+	// Each host sends the tx at most once to each of its two subscribers
+	for _, counter := range counters {
+		require.LessOrEqual(t, counter.NumPuts(tx.ID), 2)
+	}
+	require.Equal(t, 2, counters[0].NumPuts(tx.ID))
+}
+
+func TestHost_MissingParentsAreBackfilledFromTheSender(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptSender, tptReceiver := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptSender.libp2pHost.ID(), tptReceiver.libp2pHost.ID())
+	require.NoError(t, err)
+
+	hostSender := newTestHost(t, tptSender)
+	hostReceiver := newTestHost(t, tptReceiver)
+
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}},
+	})
+	parent := signTestTx(t, &Tx{
+		ID:      types.IDFromString("parent"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "parent"}},
+	})
+	child := signTestTx(t, &Tx{
+		ID:      types.IDFromString("child"),
+		Parents: []types.ID{parent.ID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("bar"), Val: "child"}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tx := range []*Tx{genesis, parent, child} {
+		txCopy := *tx
+		err := hostSender.controller.AddTxAndWait(ctx, &txCopy)
+		require.NoError(t, err)
+	}
+	txCopy := *genesis
+	err = hostReceiver.controller.AddTxAndWait(ctx, &txCopy)
+	require.NoError(t, err)
+
+	// The child arrives before its parent
+	receiver := &libp2pPeer{t: tptSender, pinfo: tptSender.libp2pHost.Peerstore().PeerInfo(tptReceiver.libp2pHost.ID())}
+	err = receiver.WriteMsg(Msg{Type: MsgType_Put, Payload: *child})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		leaves, err := hostReceiver.controller.Leaves("localhost/test")
+		require.NoError(t, err)
+		_, haveChild := leaves[child.ID]
+		return len(leaves) == 1 && haveChild
+	}, 5*time.Second, 10*time.Millisecond)
+
+	val, err := hostReceiver.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "parent", val)
+	val, err = hostReceiver.Get(context.Background(), "localhost/test", tree.Keypath("bar"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "child", val)
+}
+
+// addBackfillTestTxs gives the sender a genesis tx, a parent, and a child, and gives the
+// receiver only the genesis tx.  It returns the child.
+func addBackfillTestTxs(t *testing.T, hostSender, hostReceiver *host) *Tx {
+	t.Helper()
+
+	genesis := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}},
+	})
+	parent := signTestTx(t, &Tx{
+		ID:      types.IDFromString("parent"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "parent"}},
+	})
+	child := signTestTx(t, &Tx{
+		ID:      types.IDFromString("child"),
+		Parents: []types.ID{parent.ID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("bar"), Val: "child"}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tx := range []*Tx{genesis, parent, child} {
+		txCopy := *tx
+		err := hostSender.controller.AddTxAndWait(ctx, &txCopy)
+		require.NoError(t, err)
+	}
+	txCopy := *genesis
+	err := hostReceiver.controller.AddTxAndWait(ctx, &txCopy)
+	require.NoError(t, err)
+	return child
+}
+
+func requireBackfilled(t *testing.T, hostReceiver *host, child *Tx) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		leaves, err := hostReceiver.controller.Leaves("localhost/test")
+		require.NoError(t, err)
+		_, haveChild := leaves[child.ID]
+		return len(leaves) == 1 && haveChild
+	}, 5*time.Second, 10*time.Millisecond)
+
+	val, err := hostReceiver.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+	require.NoError(t, err)
+	require.Equal(t, "parent", val)
+}
+
+func TestHost_MissingParentsAreBackfilledOverHTTP(t *testing.T) {
+	tptSender := newTestHTTPTransport(t, nil)
+	tptReceiver := newTestHTTPTransport(t, nil)
+	hostSender := newTestHost(t, tptSender)
+	hostReceiver := newTestHost(t, tptReceiver)
+
+	server := httptest.NewServer(tptSender)
+	defer server.Close()
+
+	child := addBackfillTestTxs(t, hostSender, hostReceiver)
+
+	// The child arrives (before its parent) from a peer that we can reach over HTTP
+	sender := &httpPeer{t: tptReceiver, reachableAt: server.URL}
+	hostReceiver.onTxReceived(*child, sender)
+	requireBackfilled(t, hostReceiver, child)
+}
+
+func TestHost_MissingParentsOfTxsFromUnreachablePeersAreFetchedFromProviders(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptReceiver := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptReceiver.libp2pHost.ID())
+	require.NoError(t, err)
+
+	tptReceiverHTTP := newTestHTTPTransport(t, nil)
+	hostProvider := newTestHost(t, tptProvider)
+	hostReceiver := newTestHost(t, tptReceiver, tptReceiverHTTP)
+	hostReceiver.findProviderTimeout = 5 * time.Second
+
+	child := addBackfillTestTxs(t, hostProvider, hostReceiver)
+
+	require.Eventually(t, func() bool {
+		return tptProvider.dht.RoutingTable().Size() > 0 && tptReceiver.dht.RoutingTable().Size() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	err = tptProvider.AnnounceStateURI("localhost/test")
+	require.NoError(t, err)
+
+	// An HTTP client PUTs the child to us, and HTTP clients can't be reached in turn
+	sender := &httpPeer{t: tptReceiverHTTP}
+	require.Empty(t, sender.ReachableAt())
+	hostReceiver.onTxReceived(*child, sender)
+	requireBackfilled(t, hostReceiver, child)
+}
+
+func TestHost_FetchHistoryHonorsParentsAndToVersion(t *testing.T) {
+	h := newTestHost(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// genesis <- a <- b <- c, and d off to the side
+	var prev types.ID
+	for _, id := range []string{"genesis", "a", "b", "c", "d"} {
+		tx := &Tx{ID: types.IDFromString(id), URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath(id), Val: id}}}
+		if id == "genesis" {
+			tx.ID = GenesisTxID
+		} else if id == "d" {
+			tx.Parents = []types.ID{GenesisTxID}
+		} else {
+			tx.Parents = []types.ID{prev}
+		}
+		prev = tx.ID
+		err := h.controller.AddTxAndWait(ctx, signTestTx(t, tx))
+		require.NoError(t, err)
+	}
+
+	fetch := func(parents []types.ID, toVersion types.ID) []types.ID {
+		peer := &recordingPeer{}
+		err := h.onFetchHistoryRequestReceived("localhost/test", nil, parents, nil, toVersion, peer)
+		require.NoError(t, err)
+		var txIDs []types.ID
+		for _, msg := range peer.msgs {
+			txIDs = append(txIDs, msg.Payload.(Tx).ID)
+		}
+		return txIDs
+	}
+
+	a, b, c, d := types.IDFromString("a"), types.IDFromString("b"), types.IDFromString("c"), types.IDFromString("d")
+	require.Equal(t, []types.ID{GenesisTxID, a, b, c}, fetch(nil, c))
+	require.Equal(t, []types.ID{b, c}, fetch([]types.ID{a, d}, c))
+	require.Empty(t, fetch([]types.ID{c}, b))
+	require.ElementsMatch(t, []types.ID{b, c, d}, fetch([]types.ID{a}, types.ID{}))
+}
+
+func TestHost_BloomHistorySyncSendsOnlyMissingTxs(t *testing.T) {
+	provider := newTestHost(t)
+	subscriber := newTestHost(t)
+	subscriber.bloomHistorySync = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The subscriber has all but the last few of the provider's txs
+	const numTxs, numMissing = 200, 5
+	var txs []*Tx
+	prev := GenesisTxID
+	for i := 0; i < numTxs; i++ {
+		tx := &Tx{ID: types.RandomID(), Parents: []types.ID{prev}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("messages"), Val: fmt.Sprintf("message %v", i)}}}
+		if i == 0 {
+			tx.ID, tx.Parents = GenesisTxID, nil
+		}
+		prev = tx.ID
+		txs = append(txs, signTestTx(t, tx))
+
+		err := provider.controller.AddTxAndWait(ctx, txs[i])
+		require.NoError(t, err)
+		if i < numTxs-numMissing {
+			err = subscriber.controller.AddTxAndWait(ctx, txs[i])
+			require.NoError(t, err)
+		}
+	}
+
+	knownTxs, err := subscriber.knownTxsFilter("localhost/test")
+	require.NoError(t, err)
+
+	fetch := func(knownTxs *TxBloomFilter) (txIDs []types.ID, numBytes int) {
+		peer := &recordingPeer{}
+		err := provider.onFetchHistoryRequestReceived("localhost/test", nil, nil, knownTxs, types.ID{}, peer)
+		require.NoError(t, err)
+		for _, msg := range peer.msgs {
+			bs, err := json.Marshal(msg)
+			require.NoError(t, err)
+			numBytes += len(bs)
+			txIDs = append(txIDs, msg.Payload.(Tx).ID)
+		}
+		return txIDs, numBytes
+	}
+
+	fullTxIDs, fullBytes := fetch(nil)
+	require.Len(t, fullTxIDs, numTxs)
+
+	// Every missing tx is sent, and hardly anything else is.  The exception is a missing tx
+	// that the filter happens to claim (a false positive), which the subscriber backfills
+	// once it sees the leaf, so the leaf is always sent.
+	bloomTxIDs, bloomBytes := fetch(knownTxs)
+	require.Contains(t, bloomTxIDs, txs[numTxs-1].ID)
+	for _, tx := range txs[numTxs-numMissing:] {
+		if !knownTxs.MayContain(tx.ID) {
+			require.Contains(t, bloomTxIDs, tx.ID)
+		}
+	}
+	require.Less(t, len(bloomTxIDs), 2*numMissing)
+
+	// Counting the filter that the subscriber sends, too
+	filterBytes, err := json.Marshal(SubscribeMsg{StateURI: "localhost/test", KnownTxs: knownTxs})
+	require.NoError(t, err)
+	bloomBytes += len(filterBytes)
+	require.Less(t, bloomBytes, fullBytes/5)
+
+	t.Run("the subscriber offers its filter when it subscribes", func(t *testing.T) {
+		stub := newStubPeer(&silentTransport{}, provider.Address(), "provider")
+		defer stub.close()
+		peer := &recordingPeer{Peer: stub}
+		err := subscriber.subscribeToPeer(peer, "localhost/test", nil)
+		require.NoError(t, err)
+		require.Len(t, peer.msgs, 1)
+
+		offered := peer.msgs[0].Payload.(SubscribeMsg).KnownTxs
+		require.NotNil(t, offered)
+		for _, tx := range txs[:numTxs-numMissing] {
+			require.True(t, offered.MayContain(tx.ID))
+		}
+	})
+}
+
+// recordingPeer records the messages written to it.
+type recordingPeer struct {
+	Peer
+	msgs []Msg
+}
+
+func (p *recordingPeer) WriteMsg(msg Msg) error {
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+// putCountingTransport counts the txs written to subscribers over the transport it wraps.
+type putCountingTransport struct {
+	*libp2pTransport
+	numPuts   map[types.ID]int
+	numPutsMu sync.Mutex
+}
+
+type putCountingPeer struct {
+	Peer
+	t *putCountingTransport
+}
+
+func (t *putCountingTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Subscriber, error) {
+	ch, err := t.libp2pTransport.ForEachSubscriberToStateURI(ctx, stateURI)
+	if err != nil {
+		return nil, err
+	}
+	chCounted := make(chan Subscriber)
+	go func() {
+		defer close(chCounted)
+		for sub := range ch {
+			sub.Peer = &putCountingPeer{Peer: sub.Peer, t: t}
+			chCounted <- sub
+		}
+	}()
+	return chCounted, nil
+}
+
+func (t *putCountingTransport) NumPuts(txID types.ID) int {
+	t.numPutsMu.Lock()
+	defer t.numPutsMu.Unlock()
+	return t.numPuts[txID]
+}
+
+func (p *putCountingPeer) WriteMsg(msg Msg) error {
+	if msg.Type == MsgType_Put {
+		p.t.numPutsMu.Lock()
+		p.t.numPuts[msg.Payload.(Tx).ID]++
+		p.t.numPutsMu.Unlock()
+	}
+	return p.Peer.WriteMsg(msg)
+}
+
+// newTestHost returns a host that holds state in its own metacontroller and serves it over
+// the given transports.
+func newTestHost(t *testing.T, transports ...Transport) *host {
+	t.Helper()
+
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	m, refStore := newTestMetacontroller(t)
+	h := &host{
+		Context:              &ctx.Context{},
+		signingKeypair:       signingKeypair,
+		controller:           m,
+		refStore:             refStore,
+		peerStore:            NewPeerStore(signingKeypair.Address()),
+		transports:           make(map[string]Transport),
+		subscriptionsOut:     make(map[string]map[peerTuple]*subscriptionOut),
+		peerSeenTxs:          make(map[peerTuple]map[types.ID]bool),
+		recentlyBroadcastTxs: make(map[types.ID]time.Time),
+		parentBackfills:      make(map[types.ID]struct{}),
+		mailboxForwarding:    make(map[types.Address]struct{}),
+	}
+	err = h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+	for _, tpt := range transports {
+		// Providers only serve subscriptions to the stateURIs that they hold
+		switch tpt := tpt.(type) {
+		case *libp2pTransport:
+			tpt.metacontroller = m
+		case *putCountingTransport:
+			tpt.metacontroller = m
+		case *httpTransport:
+			tpt.controller = m
+		}
+		h.transports[tpt.Name()] = tpt
+		tpt.SetFetchHistoryHandler(h.onFetchHistoryRequestReceived)
+		tpt.SetTxHandler(h.onTxReceived)
+	}
+	return h
+}
+
+// subscribeRaw subscribes to the given provider without going through a host, and returns
+// a function listing the IDs of the txs that have been received over the subscription.
+func subscribeRaw(t *testing.T, tptProvider, tptSubscriber *libp2pTransport, stateURI string, keypath tree.Keypath) func() []types.ID {
+	t.Helper()
+
+	pinfo := tptSubscriber.libp2pHost.Peerstore().PeerInfo(tptProvider.libp2pHost.ID())
+	peer := &libp2pPeer{t: tptSubscriber, pinfo: pinfo}
+	err := peer.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: SubscribeMsg{StateURI: stateURI, Keypath: string(keypath)}})
+	require.NoError(t, err)
+
+	// The provider sends txs back over the subscription stream
+	var mu sync.Mutex
+	var received []types.ID
+	chReaderDone := make(chan struct{})
+	go func() {
+		defer close(chReaderDone)
+		for {
+			msg, err := peer.ReadMsg()
+			if err != nil {
+				return
+			} else if msg.Type != MsgType_Put {
+				continue
+			}
+			mu.Lock()
+			received = append(received, msg.Payload.(Tx).ID)
+			mu.Unlock()
+		}
+	}()
+
+	// Resetting the stream unblocks the reader, which has to be finished with the peer
+	// before the peer's stream can be cleared
+	stream := peer.stream
+	t.Cleanup(func() {
+		stream.Reset()
+		<-chReaderDone
+		peer.CloseConn()
+	})
+
+	// Txs broadcast before the provider has registered the subscription would never reach us
+	require.Eventually(t, func() bool {
+		tptProvider.subscriptionsInMu.RLock()
+		defer tptProvider.subscriptionsInMu.RUnlock()
+		return len(tptProvider.subscriptionsIn[stateURI]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return func() []types.ID {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]types.ID(nil), received...)
+	}
+}
+
+func TestTx_TouchesKeypath(t *testing.T) {
+	tx := Tx{Patches: []Patch{{Keypath: tree.Keypath("messages/0/text")}}}
+	require.True(t, tx.TouchesKeypath(nil))
+	require.True(t, Tx{}.TouchesKeypath(nil))
+	require.False(t, Tx{}.TouchesKeypath(tree.Keypath("messages")))
+	require.True(t, tx.TouchesKeypath(tree.Keypath("messages")))
+	require.True(t, tx.TouchesKeypath(tree.Keypath("messages/0/text/foo")))
+	require.False(t, tx.TouchesKeypath(tree.Keypath("users")))
+	require.False(t, tx.TouchesKeypath(tree.Keypath("messages/1")))
+}
+
+func TestHost_SendTxAndWait(t *testing.T) {
+	h := newTestHost(t)
+
+	t.Run("accepted", func(t *testing.T) {
+		err := h.SendTxAndWait(context.Background(), *signTestTx(t, &Tx{
+			ID:      GenesisTxID,
+			URL:     "localhost/test",
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+		}))
+		require.NoError(t, err)
+
+		// The state has already been updated by the time SendTxAndWait returns
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "bar", val)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		tx := Tx{
+			ID:      types.RandomID(),
+			URL:     "localhost/test",
+			Parents: []types.ID{GenesisTxID},
+			Sig:     types.Signature{0x1},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+		}
+		err := h.SendTxAndWait(context.Background(), tx)
+		require.Equal(t, ErrInvalidSignature, errors.Cause(err))
+
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "bar", val)
+	})
+}
+
+func TestHost_DryRunTx(t *testing.T) {
+	h := newTestHost(t)
+
+	// Only the host itself may write to the state
+	err := h.SendTxAndWait(context.Background(), Tx{
+		ID:   GenesisTxID,
+		From: h.Address(),
+		URL:  "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("foo"), Val: "bar"},
+			{Keypath: ValidatorKeypath, Val: map[string]interface{}{
+				"Content-Type": "validator/permissions",
+				"value": map[string]interface{}{
+					h.Address().Hex(): map[string]interface{}{"^.*$": map[string]interface{}{"write": true}},
+				},
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	t.Run("a valid tx returns the state it would result in", func(t *testing.T) {
+		tx := Tx{
+			ID:      types.IDFromString("dry run"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{GenesisTxID},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+		}
+		state, err := h.DryRunTx(context.Background(), tx)
+		require.NoError(t, err)
+		val, _, err := state.Value(tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "baz", val)
+		require.Contains(t, state.Diff().Added, "foo")
+		state.Close()
+
+		// Nothing was kept
+		val, err = h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "bar", val)
+		require.False(t, h.controller.HaveTx("localhost/test", tx.ID))
+		leaves, err := h.controller.Leaves("localhost/test")
+		require.NoError(t, err)
+		require.Equal(t, map[types.ID]struct{}{GenesisTxID: {}}, leaves)
+
+		// So the tx can still be sent for real afterwards
+		err = h.SendTxAndWait(context.Background(), tx)
+		require.NoError(t, err)
+		val, err = h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "baz", val)
+	})
+
+	t.Run("a tx that isn't permitted returns the validator's error", func(t *testing.T) {
+		tx := *signTestTx(t, &Tx{
+			ID:      types.IDFromString("denied"),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("dry run")},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "quux"}},
+		})
+		_, err := h.DryRunTx(context.Background(), tx)
+		require.True(t, errors.Is(err, types.Err403))
+		require.False(t, h.controller.HaveTx("localhost/test", tx.ID))
+	})
+
+	t.Run("a tx that would pass through a resolver that can't dry run is refused", func(t *testing.T) {
+		RegisterResolver("resolver/test-upper", func(config tree.Node, internalState map[string]interface{}) (Resolver, error) {
+			return &upperResolver{}, nil
+		})
+		err := h.SendTxAndWait(context.Background(), Tx{
+			ID:      types.IDFromString("install resolver"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("dry run")},
+			Patches: []Patch{{
+				Keypath: tree.Keypath("sub"),
+				Val: map[string]interface{}{
+					"Merge-Type": map[string]interface{}{
+						"Content-Type": "resolver/test-upper",
+						"value":        map[string]interface{}{},
+					},
+				},
+			}},
+		})
+		require.NoError(t, err)
+
+		_, err = h.DryRunTx(context.Background(), Tx{
+			ID:      types.IDFromString("beneath resolver"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("install resolver")},
+			Patches: []Patch{{Keypath: tree.Keypath("sub/greeting"), Val: "hello"}},
+		})
+		require.True(t, errors.Is(err, ErrDryRunUnsupported))
+
+		// Txs that don't reach it are fine
+		state, err := h.DryRunTx(context.Background(), Tx{
+			ID:      types.IDFromString("beside resolver"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("install resolver")},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "quux"}},
+		})
+		require.NoError(t, err)
+		state.Close()
+	})
+
+	t.Run("a tx is ordered against the txs after its parents", func(t *testing.T) {
+		err := h.SendTxAndWait(context.Background(), Tx{
+			ID:      types.IDFromString("later"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("install resolver")},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "later"}},
+		})
+		require.NoError(t, err)
+
+		// A tx on an old parent loses to the later write
+		state, err := h.DryRunTx(context.Background(), Tx{
+			ID:      types.IDFromString("stale"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{GenesisTxID},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "stale"}},
+		})
+		require.NoError(t, err)
+		val, _, err := state.Value(tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "later", val)
+		require.NotContains(t, state.Diff().Added, "foo")
+
+		// A dry run isn't recorded as a write, so it can't win out over a real tx that comes
+		// before it in the total order
+		state, err = h.DryRunTx(context.Background(), Tx{
+			ID:      types.IDFromString("zzz"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("later")},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "zzz"}},
+		})
+		require.NoError(t, err)
+		val, _, err = state.Value(tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "zzz", val)
+
+		err = h.SendTxAndWait(context.Background(), Tx{
+			ID:      types.IDFromString("aaa"),
+			From:    h.Address(),
+			URL:     "localhost/test",
+			Parents: []types.ID{types.IDFromString("later")},
+			Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "aaa"}},
+		})
+		require.NoError(t, err)
+		val, err = h.Get(context.Background(), "localhost/test", tree.Keypath("foo"), nil)
+		require.NoError(t, err)
+		require.Equal(t, "aaa", val)
+	})
+}
+
+func TestHost_TxsAreInTopologicalOrder(t *testing.T) {
+	h := newTestHost(t)
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	h.signingKeypair = signingKeypair
+
+	// The IDs sort in the opposite order of the DAG, so the store's own order won't do:
+	//
+	//   genesis -> c1 -> b1 -> a1
+	//           \-> c2 -/
+	genesis := Tx{ID: GenesisTxID, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("n"), Val: float64(0)}}}
+	c1 := Tx{ID: types.IDFromString("c1"), Parents: []types.ID{genesis.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("c1"), Val: true}}}
+	c2 := Tx{ID: types.IDFromString("c2"), Parents: []types.ID{genesis.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("c2"), Val: true}}}
+	b1 := Tx{ID: types.IDFromString("b1"), Parents: []types.ID{c1.ID, c2.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("b1"), Val: true}}}
+	a1 := Tx{ID: types.IDFromString("a1"), Parents: []types.ID{b1.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("a1"), Val: true}}}
+
+	for _, tx := range []Tx{a1, b1, c2, c1, genesis} {
+		tx.From = signingKeypair.Address()
+		_, err := h.SendTx(context.Background(), tx)
+		require.NoError(t, err)
+	}
+
+	// Wait for the mempool to sort out the DAG
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		val, err := h.Get(context.Background(), "localhost/test", tree.Keypath("a1"), nil)
+		if err == nil && val == true {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "txs were never applied")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	iter := h.Txs("localhost/test")
+	defer iter.Cancel()
+
+	var ids []types.ID
+	for {
+		tx := iter.Next()
+		require.NoError(t, iter.Error())
+		if tx == nil {
+			break
+		}
+		ids = append(ids, tx.ID)
+	}
+	require.Equal(t, []types.ID{genesis.ID, c1.ID, c2.ID, b1.ID, a1.ID}, ids)
+}
+
+func TestHost_SendTxBatch(t *testing.T) {
+	h := newTestHost(t)
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	h.signingKeypair = signingKeypair
+
+	// The same shape as the chat demo: a genesis tx, a tx that sets up the talk0 channel,
+	// and three txs that each splice a message onto the end of it
+	genesis := Tx{ID: GenesisTxID, URL: "localhost/chat", Patches: []Patch{{Keypath: nil, Val: map[string]interface{}{"users": map[string]interface{}{}}}}}
+	tx1 := Tx{ID: types.IDFromString("tx1"), Parents: []types.ID{genesis.ID}, URL: "localhost/chat", Patches: []Patch{{
+		Keypath: tree.Keypath("talk0"),
+		Val:     map[string]interface{}{"messages": map[string]interface{}{"value": []interface{}{}}},
+	}}}
+	tx2 := Tx{ID: types.IDFromString("tx2"), Parents: []types.ID{tx1.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("talk0/messages/value"), Range: &tree.Range{0, 0}, Val: []interface{}{"hello"}}}}
+	tx3 := Tx{ID: types.IDFromString("tx3"), Parents: []types.ID{tx2.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("talk0/messages/value"), Range: &tree.Range{1, 1}, Val: []interface{}{"from"}}}}
+	tx4 := Tx{ID: types.IDFromString("tx4"), Parents: []types.ID{tx3.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("talk0/messages/value"), Range: &tree.Range{2, 2}, Val: []interface{}{"the batch"}}}}
+
+	batch := []Tx{tx4, tx2, genesis, tx3, tx1}
+	for i := range batch {
+		batch[i].From = signingKeypair.Address()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := h.SendTxBatch(ctx, batch)
+	require.NoError(t, err)
+	require.Len(t, results, len(batch))
+
+	val, err := h.Get(context.Background(), "localhost/chat", tree.Keypath("talk0/messages/value"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"hello", "from", "the batch"}, val)
+}
+
+func TestHost_SendTxBatchBroadcastsAppliedTxsWhenOthersAreRejected(t *testing.T) {
+	h := newTestHost(t)
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	h.signingKeypair = signingKeypair
+
+	genesis := Tx{ID: GenesisTxID, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "genesis"}}}
+	good := Tx{ID: types.IDFromString("good"), Parents: []types.ID{genesis.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("good"), Val: true}}}
+	// Already signed, but not by its sender
+	bad := Tx{ID: types.IDFromString("bad"), Parents: []types.ID{genesis.ID}, URL: "localhost/test", Sig: types.Signature{0x1}, Patches: []Patch{{Keypath: tree.Keypath("bad"), Val: true}}}
+	orphaned := Tx{ID: types.IDFromString("orphaned"), Parents: []types.ID{bad.ID}, URL: "localhost/test", Patches: []Patch{{Keypath: tree.Keypath("orphaned"), Val: true}}}
+
+	batch := []Tx{orphaned, bad, good, genesis}
+	for i := range batch {
+		batch[i].From = signingKeypair.Address()
+	}
+
+	// The orphaned tx can never be applied, but we shouldn't have to wait for ctx to find out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := h.SendTxBatch(ctx, batch)
+	require.Error(t, err)
+	require.NoError(t, ctx.Err())
+
+	require.NoError(t, results[genesis.ID])
+	require.NoError(t, results[good.ID])
+	require.Equal(t, ErrInvalidSignature, errors.Cause(results[bad.ID]))
+	require.Contains(t, results[orphaned.ID].Error(), "was rejected")
+
+	// The txs that were applied locally were broadcast as well
+	h.recentlyBroadcastTxsMu.Lock()
+	defer h.recentlyBroadcastTxsMu.Unlock()
+	require.Contains(t, h.recentlyBroadcastTxs, genesis.ID)
+	require.Contains(t, h.recentlyBroadcastTxs, good.ID)
+	require.NotContains(t, h.recentlyBroadcastTxs, bad.ID)
+	require.NotContains(t, h.recentlyBroadcastTxs, orphaned.ID)
+}
+
+func TestHost_ExportImportStateURI(t *testing.T) {
+	hostA := newTestHost(t)
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	hostA.signingKeypair = signingKeypair
+
+	refHash, _, err := hostA.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("avatar bytes"))), "image/png")
+	require.NoError(t, err)
+	var missingRefHash types.Hash
+	copy(missingRefHash[:], []byte("a ref that nobody has"))
+
+	genesis := Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/chat",
+		Patches: []Patch{{
+			Keypath: nil,
+			Val: map[string]interface{}{
+				"messages": []interface{}{},
+				"avatar":   map[string]interface{}{"Content-Type": "link", "value": "ref:" + refHash.Hex()},
+			},
+		}},
+	}
+	msg1 := Tx{ID: types.IDFromString("msg1"), Parents: []types.ID{genesis.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("messages"), Range: &tree.Range{0, 0}, Val: []interface{}{"hello"}}}}
+	msg2 := Tx{ID: types.IDFromString("msg2"), Parents: []types.ID{msg1.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("messages"), Range: &tree.Range{1, 1}, Val: []interface{}{"world"}}}}
+	// This ref is missing, so the export has to leave it out
+	msg3 := Tx{ID: types.IDFromString("msg3"), Parents: []types.ID{msg2.ID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("attachment"), Val: map[string]interface{}{"Content-Type": "link", "value": "ref:" + missingRefHash.Hex()}}}}
+
+	for _, tx := range []Tx{genesis, msg1, msg2, msg3} {
+		tx.From = signingKeypair.Address()
+		err := hostA.SendTxAndWait(context.Background(), tx)
+		require.NoError(t, err)
+	}
+
+	var archive bytes.Buffer
+	err = hostA.ExportStateURI("localhost/chat", &archive)
+	require.NoError(t, err)
+
+	hostB := newTestHost(t)
+	for i := 0; i < 2; i++ {
+		// Importing the same archive a second time is a no-op
+		stateURI, err := hostB.ImportStateURI(context.Background(), bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, "localhost/chat", stateURI)
+
+		for _, tx := range []Tx{genesis, msg1, msg2, msg3} {
+			require.True(t, hostB.controller.HaveTx("localhost/chat", tx.ID))
+		}
+		require.True(t, hostB.refStore.HaveObject(refHash))
+		require.False(t, hostB.refStore.HaveObject(missingRefHash))
+
+		expected, err := hostA.Get(context.Background(), "localhost/chat", tree.Keypath("messages"), nil)
+		require.NoError(t, err)
+		actual, err := hostB.Get(context.Background(), "localhost/chat", tree.Keypath("messages"), nil)
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"hello", "world"}, actual)
+		require.Equal(t, expected, actual)
+
+		avatar, err := hostB.Get(context.Background(), "localhost/chat", tree.Keypath("avatar"), nil)
+		require.NoError(t, err)
+		avatarBytes, err := ioutil.ReadAll(avatar.(io.ReadCloser))
+		require.NoError(t, err)
+		avatar.(io.ReadCloser).Close()
+		require.Equal(t, "avatar bytes", string(avatarBytes))
+	}
+
+	var emptyArchive bytes.Buffer
+	err = hostA.ExportStateURI("localhost/nonexistent", &emptyArchive)
+	require.Equal(t, ErrNoController, errors.Cause(err))
+}
+
+func TestHost_RefsAndRefStats(t *testing.T) {
+	store := newTestRefStore(t)
+	h := &host{Context: &ctx.Context{}, refStore: store}
+
+	expected := make(map[types.Hash]RefInfo)
+	for _, obj := range []struct {
+		content     string
+		contentType string
+	}{
+		{"<html></html>", "text/html"},
+		{"body { color: red; }", "text/css"},
+		{"console.log('hi')", "application/js"},
+	} {
+		hash, _, err := h.AddRef(ioutil.NopCloser(bytes.NewBufferString(obj.content)), obj.contentType)
+		require.NoError(t, err)
+		expected[hash] = RefInfo{Hash: hash, ContentType: obj.contentType, Size: int64(len(obj.content))}
+	}
+
+	// A ref file that never had any metadata recorded
+	orphan := types.HashBytes([]byte("orphan"))
+	err := ioutil.WriteFile(filepath.Join(store.(*refStore).rootPath, "ref-"+orphan.String()), []byte("orphan"), 0644)
+	require.NoError(t, err)
+	expected[orphan] = RefInfo{Hash: orphan, Size: int64(len("orphan"))}
+
+	refs, err := h.Refs()
+	require.NoError(t, err)
+	require.Len(t, refs, len(expected))
+	var totalBytes int64
+	for _, ref := range refs {
+		require.Equal(t, expected[ref.Hash], ref)
+		totalBytes += ref.Size
+	}
+
+	count, total, err := h.RefStats()
+	require.NoError(t, err)
+	require.Equal(t, len(expected), count)
+	require.Equal(t, totalBytes, total)
+}
+
+func TestHost_AddRefReturnsSize(t *testing.T) {
+	store := newTestRefStore(t)
+	h := &host{Context: &ctx.Context{}, refStore: store}
+
+	// Stream the ref in chunks so that its size isn't known up front
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+
+	hash, size, err := h.AddRef(pr, "application/octet-stream")
+	require.NoError(t, err)
+	require.Equal(t, int64(10*len(chunk)), size)
+
+	reader, storedSize, err := store.Object(hash)
+	require.NoError(t, err)
+	defer reader.Close()
+	require.Equal(t, storedSize, size)
+}
+
+// refServingTransport provides every stateURI, and every ref that its provider host holds,
+// through in-memory peers.  It records the fetch ref requests that it receives.  The
+// first numInterrupted fetches are cut off once interruptAfter response messages have been
+// read, and every response message takes delay to read.
+type refServingTransport struct {
+	Transport
+	name           string
+	provider       *host
+	numInterrupted int
+	interruptAfter int
+	delay          time.Duration
+
+	mu       sync.Mutex
+	requests []FetchRefMsg
+}
+
+func newRefServingTransport(t *testing.T, name string) *refServingTransport {
+	provider := &host{Context: &ctx.Context{}, refStore: newTestRefStore(t)}
+	err := provider.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { provider.CtxStop("test finished", nil) })
+	return &refServingTransport{name: name, provider: provider}
+}
+
+func (t *refServingTransport) Name() string { return t.name }
+
+func (t *refServingTransport) ForEachProviderOfStateURI(ctx context.Context, stateURI string) (<-chan Peer, error) {
+	ch := make(chan Peer, 1)
+	ch <- &refServingPeer{t: t}
+	close(ch)
+	return ch, nil
+}
+
+func (t *refServingTransport) ForEachProviderOfRef(ctx context.Context, refHash types.Hash) (<-chan Peer, error) {
+	ch := make(chan Peer, 1)
+	if t.provider.refStore.HaveObject(refHash) {
+		ch <- &refServingPeer{t: t}
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (t *refServingTransport) AnnounceRef(refHash types.Hash) error { return nil }
+
+func (t *refServingTransport) fetchRequests() []FetchRefMsg {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]FetchRefMsg(nil), t.requests...)
+}
+
+func (t *refServingTransport) fetchedRefs() []types.Hash {
+	var refs []types.Hash
+	for _, req := range t.fetchRequests() {
+		refs = append(refs, req.Ref)
+	}
+	return refs
+}
+
+// refServingPeer hands FetchRef messages to its transport's provider host, and queues up
+// the responses.  It never sends any txs over a subscription.
+type refServingPeer struct {
+	Peer
+	t              *refServingTransport
+	msgs           []Msg
+	interruptAfter int
+	numRead        int
+}
+
+func (p *refServingPeer) Transport() Transport                      { return p.t }
+func (p *refServingPeer) ReachableAt() StringSet                    { return NewStringSet([]string{p.t.name}) }
+func (p *refServingPeer) Address() types.Address                    { return types.Address{} }
+func (p *refServingPeer) EnsureConnected(ctx context.Context) error { return nil }
+func (p *refServingPeer) CloseConn() error                          { return nil }
+
+func (p *refServingPeer) WriteMsg(msg Msg) error {
+	switch msg.Type {
+	case MsgType_FetchRef:
+		fetchRef := msg.Payload.(FetchRefMsg)
+
+		p.msgs = nil
+		p.numRead = 0
+		p.interruptAfter = 0
+		p.t.mu.Lock()
+		p.t.requests = append(p.t.requests, fetchRef)
+		if p.t.numInterrupted > 0 {
+			p.t.numInterrupted--
+			p.interruptAfter = p.t.interruptAfter
+		}
+		p.t.mu.Unlock()
+
+		p.t.provider.onFetchRefReceived(fetchRef.Ref, fetchRef.Offset, fetchRef.Length, p)
+
+	case MsgType_FetchRefResponse:
+		// The provider reuses its buffer from one chunk to the next
+		if resp := msg.Payload.(FetchRefResponse); resp.Body != nil {
+			resp.Body = &FetchRefResponseBody{Data: append([]byte(nil), resp.Body.Data...), End: resp.Body.End}
+			msg.Payload = resp
+		}
+		p.msgs = append(p.msgs, msg)
+	}
+	return nil
+}
+
+func (p *refServingPeer) ReadMsg() (Msg, error) {
+	if len(p.msgs) == 0 || (p.interruptAfter > 0 && p.numRead == p.interruptAfter) {
+		return Msg{}, io.EOF
+	}
+	time.Sleep(p.t.delay)
+	msg := p.msgs[0]
+	p.msgs = p.msgs[1:]
+	p.numRead++
+	return msg, nil
+}
+
+func TestHost_PrefetchRefsOnSubscribe(t *testing.T) {
+	tpt := newRefServingTransport(t, "ref-serving")
+	m, refStore := newTestMetacontroller(t)
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	h := &host{
+		Context:                 &ctx.Context{},
+		signingKeypair:          signingKeypair,
+		controller:              m,
+		refStore:                refStore,
+		transports:              map[string]Transport{tpt.Name(): tpt},
+		subscriptionsOut:        make(map[string]map[peerTuple]*subscriptionOut),
+		missingRefs:             make(map[types.Hash]struct{}),
+		chMissingRefs:           make(chan []types.Hash, 100),
+		findProviderTimeout:     5 * time.Second,
+		prefetchRefsOnSubscribe: true,
+	}
+	h.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, h.announceRefs)
+	err = h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+	go h.fetchRefsLoop()
+
+	storeRef := func(refStore RefStore, content string) types.Hash {
+		hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewBufferString(content)), "application/octet-stream")
+		require.NoError(t, err)
+		return hash
+	}
+	link := func(refHash types.Hash) map[string]interface{} {
+		return map[string]interface{}{"Content-Type": "link", "value": "ref:" + refHash.Hex()}
+	}
+
+	// The host already holds the state, but only one of the refs that it links to
+	indexHTML := storeRef(tpt.provider.refStore, "<html></html>")
+	logo := storeRef(tpt.provider.refStore, "logo")
+	video := storeRef(tpt.provider.refStore, "video")
+	have := storeRef(tpt.provider.refStore, "already have it")
+	storeRef(refStore, "already have it")
+
+	ctxWait, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = m.AddTxAndWait(ctxWait, signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: nil,
+			Val: map[string]interface{}{
+				"index.html": link(indexHTML),
+				"media": map[string]interface{}{
+					"logo":  link(logo),
+					"video": link(video),
+					"old":   link(have),
+				},
+				"alias": map[string]interface{}{"Content-Type": "link", "value": "state:localhost/test/media"},
+			},
+		}},
+	}))
+	require.NoError(t, err)
+
+	anySucceeded, errs := h.Subscribe(context.Background(), "localhost/test", nil)
+	require.True(t, anySucceeded)
+	require.Empty(t, errs)
+
+	// Nothing but the subscription asks for the refs
+	require.Eventually(t, func() bool {
+		return refStore.HaveObject(indexHTML) && refStore.HaveObject(logo) && refStore.HaveObject(video)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []types.Hash{indexHTML, logo, video}, tpt.fetchedRefs())
+}
+
+func TestHost_InterruptedRefFetchResumes(t *testing.T) {
+	tpt := newRefServingTransport(t, "ref-serving")
+	h := &host{
+		Context:    &ctx.Context{},
+		refStore:   newTestRefStore(t),
+		transports: map[string]Transport{tpt.Name(): tpt},
+	}
+	h.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, h.announceRefs)
+	err := h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+	content := make([]byte, 10*REF_CHUNK_SIZE+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	ref, _, err := tpt.provider.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(content)), "application/octet-stream")
+	require.NoError(t, err)
+
+	// Cut the first transfer off after the header and three chunks
+	tpt.numInterrupted = 1
+	tpt.interruptAfter = 4
+
+	err = h.fetchRef(ref)
+	require.Equal(t, ErrRefIncomplete, errors.Cause(err))
+	require.False(t, h.refStore.HaveObject(ref))
+	received, err := h.refStore.PartialObjectSize(ref)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*REF_CHUNK_SIZE), received)
+
+	// The retry only asks for the rest
+	err = h.fetchRef(ref)
+	require.NoError(t, err)
+	require.Equal(t, []FetchRefMsg{
+		{Ref: ref, Length: REF_PIECE_SIZE},
+		{Ref: ref, Offset: 3 * REF_CHUNK_SIZE, Length: REF_PIECE_SIZE},
+	}, tpt.fetchRequests())
+
+	reader, _, err := h.refStore.Object(ref)
+	require.NoError(t, err)
+	defer reader.Close()
+	bs, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, content, bs)
+
+	received, err = h.refStore.PartialObjectSize(ref)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), received)
+}
+
+func TestHost_RefIsFetchedFromSeveralProvidersInParallel(t *testing.T) {
+	content := make([]byte, 16*REF_PIECE_SIZE+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	fast := newRefServingTransport(t, "fast")
+	fast.delay = 100 * time.Microsecond
+	slow := newRefServingTransport(t, "slow")
+	slow.delay = 2 * time.Millisecond
+	// This one drops out partway through the first range it's asked for
+	flaky := newRefServingTransport(t, "flaky")
+	flaky.delay = 100 * time.Microsecond
+	flaky.numInterrupted = 1
+	flaky.interruptAfter = 10
+
+	var ref types.Hash
+	for _, tpt := range []*refServingTransport{fast, slow, flaky} {
+		var err error
+		ref, _, err = tpt.provider.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(content)), "application/octet-stream")
+		require.NoError(t, err)
+	}
+
+	h := &host{
+		Context:    &ctx.Context{},
+		refStore:   newTestRefStore(t),
+		transports: map[string]Transport{fast.name: fast, slow.name: slow, flaky.name: flaky},
+	}
+	h.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, h.announceRefs)
+	err := h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+	err = h.fetchRef(ref)
+	require.NoError(t, err)
+
+	reader, _, err := h.refStore.Object(ref)
+	require.NoError(t, err)
+	defer reader.Close()
+	bs, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, content, bs)
+
+	// Every provider served part of the ref, and the fast one served more than the slow one
+	require.NotEmpty(t, slow.fetchRequests())
+	require.Len(t, flaky.fetchRequests(), 1)
+	require.Greater(t, len(fast.fetchRequests()), len(slow.fetchRequests()))
+
+	// The rest of the range that the flaky provider dropped was picked up by another one
+	dropped := flaky.fetchRequests()[0]
+	var resumed bool
+	for _, req := range append(fast.fetchRequests(), slow.fetchRequests()...) {
+		if req.Offset == dropped.Offset+9*REF_CHUNK_SIZE {
+			resumed = true
+		}
+	}
+	require.True(t, resumed)
+}
+
+func TestHost_FetchRefResponseHeaderCarriesSize(t *testing.T) {
+	tpt := newRefServingTransport(t, "ref-serving")
+	content := bytes.Repeat([]byte("abc"), 1000)
+	ref, _, err := tpt.provider.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(content)), "application/octet-stream")
+	require.NoError(t, err)
+
+	// The header carries the size of the whole ref, even when only part of it is sent
+	peer := &refServingPeer{t: tpt}
+	err = peer.WriteMsg(Msg{Type: MsgType_FetchRef, Payload: FetchRefMsg{Ref: ref, Offset: 100, Length: 50}})
+	require.NoError(t, err)
+
+	msg, err := peer.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, &FetchRefResponseHeader{Offset: 100, Size: int64(len(content)), ContentType: "application/octet-stream"}, msg.Payload.(FetchRefResponse).Header)
+
+	msg, err = peer.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, content[100:150], msg.Payload.(FetchRefResponse).Body.Data)
+}
+
+func TestHost_FetchedRefKeepsItsContentType(t *testing.T) {
+	tpt := newRefServingTransport(t, "ref-serving")
+	jpeg := append([]byte{0xff, 0xd8, 0xff, 0xe0}, bytes.Repeat([]byte{0x42}, 3*REF_PIECE_SIZE)...)
+	ref, _, err := tpt.provider.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(jpeg)), "image/jpg")
+	require.NoError(t, err)
+
+	h := &host{
+		Context:    &ctx.Context{},
+		refStore:   newTestRefStore(t),
+		transports: map[string]Transport{tpt.Name(): tpt},
+	}
+	h.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, h.announceRefs)
+	err = h.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+	err = h.fetchRef(ref)
+	require.NoError(t, err)
+
+	contentType, err := h.refStore.ContentType(ref)
+	require.NoError(t, err)
+	require.Equal(t, "image/jpg", contentType)
+
+	refs, err := h.Refs()
+	require.NoError(t, err)
+	require.Equal(t, []RefInfo{{Hash: ref, ContentType: "image/jpg", Size: int64(len(jpeg))}}, refs)
+}
+
+// refSearchTransport finds no providers of any ref.  Its search fails with err if that's
+// set, ends right away if done is set, and otherwise lasts until it's canceled.
+type refSearchTransport struct {
+	Transport
+	err  error
+	done bool
+}
+
+func (t *refSearchTransport) Name() string { return "search" }
+
+func (t *refSearchTransport) ForEachProviderOfRef(ctx context.Context, refHash types.Hash) (<-chan Peer, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	ch := make(chan Peer)
+	if t.done {
+		close(ch)
+	} else {
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+	}
+	return ch, nil
+}
+
+func TestHost_FetchRefTellsAFailedSearchFromAMissingRef(t *testing.T) {
+	errSearch := errors.New("dht unreachable")
+	ref := types.HashBytes([]byte("nobody has this"))
+
+	tests := []struct {
+		name       string
+		transports []Transport
+		expected   error
+	}{
+		{"the search ran its course", []Transport{&refSearchTransport{done: true}}, ErrRefNotFound},
+		{"the search timed out", []Transport{&refSearchTransport{}}, context.DeadlineExceeded},
+		{"the search failed", []Transport{&refSearchTransport{err: errSearch}}, errSearch},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			h := &host{
+				Context:             &ctx.Context{},
+				refStore:            newTestRefStore(t),
+				transports:          make(map[string]Transport),
+				findProviderTimeout: 100 * time.Millisecond,
+			}
+			for _, tpt := range test.transports {
+				h.transports[tpt.Name()] = tpt
+			}
+			err := h.CtxStart(func() error { return nil }, nil, nil, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { h.CtxStop("test finished", nil) })
+
+			err = h.fetchRef(ref)
+			require.Equal(t, test.expected, errors.Cause(err))
+			require.False(t, h.refStore.HaveObject(ref))
+		})
+	}
+}
+
+// stubPeer accepts whatever's written to it, and never has anything to read.
+type stubPeer struct {
+	Peer
+	transport   Transport
+	reachableAt StringSet
+	address     types.Address
+	closed      chan struct{}
+}
+
+func newStubPeer(transport Transport, address types.Address, reachableAt ...string) *stubPeer {
+	return &stubPeer{transport: transport, reachableAt: NewStringSet(reachableAt), address: address, closed: make(chan struct{})}
+}
+
+func (p *stubPeer) Transport() Transport   { return p.transport }
+func (p *stubPeer) ReachableAt() StringSet { return p.reachableAt }
+func (p *stubPeer) Address() types.Address { return p.address }
+func (p *stubPeer) WriteMsg(msg Msg) error { return nil }
+func (p *stubPeer) ReadMsg() (Msg, error)  { <-p.closed; return Msg{}, io.EOF }
+func (p *stubPeer) CloseConn() error       { return nil }
+func (p *stubPeer) close()                 { close(p.closed) }
+
+func TestHost_SubscriptionsOutAndPeers(t *testing.T) {
+	tpt := &silentTransport{}
+	h := newTestHost(t)
+	h.peerStore = NewPeerStore(types.Address{})
+
+	require.Empty(t, h.SubscriptionsOut())
+	require.Empty(t, h.Peers())
+
+	alice, bob := types.Address{0xa}, types.Address{0xb}
+	peerAlice := newStubPeer(tpt, alice, "alice-1", "alice-2")
+	peerBob := newStubPeer(tpt, bob, "bob")
+	defer peerAlice.close()
+	defer peerBob.close()
+
+	before := time.Now()
+	err := h.subscribeToPeer(peerAlice, "localhost/test", tree.Keypath("messages"))
+	require.NoError(t, err)
+	err = h.subscribeToPeer(peerBob, "localhost/test", nil)
+	require.NoError(t, err)
+	err = h.subscribeToPeer(peerBob, "localhost/other", nil)
+	require.NoError(t, err)
+	// Subscribing to the same peer twice doesn't make a second subscription
+	err = h.subscribeToPeer(peerAlice, "localhost/test", tree.Keypath("messages"))
+	require.NoError(t, err)
+
+	subs := h.SubscriptionsOut()
+	require.Len(t, subs, 3)
+	for _, sub := range subs {
+		require.False(t, sub.Since.Before(before))
+		require.Equal(t, "silent", sub.Transport)
+	}
+	require.Equal(t, "localhost/other", subs[0].StateURI)
+	require.Equal(t, bob, subs[0].PeerAddress)
+	require.Equal(t, []string{"bob"}, subs[0].ReachableAt)
+	require.Equal(t, "localhost/test", subs[1].StateURI)
+	require.Equal(t, alice, subs[1].PeerAddress)
+	require.Equal(t, "messages", subs[1].Keypath)
+	require.Equal(t, []string{"alice-1", "alice-2"}, subs[1].ReachableAt)
+	require.Equal(t, "localhost/test", subs[2].StateURI)
+	require.Equal(t, bob, subs[2].PeerAddress)
+	require.Empty(t, subs[2].Keypath)
+
+	h.peerStore.AddReachableAddresses("http", NewStringSet([]string{"unverified:8080"}))
+	h.peerStore.AddVerifiedCredentials("http", NewStringSet([]string{"alice:8080"}), alice, nil, nil)
+	h.peerStore.AddVerifiedCredentials("libp2p", NewStringSet([]string{"/alice/1", "/alice/2"}), alice, nil, nil)
+	h.peerStore.AddVerifiedCredentials("http", NewStringSet([]string{"bob:8080"}), bob, nil, nil)
+
+	require.Equal(t, []PeerInfo{
+		{Address: alice, Verified: true, ReachableAt: map[string][]string{"http": {"alice:8080"}, "libp2p": {"/alice/1", "/alice/2"}}},
+		{Address: bob, Verified: true, ReachableAt: map[string][]string{"http": {"bob:8080"}}},
+		{ReachableAt: map[string][]string{"http": {"unverified:8080"}}},
+	}, h.Peers())
+
+	// Verifying a peer moves it out of the unverified ones
+	h.peerStore.AddVerifiedCredentials("http", NewStringSet([]string{"unverified:8080"}), types.Address{0xc}, nil, nil)
+	peers := h.Peers()
+	require.Len(t, peers, 3)
+	require.Equal(t, types.Address{0xc}, peers[2].Address)
+	require.True(t, peers[2].Verified)
+}
+
+// malformedPeer answers a subscription with a message that isn't a tx.
+type malformedPeer struct {
+	*stubPeer
+	chClosed chan struct{}
+}
+
+func (p *malformedPeer) ReadMsg() (Msg, error) {
+	return Msg{Type: MsgType_VerifyAddress, Payload: types.ChallengeMsg{}}, nil
+}
+
+func (p *malformedPeer) CloseConn() error {
+	close(p.chClosed)
+	return nil
+}
+
+func TestHost_MalformedSubscriptionMessageClosesTheSubscription(t *testing.T) {
+	h := newTestHost(t)
+	peer := &malformedPeer{newStubPeer(&silentTransport{}, types.Address{0xa}, "alice"), make(chan struct{})}
+
+	err := h.subscribeToPeer(peer, "localhost/test", nil)
+	require.NoError(t, err)
+
+	select {
+	case <-peer.chClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription wasn't closed")
+	}
+	require.Eventually(t, func() bool { return len(h.SubscriptionsOut()) == 0 }, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestHost_ReceivedTxForUnknownStateURIIsRejected(t *testing.T) {
+	h := newTestHost(t)
+	peer := newStubPeer(&silentTransport{}, types.Address{0xa}, "alice")
+	defer peer.close()
+
+	tx := signTestTx(t, &Tx{
+		ID:      types.IDFromString("stray"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/unknown",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	require.Equal(t, ErrUnknownStateURI, errors.Cause(h.checkReceivedTxStateURI(*tx)))
+
+	h.onTxReceived(*tx, peer)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := h.controller.ControllerForStateURI("localhost/unknown")
+	require.Equal(t, ErrNoController, errors.Cause(err))
+	require.False(t, h.controller.HaveTx("localhost/unknown", tx.ID))
+	require.Empty(t, h.controller.KnownStateURIs())
+}
+
+func TestHost_RejectedSubscriptionStopsAcceptingTxs(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tptProvider, tptSubscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tptProvider.libp2pHost.ID(), tptSubscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	newTestHost(t, tptProvider)
+	hostSubscriber := newTestHost(t, tptSubscriber)
+
+	tx := signTestTx(t, &Tx{
+		ID:      types.IDFromString("stray"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+
+	// The provider doesn't know the stateURI, so it rejects the subscription, after which
+	// txs for that stateURI are no longer accepted
+	providerID := tptProvider.libp2pHost.ID()
+	peer := &libp2pPeer{t: tptSubscriber, pinfo: tptSubscriber.libp2pHost.Peerstore().PeerInfo(providerID)}
+	err = hostSubscriber.subscribeToPeer(peer, "localhost/test", nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return errors.Cause(hostSubscriber.checkReceivedTxStateURI(*tx)) == ErrUnknownStateURI
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Empty(t, hostSubscriber.SubscriptionsOut())
+}
+
+func TestHost_TrustPolicyRejectsTxsFromUnlistedAddresses(t *testing.T) {
+	h := newTestHost(t)
+	trusted, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	untrusted, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	h.trustPolicy = NewAllowlistTrustPolicy([]types.Address{trusted.Address()})
+
+	stub := newStubPeer(&silentTransport{}, trusted.Address(), "trusted")
+	defer stub.close()
+	peer := &recordingPeer{Peer: stub}
+
+	// The untrusted tx is otherwise perfectly valid: it creates a new stateURI, so there are
+	// no permissions that it could violate
+	rejected := signTestTxWith(t, untrusted, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/untrusted",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	require.Equal(t, ErrUntrustedAddress, errors.Cause(h.checkTrustPolicy(*rejected, peer)))
+	h.onTxReceived(*rejected, peer)
+
+	accepted := signTestTxWith(t, trusted, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/trusted",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	h.onTxReceived(*accepted, peer)
+
+	require.Eventually(t, func() bool { return h.controller.HaveTx("localhost/trusted", GenesisTxID) }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, h.controller.HaveTx("localhost/untrusted", GenesisTxID))
+
+	// Only the accepted tx is ACKed
+	var acked []types.ID
+	for _, msg := range peer.msgs {
+		if msg.Type == MsgType_Ack {
+			acked = append(acked, msg.Payload.(types.ID))
+		}
+	}
+	require.Equal(t, []types.ID{accepted.ID}, acked)
+
+	// Nor is a trusted author's tx taken from a peer that's proven an untrusted address
+	untrustedPeer := newStubPeer(&silentTransport{}, untrusted.Address(), "untrusted")
+	defer untrustedPeer.close()
+	relayed := signTestTxWith(t, trusted, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/relayed",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	require.Equal(t, ErrUntrustedAddress, errors.Cause(h.checkTrustPolicy(*relayed, untrustedPeer)))
+}
+
+func TestHost_ReceivedTxsAreRoutedByStateURI(t *testing.T) {
+	h := newTestHost(t)
+	peer := newStubPeer(&silentTransport{}, types.Address{0xa}, "alice")
+	defer peer.close()
+
+	stateURIs := []string{"localhost/one", "localhost/two"}
+	for _, stateURI := range stateURIs {
+		genesis := signTestTx(t, &Tx{
+			ID:      GenesisTxID,
+			URL:     stateURI,
+			Patches: []Patch{{Keypath: tree.Keypath("name"), Val: stateURI}},
+		})
+		h.onTxReceived(*genesis, peer)
+	}
+	for _, stateURI := range stateURIs {
+		tx := signTestTx(t, &Tx{
+			ID:      types.IDFromString("update " + stateURI),
+			Parents: []types.ID{GenesisTxID},
+			URL:     stateURI,
+			Patches: []Patch{{Keypath: tree.Keypath("updated"), Val: stateURI}},
+		})
+		require.NoError(t, h.checkReceivedTxStateURI(*tx))
+		h.onTxReceived(*tx, peer)
+	}
+
+	for _, stateURI := range stateURIs {
+		require.Eventually(t, func() bool {
+			return h.controller.HaveTx(stateURI, types.IDFromString("update "+stateURI))
+		}, 5*time.Second, 10*time.Millisecond)
+
+		_, err := h.controller.ControllerForStateURI(stateURI)
+		require.NoError(t, err)
+
+		for _, keypath := range []string{"name", "updated"} {
+			val, err := h.Get(context.Background(), stateURI, tree.Keypath(keypath), nil)
+			require.NoError(t, err)
+			require.Equal(t, stateURI, val)
+		}
+	}
+	require.False(t, h.controller.HaveTx("localhost/one", types.IDFromString("update localhost/two")))
+	require.False(t, h.controller.HaveTx("localhost/two", types.IDFromString("update localhost/one")))
+	require.ElementsMatch(t, stateURIs, h.controller.KnownStateURIs())
+}
+
+// fixedPeersTransport offers the same peers as the providers of, and subscribers to, every
+// stateURI.
+type fixedPeersTransport struct {
+	Transport
+	peers []Peer
+}
+
+func (t *fixedPeersTransport) Name() string { return "fixed" }
+
+func (t *fixedPeersTransport) ForEachProviderOfStateURI(ctx context.Context, stateURI string) (<-chan Peer, error) {
+	ch := make(chan Peer, len(t.peers))
+	for _, peer := range t.peers {
+		ch <- peer
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (t *fixedPeersTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Subscriber, error) {
+	ch := make(chan Subscriber, len(t.peers))
+	for _, peer := range t.peers {
+		ch <- Subscriber{Peer: peer}
+	}
+	close(ch)
+	return ch, nil
+}
+
+// putRecordingPeer is a stubPeer that records the IDs of the txs written to it.
+type putRecordingPeer struct {
+	*stubPeer
+	puts   []types.ID
+	putsMu sync.Mutex
+}
+
+func (p *putRecordingPeer) EnsureConnected(ctx context.Context) error { return nil }
+
+func (p *putRecordingPeer) WriteMsg(msg Msg) error {
+	if msg.Type == MsgType_Put {
+		p.putsMu.Lock()
+		p.puts = append(p.puts, msg.Payload.(Tx).ID)
+		p.putsMu.Unlock()
+	}
+	return nil
+}
+
+func (p *putRecordingPeer) Puts() []types.ID {
+	p.putsMu.Lock()
+	defer p.putsMu.Unlock()
+	return p.puts
+}
+
+func TestHost_CannotSubscribeToSelf(t *testing.T) {
+	_, transports := newMocknetTransports(t, 1)
+	tptLibp2p := transports[0]
+	h := newTestHost(t, tptLibp2p)
+	tptHTTP := newTestHTTPTransport(t, h.controller)
+
+	selfPeers := map[string]Peer{
+		"address": newStubPeer(&silentTransport{}, h.Address(), "elsewhere"),
+		"libp2p":  &libp2pPeer{t: tptLibp2p, pinfo: tptLibp2p.libp2pHost.Peerstore().PeerInfo(tptLibp2p.libp2pHost.ID())},
+		"http":    &httpPeer{t: tptHTTP, reachableAt: tptHTTP.ownURL},
+	}
+	for name, peer := range selfPeers {
+		err := h.subscribeToPeer(peer, "localhost/test", nil)
+		require.Equal(t, ErrPeerIsSelf, errors.Cause(err), name)
+	}
+	require.Empty(t, h.SubscriptionsOut())
+
+	// A transport whose only provider is ourselves fails with ErrPeerIsSelf rather than
+	// timing out
+	h.transports = map[string]Transport{"fixed": &fixedPeersTransport{peers: []Peer{selfPeers["address"]}}}
+	h.findProviderTimeout = 5 * time.Second
+	anySucceeded, errs := h.Subscribe(context.Background(), "localhost/test", nil)
+	require.False(t, anySucceeded)
+	require.Len(t, errs, 1)
+	require.Equal(t, ErrPeerIsSelf, errors.Cause(errs[0]))
+	require.Empty(t, h.SubscriptionsOut())
+}
+
+func TestHost_TxsAreNotBroadcastToSelf(t *testing.T) {
+	h := newTestHost(t)
+
+	self := &putRecordingPeer{stubPeer: newStubPeer(&silentTransport{}, h.Address(), "self")}
+	other := &putRecordingPeer{stubPeer: newStubPeer(&silentTransport{}, types.Address{0xa}, "other")}
+	h.transports = map[string]Transport{"fixed": &fixedPeersTransport{peers: []Peer{self, other}}}
+
+	tx := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	_, err := h.broadcastTx(context.Background(), *tx)
+	require.NoError(t, err)
+
+	require.Empty(t, self.Puts())
+	require.Equal(t, []types.ID{tx.ID}, other.Puts())
+}
+
+// addressedTransport hands out the given peers by the places they're reachable at, and
+// leaves finding them by address to the peer store.
+type addressedTransport struct {
+	Transport
+	peers   map[string]Peer
+	peersMu sync.Mutex
+}
+
+func (t *addressedTransport) Name() string { return "addressed" }
+
+func (t *addressedTransport) addPeer(reachableAt string, peer Peer) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	t.peers[reachableAt] = peer
+}
+
+func (t *addressedTransport) GetPeerByConnStrings(ctx context.Context, reachableAt StringSet) (Peer, error) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	for ra := range reachableAt {
+		if peer, exists := t.peers[ra]; exists {
+			return peer, nil
+		}
+	}
+	return nil, errors.New("no such peer")
+}
+
+func (t *addressedTransport) PeersClaimingAddress(ctx context.Context, address types.Address) (<-chan Peer, error) {
+	ch := make(chan Peer)
+	close(ch)
+	return ch, nil
+}
+
+func TestHost_UnencryptedPrivateTxsGoOnlyToRecipients(t *testing.T) {
+	h := newTestHost(t)
+	// Sending an unencrypted tx mustn't touch the encrypting keypair
+	h.encryptingKeypair = nil
+
+	alice, bob, carol := types.Address{0xa}, types.Address{0xb}, types.Address{0xc}
+	tpt := &addressedTransport{peers: make(map[string]Peer)}
+	peers := make(map[types.Address]*putRecordingPeer)
+	for _, addr := range []types.Address{alice, bob, carol} {
+		peer := &putRecordingPeer{stubPeer: newStubPeer(tpt, addr, addr.Hex())}
+		peers[addr] = peer
+		tpt.addPeer(addr.Hex(), peer)
+		h.peerStore.AddVerifiedCredentials(tpt.Name(), NewStringSet([]string{addr.Hex()}), addr, nil, nil)
+	}
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	recipients := []types.Address{alice, bob}
+	tx := *signTestTx(t, &Tx{
+		ID:          GenesisTxID,
+		URL:         "localhost/" + PrivateRootKeyForRecipients(recipients),
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	recipientErrs, err := h.broadcastTx(context.Background(), tx)
+	require.NoError(t, err)
+	require.Equal(t, map[types.Address]error{alice: nil, bob: nil}, recipientErrs)
+
+	require.Equal(t, []types.ID{tx.ID}, peers[alice].Puts())
+	require.Equal(t, []types.ID{tx.ID}, peers[bob].Puts())
+	require.Empty(t, peers[carol].Puts())
+
+	// It isn't sent again right away
+	recipientErrs, err = h.broadcastTx(context.Background(), tx)
+	require.NoError(t, err)
+	require.NotNil(t, recipientErrs)
+	require.Empty(t, recipientErrs)
+	require.Equal(t, []types.ID{tx.ID}, peers[alice].Puts())
+}
+
+func TestHost_ReceivedPrivateTxsMustBeAddressedToUs(t *testing.T) {
+	recipient := newTestHost(t)
+	bystander := newTestHost(t)
+	senderKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	sender := newStubPeer(&silentTransport{}, senderKeypair.Address(), "sender")
+	defer sender.close()
+
+	recipients := []types.Address{recipient.Address(), senderKeypair.Address()}
+	stateURI := "localhost/" + PrivateRootKeyForRecipients(recipients)
+	genesis := *signTestTxWith(t, senderKeypair, &Tx{
+		ID:          GenesisTxID,
+		URL:         stateURI,
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	tx := *signTestTxWith(t, senderKeypair, &Tx{
+		ID:          types.IDFromString("dm"),
+		Parents:     []types.ID{GenesisTxID},
+		URL:         stateURI,
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+	})
+
+	// The recipient accepts it even though it's never heard of the stateURI
+	require.NoError(t, recipient.checkReceivedTxStateURI(tx))
+	require.Equal(t, ErrNotARecipient, errors.Cause(bystander.checkReceivedTxStateURI(genesis)))
+	require.Equal(t, ErrNotARecipient, errors.Cause(bystander.checkReceivedTxStateURI(tx)))
+
+	// ...but only at the stateURI that its recipients share, and only from one of them
+	elsewhere := *signTestTxWith(t, senderKeypair, &Tx{
+		ID:          types.IDFromString("elsewhere"),
+		Parents:     []types.ID{GenesisTxID},
+		URL:         "localhost/test",
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+	})
+	require.Equal(t, ErrInvalidPrivateRootKey, errors.Cause(recipient.checkReceivedTxStateURI(elsewhere)))
+	outsider := *signTestTx(t, &Tx{
+		ID:          types.IDFromString("outsider"),
+		Parents:     []types.ID{GenesisTxID},
+		URL:         stateURI,
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "baz"}},
+	})
+	require.Equal(t, ErrNotARecipient, errors.Cause(recipient.checkReceivedTxStateURI(outsider)))
+
+	for _, tx := range []Tx{genesis, tx} {
+		recipient.onTxReceived(tx, sender)
+		bystander.onTxReceived(tx, sender)
+	}
+
+	require.Eventually(t, func() bool { return recipient.controller.HaveTx(stateURI, tx.ID) }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, bystander.controller.HaveTx(stateURI, GenesisTxID))
+	require.False(t, bystander.controller.HaveTx(stateURI, tx.ID))
+	_, err = bystander.controller.ControllerForStateURI(stateURI)
+	require.Equal(t, ErrNoController, errors.Cause(err))
+}
+
+func TestHost_SendTxReportsDeliveryToEachRecipient(t *testing.T) {
+	h := newTestHost(t)
+	h.encryptingKeypair = nil
+
+	// Bob can be reached, but nobody claims to be Dave
+	bob, dave := types.Address{0xb}, types.Address{0xd}
+	tpt := &addressedTransport{peers: make(map[string]Peer)}
+	bobPeer := &putRecordingPeer{stubPeer: newStubPeer(tpt, bob, bob.Hex())}
+	tpt.addPeer(bob.Hex(), bobPeer)
+	h.peerStore.AddVerifiedCredentials(tpt.Name(), NewStringSet([]string{bob.Hex()}), bob, nil, nil)
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	recipients := []types.Address{h.Address(), bob, dave}
+	tx := Tx{
+		ID:          GenesisTxID,
+		URL:         "localhost/" + PrivateRootKeyForRecipients(recipients),
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}
+	recipientErrs, err := h.SendTx(context.Background(), tx)
+	require.NoError(t, err)
+
+	require.Len(t, recipientErrs, 2)
+	require.NoError(t, recipientErrs[bob])
+	require.Equal(t, ErrRecipientUnreachable, errors.Cause(recipientErrs[dave]))
+	require.Equal(t, []types.ID{GenesisTxID}, bobPeer.Puts())
+}
+
+func TestHost_UndeliveredPrivateTxsAreRetried(t *testing.T) {
+	h := newTestHost(t)
+	h.encryptingKeypair = nil
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-outbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	h.outbox = NewBadgerOutbox(filepath.Join(dbRoot, "outbox"), h.Address(), testDBOptions, OutboxOptions{
+		TTL:              time.Minute,
+		MinRetryInterval: 20 * time.Millisecond,
+		MaxRetryInterval: 100 * time.Millisecond,
+	})
+	h.CtxAddChild(h.outbox.Ctx(), nil)
+	require.NoError(t, h.outbox.Start())
+	go h.retryOutboxLoop()
+
+	tpt := &addressedTransport{peers: make(map[string]Peer)}
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	// Bob is offline when the tx is sent
+	bob := types.Address{0xb}
+	recipients := []types.Address{h.Address(), bob}
+	tx := Tx{
+		ID:          GenesisTxID,
+		URL:         "localhost/" + PrivateRootKeyForRecipients(recipients),
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	}
+	recipientErrs, err := h.SendTx(context.Background(), tx)
+	require.NoError(t, err)
+	require.Equal(t, ErrRecipientUnreachable, errors.Cause(recipientErrs[bob]))
+
+	entries, err := h.outbox.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, bob, entries[0].Recipient)
+
+	// Once Bob comes online, the tx reaches them and leaves the outbox
+	bobPeer := &putRecordingPeer{stubPeer: newStubPeer(tpt, bob, bob.Hex())}
+	tpt.addPeer(bob.Hex(), bobPeer)
+	h.peerStore.AddVerifiedCredentials(tpt.Name(), NewStringSet([]string{bob.Hex()}), bob, nil, nil)
+
+	require.Eventually(t, func() bool { return len(bobPeer.Puts()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, GenesisTxID, bobPeer.Puts()[0])
+	require.Eventually(t, func() bool {
+		entries, err := h.outbox.Entries()
+		require.NoError(t, err)
+		return len(entries) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// lookupCountingTransport counts how many times it's asked for the peers claiming an
+// address.
+type lookupCountingTransport struct {
+	addressedTransport
+	lookups int32
+}
+
+func (t *lookupCountingTransport) PeersClaimingAddress(ctx context.Context, address types.Address) (<-chan Peer, error) {
+	atomic.AddInt32(&t.lookups, 1)
+	return t.addressedTransport.PeersClaimingAddress(ctx, address)
+}
+
+func TestHost_OutboxLooksForAnUnreachableRecipientOnce(t *testing.T) {
+	h := newTestHost(t)
+	h.encryptingKeypair = nil
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-outbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	options := OutboxOptions{TTL: time.Minute, MinRetryInterval: time.Minute, MaxRetryInterval: time.Hour}
+	h.outbox = NewBadgerOutbox(filepath.Join(dbRoot, "outbox"), h.Address(), testDBOptions, options)
+	h.CtxAddChild(h.outbox.Ctx(), nil)
+	require.NoError(t, h.outbox.Start())
+
+	tpt := &lookupCountingTransport{addressedTransport: addressedTransport{peers: make(map[string]Peer)}}
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	bob := types.Address{0xb}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		tx := Tx{ID: types.RandomID(), Recipients: []types.Address{h.Address(), bob}, Unencrypted: true}
+		require.NoError(t, h.outbox.PutEntry(OutboxEntry{Tx: tx, Recipient: bob, Enqueued: now, Attempts: 1, NextAttempt: now}))
+	}
+
+	h.retryOutbox()
+	require.Equal(t, int32(1), atomic.LoadInt32(&tpt.lookups))
+
+	// Each entry backs off on its own
+	entries, err := h.outbox.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		require.Equal(t, 2, entry.Attempts)
+		require.True(t, entry.NextAttempt.After(now))
+	}
+	due, err := h.outbox.DueEntries(time.Now(), OUTBOX_RETRY_BATCH)
+	require.NoError(t, err)
+	require.Empty(t, due)
+}
+
+func TestNewHost_RejectsAnOutboxThatCantBeRetried(t *testing.T) {
+	signingKeypair, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	outbox := NewBadgerOutbox("", signingKeypair.Address(), testDBOptions, OutboxOptions{TTL: time.Minute})
+	_, err = NewHost(signingKeypair, nil, nil, nil, nil, nil, HostConfig{Outbox: outbox})
+	require.Error(t, err)
+
+	outbox = NewBadgerOutbox("", signingKeypair.Address(), testDBOptions, DefaultOutboxOptions)
+	_, err = NewHost(signingKeypair, nil, nil, nil, nil, nil, HostConfig{Outbox: outbox})
+	require.NoError(t, err)
+}
+
+// claimingTransport turns up the given peers, in order, as the ones claiming an address.
+type claimingTransport struct {
+	Transport
+	claimants []Peer
+}
+
+func (t *claimingTransport) Name() string { return "claiming" }
+
+func (t *claimingTransport) PeersClaimingAddress(ctx context.Context, address types.Address) (<-chan Peer, error) {
+	ch := make(chan Peer)
+	go func() {
+		defer close(ch)
+		for _, peer := range t.claimants {
+			select {
+			case ch <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// gatedPeer claims an address that it can't prove.  Its credential exchange is held up
+// until the test lets it through, and it keeps track of how many of the peers sharing its
+// counters are in the middle of one.
+type gatedPeer struct {
+	*stubPeer
+	counters *verificationCounters
+}
+
+type verificationCounters struct {
+	mu                    sync.Mutex
+	started, active, most int
+	chStarted             chan struct{} // Receives each exchange as it starts
+	chRelease             chan struct{} // Lets one exchange finish, or all of them once closed
+}
+
+func newVerificationCounters() *verificationCounters {
+	return &verificationCounters{chStarted: make(chan struct{}, 1000), chRelease: make(chan struct{})}
+}
+
+func (p *gatedPeer) EnsureConnected(ctx context.Context) error { return nil }
+
+func (p *gatedPeer) WriteMsg(msg Msg) error {
+	if msg.Type == MsgType_VerifyAddress {
+		p.counters.mu.Lock()
+		p.counters.started++
+		p.counters.active++
+		if p.counters.active > p.counters.most {
+			p.counters.most = p.counters.active
+		}
+		p.counters.mu.Unlock()
+		p.counters.chStarted <- struct{}{}
+	}
+	return nil
+}
+
+func (p *gatedPeer) ReadMsg() (Msg, error) {
+	<-p.counters.chRelease
+	p.counters.mu.Lock()
+	defer p.counters.mu.Unlock()
+	p.counters.active--
+	return Msg{}, io.EOF
+}
+
+func (c *verificationCounters) get() (started, most int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started, c.most
+}
+
+func newGatedImpostors(tpt Transport, counters *verificationCounters, n int) []Peer {
+	var peers []Peer
+	for i := 0; i < n; i++ {
+		peers = append(peers, &gatedPeer{
+			stubPeer: newStubPeer(tpt, types.Address{}, fmt.Sprintf("impostor-%v", i)),
+			counters: counters,
+		})
+	}
+	return peers
+}
+
+func TestHost_PeersWithAddressLimitsConcurrentVerifications(t *testing.T) {
+	h := newTestHostWithEncryptingKeypair(t)
+	recipient := newTestHostWithEncryptingKeypair(t)
+	h.verificationSlots = make(chan struct{}, 4)
+
+	// A crowd of peers claim the recipient's address, and only one of them, among the
+	// first few, can prove it.  The others are stuck until the test is over.
+	tpt := &claimingTransport{}
+	counters := newVerificationCounters()
+	defer close(counters.chRelease)
+	toRecipient, _ := newPipePeers(tpt, h, recipient)
+	impostors := newGatedImpostors(tpt, counters, 50)
+	tpt.claimants = append(append(append([]Peer{}, impostors[:2]...), toRecipient), impostors[2:]...)
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	// The tx is delivered without waiting on the impostors' exchanges
+	tx := Tx{ID: GenesisTxID, URL: "localhost/test", Unencrypted: true}
+	err := h.sendTxToRecipient(context.Background(), tx, recipient.Address())
+	require.NoError(t, err)
+	require.Equal(t, MsgType_Put, toRecipient.written[len(toRecipient.written)-1].Type)
+
+	// Only the impostors that shared the first slotful with the recipient (or took its slot
+	// as it finished) were taken on
+	started, most := counters.get()
+	require.LessOrEqual(t, started, 4)
+	require.LessOrEqual(t, most, 4)
+}
+
+func TestHost_VerificationLimitIsSharedAcrossLookups(t *testing.T) {
+	h := newTestHostWithEncryptingKeypair(t)
+	h.verificationSlots = make(chan struct{}, 4)
+
+	const numImpostors = 10
+	tpt := &claimingTransport{}
+	counters := newVerificationCounters()
+	tpt.claimants = newGatedImpostors(tpt, counters, numImpostors)
+	h.transports = map[string]Transport{tpt.Name(): tpt}
+
+	// Two addresses are looked up at once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, address := range []types.Address{{0xa}, {0xb}} {
+		chPeers, err := h.peersWithAddress(ctx, address)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range chPeers {
+			}
+		}()
+	}
+
+	// Between them, they fill the slots, and no other exchange starts until one of those
+	// finishes
+	for i := 0; i < 4; i++ {
+		<-counters.chStarted
+	}
+	select {
+	case <-counters.chStarted:
+		t.Fatal("more exchanges started than there are slots")
+	default:
+	}
+
+	for i := 4; i < 2*numImpostors; i++ {
+		counters.chRelease <- struct{}{}
+		<-counters.chStarted
+	}
+	close(counters.chRelease)
+	wg.Wait()
+
+	started, most := counters.get()
+	require.Equal(t, 2*numImpostors, started)
+	require.Equal(t, 4, most)
+}
+
+// loopbackNetwork connects test hosts in-process.  A message written to one of its peers
+// is handed straight to the host that the peer stands for, as long as that host is online.
+type loopbackNetwork struct {
+	hosts    map[types.Address]*host
+	online   map[types.Address]bool
+	onlineMu sync.Mutex
+}
+
+func newLoopbackNetwork(hosts ...*host) *loopbackNetwork {
+	n := &loopbackNetwork{
+		hosts:  make(map[types.Address]*host),
+		online: make(map[types.Address]bool),
+	}
+	for _, h := range hosts {
+		n.hosts[h.Address()] = h
+		n.online[h.Address()] = true
+		h.transports = map[string]Transport{"loopback": &loopbackTransport{n: n, self: h}}
+	}
+	// Every host has verified the others' credentials at some point in the past
+	for _, h := range hosts {
+		for _, other := range hosts {
+			if other != h {
+				h.peerStore.AddVerifiedCredentials("loopback", NewStringSet([]string{other.Address().Hex()}), other.Address(), other.signingKeypair.SigningPublicKey, other.encryptingKeypair.EncryptingPublicKey)
+			}
+		}
+	}
+	return n
+}
+
+func (n *loopbackNetwork) setOnline(h *host, online bool) {
+	n.onlineMu.Lock()
+	defer n.onlineMu.Unlock()
+	n.online[h.Address()] = online
+}
+
+func (n *loopbackNetwork) isOnline(h *host) bool {
+	n.onlineMu.Lock()
+	defer n.onlineMu.Unlock()
+	return n.online[h.Address()]
+}
+
+type loopbackTransport struct {
+	Transport
+	n    *loopbackNetwork
+	self *host
+}
+
+func (t *loopbackTransport) Name() string { return "loopback" }
+
+func (t *loopbackTransport) GetPeerByConnStrings(ctx context.Context, reachableAt StringSet) (Peer, error) {
+	for ra := range reachableAt {
+		addr, err := types.AddressFromHex(ra)
+		if err != nil {
+			continue
+		} else if to, exists := t.n.hosts[addr]; exists {
+			return t.peerFor(to), nil
+		}
+	}
+	return nil, errors.New("no such peer")
+}
+
+func (t *loopbackTransport) PeersClaimingAddress(ctx context.Context, address types.Address) (<-chan Peer, error) {
+	ch := make(chan Peer)
+	close(ch)
+	return ch, nil
+}
+
+func (t *loopbackTransport) peerFor(to *host) *loopbackPeer {
+	return &loopbackPeer{stubPeer: newStubPeer(t, to.Address(), to.Address().Hex()), from: t.self, to: to}
+}
+
+type loopbackPeer struct {
+	*stubPeer
+	from, to *host
+}
+
+func (p *loopbackPeer) EnsureConnected(ctx context.Context) error {
+	if !p.transport.(*loopbackTransport).n.isOnline(p.to) {
+		return errors.New("peer is offline")
+	}
+	return nil
+}
+
+func (p *loopbackPeer) WriteMsg(msg Msg) error {
+	err := p.EnsureConnected(context.Background())
+	if err != nil {
+		return err
+	}
+
+	replyTo := p.to.transports["loopback"].(*loopbackTransport).peerFor(p.from)
+	switch msg.Type {
+	case MsgType_Put:
+		p.to.onTxReceived(msg.Payload.(Tx), replyTo)
+	case MsgType_Private:
+		p.to.onPrivateTxReceived(msg.Payload.(EncryptedTx), replyTo)
+	case MsgType_Ack:
+		p.to.onAckReceived(msg.Payload.(types.ID), replyTo)
+	}
+	return nil
+}
+
+func TestHost_MailboxRelayBridgesPeersThatAreNeverOnlineTogether(t *testing.T) {
+	newHost := func() *host {
+		h := newTestHost(t)
+		encryptingKeypair, err := GenerateEncryptingKeypair()
+		require.NoError(t, err)
+		h.encryptingKeypair = encryptingKeypair
+		return h
+	}
+	sender, relay, recipient := newHost(), newHost(), newHost()
+	n := newLoopbackNetwork(sender, relay, recipient)
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-mailbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	relay.mailbox = NewBadgerMailbox(filepath.Join(dbRoot, "mailbox"), relay.Address(), testDBOptions, MailboxOptions{
+		TTL:             time.Minute,
+		ForwardInterval: 20 * time.Millisecond,
+	})
+	relay.CtxAddChild(relay.mailbox.Ctx(), nil)
+	require.NoError(t, relay.mailbox.Start())
+	go relay.forwardMailboxLoop()
+	sender.mailboxRelays = []types.Address{relay.Address()}
+
+	// The recipient is offline while the sender is online...
+	n.setOnline(recipient, false)
+
+	recipients := []types.Address{sender.Address(), recipient.Address()}
+	stateURI := "localhost/" + PrivateRootKeyForRecipients(recipients)
+	recipientErrs, err := sender.SendTx(context.Background(), Tx{
+		ID:         GenesisTxID,
+		From:       sender.Address(),
+		URL:        stateURI,
+		Recipients: recipients,
+		Patches:    []Patch{{Keypath: tree.Keypath("message"), Val: "hello"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, ErrRecipientUnreachable, errors.Cause(recipientErrs[recipient.Address()]))
+
+	msgs, err := relay.mailbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, recipient.Address(), msgs[0].EncryptedTx.Recipient)
+
+	// ...and the sender is offline while the recipient is online
+	n.setOnline(sender, false)
+	n.setOnline(recipient, true)
+
+	require.Eventually(t, func() bool {
+		val, err := recipient.Get(context.Background(), stateURI, tree.Keypath("message"), nil)
+		return err == nil && val == "hello"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		msgs, err := relay.mailbox.Messages()
+		require.NoError(t, err)
+		return len(msgs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The relay never saw what was in the tx
+	require.False(t, relay.controller.HaveTx(stateURI, GenesisTxID))
+}
+
+func TestHost_MailboxOnlyHoldsSignedDepositsAndForgetsThemOnAck(t *testing.T) {
+	newHost := func() *host {
+		h := newTestHost(t)
+		encryptingKeypair, err := GenerateEncryptingKeypair()
+		require.NoError(t, err)
+		h.encryptingKeypair = encryptingKeypair
+		return h
+	}
+	sender, forger, relay, recipient := newHost(), newHost(), newHost(), newHost()
+	n := newLoopbackNetwork(sender, forger, relay, recipient)
+	n.setOnline(recipient, false)
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-mailbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	relay.mailbox = NewBadgerMailbox(filepath.Join(dbRoot, "mailbox"), relay.Address(), testDBOptions, DefaultMailboxOptions)
+	relay.CtxAddChild(relay.mailbox.Ctx(), nil)
+	require.NoError(t, relay.mailbox.Start())
+
+	relayTpt := relay.transports["loopback"].(*loopbackTransport)
+	deposit := func(from *host, txID types.ID) EncryptedTx {
+		payload, err := encodePrivateTx(Tx{ID: txID, From: from.Address(), URL: "localhost/test"})
+		require.NoError(t, err)
+		sealed, err := from.encryptingKeypair.SealMessageFor(recipient.encryptingKeypair.EncryptingPublicKey, payload)
+		require.NoError(t, err)
+		return EncryptedTx{
+			TxID:             txID,
+			EncryptedPayload: sealed,
+			SenderPublicKey:  from.encryptingKeypair.EncryptingPublicKey.Bytes(),
+			Recipient:        recipient.Address(),
+		}
+	}
+	heldTxIDs := func() []types.ID {
+		msgs, err := relay.mailbox.MessagesFor(recipient.Address())
+		require.NoError(t, err)
+		var txIDs []types.ID
+		for _, msg := range msgs {
+			txIDs = append(txIDs, msg.EncryptedTx.TxID)
+		}
+		return txIDs
+	}
+
+	// Deposits that aren't signed by the peer making them are refused, as are deposits
+	// from peers that haven't proven their address
+	real := deposit(sender, GenesisTxID)
+	relay.onMailboxMessageReceived(real, relayTpt.peerFor(sender))
+	require.NoError(t, real.sign(sender.signingKeypair))
+	relay.onMailboxMessageReceived(real, relayTpt.peerFor(forger))
+	relay.onMailboxMessageReceived(real, newStubPeer(relayTpt, types.Address{}, "anonymous"))
+	require.Empty(t, heldTxIDs())
+
+	relay.onMailboxMessageReceived(real, relayTpt.peerFor(sender))
+	require.Equal(t, []types.ID{GenesisTxID}, heldTxIDs())
+
+	// A forged deposit of the same tx can't replace the real one
+	forged := deposit(forger, GenesisTxID)
+	forged.EncryptedPayload = []byte("garbage")
+	require.NoError(t, forged.sign(forger.signingKeypair))
+	relay.onMailboxMessageReceived(forged, relayTpt.peerFor(forger))
+	require.Len(t, heldTxIDs(), 2)
+
+	// Messages that the recipient can't open are never ACKed, so they stay put
+	unopenable := deposit(forger, types.RandomID())
+	unopenable.EncryptedPayload = []byte("garbage")
+	require.NoError(t, unopenable.sign(forger.signingKeypair))
+	relay.onMailboxMessageReceived(unopenable, relayTpt.peerFor(forger))
+	require.Len(t, heldTxIDs(), 3)
+
+	n.setOnline(recipient, true)
+	relay.forwardMailboxTo(recipient.Address())
+	require.Eventually(t, func() bool {
+		txIDs := heldTxIDs()
+		return len(txIDs) == 1 && txIDs[0] == unopenable.TxID
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+// challengeAnsweringPeer answers every verify address message with whatever its answer
+// func returns, and hangs up on anything else.
+type challengeAnsweringPeer struct {
+	*stubPeer
+	answer    func(challengeMsg types.ChallengeMsg) Msg
+	chAnswers chan Msg
+}
+
+func (p *challengeAnsweringPeer) EnsureConnected(ctx context.Context) error { return nil }
+func (p *challengeAnsweringPeer) SetAddress(addr types.Address) error       { return nil }
+
+func (p *challengeAnsweringPeer) ReadMsg() (Msg, error) {
+	select {
+	case msg := <-p.chAnswers:
+		return msg, nil
+	default:
+		return Msg{}, io.EOF
+	}
+}
+
+func (p *challengeAnsweringPeer) WriteMsg(msg Msg) error {
+	if msg.Type == MsgType_VerifyAddress {
+		p.chAnswers <- p.answer(msg.Payload.(types.ChallengeMsg))
+	}
+	return nil
+}
+
+// msgCapturingPeer keeps the last message written to it.
+type msgCapturingPeer struct {
+	*stubPeer
+	msg Msg
+}
+
+func (p *msgCapturingPeer) WriteMsg(msg Msg) error { p.msg = msg; return nil }
+
+// pipePeer is one end of an in-process connection between two hosts.  Whatever's written
+// to one end is read from the other, and a verify address message sets the host at the
+// other end to answering it.
+type pipePeer struct {
+	*stubPeer
+	remote  *pipePeer
+	to      *host
+	chMsgs  chan Msg
+	written []Msg
+	chErr   chan error
+}
+
+// newPipePeers connects a and b, and returns a's view of b along with b's view of a.
+func newPipePeers(tpt Transport, a, b *host) (*pipePeer, *pipePeer) {
+	aToB := &pipePeer{stubPeer: newStubPeer(tpt, types.Address{}, b.Address().Hex()), to: b, chMsgs: make(chan Msg, 10), chErr: make(chan error, 1)}
+	bToA := &pipePeer{stubPeer: newStubPeer(tpt, types.Address{}, a.Address().Hex()), to: a, chMsgs: make(chan Msg, 10), chErr: make(chan error, 1)}
+	aToB.remote, bToA.remote = bToA, aToB
+	return aToB, bToA
+}
+
+func (p *pipePeer) EnsureConnected(ctx context.Context) error { return nil }
+func (p *pipePeer) SetAddress(addr types.Address) error       { p.address = addr; return nil }
+func (p *pipePeer) ReadMsg() (Msg, error)                     { return <-p.chMsgs, nil }
+
+func (p *pipePeer) WriteMsg(msg Msg) error {
+	p.written = append(p.written, msg)
+	if msg.Type == MsgType_VerifyAddress {
+		go func() { p.chErr <- p.to.onVerifyAddressReceived(msg.Payload.(types.ChallengeMsg), p.remote) }()
+		return nil
+	}
+	p.remote.chMsgs <- msg
+	return nil
+}
+
+func newTestHostWithEncryptingKeypair(t *testing.T) *host {
+	h := newTestHost(t)
+	encryptingKeypair, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	h.encryptingKeypair = encryptingKeypair
+	return h
+}
+
+func TestHost_VerifyAddressIsMutual(t *testing.T) {
+	initiator := newTestHostWithEncryptingKeypair(t)
+	responder := newTestHostWithEncryptingKeypair(t)
+	tpt := &silentTransport{}
+
+	toResponder, toInitiator := newPipePeers(tpt, initiator, responder)
+	sigpubkey, encpubkey, err := initiator.requestPeerCredentials(context.Background(), toResponder, tpt)
+	require.NoError(t, err)
+	require.NoError(t, <-toResponder.chErr)
+	require.Equal(t, responder.Address(), sigpubkey.Address())
+	require.Equal(t, responder.encryptingKeypair.EncryptingPublicKey.Bytes(), encpubkey.Bytes())
+
+	// Both sides know who they were talking to, and can encrypt to one another
+	require.Equal(t, responder.Address(), toResponder.Address())
+	require.Equal(t, initiator.Address(), toInitiator.Address())
+
+	for _, x := range []struct {
+		h, other *host
+	}{{initiator, responder}, {responder, initiator}} {
+		stored := x.h.peerStore.PeersWithAddress(x.other.Address())
+		require.Len(t, stored, 1)
+		require.Equal(t, x.other.Address(), stored[0].sigpubkey.Address())
+		require.Equal(t, x.other.encryptingKeypair.EncryptingPublicKey.Bytes(), stored[0].encpubkey.Bytes())
+	}
+
+	t.Run("an initiator that can't prove its address is refused", func(t *testing.T) {
+		// An eavesdropper claims to be the initiator by replaying the initiator's answer
+		// to an earlier counter-challenge
+		eavesdropper := newTestHostWithEncryptingKeypair(t)
+		replayed := toResponder.written[1]
+
+		toResponder, toEavesdropper := newPipePeers(tpt, eavesdropper, responder)
+		challengeMsg, err := types.GenerateChallengeMsg()
+		require.NoError(t, err)
+		err = toResponder.WriteMsg(Msg{Type: MsgType_VerifyAddress, Payload: challengeMsg})
+		require.NoError(t, err)
+
+		resp, err := readVerifyAddressResponse(toResponder)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.CounterChallenge)
+		require.Empty(t, resp.EncryptingPublicKey)
+
+		err = toResponder.WriteMsg(replayed)
+		require.NoError(t, err)
+
+		_, err = readVerifyAddressResponse(toResponder)
+		require.Equal(t, ErrUnauthenticatedPeer, errors.Cause(err))
+		require.Equal(t, ErrUnauthenticatedPeer, errors.Cause(<-toResponder.chErr))
+
+		// The responder never handed over its encrypting key
+		for _, msg := range toEavesdropper.written {
+			if resp, ok := msg.Payload.(VerifyAddressResponse); ok {
+				require.Empty(t, resp.EncryptingPublicKey)
+			}
+		}
+		require.Equal(t, types.Address{}, toEavesdropper.Address())
+	})
+}
+
+// bindingTransport binds the verify address handshake to the hosts at either end of a
+// pipePeer, the way that a real transport binds it to the connection.
+type bindingTransport struct {
+	silentTransport
+}
+
+type channelBoundPeer interface {
+	channelBindings() (peerBinding, ownBinding []byte)
+}
+
+func (t *bindingTransport) PeerChannelBinding(peer Peer) []byte {
+	peerBinding, _ := peer.(channelBoundPeer).channelBindings()
+	return peerBinding
+}
+
+func (t *bindingTransport) OwnChannelBinding(peer Peer) []byte {
+	_, ownBinding := peer.(channelBoundPeer).channelBindings()
+	return ownBinding
+}
+
+func (p *pipePeer) channelBindings() ([]byte, []byte) {
+	return []byte(p.to.Address().Hex()), []byte(p.remote.to.Address().Hex())
+}
+
+// relayingPeer looks to its own host like a connection to the middle host, but the middle
+// host passes everything along over its own connection to another.
+type relayingPeer struct {
+	*pipePeer
+	middle, self *host
+}
+
+func (p *relayingPeer) channelBindings() ([]byte, []byte) {
+	return []byte(p.middle.Address().Hex()), []byte(p.self.Address().Hex())
+}
+
+func TestHost_RelayedVerifyAddressHandshakeIsRejected(t *testing.T) {
+	verifier := newTestHostWithEncryptingKeypair(t)
+	middle := newTestHostWithEncryptingKeypair(t)
+	responder := newTestHostWithEncryptingKeypair(t)
+	tpt := &bindingTransport{}
+
+	// A handshake over a direct connection goes through
+	toResponder, _ := newPipePeers(tpt, verifier, responder)
+	sigpubkey, _, err := verifier.requestPeerCredentials(context.Background(), toResponder, tpt)
+	require.NoError(t, err)
+	require.NoError(t, <-toResponder.chErr)
+	require.Equal(t, responder.Address(), sigpubkey.Address())
+
+	// The middle host tries to pass as the responder to the verifier, and as the verifier
+	// to the responder, by relaying the handshake between them
+	other := newTestHostWithEncryptingKeypair(t)
+	middleToResponder, _ := newPipePeers(tpt, middle, responder)
+	toMiddle := &relayingPeer{pipePeer: middleToResponder, middle: middle, self: other}
+	_, _, err = other.requestPeerCredentials(context.Background(), toMiddle, tpt)
+	require.Equal(t, ErrUnauthenticatedPeer, errors.Cause(err))
+	<-middleToResponder.chErr
+
+	require.Empty(t, other.peerStore.PeersWithAddress(responder.Address()))
+	require.Empty(t, responder.peerStore.PeersWithAddress(other.Address()))
+}
+
+func TestHost_ReplayedVerifyAddressResponsesAreRejected(t *testing.T) {
+	verifier := newTestHostWithEncryptingKeypair(t)
+	responder := newTestHostWithEncryptingKeypair(t)
+	tpt := &silentTransport{}
+
+	toResponder, toVerifier := newPipePeers(tpt, verifier, responder)
+	sigpubkey, _, err := verifier.requestPeerCredentials(context.Background(), toResponder, tpt)
+	require.NoError(t, err)
+	require.NoError(t, <-toResponder.chErr)
+	require.Equal(t, responder.Address(), sigpubkey.Address())
+	captured := toVerifier.written
+
+	// An eavesdropper who captured that response can't use it to pass as the responder
+	peer := &challengeAnsweringPeer{
+		stubPeer:  newStubPeer(tpt, responder.Address(), "responder"),
+		chAnswers: make(chan Msg, 1),
+		answer:    func(types.ChallengeMsg) Msg { return captured[0] },
+	}
+	_, _, err = verifier.requestPeerCredentials(context.Background(), peer, tpt)
+	require.Equal(t, ErrChallengeMismatch, errors.Cause(err))
+
+	// Nor can they make the replay match by swapping in the new challenge, since the
+	// signature doesn't cover it
+	peer.answer = func(challengeMsg types.ChallengeMsg) Msg {
+		resp := captured[0].Payload.(VerifyAddressResponse)
+		resp.Challenge = challengeMsg
+		return Msg{Type: MsgType_VerifyAddressResponse, Payload: resp}
+	}
+	sigpubkey, _, err = verifier.requestPeerCredentials(context.Background(), peer, tpt)
+	require.Error(t, err)
+	require.Nil(t, sigpubkey)
+
+	t.Run("responses that don't say which challenge they answer are checked against the pending one", func(t *testing.T) {
+		challengeMsg, err := types.GenerateChallengeMsg()
+		require.NoError(t, err)
+		capturer := &msgCapturingPeer{stubPeer: newStubPeer(tpt, verifier.Address(), "verifier")}
+		capturer.close()
+		err = responder.onVerifyAddressReceived(challengeMsg, capturer)
+		require.Equal(t, io.EOF, errors.Cause(err))
+
+		resp := capturer.msg.Payload.(VerifyAddressResponse)
+		resp.Challenge = nil
+		sigpubkey, err := verifyChallengeResponse(challengeMsg, resp, capturer, time.Now(), nil)
+		require.NoError(t, err)
+		require.Equal(t, responder.Address(), sigpubkey.Address())
+
+		otherChallengeMsg, err := types.GenerateChallengeMsg()
+		require.NoError(t, err)
+		sigpubkey, err = verifyChallengeResponse(otherChallengeMsg, resp, capturer, time.Now(), nil)
+		require.NoError(t, err)
+		require.NotEqual(t, responder.Address(), sigpubkey.Address())
+	})
+
+	t.Run("responses to expired challenges are rejected", func(t *testing.T) {
+		challengeMsg, err := types.GenerateChallengeMsgWithExpiry(time.Now().Add(-time.Second))
+		require.NoError(t, err)
+		capturer := &msgCapturingPeer{stubPeer: newStubPeer(tpt, verifier.Address(), "verifier")}
+		capturer.close()
+		err = responder.onVerifyAddressReceived(challengeMsg, capturer)
+		require.Equal(t, io.EOF, errors.Cause(err))
+
+		_, err = verifyChallengeResponse(challengeMsg, capturer.msg.Payload.(VerifyAddressResponse), capturer, time.Now(), nil)
+		require.Equal(t, ErrChallengeExpired, errors.Cause(err))
+	})
+}
@@ -1,6 +1,8 @@
 package redwood
 
 import (
+	"fmt"
+
 	"github.com/pkg/errors"
 
 	//"github.com/brynbellomy/redwood/nelson"
@@ -39,18 +41,76 @@ func NewKeypathIndexer(config tree.Node) (Indexer, error) {
 	return &keypathIndexer{keypathName: tree.Keypath(keypathStr)}, nil
 }
 
-func (i *keypathIndexer) IndexKeyForNode(node tree.Node) (tree.Keypath, error) {
-	val, exists, err := node.Value(i.keypathName, nil)
+func (i *keypathIndexer) IndexKeyForNode(node tree.Node) ([]tree.Keypath, error) {
+	component, err := indexKeyComponentAtKeypath(node, i.keypathName)
+	if err != nil || component == nil {
+		return nil, err
+	}
+	return []tree.Keypath{component}, nil
+}
+
+// compoundIndexer indexes nodes by the values found at several keypaths, in order.  For
+// example, a config of `{"keypaths": ["sender", "timestamp"]}` indexes messages by sender,
+// then by timestamp.
+type compoundIndexer struct {
+	keypaths []tree.Keypath
+}
+
+func NewCompoundIndexer(config tree.Node) (Indexer, error) {
+	val, exists, err := config.Value(tree.Keypath("keypaths"), nil)
 	if err != nil {
 		return nil, err
 	} else if !exists {
-		return nil, nil
+		return nil, errors.New("compound indexer needs a 'keypaths' field in its config")
 	}
 
-	valStr, is := val.(string)
-	if !is {
+	vals, is := val.([]interface{})
+	if !is || len(vals) == 0 {
+		return nil, errors.New("compound indexer's 'keypaths' field must be a non-empty array")
+	}
+
+	keypaths := make([]tree.Keypath, len(vals))
+	for i := range vals {
+		keypathStr, is := vals[i].(string)
+		if !is {
+			return nil, errors.Errorf("compound indexer's 'keypaths' field must only contain strings (got %T)", vals[i])
+		}
+		keypaths[i] = tree.Keypath(keypathStr)
+	}
+	return &compoundIndexer{keypaths: keypaths}, nil
+}
+
+func (i *compoundIndexer) IndexKeyForNode(node tree.Node) ([]tree.Keypath, error) {
+	components := make([]tree.Keypath, len(i.keypaths))
+	for j, keypath := range i.keypaths {
+		component, err := indexKeyComponentAtKeypath(node, keypath)
+		if err != nil {
+			return nil, err
+		} else if component == nil {
+			// Nodes missing any part of the key aren't indexed
+			return nil, nil
+		}
+		components[j] = component
+	}
+	return components, nil
+}
+
+// indexKeyComponentAtKeypath returns the string or numeric value at the given keypath as an
+// index key component, or nil if there's no such value.
+func indexKeyComponentAtKeypath(node tree.Node, keypath tree.Keypath) (tree.Keypath, error) {
+	val, exists, err := node.Value(keypath, nil)
+	if err != nil {
+		return nil, err
+	} else if !exists {
 		return nil, nil
 	}
 
-	return tree.Keypath(valStr), nil
+	switch val := val.(type) {
+	case string:
+		return tree.Keypath(val), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return tree.Keypath(fmt.Sprintf("%v", val)), nil
+	default:
+		return nil, nil
+	}
 }
@@ -0,0 +1,190 @@
+package redwood
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// KeyRotationsKeypath is where a stateURI records the keys that its users have rotated
+// away from.  Each entry is keyed by the hex address of the old key:
+//
+//	"Key-Rotations": {
+//	    "<old address>": { "To": "<new address>", "Signature": "<new key's signature>" }
+//	}
+//
+// An entry can only be written by a tx signed with the old key, and carries the new key's
+// signature (see KeyRotation.Verify), so that nobody can be made to take over a key they
+// don't want.  Once a key has been rotated away from, txs signed with it are rejected, and
+// the permissions validator grants the new key whatever it granted the old one.
+var KeyRotationsKeypath = tree.Keypath("Key-Rotations")
+
+const keyRotationDomain = "key rotation"
+
+var ErrInvalidKeyRotation = errors.New("invalid key rotation")
+
+type KeyRotation struct {
+	From      types.Address
+	To        types.Address
+	Signature types.Signature
+}
+
+// NewKeyRotationPatch returns the patch that rotates oldAddress's key to newKeypair.  It
+// has to be sent in a tx signed with the old key.
+func NewKeyRotationPatch(oldAddress types.Address, newKeypair *SigningKeypair) (Patch, error) {
+	rotation := KeyRotation{From: oldAddress, To: newKeypair.Address()}
+	sig, err := newKeypair.SignMessage(keyRotationDomain, rotation.message())
+	if err != nil {
+		return Patch{}, err
+	}
+	rotation.Signature = sig
+	return Patch{Keypath: KeyRotationsKeypath.Push(tree.Keypath(oldAddress.Hex())), Val: rotation.value()}, nil
+}
+
+func (r KeyRotation) message() []byte {
+	return bytes.Join([][]byte{r.From[:], r.To[:]}, nil)
+}
+
+func (r KeyRotation) value() map[string]interface{} {
+	return map[string]interface{}{
+		"To":        r.To.Hex(),
+		"Signature": r.Signature.Hex(),
+	}
+}
+
+// Verify checks that the rotation was signed by the key it rotates to, whose address is
+// derived with the given AddressDerivation.
+func (r KeyRotation) Verify(addressDerivation AddressDerivation) error {
+	if r.From == r.To {
+		return errors.Wrapf(ErrInvalidKeyRotation, "%v can't be rotated to itself", r.From.Hex())
+	}
+	pubkey, err := RecoverSigningPubkey(HashMessage(keyRotationDomain, r.message()), r.Signature, addressDerivation)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidKeyRotation, "bad signature: %v", err)
+	} else if !VerifyMessage(pubkey, keyRotationDomain, r.message(), r.Signature) || pubkey.Address() != r.To {
+		return errors.Wrapf(ErrInvalidKeyRotation, "not signed by %v", r.To.Hex())
+	}
+	return nil
+}
+
+func parseKeyRotation(fromHex string, val interface{}) (KeyRotation, error) {
+	from, err := types.AddressFromHex(fromHex)
+	if err != nil {
+		return KeyRotation{}, errors.Wrapf(ErrInvalidKeyRotation, "bad address '%v'", fromHex)
+	}
+	asMap, isMap := val.(map[string]interface{})
+	if !isMap {
+		return KeyRotation{}, errors.Wrapf(ErrInvalidKeyRotation, "rotation of %v is not a map", fromHex)
+	}
+	toHex, _ := asMap["To"].(string)
+	to, err := types.AddressFromHex(toHex)
+	if err != nil {
+		return KeyRotation{}, errors.Wrapf(ErrInvalidKeyRotation, "rotation of %v has a bad 'To' address", fromHex)
+	}
+	sigHex, _ := asMap["Signature"].(string)
+	sig, err := types.SignatureFromHex(sigHex)
+	if err != nil {
+		return KeyRotation{}, errors.Wrapf(ErrInvalidKeyRotation, "rotation of %v has a bad 'Signature'", fromHex)
+	}
+	return KeyRotation{From: from, To: to, Signature: sig}, nil
+}
+
+// keyRotations returns the key rotations recorded in the state, keyed by the old address.
+func keyRotations(state tree.Node) (map[types.Address]KeyRotation, error) {
+	val, exists, err := state.Value(KeyRotationsKeypath, nil)
+	if err != nil && !errors.Is(err, types.Err404) {
+		return nil, err
+	} else if !exists {
+		return nil, nil
+	}
+	asMap, isMap := val.(map[string]interface{})
+	if !isMap {
+		return nil, errors.Wrapf(ErrInvalidKeyRotation, "%v is not a map", KeyRotationsKeypath)
+	}
+
+	rotations := make(map[types.Address]KeyRotation, len(asMap))
+	for fromHex, entry := range asMap {
+		rotation, err := parseKeyRotation(fromHex, entry)
+		if err != nil {
+			return nil, err
+		}
+		rotations[rotation.From] = rotation
+	}
+	return rotations, nil
+}
+
+// validateKeyRotations checks the tx's key rotation patches and returns the rest of its
+// patches, which are left to the stateURI's validators.  It also returns the addresses
+// that the tx's sender has rotated away from, most recent first.
+func validateKeyRotations(state tree.Node, tx *Tx, addressDerivation AddressDerivation) ([]Patch, []types.Address, error) {
+	rotations, err := keyRotations(state)
+	if err != nil {
+		return nil, nil, err
+	} else if rotations == nil {
+		rotations = make(map[types.Address]KeyRotation)
+	}
+
+	if rotation, rotatedAway := rotations[tx.From]; rotatedAway {
+		return nil, nil, errors.Wrapf(ErrInvalidSignature, "%v has been rotated to %v", tx.From.Hex(), rotation.To.Hex())
+	}
+
+	rotatedFrom := make(map[types.Address]types.Address, len(rotations))
+	for _, rotation := range rotations {
+		rotatedFrom[rotation.To] = rotation.From
+	}
+
+	var otherPatches []Patch
+	for _, patch := range tx.Patches {
+		if !patch.Keypath.StartsWith(KeyRotationsKeypath) {
+			// Rotations are only recorded one at a time, so that each one can be checked
+			if len(patch.Keypath) == 0 && patch.Delete {
+				return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v can't be deleted", KeyRotationsKeypath)
+			} else if len(patch.Keypath) == 0 {
+				if asMap, isMap := patch.Val.(map[string]interface{}); isMap {
+					if _, exists := asMap[string(KeyRotationsKeypath)]; exists {
+						return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v can't be set all at once", KeyRotationsKeypath)
+					}
+				}
+			}
+			otherPatches = append(otherPatches, patch)
+			continue
+		}
+
+		fromHex := patch.Keypath.RelativeTo(KeyRotationsKeypath)
+		if fromHex.NumParts() != 1 || patch.Range != nil {
+			return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v can't be set all at once or in part", KeyRotationsKeypath)
+		}
+		rotation, err := parseKeyRotation(string(fromHex), patch.Val)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rotation.From != tx.From {
+			return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v can't rotate %v's key", tx.From.Hex(), rotation.From.Hex())
+		} else if _, exists := rotations[rotation.From]; exists {
+			return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v has already been rotated", rotation.From.Hex())
+		}
+		// The new key has to be a fresh one, or else rotations could form a cycle
+		if _, exists := rotations[rotation.To]; exists {
+			return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v has already been rotated away from", rotation.To.Hex())
+		} else if _, exists := rotatedFrom[rotation.To]; exists {
+			return nil, nil, errors.Wrapf(ErrInvalidKeyRotation, "%v has already been rotated to", rotation.To.Hex())
+		}
+		err = rotation.Verify(addressDerivation)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rotations[rotation.From] = rotation
+		rotatedFrom[rotation.To] = rotation.From
+	}
+
+	var formerAddresses []types.Address
+	for addr, exists := rotatedFrom[tx.From]; exists; addr, exists = rotatedFrom[addr] {
+		formerAddresses = append(formerAddresses, addr)
+	}
+	return otherPatches, formerAddresses, nil
+}
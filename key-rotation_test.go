@@ -0,0 +1,131 @@
+package redwood
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func signTestTxWith(t *testing.T, keypair *SigningKeypair, tx *Tx) *Tx {
+	t.Helper()
+
+	tx.From = keypair.Address()
+	var err error
+	tx.Sig, err = keypair.SignHash(tx.Hash())
+	require.NoError(t, err)
+	return tx
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	newKey, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	newerKey, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	mallory, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	c := newTestController(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = c.AddTxAndWait(ctx, signTestTxWith(t, oldKey, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("docs"), Val: "genesis"}},
+	}))
+	require.NoError(t, err)
+
+	// Only the old key may write to .docs
+	config := tree.NewMemoryNode()
+	err = config.Set(nil, nil, map[string]interface{}{
+		oldKey.Address().Hex(): map[string]interface{}{"^\\.docs": map[string]interface{}{"write": true}},
+	})
+	require.NoError(t, err)
+	validator, err := NewPermissionsValidator(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addValidator(nil, validator)
+
+	parent := GenesisTxID
+	send := func(keypair *SigningKeypair, id string, patches ...Patch) error {
+		tx := signTestTxWith(t, keypair, &Tx{
+			ID:      types.IDFromString(id),
+			Parents: []types.ID{parent},
+			URL:     "localhost/test",
+			Patches: patches,
+		})
+		err := c.AddTxAndWait(ctx, tx)
+		if err == nil {
+			parent = tx.ID
+		}
+		return err
+	}
+	writeDocs := Patch{Keypath: tree.Keypath("docs"), Val: "hello"}
+
+	err = send(newKey, "before rotation", writeDocs)
+	require.True(t, errors.Is(err, types.Err403))
+
+	t.Run("rotations have to be signed by both keys", func(t *testing.T) {
+		// Only the old key can rotate itself
+		rotation, err := NewKeyRotationPatch(oldKey.Address(), mallory)
+		require.NoError(t, err)
+		err = send(mallory, "rotated by someone else", rotation)
+		require.True(t, errors.Is(err, ErrInvalidKeyRotation))
+
+		// And only to a key that agreed to it
+		unconsented := KeyRotation{From: oldKey.Address(), To: mallory.Address()}
+		unconsented.Signature, err = oldKey.SignMessage(keyRotationDomain, unconsented.message())
+		require.NoError(t, err)
+		err = send(oldKey, "rotated without consent", Patch{
+			Keypath: KeyRotationsKeypath.Push(tree.Keypath(oldKey.Address().Hex())),
+			Val:     unconsented.value(),
+		})
+		require.True(t, errors.Is(err, ErrInvalidKeyRotation))
+	})
+
+	rotation, err := NewKeyRotationPatch(oldKey.Address(), newKey)
+	require.NoError(t, err)
+	err = send(oldKey, "rotation", rotation)
+	require.NoError(t, err)
+
+	// The new key inherits the old key's permissions, and the old key is retired
+	err = send(newKey, "after rotation", writeDocs)
+	require.NoError(t, err)
+	err = send(oldKey, "old key after rotation", writeDocs)
+	require.True(t, errors.Is(err, ErrInvalidSignature))
+
+	t.Run("a key can only be rotated once", func(t *testing.T) {
+		rotation, err := NewKeyRotationPatch(oldKey.Address(), mallory)
+		require.NoError(t, err)
+		err = send(oldKey, "second rotation", rotation)
+		require.True(t, errors.Is(err, ErrInvalidSignature))
+	})
+
+	t.Run("permissions carry through several rotations", func(t *testing.T) {
+		rotation, err := NewKeyRotationPatch(newKey.Address(), newerKey)
+		require.NoError(t, err)
+		err = send(newKey, "another rotation", rotation)
+		require.NoError(t, err)
+
+		err = send(newerKey, "after another rotation", writeDocs)
+		require.NoError(t, err)
+		err = send(newKey, "new key after another rotation", writeDocs)
+		require.True(t, errors.Is(err, ErrInvalidSignature))
+	})
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	rotations, err := keyRotations(state)
+	require.NoError(t, err)
+	require.Len(t, rotations, 2)
+	require.Equal(t, newKey.Address(), rotations[oldKey.Address()].To)
+	require.Equal(t, newerKey.Address(), rotations[newKey.Address()].To)
+}
@@ -0,0 +1,81 @@
+package redwood
+
+import (
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+type badgerMailbox struct {
+	*badgerStore
+	options MailboxOptions
+}
+
+func NewBadgerMailbox(dbFilename string, address types.Address, dbOptions tree.DBTreeOptions, options MailboxOptions) Mailbox {
+	return &badgerMailbox{
+		badgerStore: newBadgerStore("mailbox", dbFilename, address, dbOptions),
+		options:     options,
+	}
+}
+
+func (m *badgerMailbox) Options() MailboxOptions {
+	return m.options
+}
+
+func (m *badgerMailbox) PutMessage(msg MailboxMessage) error {
+	if m.options.MaxMessageSize > 0 && len(msg.EncryptedTx.EncryptedPayload) > m.options.MaxMessageSize {
+		return errors.Wrapf(ErrMessageTooLarge, "%v bytes", len(msg.EncryptedTx.EncryptedPayload))
+	}
+
+	recipient := msg.EncryptedTx.Recipient
+	hash := msg.EncryptedTx.Hash()
+	key := m.key(recipient[:], hash[:])
+
+	return m.update(func(txn *badger.Txn) error {
+		if m.options.MaxMessagesPerRecipient > 0 {
+			_, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				if m.countRecords(txn, m.key(recipient[:])) >= m.options.MaxMessagesPerRecipient {
+					return errors.Wrapf(ErrMailboxFull, recipient.Hex())
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+		return m.putRecord(txn, key, msg)
+	})
+}
+
+func (m *badgerMailbox) RemoveMessage(recipient types.Address, hash types.Hash) error {
+	return m.update(func(txn *badger.Txn) error {
+		return txn.Delete(m.key(recipient[:], hash[:]))
+	})
+}
+
+func (m *badgerMailbox) MessagesFor(recipient types.Address) ([]MailboxMessage, error) {
+	return m.messagesWithPrefix(m.key(recipient[:]))
+}
+
+func (m *badgerMailbox) Messages() ([]MailboxMessage, error) {
+	return m.messagesWithPrefix(m.key())
+}
+
+func (m *badgerMailbox) messagesWithPrefix(prefix []byte) ([]MailboxMessage, error) {
+	var msgs []MailboxMessage
+	err := m.view(func(txn *badger.Txn) error {
+		return m.scanRecords(txn, prefix, func(key, val []byte) error {
+			var msg MailboxMessage
+			err := json.Unmarshal(val, &msg)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+	return msgs, err
+}
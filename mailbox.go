@@ -0,0 +1,98 @@
+package redwood
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// Mailbox holds the encrypted private txs that a store-and-forward relay has accepted on
+// behalf of recipients who couldn't be reached.  The relay can't read them: it only ever
+// sees the EncryptedTx, which it forwards untouched once the recipient is online.
+type Mailbox interface {
+	Ctx() *ctx.Context
+	Start() error
+
+	Options() MailboxOptions
+	PutMessage(msg MailboxMessage) error
+	RemoveMessage(recipient types.Address, hash types.Hash) error
+	MessagesFor(recipient types.Address) ([]MailboxMessage, error)
+	Messages() ([]MailboxMessage, error)
+}
+
+var (
+	ErrMailboxFull     = errors.New("recipient's mailbox is full")
+	ErrMessageTooLarge = errors.New("message is too large for the mailbox")
+	ErrUnsignedMessage = errors.New("message isn't signed by the peer that deposited it")
+)
+
+// MailboxMessage is an encrypted private tx waiting in a relay's mailbox.  It's addressed
+// to EncryptedTx.Recipient.
+type MailboxMessage struct {
+	EncryptedTx EncryptedTx `json:"encryptedTx"`
+	Received    time.Time   `json:"received"`
+}
+
+// MailboxOptions control how a relay holds on to the messages in its mailbox.  It tries
+// to forward them every ForwardInterval (and whenever their recipient connects), and
+// drops them once they've been held for longer than the TTL.  It accepts no message with
+// an EncryptedPayload larger than MaxMessageSize bytes, and holds no more than
+// MaxMessagesPerRecipient for any one recipient.  Zero means no limit.
+type MailboxOptions struct {
+	TTL                     time.Duration
+	ForwardInterval         time.Duration
+	MaxMessageSize          int
+	MaxMessagesPerRecipient int
+}
+
+var DefaultMailboxOptions = MailboxOptions{
+	TTL:                     7 * 24 * time.Hour,
+	ForwardInterval:         30 * time.Second,
+	MaxMessageSize:          1024 * 1024,
+	MaxMessagesPerRecipient: 100,
+}
+
+func (m MailboxMessage) isExpired(now time.Time, options MailboxOptions) bool {
+	return options.TTL > 0 && now.Sub(m.Received) > options.TTL
+}
+
+const mailboxDepositDomain = "mailbox deposit"
+
+// message is what the sender of an EncryptedTx signs when depositing it with a relay.
+// The variable-length fields are hashed so that no two EncryptedTxs have the same message.
+func (etx EncryptedTx) message() []byte {
+	senderPublicKeyHash := types.HashBytes(etx.SenderPublicKey)
+	payloadHash := types.HashBytes(etx.EncryptedPayload)
+	return bytes.Join([][]byte{etx.TxID[:], etx.Recipient[:], senderPublicKeyHash[:], payloadHash[:]}, nil)
+}
+
+// Hash identifies an EncryptedTx by its content, so that two deposits of the same TxID
+// don't collide in a relay's mailbox.
+func (etx EncryptedTx) Hash() types.Hash {
+	return types.HashBytes(etx.message())
+}
+
+func (etx *EncryptedTx) sign(keypair *SigningKeypair) error {
+	sig, err := keypair.SignMessage(mailboxDepositDomain, etx.message())
+	if err != nil {
+		return err
+	}
+	etx.Sig = sig
+	return nil
+}
+
+// verifySender checks that the EncryptedTx was signed by the given address, derived with
+// the given AddressDerivation.
+func (etx EncryptedTx) verifySender(sender types.Address, addressDerivation AddressDerivation) error {
+	pubkey, err := RecoverSigningPubkey(HashMessage(mailboxDepositDomain, etx.message()), etx.Sig, addressDerivation)
+	if err != nil {
+		return errors.Wrapf(ErrUnsignedMessage, "bad signature: %v", err)
+	} else if !VerifyMessage(pubkey, mailboxDepositDomain, etx.message(), etx.Sig) || pubkey.Address() != sender {
+		return errors.Wrapf(ErrUnsignedMessage, "not signed by %v", sender.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package redwood
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestBadgerMailbox_Limits(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "redwood-test-mailbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	mailbox := NewBadgerMailbox(filepath.Join(dbRoot, "mailbox"), types.Address{0xa}, testDBOptions, MailboxOptions{
+		TTL:                     time.Minute,
+		ForwardInterval:         time.Minute,
+		MaxMessageSize:          16,
+		MaxMessagesPerRecipient: 2,
+	})
+	require.NoError(t, mailbox.Start())
+	t.Cleanup(func() { mailbox.Ctx().CtxStop("test finished", nil) })
+
+	msg := func(recipient types.Address, payload string) MailboxMessage {
+		return MailboxMessage{
+			EncryptedTx: EncryptedTx{TxID: GenesisTxID, EncryptedPayload: []byte(payload), Recipient: recipient},
+			Received:    time.Now(),
+		}
+	}
+	bob, carol := types.Address{0xb}, types.Address{0xc}
+
+	err = mailbox.PutMessage(msg(bob, "this is more than sixteen bytes"))
+	require.Equal(t, ErrMessageTooLarge, errors.Cause(err))
+
+	// Messages with the same tx ID are held side by side
+	require.NoError(t, mailbox.PutMessage(msg(bob, "one")))
+	require.NoError(t, mailbox.PutMessage(msg(bob, "two")))
+	err = mailbox.PutMessage(msg(bob, "three"))
+	require.Equal(t, ErrMailboxFull, errors.Cause(err))
+
+	// A message that's already held doesn't count twice, and other recipients have their
+	// own quota
+	require.NoError(t, mailbox.PutMessage(msg(bob, "two")))
+	require.NoError(t, mailbox.PutMessage(msg(carol, "three")))
+
+	msgs, err := mailbox.MessagesFor(bob)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	require.NoError(t, mailbox.RemoveMessage(bob, msg(bob, "one").EncryptedTx.Hash()))
+	msgs, err = mailbox.Messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+}
@@ -1,6 +1,7 @@
 package redwood
 
 import (
+	"context"
 	"io"
 	"strings"
 	"sync"
@@ -18,18 +19,27 @@ type Metacontroller interface {
 	Start() error
 
 	AddTx(tx *Tx) error
+	AddTxAndWait(ctx context.Context, tx *Tx) error
+	DryRunTx(tx *Tx) (tree.Node, error)
 	FetchTx(stateURI string, txID types.ID) (*Tx, error)
 	FetchTxs(stateURI string) TxIterator
 	HaveTx(stateURI string, txID types.ID) bool
 
 	KnownStateURIs() []string
+	ControllerForStateURI(stateURI string) (Controller, error)
+	MempoolLen() int
 	StateAtVersion(stateURI string, version *types.ID) (tree.Node, error)
 	QueryIndex(stateURI string, version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, rng *tree.Range) (tree.Node, error)
+	QueryIndexPage(stateURI string, version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, cursor tree.Keypath, limit int) (IndexPage, error)
 	Leaves(stateURI string) (map[types.ID]struct{}, error)
 
 	SetReceivedRefsHandler(handler ReceivedRefsHandler)
+	SetTxRejectedHandler(handler TxRejectedHandler)
+	SetFetchingParentsChecker(checker FetchingParentsChecker)
 	OnDownloadedRef()
 	RefObjectReader(refHash types.Hash) (io.ReadCloser, int64, error)
+	RefObjectContentType(refHash types.Hash) (string, error)
+	GarbageCollectRefs() ([]types.Hash, error)
 
 	DebugLockResolvers()
 }
@@ -42,12 +52,20 @@ type metacontroller struct {
 	controllers         map[string]Controller
 	controllersMu       sync.RWMutex
 	receivedRefsHandler ReceivedRefsHandler
+	txRejectedHandler   TxRejectedHandler
+	fetchingParents     FetchingParentsChecker
 	txStore             TxStore
 	refStore            RefStore
+	txLimits            TxLimits
+	dbOptions           tree.DBTreeOptions
 	dbRootPath          string
 
 	resolversLocked bool
 
+	// refGCMu keeps txs from being processed while refs are being garbage collected, so
+	// that a ref can't be deleted out from under a tx that has just started to use it
+	refGCMu sync.RWMutex
+
 	validStateURIs   map[string]struct{}
 	validStateURIsMu sync.Mutex
 }
@@ -57,9 +75,16 @@ var (
 
 	MergeTypeKeypath = tree.Keypath("Merge-Type")
 	ValidatorKeypath = tree.Keypath("Validator")
+	IndexTypeKeypath = tree.Keypath("Index-Type")
 )
 
-func NewMetacontroller(address types.Address, dbRootPath string, txStore TxStore, refStore RefStore) Metacontroller {
+func NewMetacontroller(address types.Address, dbRootPath string, txStore TxStore, refStore RefStore, txLimits TxLimits) Metacontroller {
+	return NewMetacontrollerWithDBOptions(address, dbRootPath, txStore, refStore, txLimits, tree.DBTreeOptions{})
+}
+
+// NewMetacontrollerWithDBOptions is like NewMetacontroller, but opens its controllers' DBs
+// with the given options.
+func NewMetacontrollerWithDBOptions(address types.Address, dbRootPath string, txStore TxStore, refStore RefStore, txLimits TxLimits, dbOptions tree.DBTreeOptions) Metacontroller {
 	return &metacontroller{
 		Context:        &ctx.Context{},
 		address:        address,
@@ -67,6 +92,8 @@ func NewMetacontroller(address types.Address, dbRootPath string, txStore TxStore
 		dbRootPath:     dbRootPath,
 		txStore:        txStore,
 		refStore:       refStore,
+		txLimits:       txLimits,
+		dbOptions:      dbOptions,
 		validStateURIs: make(map[string]struct{}),
 	}
 }
@@ -77,8 +104,6 @@ func (m *metacontroller) Start() error {
 		func() error {
 			m.SetLogLabel(m.address.Pretty() + " metacontroller")
 
-			m.CtxAddChild(m.txStore.Ctx(), nil)
-
 			err := m.txStore.Start()
 			if err != nil {
 				return err
@@ -94,7 +119,13 @@ func (m *metacontroller) Start() error {
 		nil,
 		nil,
 		// on shutdown
-		func() {},
+		func() {
+			// The controllers write to the tx store as they process txs, so it isn't a
+			// child (children are stopped concurrently), and is only closed once they've
+			// all stopped
+			m.txStore.Ctx().CtxStop("metacontroller stopped", nil)
+			m.txStore.Ctx().CtxWait()
+		},
 	)
 }
 
@@ -127,10 +158,12 @@ func (m *metacontroller) ensureController(stateURI string) (Controller, error) {
 	if ctrl == nil {
 		// Set up the controller
 		var err error
-		ctrl, err = NewController(m.address, stateURI, m.dbRootPath, m.txStore, m.txProcessedHandler)
+		ctrl, err = NewControllerWithDBOptions(m.address, stateURI, m.dbRootPath, m.txStore, m.txLimits, m.dbOptions, m.txProcessedHandler)
 		if err != nil {
 			return nil, err
 		}
+		ctrl.SetTxRejectedHandler(m.txRejectedHandler)
+		ctrl.SetFetchingParentsChecker(m.fetchingParents)
 
 		m.CtxAddChild(ctrl.Ctx(), nil)
 		err = ctrl.Start()
@@ -145,6 +178,9 @@ func (m *metacontroller) ensureController(stateURI string) (Controller, error) {
 }
 
 func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DBNode) error {
+	m.refGCMu.RLock()
+	defer m.refGCMu.RUnlock()
+
 	err := m.txStore.AddTx(tx)
 	if err != nil {
 		m.Errorf("error adding tx to store: %+v", err)
@@ -177,7 +213,7 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 			switch {
 			case key.Equals(nelson.ValueKey):
 				contentType, err := nelson.GetContentType(state.AtKeypath(parentKeypath, nil))
-				if err != nil && errors.Cause(err) != types.Err404 {
+				if err != nil && !errors.Is(err, types.Err404) {
 					return err
 				} else if contentType != "link" {
 					continue
@@ -206,9 +242,8 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 				c.BehaviorTree().removeResolver(parentKeypath)
 			case key.Equals(ValidatorKeypath):
 				c.BehaviorTree().removeValidator(parentKeypath)
-			case parentKeypath.Part(-1).Equals(tree.Keypath("Indices")):
-				//indicesKeypath, _ := parentKeypath.Pop()
-				//c.BehaviorTree().removeIndexer()
+			case key.Equals(IndexTypeKeypath):
+				c.BehaviorTree().removeIndexers(parentKeypath)
 			}
 
 			for parentKeypath != nil {
@@ -224,6 +259,11 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 					if err != nil {
 						return err
 					}
+				case key.Equals(IndexTypeKeypath):
+					err := m.initializeIndexers(state, parentKeypath, c)
+					if err != nil {
+						return err
+					}
 				}
 				parentKeypath = nextParentKeypath
 			}
@@ -246,8 +286,8 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 					return err
 				}
 
-			case key.Equals(tree.Keypath("Indices")):
-				err := m.initializeIndexer(state, keypath, c)
+			case key.Equals(IndexTypeKeypath):
+				err := m.initializeIndexers(state, keypath, c)
 				if err != nil {
 					return err
 				}
@@ -266,6 +306,11 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 					if err != nil {
 						return err
 					}
+				case key.Equals(IndexTypeKeypath):
+					err := m.initializeIndexers(state, parentKeypath, c)
+					if err != nil {
+						return err
+					}
 				}
 				parentKeypath = nextParentKeypath
 			}
@@ -275,10 +320,14 @@ func (m *metacontroller) txProcessedHandler(c Controller, tx *Tx, state *tree.DB
 	return nil
 }
 
-func (m *metacontroller) initializeResolver(state *tree.DBNode, resolverKeypath tree.Keypath, c Controller) error {
+// initializeResolver sets up the resolver declared under a "Merge-Type" key, and attaches
+// it to the node containing that key.
+func (m *metacontroller) initializeResolver(state *tree.DBNode, mergeTypeKeypath tree.Keypath, c Controller) error {
+	resolverKeypath, _ := mergeTypeKeypath.Pop()
+
 	// Resolve any refs (to code) in the resolver config object.  We copy the config so
 	// that we don't inject any refs into the state tree itself
-	config, err := state.CopyToMemory(resolverKeypath, nil)
+	config, err := state.CopyToMemory(mergeTypeKeypath, nil)
 	if err != nil {
 		return err
 	}
@@ -297,7 +346,7 @@ func (m *metacontroller) initializeResolver(state *tree.DBNode, resolverKeypath
 		return errors.New("cannot initialize resolver without a 'Content-Type' key")
 	}
 
-	ctor, exists := resolverRegistry[contentType]
+	ctor, exists := resolverConstructor(contentType)
 	if !exists {
 		return errors.Errorf("unknown resolver type '%v'", contentType)
 	}
@@ -320,10 +369,14 @@ func (m *metacontroller) initializeResolver(state *tree.DBNode, resolverKeypath
 	return nil
 }
 
-func (m *metacontroller) initializeValidator(state *tree.DBNode, validatorKeypath tree.Keypath, c Controller) error {
+// initializeValidator sets up the validator declared under a "Validator" key, and attaches
+// it to the node containing that key.
+func (m *metacontroller) initializeValidator(state *tree.DBNode, validatorConfigKeypath tree.Keypath, c Controller) error {
+	validatorKeypath, _ := validatorConfigKeypath.Pop()
+
 	// Resolve any refs (to code) in the validator config object.  We copy the config so
 	// that we don't inject any refs into the state tree itself
-	config, err := state.CopyToMemory(validatorKeypath, nil)
+	config, err := state.CopyToMemory(validatorConfigKeypath, nil)
 	if err != nil {
 		return err
 	}
@@ -356,17 +409,30 @@ func (m *metacontroller) initializeValidator(state *tree.DBNode, validatorKeypat
 	return nil
 }
 
-func (m *metacontroller) initializeIndexer(state *tree.DBNode, indexerConfigKeypath tree.Keypath, c Controller) error {
-	// Resolve any refs (to code) in the indexer config object.  We copy the config so
+// initializeIndexers sets up the indexers declared under an "Index-Type" key, which maps
+// index names to indexer configs:
+//
+//	"Index-Type": {
+//	    "by-sender": { "Content-Type": "indexer/keypath", "value": { "keypath": "sender" } }
+//	}
+//
+// The indexers are attached to the node containing the "Index-Type" key.
+func (m *metacontroller) initializeIndexers(state *tree.DBNode, indexTypeKeypath tree.Keypath, c Controller) error {
+	indexedKeypath, _ := indexTypeKeypath.Pop()
+
+	// Replace whatever indexers were declared here before
+	c.BehaviorTree().removeIndexers(indexedKeypath)
+
+	// Resolve any refs (to code) in the indexer config objects.  We copy the configs so
 	// that we don't inject any refs into the state tree itself
-	indexConfigs, err := state.CopyToMemory(indexerConfigKeypath, nil)
-	if err != nil {
+	indexConfigs, err := state.CopyToMemory(indexTypeKeypath, nil)
+	if errors.Is(err, types.Err404) {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	subkeys := indexConfigs.Subkeys()
-
-	for _, indexName := range subkeys {
+	for _, indexName := range indexConfigs.Subkeys() {
 		config, anyMissing, err := nelson.Resolve(indexConfigs.AtKeypath(indexName, nil), m)
 		if err != nil {
 			return err
@@ -381,7 +447,7 @@ func (m *metacontroller) initializeIndexer(state *tree.DBNode, indexerConfigKeyp
 			return errors.New("cannot initialize indexer without a 'Content-Type' key")
 		}
 
-		ctor, exists := indexerRegistry[contentType]
+		ctor, exists := indexerConstructor(contentType)
 		if !exists {
 			return errors.Errorf("unknown indexer type '%v'", contentType)
 		}
@@ -391,10 +457,7 @@ func (m *metacontroller) initializeIndexer(state *tree.DBNode, indexerConfigKeyp
 			return err
 		}
 
-		indexerNodeKeypath, _ := indexerConfigKeypath.Pop()
-		indexerNodeKeypath = indexerNodeKeypath.Push(nelson.ValueKey)
-
-		c.BehaviorTree().addIndexer(indexerNodeKeypath, indexName, indexer)
+		c.BehaviorTree().addIndexer(indexedKeypath, indexName, indexer)
 	}
 	return nil
 }
@@ -410,19 +473,49 @@ func (m *metacontroller) KnownStateURIs() []string {
 	return stateURIs
 }
 
+// ControllerForStateURI returns the controller for the given stateURI.  Unlike AddTx, it
+// never creates one, and returns an error wrapping ErrNoController if there isn't one yet.
+func (m *metacontroller) ControllerForStateURI(stateURI string) (Controller, error) {
+	m.controllersMu.RLock()
+	defer m.controllersMu.RUnlock()
+
+	ctrl := m.controllers[stateURI]
+	if ctrl == nil {
+		return nil, errors.Wrapf(ErrNoController, stateURI)
+	}
+	return ctrl, nil
+}
+
+// MempoolLen returns the number of txs waiting to be processed across all stateURIs.
+func (m *metacontroller) MempoolLen() int {
+	m.controllersMu.RLock()
+	defer m.controllersMu.RUnlock()
+
+	var n int
+	for _, ctrl := range m.controllers {
+		n += ctrl.MempoolLen()
+	}
+	return n
+}
+
 var (
 	ErrInvalidPrivateRootKey = errors.New("invalid private root key")
 )
 
-func (m *metacontroller) AddTx(tx *Tx) error {
+// checkPrivateRootKey returns ErrInvalidPrivateRootKey if the tx is private and its
+// stateURI doesn't end in the root key for its recipients.
+func checkPrivateRootKey(tx *Tx) error {
 	if tx.IsPrivate() {
 		parts := strings.Split(tx.URL, "/")
 		if parts[len(parts)-1] != tx.PrivateRootKey() {
 			return ErrInvalidPrivateRootKey
 		}
 	}
+	return nil
+}
 
-	ctrl, err := m.ensureController(tx.URL)
+func (m *metacontroller) AddTx(tx *Tx) error {
+	ctrl, err := m.controllerForTx(tx)
 	if err != nil {
 		return err
 	}
@@ -430,8 +523,41 @@ func (m *metacontroller) AddTx(tx *Tx) error {
 	return nil
 }
 
+func (m *metacontroller) AddTxAndWait(ctx context.Context, tx *Tx) error {
+	ctrl, err := m.controllerForTx(tx)
+	if err != nil {
+		return err
+	}
+	return ctrl.AddTxAndWait(ctx, tx)
+}
+
+// DryRunTx checks the tx against the current state of its stateURI without applying it
+// (see Controller.DryRunTx).  Unlike AddTx, it won't set up a controller for a stateURI
+// that we don't already have.
+func (m *metacontroller) DryRunTx(tx *Tx) (tree.Node, error) {
+	err := checkPrivateRootKey(tx)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := m.ControllerForStateURI(tx.URL)
+	if err != nil {
+		return nil, err
+	}
+	return ctrl.DryRunTx(tx)
+}
+
+func (m *metacontroller) controllerForTx(tx *Tx) (Controller, error) {
+	err := checkPrivateRootKey(tx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ensureController(tx.URL)
+}
+
+// FetchTxs returns the txs for the given stateURI in topological order, so that each tx
+// comes after all of its parents.
 func (m *metacontroller) FetchTxs(stateURI string) TxIterator {
-	return m.txStore.AllTxsForStateURI(stateURI)
+	return newTopologicalTxIterator(m.txStore.AllTxsForStateURI(stateURI))
 }
 
 func (m *metacontroller) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
@@ -439,14 +565,12 @@ func (m *metacontroller) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
 }
 
 func (m *metacontroller) HaveTx(stateURI string, txID types.ID) bool {
-	m.controllersMu.RLock()
-	defer m.controllersMu.RUnlock()
-
-	ctrl := m.controllers[stateURI]
-	if ctrl == nil {
+	exists, err := m.txStore.TxExists(stateURI, txID)
+	if err != nil {
+		m.Errorf("error checking for tx %v: %v", txID.Pretty(), err)
 		return false
 	}
-	return ctrl.HaveTx(txID)
+	return exists
 }
 
 func (m *metacontroller) StateAtVersion(stateURI string, version *types.ID) (tree.Node, error) {
@@ -471,10 +595,90 @@ func (m *metacontroller) QueryIndex(stateURI string, version *types.ID, keypath
 	return ctrl.QueryIndex(version, keypath, indexName, queryParam, rng)
 }
 
+func (m *metacontroller) QueryIndexPage(stateURI string, version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, cursor tree.Keypath, limit int) (IndexPage, error) {
+	m.controllersMu.RLock()
+	defer m.controllersMu.RUnlock()
+
+	ctrl := m.controllers[stateURI]
+	if ctrl == nil {
+		return IndexPage{}, errors.Wrapf(ErrNoController, stateURI)
+	}
+	return ctrl.QueryIndexPage(version, keypath, indexName, queryParam, cursor, limit)
+}
+
 func (m *metacontroller) RefObjectReader(refHash types.Hash) (io.ReadCloser, int64, error) {
 	return m.refStore.Object(refHash)
 }
 
+func (m *metacontroller) RefObjectContentType(refHash types.Hash) (string, error) {
+	return m.refStore.ContentType(refHash)
+}
+
+// GarbageCollectRefs deletes every unpinned ref that isn't linked from the current state
+// of any stateURI, and returns the hashes of the refs it deleted.  The ref store is shared
+// by every stateURI, so a ref survives as long as any one of them still links to it.
+func (m *metacontroller) GarbageCollectRefs() ([]types.Hash, error) {
+	m.refGCMu.Lock()
+	defer m.refGCMu.Unlock()
+
+	referenced := make(map[types.Hash]struct{})
+	for _, stateURI := range m.KnownStateURIs() {
+		state, err := m.StateAtVersion(stateURI, nil)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := refsInState(state)
+		state.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range refs {
+			referenced[hash] = struct{}{}
+		}
+	}
+	return m.refStore.GarbageCollect(referenced)
+}
+
+// refsInState returns the hashes of all of the refs linked from the given state.
+func refsInState(state tree.Node) ([]types.Hash, error) {
+	var refs []types.Hash
+	iter := state.DepthFirstIterator(nil, false, 0)
+	defer iter.Close()
+	for {
+		node := iter.Next()
+		if node == nil {
+			break
+		}
+
+		parentKeypath, key := node.Keypath().Pop()
+		if !key.Equals(nelson.ValueKey) {
+			continue
+		}
+
+		contentType, err := nelson.GetContentType(state.AtKeypath(parentKeypath, nil))
+		if err != nil && !errors.Is(err, types.Err404) {
+			return nil, err
+		} else if contentType != "link" {
+			continue
+		}
+
+		linkStr, _, err := node.StringValue(nil)
+		if err != nil {
+			return nil, err
+		}
+		linkType, linkValue := nelson.DetermineLinkType(linkStr)
+		if linkType != nelson.LinkTypeRef {
+			continue
+		}
+		hash, err := types.HashFromHex(linkValue)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, hash)
+	}
+	return refs, nil
+}
+
 func (m *metacontroller) Leaves(stateURI string) (map[types.ID]struct{}, error) {
 	m.controllersMu.RLock()
 	defer m.controllersMu.RUnlock()
@@ -490,6 +694,30 @@ func (m *metacontroller) SetReceivedRefsHandler(handler ReceivedRefsHandler) {
 	m.receivedRefsHandler = handler
 }
 
+// SetTxRejectedHandler sets the handler that's called whenever the controller of any
+// stateURI permanently rejects a tx.
+func (m *metacontroller) SetTxRejectedHandler(handler TxRejectedHandler) {
+	m.controllersMu.Lock()
+	defer m.controllersMu.Unlock()
+
+	m.txRejectedHandler = handler
+	for _, ctrl := range m.controllers {
+		ctrl.SetTxRejectedHandler(handler)
+	}
+}
+
+// SetFetchingParentsChecker sets the checker that keeps the controller of every stateURI
+// from expiring txs whose parents are still being fetched.
+func (m *metacontroller) SetFetchingParentsChecker(checker FetchingParentsChecker) {
+	m.controllersMu.Lock()
+	defer m.controllersMu.Unlock()
+
+	m.fetchingParents = checker
+	for _, ctrl := range m.controllers {
+		ctrl.SetFetchingParentsChecker(checker)
+	}
+}
+
 func (m *metacontroller) OnDownloadedRef() {
 	m.controllersMu.RLock()
 	defer m.controllersMu.RUnlock()
@@ -0,0 +1,326 @@
+package redwood
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/nelson"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func newTestMetacontroller(t *testing.T) (Metacontroller, RefStore) {
+	t.Helper()
+	return newTestMetacontrollerWithTxLimits(t, DefaultTxLimits)
+}
+
+func newTestMetacontrollerWithTxLimits(t *testing.T, txLimits TxLimits) (Metacontroller, RefStore) {
+	t.Helper()
+
+	dbRoot, err := ioutil.TempDir("", "redwood-test-metacontroller")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	txStore := NewBadgerTxStoreWithOptions(filepath.Join(dbRoot, "txs"), types.Address{}, testDBOptions)
+	refStore := NewRefStore(filepath.Join(dbRoot, "refs"), "")
+
+	m := NewMetacontrollerWithDBOptions(types.Address{}, dbRoot, txStore, refStore, txLimits, testDBOptions)
+	err = m.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Ctx().CtxStop("test finished", nil) })
+	return m, refStore
+}
+
+// initialIndexer indexes nodes by the first letter of the string at a keypath.
+type initialIndexer struct {
+	keypath tree.Keypath
+}
+
+func (i *initialIndexer) IndexKeyForNode(node tree.Node) ([]tree.Keypath, error) {
+	s, exists, err := node.StringValue(i.keypath)
+	if err != nil && !errors.Is(err, types.Err404) {
+		return nil, err
+	} else if !exists || len(s) == 0 {
+		return nil, nil
+	}
+	return []tree.Keypath{tree.Keypath(s[:1])}, nil
+}
+
+func TestMetacontroller_RegisteredIndexerDeclaredInState(t *testing.T) {
+	RegisterIndexer("indexer/test-initial", func(config tree.Node) (Indexer, error) {
+		keypath, exists, err := config.StringValue(tree.Keypath("keypath"))
+		if err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, errors.New("missing keypath")
+		}
+		return &initialIndexer{keypath: tree.Keypath(keypath)}, nil
+	})
+
+	m, _ := newTestMetacontroller(t)
+
+	alice := map[string]interface{}{"name": "alice"}
+	adam := map[string]interface{}{"name": "adam"}
+	bob := map[string]interface{}{"name": "bob"}
+
+	err := m.AddTx(signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: tree.Keypath("people"),
+			Val: map[string]interface{}{
+				"Index-Type": map[string]interface{}{
+					"by-initial": map[string]interface{}{
+						"Content-Type": "indexer/test-initial",
+						"value":        map[string]interface{}{"keypath": "name"},
+					},
+				},
+				"p1": alice,
+				"p2": adam,
+				"p3": bob,
+			},
+		}},
+	}))
+	require.NoError(t, err)
+
+	// Building the index can outlast a tick, and then the checks overlap, so they mustn't
+	// share anything
+	require.Eventually(t, func() bool {
+		node, err := m.QueryIndex("localhost/test", nil, tree.Keypath("people"), tree.Keypath("by-initial"), tree.Keypath("a"), nil)
+		if err != nil {
+			return false
+		}
+		node.Close()
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	node, err := m.QueryIndex("localhost/test", nil, tree.Keypath("people"), tree.Keypath("by-initial"), tree.Keypath("a"), nil)
+	require.NoError(t, err)
+	val, exists, err := node.Value(nil, nil)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, map[string]interface{}{"p1": alice, "p2": adam}, val)
+
+	node, err = m.QueryIndex("localhost/test", nil, tree.Keypath("people"), tree.Keypath("by-initial"), tree.Keypath("b"), nil)
+	require.NoError(t, err)
+	val, exists, err = node.Value(nil, nil)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, map[string]interface{}{"p3": bob}, val)
+}
+
+// upperResolver sets the string values it's given in upper case.
+type upperResolver struct{}
+
+func (r *upperResolver) InternalState() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (r *upperResolver) ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, patches []Patch) error {
+	for _, p := range patches {
+		if s, isString := p.Val.(string); isString {
+			p.Val = strings.ToUpper(s)
+		}
+		err := state.Set(p.Keypath, p.Range, p.Val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMetacontroller_ResolverInstalledByTx(t *testing.T) {
+	RegisterResolver("resolver/test-upper", func(config tree.Node, internalState map[string]interface{}) (Resolver, error) {
+		return &upperResolver{}, nil
+	})
+
+	m, _ := newTestMetacontroller(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("greeting"), Val: "hello"}},
+	}))
+	require.NoError(t, err)
+
+	// Install a resolver at .sub
+	err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("one"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{{
+			Keypath: tree.Keypath("sub"),
+			Val: map[string]interface{}{
+				"Merge-Type": map[string]interface{}{
+					"Content-Type": "resolver/test-upper",
+					"value":        map[string]interface{}{},
+				},
+			},
+		}},
+	}))
+	require.NoError(t, err)
+
+	// The next tx's patches beneath .sub go through it, and the rest don't
+	err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("two"),
+		Parents: []types.ID{types.IDFromString("one")},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("sub/greeting"), Val: "hello"},
+			{Keypath: tree.Keypath("greeting"), Val: "hi"},
+		},
+	}))
+	require.NoError(t, err)
+
+	state, err := m.StateAtVersion("localhost/test", nil)
+	require.NoError(t, err)
+	defer state.Close()
+
+	val, _, err := state.StringValue(tree.Keypath("sub/greeting"))
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", val)
+
+	val, _, err = state.StringValue(tree.Keypath("greeting"))
+	require.NoError(t, err)
+	require.Equal(t, "hi", val)
+}
+
+func TestMetacontroller_GarbageCollectRefsSpansStateURIs(t *testing.T) {
+	m, refStore := newTestMetacontroller(t)
+
+	shared, _, err := refStore.StoreObject(ioutil.NopCloser(strings.NewReader("shared")), "text/plain")
+	require.NoError(t, err)
+	orphan, _, err := refStore.StoreObject(ioutil.NopCloser(strings.NewReader("orphan")), "text/plain")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	link := func(ref types.Hash) map[string]interface{} {
+		return map[string]interface{}{"Content-Type": "link", "value": "ref:" + ref.Hex()}
+	}
+
+	// Both stateURIs link to the same ref
+	for _, stateURI := range []string{"localhost/a", "localhost/b"} {
+		err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+			ID:      GenesisTxID,
+			URL:     stateURI,
+			Patches: []Patch{{Keypath: tree.Keypath("file"), Val: link(shared)}},
+		}))
+		require.NoError(t, err)
+	}
+
+	// One of them stops linking to it
+	err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("one"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/a",
+		Patches: []Patch{{Keypath: tree.Keypath("file"), Val: "nothing to see here"}},
+	}))
+	require.NoError(t, err)
+
+	removed, err := m.GarbageCollectRefs()
+	require.NoError(t, err)
+	require.Equal(t, []types.Hash{orphan}, removed)
+	require.True(t, refStore.HaveObject(shared))
+	require.False(t, refStore.HaveObject(orphan))
+
+	// Once neither of them links to it, it's collected
+	err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:      types.IDFromString("one"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/b",
+		Patches: []Patch{{Keypath: tree.Keypath("file"), Val: "nothing to see here"}},
+	}))
+	require.NoError(t, err)
+
+	removed, err = m.GarbageCollectRefs()
+	require.NoError(t, err)
+	require.Equal(t, []types.Hash{shared}, removed)
+	require.False(t, refStore.HaveObject(shared))
+}
+
+func TestMetacontroller_ContentTypeRoundTripsThroughState(t *testing.T) {
+	m, _ := newTestMetacontroller(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Txs arrive as JSON, so decode the patch the way a received tx would be
+	var image map[string]interface{}
+	err := json.Unmarshal([]byte(`{"Content-Type": "image/png", "Content-Length": 1234, "value": "..."}`), &image)
+	require.NoError(t, err)
+
+	err = m.AddTxAndWait(ctx, signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{Keypath: nil, Val: map[string]interface{}{
+			"image":     image,
+			"lowercase": map[string]interface{}{"content-type": "image/png", "value": "..."},
+			"plain":     "just a string",
+		}}},
+	}))
+	require.NoError(t, err)
+
+	state, err := m.StateAtVersion("localhost/test", nil)
+	require.NoError(t, err)
+	defer state.Close()
+
+	contentType, err := nelson.GetContentType(state.AtKeypath(tree.Keypath("image"), nil))
+	require.NoError(t, err)
+	require.Equal(t, "image/png", contentType)
+	contentLength, err := nelson.GetContentLength(state.AtKeypath(tree.Keypath("image"), nil))
+	require.NoError(t, err)
+	require.Equal(t, int64(1234), contentLength)
+
+	// Only the canonical spelling of the key counts
+	contentType, err = nelson.GetContentType(state.AtKeypath(tree.Keypath("lowercase"), nil))
+	require.NoError(t, err)
+	require.Equal(t, "application/json", contentType)
+
+	// Values that aren't frames have the length of the value itself
+	contentLength, err = nelson.GetContentLength(state.AtKeypath(tree.Keypath("plain"), nil))
+	require.NoError(t, err)
+	require.Equal(t, int64(len("just a string")), contentLength)
+
+	// The setters write the same keys that the getters (and the resolved frames) read
+	node := tree.NewMemoryNode()
+	err = node.Set(nelson.ValueKey, nil, "...")
+	require.NoError(t, err)
+	err = nelson.SetContentType(node, "video/mp4")
+	require.NoError(t, err)
+	err = nelson.SetContentLength(node, 5678)
+	require.NoError(t, err)
+
+	val, _, err := node.Value(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"Content-Type": "video/mp4", "Content-Length": int64(5678), "value": "..."}, val)
+
+	contentType, err = nelson.GetContentType(node)
+	require.NoError(t, err)
+	require.Equal(t, "video/mp4", contentType)
+	contentLength, err = nelson.GetContentLength(node)
+	require.NoError(t, err)
+	require.Equal(t, int64(5678), contentLength)
+
+	frame, _, err := nelson.Resolve(node, m)
+	require.NoError(t, err)
+	contentType, err = nelson.GetContentType(frame)
+	require.NoError(t, err)
+	require.Equal(t, "video/mp4", contentType)
+	contentLength, err = nelson.GetContentLength(frame)
+	require.NoError(t, err)
+	require.Equal(t, int64(5678), contentLength)
+}
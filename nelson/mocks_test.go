@@ -22,3 +22,7 @@ func (m *refResolverMock) State(stateURI string, version types.ID) (tree.Node, e
 func (m *refResolverMock) RefObjectReader(refHash types.Hash) (io.ReadCloser, int64, error) {
 	return nil, 0, nil
 }
+
+func (m *refResolverMock) RefObjectContentType(refHash types.Hash) (string, error) {
+	return "", nil
+}
@@ -2,7 +2,6 @@ package nelson
 
 import (
 	"encoding/json"
-	goerrors "errors"
 	"io"
 	"os"
 	"strings"
@@ -22,12 +21,20 @@ type Frame struct {
 	err           error
 }
 
+// The keys of a NelSON frame, spelled exactly as they appear in state.  A frame whose
+// Content-Type is under any other spelling (such as "content-type") doesn't have one, and
+// is treated as "application/json".  Use SetContentType and SetContentLength to write them.
 var (
 	ValueKey         = tree.Keypath("value")
 	ContentTypeKey   = tree.Keypath("Content-Type")
 	ContentLengthKey = tree.Keypath("Content-Length")
 )
 
+// ErrRefNotAvailable is returned when reading a NelSON frame that links to a ref that
+// isn't in the local ref store yet.  Unlike a keypath that doesn't exist, the frame will
+// have a value once the ref has been fetched.
+var ErrRefNotAvailable = errors.New("ref not yet available")
+
 func (n *Frame) ContentType() (string, error) {
 	if n.contentType != "" {
 		return n.contentType, nil
@@ -60,6 +67,8 @@ func (n *Frame) Value(keypath tree.Keypath, rng *tree.Range) (interface{}, bool,
 	// @@TODO: how do we handle overrideValue if there's a keypath/range?
 	if n.overrideValue != nil {
 		return n.overrideValue, true, nil
+	} else if errors.Is(n.err, ErrRefNotAvailable) {
+		return nil, false, n.err
 	}
 	//return n.Node.Value(keypath, rng)
 	return GetValueRecursive(n.Node, keypath, rng)
@@ -67,6 +76,10 @@ func (n *Frame) Value(keypath tree.Keypath, rng *tree.Range) (interface{}, bool,
 
 func (n *Frame) MarshalJSON() ([]byte, error) {
 	val, exists, err := GetValueRecursive(n, nil, nil)
+	if errors.Is(err, ErrRefNotAvailable) {
+		// Leave the link in place so that the rest of the document can still be served
+		val, exists, err = GetValueRecursive(n.Node, nil, nil)
+	}
 	if err != nil {
 		return nil, err
 	} else if !exists {
@@ -86,6 +99,7 @@ func (n *Frame) ValueNode() tree.Node {
 type ReferenceResolver interface {
 	StateAtVersion(stateURI string, version *types.ID) (tree.Node, error)
 	RefObjectReader(refHash types.Hash) (io.ReadCloser, int64, error)
+	RefObjectContentType(refHash types.Hash) (string, error)
 }
 
 func Resolve(frameNode tree.Node, refResolver ReferenceResolver) (tree.Node, bool, error) {
@@ -135,11 +149,11 @@ func Resolve(frameNode tree.Node, refResolver ReferenceResolver) (tree.Node, boo
 			for {
 				// Innermost Content-Length wins
 				if n.contentLength == 0 {
-					contentLength, exists, err := frameNode.IntValue(parentKeypath.Push(ContentLengthKey))
+					val, exists, err := frameNode.Value(parentKeypath.Push(ContentLengthKey), nil)
 					if err != nil {
 						return nil, false, err
 					}
-					if exists {
+					if contentLength, isInt := asContentLength(val); exists && isInt {
 						n.contentLength = contentLength
 					}
 				}
@@ -160,7 +174,7 @@ func Resolve(frameNode tree.Node, refResolver ReferenceResolver) (tree.Node, boo
 
 				if !newKey.Equals(ValueKey) {
 					if len(parentKeypath) == 0 {
-						return n, false, nil
+						return n, anyMissing, nil
 
 					} else {
 						err := frameNode.Set(parentKeypath, nil, n)
@@ -196,20 +210,30 @@ func resolveLink(n *Frame, linkStr string, refResolver ReferenceResolver) {
 			return
 		}
 		reader, contentLength, err := refResolver.RefObjectReader(hash)
-		if goerrors.Is(err, os.ErrNotExist) {
-			n.err = types.Err404
+		if errors.Is(err, os.ErrNotExist) {
+			n.err = errors.Wrapf(ErrRefNotAvailable, "ref %v", hash.Hex())
 			n.fullyResolved = false
 			return
 		} else if err != nil {
 			n.err = err
 			n.fullyResolved = false
 			return
-		} else {
-			n.overrideValue = reader
-			n.contentLength = contentLength
-			n.fullyResolved = true
+		}
+
+		// The ref's stored Content-Type takes precedence over anything declared in
+		// enclosing frames, since it describes the blob itself.
+		contentType, err := refResolver.RefObjectContentType(hash)
+		if err != nil {
+			reader.Close()
+			n.err = err
+			n.fullyResolved = false
 			return
 		}
+		n.contentType = contentType
+		n.overrideValue = reader
+		n.contentLength = contentLength
+		n.fullyResolved = true
+		return
 
 	} else if linkType == LinkTypePath {
 		parts := strings.Split(linkValue, "/")
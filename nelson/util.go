@@ -112,7 +112,7 @@ func GetContentType(val interface{}) (string, error) {
 
 	case tree.Node:
 		contentType, exists, err := GetValueRecursive(v, ContentTypeKey, nil)
-		if err != nil && errors.Cause(err) == types.Err404 {
+		if err != nil && errors.Is(err, types.Err404) {
 			return "application/json", nil
 		} else if err != nil {
 			return "", err
@@ -127,26 +127,61 @@ func GetContentType(val interface{}) (string, error) {
 	}
 }
 
+// GetContentLength returns the Content-Length of a resolved NelSON frame, or of an
+// unresolved one in state.  For any other node, it's the length of the node's own value.
 func GetContentLength(val interface{}) (int64, error) {
 	switch v := val.(type) {
-	case ContentLengther:
+	case *Frame:
 		return v.ContentLength()
 
 	case tree.Node:
+		// tree.Nodes are ContentLengthers too, so the Content-Length key has to be checked
+		// before falling back to the length of the node itself
 		contentLength, exists, err := GetValueRecursive(v, ContentLengthKey, nil)
-		if err != nil {
+		if err != nil && !errors.Is(err, types.Err404) {
 			return 0, err
 		}
-		if i, isInt := contentLength.(int64); exists && isInt {
+		if i, isInt := asContentLength(contentLength); exists && isInt {
 			return i, nil
 		}
-		return 0, nil
+		return v.ContentLength()
+
+	case ContentLengther:
+		return v.ContentLength()
 
 	default:
 		return 0, nil
 	}
 }
 
+// SetContentType sets the Content-Type of the NelSON frame at node.
+func SetContentType(node tree.Node, contentType string) error {
+	return node.Set(ContentTypeKey, nil, contentType)
+}
+
+// SetContentLength sets the Content-Length of the NelSON frame at node.
+func SetContentLength(node tree.Node, contentLength int64) error {
+	return node.Set(ContentLengthKey, nil, contentLength)
+}
+
+// asContentLength converts a Content-Length read out of state into an int64.  Lengths
+// usually arrive as int64s, but a tx can just as well carry one as a float64.
+func asContentLength(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, false
+		}
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
 type LinkType int
 
 const (
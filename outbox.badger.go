@@ -0,0 +1,158 @@
+package redwood
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// Each entry is stored under its recipient and tx ID, and indexed under the time of its
+// next attempt (big-endian, so that the index is in time order), its recipient, and its
+// tx ID.
+var (
+	outboxEntryPrefix = []byte("entry:")
+	outboxDuePrefix   = []byte("due:")
+)
+
+type badgerOutbox struct {
+	*badgerStore
+	options OutboxOptions
+}
+
+func NewBadgerOutbox(dbFilename string, address types.Address, dbOptions tree.DBTreeOptions, options OutboxOptions) Outbox {
+	return &badgerOutbox{
+		badgerStore: newBadgerStore("outbox", dbFilename, address, dbOptions),
+		options:     options,
+	}
+}
+
+func (o *badgerOutbox) Options() OutboxOptions {
+	return o.options
+}
+
+func (o *badgerOutbox) entryKey(recipient types.Address, txID types.ID) []byte {
+	return o.key(outboxEntryPrefix, recipient[:], txID[:])
+}
+
+func (o *badgerOutbox) dueKey(entry OutboxEntry) []byte {
+	var at [8]byte
+	binary.BigEndian.PutUint64(at[:], uint64(entry.NextAttempt.UnixNano()))
+	return o.key(outboxDuePrefix, at[:], entry.Recipient[:], entry.Tx.ID[:])
+}
+
+func (o *badgerOutbox) PutEntry(entry OutboxEntry) error {
+	key := o.entryKey(entry.Recipient, entry.Tx.ID)
+	return o.update(func(txn *badger.Txn) error {
+		old, exists, err := o.getEntry(txn, key)
+		if err != nil {
+			return err
+		} else if exists {
+			err = txn.Delete(o.dueKey(old))
+			if err != nil {
+				return err
+			}
+		} else if o.options.MaxEntries > 0 && o.countRecords(txn, o.key(outboxEntryPrefix)) >= o.options.MaxEntries {
+			return errors.WithStack(ErrOutboxFull)
+		}
+
+		err = o.putRecord(txn, key, entry)
+		if err != nil {
+			return err
+		}
+		return txn.Set(o.dueKey(entry), nil)
+	})
+}
+
+func (o *badgerOutbox) RemoveEntry(recipient types.Address, txID types.ID) error {
+	key := o.entryKey(recipient, txID)
+	return o.update(func(txn *badger.Txn) error {
+		entry, exists, err := o.getEntry(txn, key)
+		if err != nil || !exists {
+			return err
+		}
+		err = txn.Delete(o.dueKey(entry))
+		if err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
+func (o *badgerOutbox) Entries() ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	err := o.view(func(txn *badger.Txn) error {
+		return o.scanRecords(txn, o.key(outboxEntryPrefix), func(key, val []byte) error {
+			var entry OutboxEntry
+			err := json.Unmarshal(val, &entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+var errOutboxScanDone = errors.New("done")
+
+// DueEntries returns up to limit of the entries whose next attempt is due by the given
+// time, soonest first.  Only the index of the due ones is read.
+func (o *badgerOutbox) DueEntries(now time.Time, limit int) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	err := o.view(func(txn *badger.Txn) error {
+		prefix := o.key(outboxDuePrefix)
+		err := o.scanRecords(txn, prefix, func(key, val []byte) error {
+			if len(entries) >= limit {
+				return errOutboxScanDone
+			}
+			suffix := key[len(prefix):]
+			if len(suffix) != 8+len(types.Address{})+len(types.ID{}) {
+				return errors.Errorf("bad outbox index key %x", key)
+			}
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(suffix[:8])))
+			if at.After(now) {
+				return errOutboxScanDone
+			}
+			recipient := types.AddressFromBytes(suffix[8 : 8+len(types.Address{})])
+			txID := types.IDFromBytes(suffix[8+len(types.Address{}):])
+
+			entry, exists, err := o.getEntry(txn, o.entryKey(recipient, txID))
+			if err != nil {
+				return err
+			} else if exists {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err == errOutboxScanDone {
+			return nil
+		}
+		return err
+	})
+	return entries, err
+}
+
+func (o *badgerOutbox) getEntry(txn *badger.Txn, key []byte) (OutboxEntry, bool, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return OutboxEntry{}, false, nil
+	} else if err != nil {
+		return OutboxEntry{}, false, err
+	}
+
+	var entry OutboxEntry
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &entry)
+	})
+	if err != nil {
+		return OutboxEntry{}, false, err
+	}
+	return entry, true, nil
+}
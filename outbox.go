@@ -0,0 +1,98 @@
+package redwood
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// Outbox holds the private txs that we couldn't deliver to some of their recipients, so
+// that the host can keep retrying them until the recipients come online.  Entries are
+// indexed by the time of their next attempt, so that the ones that are due can be found
+// without going through the rest.
+type Outbox interface {
+	Ctx() *ctx.Context
+	Start() error
+
+	Options() OutboxOptions
+	PutEntry(entry OutboxEntry) error
+	RemoveEntry(recipient types.Address, txID types.ID) error
+	Entries() ([]OutboxEntry, error)
+	DueEntries(now time.Time, limit int) ([]OutboxEntry, error)
+}
+
+var (
+	ErrOutboxFull = errors.New("outbox is full")
+)
+
+// OutboxEntry is a private tx that is waiting to be delivered to one of its recipients.
+type OutboxEntry struct {
+	Tx          Tx            `json:"tx"`
+	Recipient   types.Address `json:"recipient"`
+	Enqueued    time.Time     `json:"enqueued"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt time.Time     `json:"nextAttempt"`
+}
+
+// OutboxOptions control how undelivered private txs are retried.  The delay between
+// attempts doubles after each failure, starting at MinRetryInterval and going no higher
+// than MaxRetryInterval.  An entry is dropped once it's been in the outbox for longer than
+// the TTL.  Once the outbox holds MaxEntries entries, new ones are refused with
+// ErrOutboxFull.
+type OutboxOptions struct {
+	TTL              time.Duration
+	MinRetryInterval time.Duration
+	MaxRetryInterval time.Duration
+	MaxEntries       int
+}
+
+var DefaultOutboxOptions = OutboxOptions{
+	TTL:              7 * 24 * time.Hour,
+	MinRetryInterval: 10 * time.Second,
+	MaxRetryInterval: 10 * time.Minute,
+	MaxEntries:       10000,
+}
+
+// check returns an error if the outbox couldn't be retried with the options.
+func (options OutboxOptions) check() error {
+	if options.MinRetryInterval <= 0 {
+		return errors.Errorf("outbox MinRetryInterval must be positive (got %v)", options.MinRetryInterval)
+	} else if options.MaxRetryInterval < options.MinRetryInterval {
+		return errors.Errorf("outbox MaxRetryInterval (%v) is less than MinRetryInterval (%v)", options.MaxRetryInterval, options.MinRetryInterval)
+	}
+	return nil
+}
+
+func newOutboxEntry(tx Tx, recipient types.Address, now time.Time, options OutboxOptions) OutboxEntry {
+	entry := OutboxEntry{
+		Tx:        tx,
+		Recipient: recipient,
+		Enqueued:  now,
+	}
+	entry.attemptFailed(now, options)
+	return entry
+}
+
+// attemptFailed schedules the entry's next attempt after backing off.
+func (e *OutboxEntry) attemptFailed(now time.Time, options OutboxOptions) {
+	backoff := options.MinRetryInterval
+	for i := 0; i < e.Attempts && backoff < options.MaxRetryInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > options.MaxRetryInterval {
+		backoff = options.MaxRetryInterval
+	}
+	e.Attempts++
+	e.NextAttempt = now.Add(backoff)
+}
+
+func (e OutboxEntry) isDue(now time.Time) bool {
+	return !now.Before(e.NextAttempt)
+}
+
+func (e OutboxEntry) isExpired(now time.Time, options OutboxOptions) bool {
+	return options.TTL > 0 && now.Sub(e.Enqueued) > options.TTL
+}
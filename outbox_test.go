@@ -0,0 +1,104 @@
+package redwood
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestOutboxEntry_BacksOff(t *testing.T) {
+	options := OutboxOptions{
+		TTL:              time.Hour,
+		MinRetryInterval: time.Second,
+		MaxRetryInterval: 5 * time.Second,
+	}
+	now := time.Now()
+
+	entry := newOutboxEntry(Tx{ID: types.RandomID()}, types.Address{0xa}, now, options)
+	require.Equal(t, 1, entry.Attempts)
+	require.Equal(t, now.Add(time.Second), entry.NextAttempt)
+	require.False(t, entry.isDue(now))
+	require.True(t, entry.isDue(now.Add(time.Second)))
+
+	var backoffs []time.Duration
+	for i := 0; i < 4; i++ {
+		entry.attemptFailed(now, options)
+		backoffs = append(backoffs, entry.NextAttempt.Sub(now))
+	}
+	require.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, backoffs)
+
+	require.False(t, entry.isExpired(now.Add(time.Hour), options))
+	require.True(t, entry.isExpired(now.Add(time.Hour+time.Second), options))
+}
+
+func TestBadgerOutbox_DueEntriesAndLimit(t *testing.T) {
+	dbRoot, err := ioutil.TempDir("", "redwood-test-outbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dbRoot) })
+
+	options := OutboxOptions{
+		TTL:              time.Hour,
+		MinRetryInterval: time.Second,
+		MaxRetryInterval: time.Minute,
+		MaxEntries:       3,
+	}
+	outbox := NewBadgerOutbox(filepath.Join(dbRoot, "outbox"), types.Address{0xa}, testDBOptions, options)
+	require.NoError(t, outbox.Start())
+	t.Cleanup(func() { outbox.Ctx().CtxStop("test finished", nil) })
+
+	now := time.Now()
+	entry := func(recipient types.Address, nextAttempt time.Duration) OutboxEntry {
+		return OutboxEntry{Tx: Tx{ID: types.RandomID()}, Recipient: recipient, Enqueued: now, Attempts: 1, NextAttempt: now.Add(nextAttempt)}
+	}
+	bob, carol := types.Address{0xb}, types.Address{0xc}
+	later := entry(bob, time.Minute)
+	soon := entry(carol, -time.Second)
+	sooner := entry(bob, -time.Minute)
+	for _, e := range []OutboxEntry{later, soon, sooner} {
+		require.NoError(t, outbox.PutEntry(e))
+	}
+
+	txIDs := func(entries []OutboxEntry) []types.ID {
+		var ids []types.ID
+		for _, e := range entries {
+			ids = append(ids, e.Tx.ID)
+		}
+		return ids
+	}
+
+	// Only the due entries come back, soonest first
+	due, err := outbox.DueEntries(now, 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.ID{sooner.Tx.ID, soon.Tx.ID}, txIDs(due))
+	due, err = outbox.DueEntries(now, 1)
+	require.NoError(t, err)
+	require.Equal(t, []types.ID{sooner.Tx.ID}, txIDs(due))
+
+	// Rescheduling an entry moves it in the index
+	sooner.attemptFailed(now, options)
+	require.NoError(t, outbox.PutEntry(sooner))
+	due, err = outbox.DueEntries(now, 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.ID{soon.Tx.ID}, txIDs(due))
+	due, err = outbox.DueEntries(now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.ID{soon.Tx.ID, sooner.Tx.ID, later.Tx.ID}, txIDs(due))
+
+	// The outbox is full, but existing entries can still be updated
+	err = outbox.PutEntry(entry(carol, 0))
+	require.Equal(t, ErrOutboxFull, errors.Cause(err))
+	require.NoError(t, outbox.PutEntry(later))
+
+	require.NoError(t, outbox.RemoveEntry(soon.Recipient, soon.Tx.ID))
+	due, err = outbox.DueEntries(now, 10)
+	require.NoError(t, err)
+	require.Empty(t, due)
+	require.NoError(t, outbox.PutEntry(entry(carol, 0)))
+}
@@ -1,7 +1,7 @@
 package redwood
 
 import (
-	"encoding/json"
+	"bytes"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -25,6 +25,9 @@ func ParsePatch(s []byte) (Patch, error) {
 			i += len(key) + 1
 
 		case '[':
+			if i+1 >= len(s) {
+				return Patch{}, errors.WithStack(ErrBadPatch)
+			}
 			switch s[i+1] {
 			case '"', '\'':
 				key, err := parseBracketKey(s[i:])
@@ -34,25 +37,39 @@ func ParsePatch(s []byte) (Patch, error) {
 				patch.Keypath = patch.Keypath.Push(key)
 				i += len(key) + 4
 
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 				rng, length, err := parseRange(s[i:])
 				if err != nil {
 					return Patch{}, err
 				}
 				patch.Range = rng
 				i += length
+
+			default:
+				return Patch{}, errors.WithStack(ErrBadPatch)
 			}
 
 		case ' ', '=':
-			for s[i] != '=' {
+			if bytes.Equal(s[i:], []byte(" delete")) {
+				patch.Delete = true
+				return patch, nil
+			}
+			for i < len(s) && s[i] != '=' {
 				i++
 			}
+			if i == len(s) {
+				return Patch{}, errors.WithStack(ErrBadPatch)
+			}
 			i++
-			err := json.Unmarshal([]byte(s[i:]), &patch.Val)
+			val, err := decodeJSONValue(s[i:])
 			if err != nil {
 				return Patch{}, errors.Wrapf(ErrBadPatch, err.Error())
 			}
+			patch.Val = val
 			return patch, nil
+
+		default:
+			return Patch{}, errors.WithStack(ErrBadPatch)
 		}
 	}
 	return Patch{}, errors.WithStack(ErrBadPatch)
@@ -91,7 +108,7 @@ func parseBracketKey(s []byte) ([]byte, error) {
 }
 
 func parseRange(s []byte) (*tree.Range, int, error) {
-	rng := &tree.Range{}
+	var start int64
 	haveStart := false
 	buf := []byte{}
 	// start at index 1, skip [
@@ -104,20 +121,19 @@ func parseRange(s []byte) (*tree.Range, int, error) {
 			if err != nil {
 				return nil, 0, errors.WithStack(ErrBadPatch)
 			}
-			rng[1] = end
-			return rng, i + 1, nil
+			return &tree.Range{start, end}, i + 1, nil
 
 		} else if s[i] == ':' {
 			if haveStart {
 				return nil, 0, errors.WithStack(ErrBadPatch)
 			}
 
-			start, err := strconv.ParseInt(string(buf), 10, 64)
+			var err error
+			start, err = strconv.ParseInt(string(buf), 10, 64)
 			if err != nil {
 				return nil, 0, errors.WithStack(ErrBadPatch)
 			}
 			buf = []byte{}
-			rng[0] = start
 			haveStart = true
 		} else {
 			buf = append(buf, s[i])
@@ -1,6 +1,8 @@
 package redwood
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/brynbellomy/redwood/ctx"
@@ -12,6 +14,16 @@ type PeerStore interface {
 	AddVerifiedCredentials(transportName string, reachableAt StringSet, address types.Address, sigpubkey SigningPublicKey, encpubkey EncryptingPublicKey)
 	PeerTuples() []peerTuple
 	PeersWithAddress(address types.Address) []*storedPeer
+	Peers() []PeerInfo
+}
+
+// PeerInfo describes a peer in the peer store.  A peer is only Verified (and only has an
+// Address) once it has proven that it holds the address's keys.  Until then, each of the
+// places it's reachable at is listed as a separate peer.
+type PeerInfo struct {
+	Address     types.Address
+	Verified    bool
+	ReachableAt map[string][]string // map[transportName][]reachableAt
 }
 
 type peerStore struct {
@@ -132,6 +144,34 @@ func (s *peerStore) PeersWithAddress(address types.Address) []*storedPeer {
 	return peers
 }
 
+// Peers lists the peers in the store, verified ones first, grouped by address.
+func (s *peerStore) Peers() []PeerInfo {
+	s.muPeers.RLock()
+	defer s.muPeers.RUnlock()
+
+	var peers []PeerInfo
+	for address, storedPeers := range s.peersWithAddress {
+		info := PeerInfo{Address: address, Verified: true, ReachableAt: make(map[string][]string)}
+		for tuple := range storedPeers {
+			info.ReachableAt[tuple.TransportName] = append(info.ReachableAt[tuple.TransportName], tuple.ReachableAt)
+		}
+		for _, reachableAt := range info.ReachableAt {
+			sort.Strings(reachableAt)
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address.Hex() < peers[j].Address.Hex() })
+
+	var maybePeers []PeerInfo
+	for tuple := range s.maybePeers {
+		maybePeers = append(maybePeers, PeerInfo{ReachableAt: map[string][]string{tuple.TransportName: {tuple.ReachableAt}}})
+	}
+	sort.Slice(maybePeers, func(i, j int) bool {
+		return fmt.Sprint(maybePeers[i].ReachableAt) < fmt.Sprint(maybePeers[j].ReachableAt)
+	})
+	return append(peers, maybePeers...)
+}
+
 func (sp *storedPeer) Tuples() []peerTuple {
 	var tuples []peerTuple
 	for reachableAt := range sp.reachableAt {
@@ -0,0 +1,78 @@
+package redwood
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket for each client.  A client's bucket holds up to burst
+// tokens, and refills at rate tokens per second.  Each request takes a token, and is
+// turned away if there are none left.
+type rateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// How often buckets that have refilled all the way are dropped, so that clients that have
+// gone away aren't remembered forever
+const rateLimiterSweepInterval = time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the client's bucket, and returns false if there were none.
+// A limiter with a zero rate allows everything.
+func (l *rateLimiter) allow(client string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		for c, bucket := range l.buckets {
+			if l.refill(bucket, now) >= float64(l.burst) {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, exists := l.buckets[client]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = bucket
+	}
+	if l.refill(bucket, now) < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.last = now
+	return bucket.tokens
+}
@@ -0,0 +1,47 @@
+package redwood
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	// A client can use up its burst all at once
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("a"))
+	}
+	require.False(t, l.allow("a"))
+
+	// Other clients have buckets of their own
+	require.True(t, l.allow("b"))
+
+	// Tokens come back at the configured rate
+	now = now.Add(250 * time.Millisecond)
+	require.False(t, l.allow("a"))
+	now = now.Add(250 * time.Millisecond)
+	require.True(t, l.allow("a"))
+	require.False(t, l.allow("a"))
+
+	// But never more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("a"))
+	}
+	require.False(t, l.allow("a"))
+
+	// Buckets that have refilled all the way are forgotten
+	require.Len(t, l.buckets, 1)
+
+	t.Run("zero rate is unlimited", func(t *testing.T) {
+		l := newRateLimiter(0, 0)
+		for i := 0; i < 100; i++ {
+			require.True(t, l.allow("a"))
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package redwood
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+// refAnnouncer coalesces ref announcements.  Refs enqueued within the same window are
+// announced together once the window closes, and a ref enqueued several times within a
+// window is only announced once.
+type refAnnouncer struct {
+	window   time.Duration
+	announce func(refHashes []types.Hash)
+
+	mu      sync.Mutex
+	pending map[types.Hash]struct{}
+	timer   *time.Timer
+}
+
+func newRefAnnouncer(window time.Duration, announce func(refHashes []types.Hash)) *refAnnouncer {
+	return &refAnnouncer{
+		window:   window,
+		announce: announce,
+		pending:  make(map[types.Hash]struct{}),
+	}
+}
+
+func (a *refAnnouncer) Enqueue(refHash types.Hash) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending[refHash] = struct{}{}
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.window, a.flush)
+	}
+}
+
+func (a *refAnnouncer) flush() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[types.Hash]struct{})
+	a.timer = nil
+	a.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	refHashes := make([]types.Hash, 0, len(pending))
+	for refHash := range pending {
+		refHashes = append(refHashes, refHash)
+	}
+	a.announce(refHashes)
+}
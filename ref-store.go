@@ -2,12 +2,13 @@ package redwood
 
 import (
 	"encoding/json"
-	goerrors "errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/sha3"
@@ -17,23 +18,62 @@ import (
 
 type RefStore interface {
 	Object(hash types.Hash) (io.ReadCloser, int64, error)
-	StoreObject(reader io.ReadCloser, contentType string) (types.Hash, error)
+	ContentType(hash types.Hash) (string, error)
+	StoreObject(reader io.ReadCloser, contentType string) (types.Hash, int64, error)
 	HaveObject(hash types.Hash) bool
 	AllHashes() ([]types.Hash, error)
+	CleanTemp(olderThan time.Duration) error
+
+	PartialObjectSize(hash types.Hash) (int64, error)
+	OpenPartialObject(hash types.Hash) (PartialObject, error)
+	StorePartialObject(hash types.Hash, contentType string) error
+
+	Pin(hash types.Hash) error
+	Unpin(hash types.Hash) error
+	IsPinned(hash types.Hash) (bool, error)
+	GarbageCollect(referenced map[types.Hash]struct{}) ([]types.Hash, error)
+}
+
+// RefInfo describes a ref held in a RefStore.
+type RefInfo struct {
+	Hash        types.Hash
+	ContentType string
+	Size        int64
 }
 
+// PartialObject holds whatever has been received so far of a ref that's being fetched.
+// The pieces of the ref can be written to it in any order, and concurrently.
+type PartialObject interface {
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+}
+
+var ErrRefHashMismatch = errors.New("ref content doesn't match its hash")
+
 type refStore struct {
 	rootPath   string
+	tempPath   string
 	fileMu     sync.Mutex
 	metadataMu sync.Mutex
 }
 
-func NewRefStore(rootPath string) RefStore {
-	return &refStore{rootPath: rootPath}
+// NewRefStore returns a RefStore that keeps refs in rootPath.  Refs are written to
+// tempPath while they're being stored, which defaults to rootPath when empty.  Keeping
+// them on the same filesystem lets a stored ref be moved into place atomically.
+func NewRefStore(rootPath, tempPath string) RefStore {
+	if tempPath == "" {
+		tempPath = rootPath
+	}
+	return &refStore{rootPath: rootPath, tempPath: tempPath}
 }
 
 func (s *refStore) ensureRootPath() error {
-	return os.MkdirAll(s.rootPath, 0755)
+	err := os.MkdirAll(s.rootPath, 0755)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(s.tempPath, 0755)
 }
 
 func (s *refStore) Object(hash types.Hash) (io.ReadCloser, int64, error) {
@@ -56,31 +96,26 @@ func (s *refStore) Object(hash types.Hash) (io.ReadCloser, int64, error) {
 		return nil, 0, err
 	}
 
-	//contentType, err := s.contentType(hash)
-	//if err != nil {
-	//    return nil, "", err
-	//}
-
 	return f, stat.Size(), nil
 }
 
-func (s *refStore) StoreObject(reader io.ReadCloser, contentType string) (h types.Hash, err error) {
+func (s *refStore) StoreObject(reader io.ReadCloser, contentType string) (h types.Hash, size int64, err error) {
 	s.fileMu.Lock()
 	defer s.fileMu.Unlock()
 	defer annotate(&err, "refStore.StoreObject")
 
 	err = s.ensureRootPath()
 	if err != nil {
-		return types.Hash{}, err
+		return types.Hash{}, 0, err
 	}
 
-	tmpFile, err := ioutil.TempFile(s.rootPath, "temp-")
+	tmpFile, err := ioutil.TempFile(s.tempPath, "temp-")
 	if err != nil {
-		return types.Hash{}, err
+		return types.Hash{}, 0, err
 	}
 	defer func() {
 		closeErr := tmpFile.Close()
-		if closeErr != nil && !goerrors.Is(closeErr, os.ErrClosed) {
+		if closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
 			err = closeErr
 		}
 	}()
@@ -88,9 +123,9 @@ func (s *refStore) StoreObject(reader io.ReadCloser, contentType string) (h type
 	hasher := sha3.NewLegacyKeccak256()
 	tee := io.TeeReader(reader, hasher)
 
-	_, err = io.Copy(tmpFile, tee)
+	size, err = io.Copy(tmpFile, tee)
 	if err != nil {
-		return types.Hash{}, err
+		return types.Hash{}, 0, err
 	}
 
 	bs := hasher.Sum(nil)
@@ -99,20 +134,102 @@ func (s *refStore) StoreObject(reader io.ReadCloser, contentType string) (h type
 
 	err = tmpFile.Close()
 	if err != nil {
-		return types.Hash{}, err
+		return types.Hash{}, 0, err
 	}
 
-	err = os.Rename(tmpFile.Name(), filepath.Join(s.rootPath, "ref-"+hash.String()))
+	err = s.moveIntoPlace(tmpFile.Name(), filepath.Join(s.rootPath, "ref-"+hash.String()))
 	if err != nil {
-		return hash, err
+		return hash, 0, err
 	}
 
 	err = s.setContentType(hash, contentType)
 	if err != nil {
-		return hash, err
+		return hash, 0, err
+	}
+
+	return hash, size, nil
+}
+
+// REF_TEMP_MAX_AGE is how long a temp file may go unmodified before CleanTemp assumes that
+// the StoreObject call writing it is never going to finish.
+const REF_TEMP_MAX_AGE = 1 * time.Hour
+
+// CleanTemp removes the temp files left behind by StoreObject calls that never finished,
+// such as when the node crashed partway through.  Temp files that have been modified within
+// olderThan may belong to a store that's still in progress, so they're left alone.
+func (s *refStore) CleanTemp(olderThan time.Duration) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	// The copy fallback in moveIntoPlace writes temp files to the ref root as well
+	dirs := []string{s.tempPath}
+	if s.rootPath != s.tempPath {
+		dirs = append(dirs, s.rootPath)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "temp-*"))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			stat, err := os.Stat(match)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			} else if stat.ModTime().After(cutoff) {
+				continue
+			}
+
+			err = os.Remove(match)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rename is swapped out by tests to simulate a temp directory on another filesystem.
+var rename = os.Rename
+
+// moveIntoPlace moves a file from the temp directory into the ref root.  If they're on
+// different filesystems, the file is copied into the ref root first, so that it still
+// appears there atomically.
+func (s *refStore) moveIntoPlace(src, dest string) error {
+	err := rename(src, dest)
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dest), "temp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
 	}
 
-	return hash, nil
+	err = rename(out.Name(), dest)
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
 }
 
 func (s *refStore) HaveObject(hash types.Hash) bool {
@@ -121,18 +238,78 @@ func (s *refStore) HaveObject(hash types.Hash) bool {
 	return fileExists(filepath.Join(s.rootPath, "ref-"+hash.String()))
 }
 
-func (s *refStore) contentType(hash types.Hash) (string, error) {
-	s.metadataMu.Lock()
-	defer s.metadataMu.Unlock()
+// PartialObjectSize returns how much of a ref that's being fetched has been received so
+// far.  It's zero if none of it has.
+func (s *refStore) PartialObjectSize(hash types.Hash) (int64, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
 
-	f, err := os.Open(filepath.Join(s.rootPath, "metadata.json"))
+	stat, err := os.Stat(s.partialObjectPath(hash))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// OpenPartialObject opens the partially received ref with the given hash, creating it if
+// none of it has been received yet.
+func (s *refStore) OpenPartialObject(hash types.Hash) (PartialObject, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	err := s.ensureRootPath()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer f.Close()
+	return os.OpenFile(s.partialObjectPath(hash), os.O_WRONLY|os.O_CREATE, 0644)
+}
 
-	var metadata map[string]interface{}
-	err = json.NewDecoder(f).Decode(&metadata)
+// StorePartialObject moves a ref that has been fully received into the store.  If its
+// content doesn't match its hash, it's thrown away and ErrRefHashMismatch is returned.
+func (s *refStore) StorePartialObject(hash types.Hash, contentType string) (err error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	defer annotate(&err, "refStore.StorePartialObject")
+
+	filename := s.partialObjectPath(hash)
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	hasher := sha3.NewLegacyKeccak256()
+	_, err = io.Copy(hasher, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var receivedHash types.Hash
+	copy(receivedHash[:], hasher.Sum(nil))
+	if receivedHash != hash {
+		os.Remove(filename)
+		return errors.Wrapf(ErrRefHashMismatch, "expected %v, got %v", hash, receivedHash)
+	}
+
+	err = os.Rename(filename, filepath.Join(s.rootPath, "ref-"+hash.String()))
+	if err != nil {
+		return err
+	}
+	return s.setContentType(hash, contentType)
+}
+
+func (s *refStore) partialObjectPath(hash types.Hash) string {
+	return filepath.Join(s.rootPath, "partial-"+hash.String())
+}
+
+// ContentType returns the Content-Type that the object was stored with, or
+// the empty string if none was recorded.
+func (s *refStore) ContentType(hash types.Hash) (string, error) {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+
+	metadata, err := s.readMetadata()
 	if err != nil {
 		return "", err
 	}
@@ -146,35 +323,120 @@ func (s *refStore) contentType(hash types.Hash) (string, error) {
 }
 
 func (s *refStore) setContentType(hash types.Hash, contentType string) error {
+	return s.updateMetadata(func(metadata map[string]interface{}) {
+		setValueAtKeypath(metadata, []string{hash.String(), "Content-Type"}, contentType, true)
+	})
+}
+
+// Pin protects a ref from GarbageCollect, whether or not anything references it.  A ref
+// may be pinned before it has been stored.
+func (s *refStore) Pin(hash types.Hash) error {
+	return s.updateMetadata(func(metadata map[string]interface{}) {
+		setValueAtKeypath(metadata, []string{hash.String(), "Pinned"}, true, true)
+	})
+}
+
+// Unpin undoes Pin, leaving the ref to be collected once nothing references it.
+func (s *refStore) Unpin(hash types.Hash) error {
+	return s.updateMetadata(func(metadata map[string]interface{}) {
+		if refMetadata, is := metadata[hash.String()].(map[string]interface{}); is {
+			delete(refMetadata, "Pinned")
+		}
+	})
+}
+
+func (s *refStore) IsPinned(hash types.Hash) (bool, error) {
 	s.metadataMu.Lock()
 	defer s.metadataMu.Unlock()
 
-	f, err := os.OpenFile(filepath.Join(s.rootPath, "metadata.json"), os.O_RDWR|os.O_CREATE, 0755)
+	metadata, err := s.readMetadata()
 	if err != nil {
-		return err
+		return false, err
+	}
+	pinned, _ := getBool(metadata, []string{hash.String(), "Pinned"})
+	return pinned, nil
+}
+
+// GarbageCollect deletes every ref that is neither in the given set of referenced refs
+// nor pinned, along with its metadata, and returns the hashes of the refs it deleted.
+func (s *refStore) GarbageCollect(referenced map[types.Hash]struct{}) ([]types.Hash, error) {
+	hashes, err := s.AllHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	var removed []types.Hash
+	var removeErr error
+	err = s.updateMetadata(func(metadata map[string]interface{}) {
+		for _, hash := range hashes {
+			if _, isReferenced := referenced[hash]; isReferenced {
+				continue
+			} else if pinned, _ := getBool(metadata, []string{hash.String(), "Pinned"}); pinned {
+				continue
+			}
+
+			err := os.Remove(filepath.Join(s.rootPath, "ref-"+hash.String()))
+			if err != nil && !os.IsNotExist(err) {
+				removeErr = errors.WithStack(err)
+				return
+			}
+			delete(metadata, hash.String())
+			removed = append(removed, hash)
+		}
+	})
+	if err != nil {
+		return removed, err
+	}
+	return removed, removeErr
+}
+
+// readMetadata reads the metadata of every ref, which is kept in a single file keyed by
+// ref hash.  The caller must hold metadataMu.
+func (s *refStore) readMetadata() (map[string]interface{}, error) {
+	f, err := os.Open(filepath.Join(s.rootPath, "metadata.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]interface{}{}, nil
+	} else if err != nil {
+		return nil, err
 	}
 	defer f.Close()
 
 	var metadata map[string]interface{}
 	err = json.NewDecoder(f).Decode(&metadata)
-	if errors.Cause(err) == io.EOF {
-		metadata = make(map[string]interface{})
+	if errors.Is(err, io.EOF) {
+		return map[string]interface{}{}, nil
 	} else if err != nil {
-		return err
+		return nil, err
 	}
+	return metadata, nil
+}
 
-	setValueAtKeypath(metadata, []string{hash.String(), "Content-Type"}, contentType, true)
+// updateMetadata passes the metadata of every ref to fn, and then saves whatever changes
+// fn made to it.
+func (s *refStore) updateMetadata(fn func(metadata map[string]interface{})) error {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
 
-	_, err = f.Seek(0, 0)
+	err := s.ensureRootPath()
 	if err != nil {
 		return err
 	}
 
-	err = json.NewEncoder(f).Encode(metadata)
+	metadata, err := s.readMetadata()
 	if err != nil {
 		return err
 	}
-	return nil
+
+	fn(metadata)
+
+	bs, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.rootPath, "metadata.json"), bs, 0755)
 }
 
 func (s *refStore) AllHashes() ([]types.Hash, error) {
@@ -0,0 +1,186 @@
+package redwood
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestRefStore_GarbageCollectHonorsPins(t *testing.T) {
+	refStore := newTestRefStore(t)
+
+	storeRef := func(content string) types.Hash {
+		hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewBufferString(content)), "text/plain")
+		require.NoError(t, err)
+		return hash
+	}
+	referenced := storeRef("referenced")
+	pinned := storeRef("pinned")
+	unpinned := storeRef("unpinned")
+	garbage := storeRef("garbage")
+
+	err := refStore.Pin(pinned)
+	require.NoError(t, err)
+	err = refStore.Pin(unpinned)
+	require.NoError(t, err)
+	err = refStore.Unpin(unpinned)
+	require.NoError(t, err)
+
+	isPinned, err := refStore.IsPinned(pinned)
+	require.NoError(t, err)
+	require.True(t, isPinned)
+	isPinned, err = refStore.IsPinned(unpinned)
+	require.NoError(t, err)
+	require.False(t, isPinned)
+
+	removed, err := refStore.GarbageCollect(map[types.Hash]struct{}{referenced: {}})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []types.Hash{unpinned, garbage}, removed)
+
+	require.True(t, refStore.HaveObject(referenced))
+	require.True(t, refStore.HaveObject(pinned))
+	require.False(t, refStore.HaveObject(unpinned))
+	require.False(t, refStore.HaveObject(garbage))
+
+	// The surviving refs keep their metadata, including the pin
+	contentType, err := refStore.ContentType(pinned)
+	require.NoError(t, err)
+	require.Equal(t, "text/plain", contentType)
+	isPinned, err = refStore.IsPinned(pinned)
+	require.NoError(t, err)
+	require.True(t, isPinned)
+
+	// Once it's unpinned and unreferenced, it goes too
+	err = refStore.Unpin(pinned)
+	require.NoError(t, err)
+	removed, err = refStore.GarbageCollect(nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []types.Hash{referenced, pinned}, removed)
+}
+
+func TestRefStore_StorePartialObjectChecksHash(t *testing.T) {
+	refStore := newTestRefStore(t)
+
+	content := []byte("partial content")
+	hash := types.HashBytes(content)
+
+	// Pieces can arrive out of order, and anything past the end can be cut off
+	partial, err := refStore.OpenPartialObject(hash)
+	require.NoError(t, err)
+	_, err = partial.WriteAt([]byte("content garbage"), int64(len("partial ")))
+	require.NoError(t, err)
+	_, err = partial.WriteAt([]byte("partial "), 0)
+	require.NoError(t, err)
+	require.NoError(t, partial.Truncate(int64(len(content))))
+	require.NoError(t, partial.Close())
+
+	size, err := refStore.PartialObjectSize(hash)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), size)
+
+	err = refStore.StorePartialObject(hash, "text/plain")
+	require.NoError(t, err)
+	require.True(t, refStore.HaveObject(hash))
+
+	// Content that doesn't match its hash is thrown away
+	var bogus types.Hash
+	partial, err = refStore.OpenPartialObject(bogus)
+	require.NoError(t, err)
+	_, err = partial.WriteAt(content, 0)
+	require.NoError(t, err)
+	require.NoError(t, partial.Close())
+
+	err = refStore.StorePartialObject(bogus, "text/plain")
+	require.Equal(t, ErrRefHashMismatch, errors.Cause(err))
+	require.False(t, refStore.HaveObject(bogus))
+	size, err = refStore.PartialObjectSize(bogus)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func TestRefStore_TempDirOnAnotherFilesystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	tempRoot, err := ioutil.TempDir("", "redwood-test-refs-temp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempRoot)
+
+	// Renames out of the temp dir fail the way they do across filesystems
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	var crossedFilesystems bool
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			crossedFilesystems = true
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	refStore := NewRefStore(filepath.Join(root, "refs"), filepath.Join(tempRoot, "temp"))
+	content := []byte("stored across filesystems")
+	hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(content)), "text/plain")
+	require.NoError(t, err)
+	require.True(t, crossedFilesystems)
+	require.Equal(t, types.HashBytes(content), hash)
+
+	reader, size, err := refStore.Object(hash)
+	require.NoError(t, err)
+	defer reader.Close()
+	require.Equal(t, int64(len(content)), size)
+	bs, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, content, bs)
+
+	contentType, err := refStore.ContentType(hash)
+	require.NoError(t, err)
+	require.Equal(t, "text/plain", contentType)
+
+	// Nothing is left behind in either directory
+	leftovers, err := filepath.Glob(filepath.Join(tempRoot, "temp", "*"))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+	leftovers, err = filepath.Glob(filepath.Join(root, "refs", "temp-*"))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+}
+
+func TestRefStore_CleanTempRemovesStaleTempFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	refStore := NewRefStore(filepath.Join(root, "refs"), filepath.Join(root, "temp"))
+	hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewBufferString("keep me")), "text/plain")
+	require.NoError(t, err)
+
+	// A temp file left by a crash a while ago, in each directory that temp files go to,
+	// and one that's still being written
+	staleTemp := filepath.Join(root, "temp", "temp-stale")
+	staleCopy := filepath.Join(root, "refs", "temp-stale")
+	inProgress := filepath.Join(root, "temp", "temp-in-progress")
+	longAgo := time.Now().Add(-2 * REF_TEMP_MAX_AGE)
+	for _, filename := range []string{staleTemp, staleCopy, inProgress} {
+		err := ioutil.WriteFile(filename, []byte("partial"), 0644)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.Chtimes(staleTemp, longAgo, longAgo))
+	require.NoError(t, os.Chtimes(staleCopy, longAgo, longAgo))
+
+	err = refStore.CleanTemp(REF_TEMP_MAX_AGE)
+	require.NoError(t, err)
+
+	require.False(t, fileExists(staleTemp))
+	require.False(t, fileExists(staleCopy))
+	require.True(t, fileExists(inProgress))
+	require.True(t, refStore.HaveObject(hash))
+}
@@ -0,0 +1,184 @@
+package redwood
+
+import (
+	"sort"
+	"sync"
+)
+
+// refSwarm hands out the byte ranges of a ref to the providers that are fetching it in
+// parallel.  Each provider asks for another range as soon as it's done with the last one,
+// so faster providers end up serving more of the ref.  When a provider drops out partway
+// through a range, whatever it didn't deliver goes back to be picked up by another one.
+//
+// The ref's size and content type aren't known until a provider responds, so at first the
+// swarm only hands out a single range, starting from whatever had already been received.
+type refSwarm struct {
+	start     int64
+	pieceSize int64
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	size        int64 // -1 until a provider tells us
+	contentType string
+	pending     []refRange
+	received    []refRange // sorted and merged
+	aborted     bool
+	chDone      chan struct{}
+}
+
+type refRange struct {
+	Offset int64
+	Length int64
+}
+
+func (r refRange) end() int64 {
+	return r.Offset + r.Length
+}
+
+func newRefSwarm(start, pieceSize int64) *refSwarm {
+	s := &refSwarm{
+		start:     start,
+		pieceSize: pieceSize,
+		size:      -1,
+		pending:   []refRange{{start, pieceSize}},
+		chDone:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// next blocks until there's a range to fetch.  It returns false once the whole ref has
+// been received, or the swarm has been aborted.
+func (s *refSwarm) next() (refRange, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.aborted || s.isComplete() {
+			return refRange{}, false
+		} else if len(s.pending) > 0 {
+			r := s.pending[0]
+			s.pending = s.pending[1:]
+			return r, true
+		}
+		s.cond.Wait()
+	}
+}
+
+// setHeader records the ref's size and content type from the first provider to respond,
+// and splits the rest of the ref into ranges.
+func (s *refSwarm) setHeader(header FetchRefResponseHeader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.contentType == "" {
+		s.contentType = header.ContentType
+	}
+	if s.size >= 0 {
+		return
+	}
+	s.size = header.Size
+	for offset := s.start + s.pieceSize; offset < s.size; offset += s.pieceSize {
+		s.pending = append(s.pending, refRange{offset, s.pieceSize})
+	}
+	s.checkComplete()
+	s.cond.Broadcast()
+}
+
+// finish records that n bytes of the given range were received.  Anything left of the
+// range is handed out again.
+func (s *refSwarm) finish(r refRange, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > 0 {
+		s.addReceived(refRange{r.Offset, n})
+	}
+
+	rest := refRange{r.Offset + n, r.Length - n}
+	if s.size >= 0 && rest.end() > s.size {
+		rest.Length = s.size - rest.Offset
+	}
+	if rest.Length > 0 {
+		s.pending = append([]refRange{rest}, s.pending...)
+	}
+	s.checkComplete()
+	s.cond.Broadcast()
+}
+
+func (s *refSwarm) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	s.cond.Broadcast()
+}
+
+// Done returns a channel that's closed once the whole ref has been received.
+func (s *refSwarm) Done() <-chan struct{} {
+	return s.chDone
+}
+
+func (s *refSwarm) complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isComplete()
+}
+
+// refContentType returns the content type that providers reported for the ref, or
+// "application/octet-stream" if none did.
+func (s *refSwarm) refContentType() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.contentType == "" {
+		return "application/octet-stream"
+	}
+	return s.contentType
+}
+
+// receivedPrefix returns how much of the ref has been received without any gaps.
+func (s *refSwarm) receivedPrefix() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.received) > 0 && s.received[0].Offset <= s.start {
+		return s.received[0].end()
+	}
+	return s.start
+}
+
+func (s *refSwarm) isComplete() bool {
+	if s.size < 0 {
+		return false
+	} else if s.size <= s.start {
+		return true
+	}
+	return len(s.received) > 0 && s.received[0].Offset <= s.start && s.received[0].end() >= s.size
+}
+
+func (s *refSwarm) checkComplete() {
+	if !s.isComplete() {
+		return
+	}
+	select {
+	case <-s.chDone:
+	default:
+		close(s.chDone)
+	}
+}
+
+func (s *refSwarm) addReceived(r refRange) {
+	received := append(s.received, r)
+	sort.Slice(received, func(i, j int) bool { return received[i].Offset < received[j].Offset })
+
+	merged := received[:1]
+	for _, r := range received[1:] {
+		last := &merged[len(merged)-1]
+		if r.Offset <= last.end() {
+			if r.end() > last.end() {
+				last.Length = r.end() - last.Offset
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	s.received = merged
+}
@@ -145,7 +145,7 @@ func (s *server) Authenticate(authSrv RemoteStore_AuthenticateServer) error {
 		return errors.New("protocol error")
 	}
 
-	pubkey, err := rw.RecoverSigningPubkey(types.HashBytes(challenge), sig.Signature)
+	pubkey, err := rw.RecoverSigningPubkey(types.HashBytes(challenge), sig.Signature, nil)
 	if err != nil {
 		return err
 	}
@@ -1,26 +1,125 @@
 package redwood
 
 import (
+	"sort"
+
+	"github.com/pkg/errors"
+
 	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
-type dumbResolver struct{}
+// dumbResolver applies patches as they are, with last-write-wins semantics: when
+// concurrent txs write to the same keypath, the one that comes last in the DAG's total
+// order (see TxOrder) wins, no matter which order they were received in.  To decide, it
+// remembers which tx last wrote to each keypath.  A patch is skipped if its keypath (or
+// one of its ancestors) has been written by a later tx, and a patch that replaces a
+// subtree keeps whatever later txs wrote beneath it.
+type dumbResolver struct {
+	writes map[string]TxOrder
+}
 
 func NewDumbResolver(config tree.Node, internalState map[string]interface{}) (Resolver, error) {
-	return &dumbResolver{}, nil
+	r := &dumbResolver{writes: make(map[string]TxOrder)}
+	if writes, is := internalState["writes"].(map[string]TxOrder); is {
+		r.writes = writes
+	}
+	return r, nil
 }
 
 func (r *dumbResolver) InternalState() map[string]interface{} {
-	return map[string]interface{}{}
+	return map[string]interface{}{"writes": r.writes}
 }
 
+// CanDryRun is true, as dry runs go through a scratch copy of the record of past writes.
+func (r *dumbResolver) CanDryRun() bool {
+	return true
+}
+
+func (r *dumbResolver) ScratchCopy() OrderedResolver {
+	writes := make(map[string]TxOrder, len(r.writes))
+	for keypath, order := range r.writes {
+		writes[keypath] = order
+	}
+	return &dumbResolver{writes: writes}
+}
+
+// ResolveState applies the patches unconditionally, since it has no way of ordering the
+// tx against the ones before it.  The controller calls ResolveStateInOrder instead.
 func (r *dumbResolver) ResolveState(state tree.Node, sender types.Address, txID types.ID, parents []types.ID, ps []Patch) error {
 	for _, p := range ps {
-		err := state.Set(p.Keypath, p.Range, p.Val)
+		err := p.Apply(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *dumbResolver) ResolveStateInOrder(state tree.Node, sender types.Address, order TxOrder, ps []Patch) error {
+	if r.writes == nil {
+		r.writes = make(map[string]TxOrder)
+	}
+
+	for _, p := range ps {
+		if r.supersededAt(p.Keypath, order) {
+			continue
+		}
+
+		// Hang on to anything that later txs wrote beneath the keypath, and put it back
+		// once the patch has been applied
+		var laterKeypaths []tree.Keypath
+		for kp, written := range r.writes {
+			keypath := tree.Keypath(kp)
+			if !p.Keypath.IsAncestorOf(keypath) {
+				continue
+			} else if order.Before(written) {
+				laterKeypaths = append(laterKeypaths, keypath)
+			} else {
+				delete(r.writes, kp)
+			}
+		}
+		// Shallowest first, so that the deeper ones land on top
+		sort.Slice(laterKeypaths, func(i, j int) bool { return laterKeypaths[i].NumParts() < laterKeypaths[j].NumParts() })
+
+		laterVals := make([]interface{}, len(laterKeypaths))
+		for i, keypath := range laterKeypaths {
+			val, exists, err := state.Value(keypath, nil)
+			if err != nil && !errors.Is(err, types.Err404) {
+				return err
+			} else if !exists {
+				continue
+			}
+			laterVals[i] = val
+		}
+
+		err := p.Apply(state)
 		if err != nil {
 			return err
 		}
+		for i, keypath := range laterKeypaths {
+			if laterVals[i] == nil {
+				continue
+			}
+			err := state.Set(keypath, nil, laterVals[i])
+			if err != nil {
+				return err
+			}
+		}
+		r.writes[string(p.Keypath)] = order
 	}
 	return nil
 }
+
+// supersededAt returns true if a tx that comes after the given one in the total order has
+// written to the keypath or one of its ancestors.
+func (r *dumbResolver) supersededAt(keypath tree.Keypath, order TxOrder) bool {
+	for {
+		if written, exists := r.writes[string(keypath)]; exists && order.Before(written) {
+			return true
+		} else if len(keypath) == 0 {
+			return false
+		}
+		keypath = keypath.Parent()
+	}
+}
@@ -77,7 +77,10 @@ func (r *jsResolver) ResolveState(state tree.Node, sender types.Address, txID ty
 		}
 
 		if patch.Range != nil {
-			convertedPatch["range"] = []interface{}{patch.Range[0], patch.Range[1]}
+			convertedPatch["range"] = []interface{}{patch.Range.Start(), patch.Range.End()}
+		}
+		if patch.Delete {
+			convertedPatch["delete"] = true
 		}
 		convertedPatches[i] = convertedPatch
 	}
@@ -2,10 +2,12 @@ package redwood
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
@@ -23,33 +25,104 @@ type Transport interface {
 
 	GetPeerByConnStrings(ctx context.Context, reachableAt StringSet) (Peer, error)
 	ForEachProviderOfStateURI(ctx context.Context, stateURI string) (<-chan Peer, error)
-	ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Peer, error)
+	ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Subscriber, error)
 	ForEachProviderOfRef(ctx context.Context, refHash types.Hash) (<-chan Peer, error)
 	PeersClaimingAddress(ctx context.Context, address types.Address) (<-chan Peer, error)
 	AnnounceRef(refHash types.Hash) error
 }
 
+// Peer is a single logical channel to a remote node.  A transport may carry many of them
+// over one underlying connection, so a host can hold a separate Peer for each
+// subscription or fetch without opening a new connection for each.
 type Peer interface {
 	Transport() Transport
 	ReachableAt() StringSet
 	Address() types.Address
-	SetAddress(addr types.Address)
+	SetAddress(addr types.Address) error
 	EnsureConnected(ctx context.Context) error
 	WriteMsg(msg Msg) error
 	ReadMsg() (Msg, error)
 	CloseConn() error
 }
 
-type FetchHistoryHandler func(stateURI string, parents []types.ID, toVersion types.ID, peer Peer) error
+// channelBindingTransport is implemented by transports that can name a connection in a
+// way that a node relaying it can't reproduce on connections of its own.  The verify
+// address handshake signs each answer along with the connection that it's sent over.
+// PeerChannelBinding is what we bind our answers to the peer to, and OwnChannelBinding is
+// what the peer binds its answers to us to, if it's talking to us directly.
+type channelBindingTransport interface {
+	PeerChannelBinding(peer Peer) []byte
+	OwnChannelBinding(peer Peer) []byte
+}
+
+func peerChannelBinding(peer Peer) []byte {
+	if tpt, is := peer.Transport().(channelBindingTransport); is {
+		return tpt.PeerChannelBinding(peer)
+	}
+	return nil
+}
+
+func ownChannelBinding(peer Peer) []byte {
+	if tpt, is := peer.Transport().(channelBindingTransport); is {
+		return tpt.OwnChannelBinding(peer)
+	}
+	return nil
+}
+
+// selfRecognizingTransport is implemented by transports that can tell when a peer they've
+// handed out is actually the local node, reached at one of its own addresses.
+type selfRecognizingTransport interface {
+	IsSelf(peer Peer) bool
+}
+
+// Subscriber is a peer subscribed to a stateURI.  If Keypath is non-empty, the peer only
+// wants the txs that touch it.
+type Subscriber struct {
+	Peer
+	Keypath tree.Keypath
+}
+
+type FetchHistoryHandler func(stateURI string, keypath tree.Keypath, parents []types.ID, knownTxs *TxBloomFilter, toVersion types.ID, peer Peer) error
 type AckHandler func(txID types.ID, peer Peer)
 type TxHandler func(tx Tx, peer Peer)
 type PrivateTxHandler func(encryptedTx EncryptedTx, peer Peer)
 type VerifyAddressHandler func(challengeMsg types.ChallengeMsg, peer Peer) error
-type FetchRefHandler func(refHash types.Hash, peer Peer)
+type FetchRefHandler func(refHash types.Hash, offset, length int64, peer Peer)
+type DebugInfoHandler func() DebugInfo
 
 type subscriptionOut struct {
-	peer   Peer
-	chDone chan struct{}
+	peer    Peer
+	keypath tree.Keypath
+	since   time.Time
+	chDone  chan struct{}
+}
+
+// closed reports whether the subscription has been told to stop.
+func (sub *subscriptionOut) closed() bool {
+	select {
+	case <-sub.chDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// SubscriptionInfo describes one of a host's subscriptions to another peer.
+type SubscriptionInfo struct {
+	StateURI    string
+	Keypath     string
+	PeerAddress types.Address
+	Transport   string
+	ReachableAt []string
+	Since       time.Time
+}
+
+// DebugInfo is a snapshot of a host's subscriptions and peers, for diagnosing a node that
+// isn't syncing.
+type DebugInfo struct {
+	Address       types.Address
+	Subscriptions []SubscriptionInfo
+	Peers         []PeerInfo
 }
 
 var ErrNoPeersForURL = errors.New("no known peers for the provided url")
@@ -4,19 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,13 +43,18 @@ type httpTransport struct {
 	defaultStateURI string
 	ownURL          string
 	listenAddr      string
+	startedAt       time.Time
 	sigkeys         *SigningKeypair
 	cookieSecret    [32]byte
 	tlsCertFilename string
 	tlsKeyFilename  string
 	cookieJar       http.CookieJar
 
-	pendingAuthorizations map[types.ID][]byte
+	pendingAuthorizations   map[types.ID]types.ChallengeMsg
+	pendingAuthorizationsMu sync.Mutex
+
+	pendingCounterChallenges   map[string]chan httpCounterChallengeResponse
+	pendingCounterChallengesMu sync.Mutex
 
 	fetchHistoryHandler  FetchHistoryHandler
 	ackHandler           AckHandler
@@ -53,14 +62,40 @@ type httpTransport struct {
 	privateTxHandler     PrivateTxHandler
 	verifyAddressHandler VerifyAddressHandler
 	fetchRefHandler      FetchRefHandler
+	debugInfoHandler     DebugInfoHandler
 
 	subscriptionsIn   map[string]map[*httpSubscriptionIn]struct{}
 	subscriptionsInMu sync.RWMutex
 
+	limits                HTTPLimits
+	putLimiter            *rateLimiter
+	subscriptionLimiter   *rateLimiter
+	clientSubscriptions   map[string]int
+	clientSubscriptionsMu sync.Mutex
+
 	refStore  RefStore
 	peerStore PeerStore
 }
 
+// HTTPLimits bounds how much any one client can ask of the HTTP transport.  Clients are
+// told apart by their IP address, since anyone can make up as many Redwood addresses as
+// they like.  A zero value for any of the limits disables it.
+type HTTPLimits struct {
+	PutsPerSecond             float64 // The rate at which a client's PUTs are let through
+	PutBurst                  int     // How many PUTs a client can make at once
+	SubscriptionsPerSecond    float64 // The rate at which a client's subscriptions are let through
+	SubscriptionBurst         int     // How many subscriptions a client can make at once
+	MaxSubscriptionsPerClient int     // How many subscriptions a client can hold open
+}
+
+var DefaultHTTPLimits = HTTPLimits{
+	PutsPerSecond:             20,
+	PutBurst:                  100,
+	SubscriptionsPerSecond:    1,
+	SubscriptionBurst:         20,
+	MaxSubscriptionsPerClient: 50,
+}
+
 func NewHTTPTransport(
 	addr types.Address,
 	listenAddr string,
@@ -71,6 +106,7 @@ func NewHTTPTransport(
 	sigkeys *SigningKeypair,
 	cookieSecret [32]byte,
 	tlsCertFilename, tlsKeyFilename string,
+	limits HTTPLimits,
 ) (Transport, error) {
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
@@ -83,21 +119,26 @@ func NewHTTPTransport(
 	}
 
 	t := &httpTransport{
-		Context:               &ctx.Context{},
-		address:               addr,
-		subscriptionsIn:       make(map[string]map[*httpSubscriptionIn]struct{}),
-		controller:            controller,
-		listenAddr:            listenAddr,
-		defaultStateURI:       defaultStateURI,
-		sigkeys:               sigkeys,
-		cookieSecret:          cookieSecret,
-		tlsCertFilename:       tlsCertFilename,
-		tlsKeyFilename:        tlsKeyFilename,
-		cookieJar:             jar,
-		pendingAuthorizations: make(map[types.ID][]byte),
-		ownURL:                ownURL,
-		refStore:              refStore,
-		peerStore:             peerStore,
+		Context:                  &ctx.Context{},
+		address:                  addr,
+		subscriptionsIn:          make(map[string]map[*httpSubscriptionIn]struct{}),
+		controller:               controller,
+		listenAddr:               listenAddr,
+		defaultStateURI:          defaultStateURI,
+		sigkeys:                  sigkeys,
+		cookieSecret:             cookieSecret,
+		tlsCertFilename:          tlsCertFilename,
+		tlsKeyFilename:           tlsKeyFilename,
+		cookieJar:                jar,
+		pendingAuthorizations:    make(map[types.ID]types.ChallengeMsg),
+		pendingCounterChallenges: make(map[string]chan httpCounterChallengeResponse),
+		ownURL:                   ownURL,
+		refStore:                 refStore,
+		peerStore:                peerStore,
+		limits:                   limits,
+		putLimiter:               newRateLimiter(limits.PutsPerSecond, limits.PutBurst),
+		subscriptionLimiter:      newRateLimiter(limits.SubscriptionsPerSecond, limits.SubscriptionBurst),
+		clientSubscriptions:      make(map[string]int),
 	}
 	return t, nil
 }
@@ -108,6 +149,7 @@ func (t *httpTransport) Start() error {
 		func() error {
 			t.SetLogLabel(t.address.Pretty() + " transport")
 			t.Infof(0, "opening http transport at %v", t.listenAddr)
+			t.startedAt = time.Now()
 
 			if t.cookieSecret == [32]byte{} {
 				_, err := rand.Read(t.cookieSecret[:])
@@ -155,6 +197,7 @@ type httpSubscriptionIn struct {
 	io.Writer
 	http.Flusher
 	address          types.Address
+	keypath          tree.Keypath
 	chDoneCatchingUp chan struct{}
 	chDone           chan struct{}
 }
@@ -168,6 +211,38 @@ func (t *httpTransport) Name() string {
 	return "http"
 }
 
+// PeerChannelBinding and OwnChannelBinding bind the verify address handshake to the host
+// that the initiator addressed it to, which is the same on both ends of an HTTP exchange.
+// A node relaying the handshake is addressed by a host of its own, so the answers that it
+// relays are bound to the wrong one.
+func (t *httpTransport) PeerChannelBinding(peer Peer) []byte {
+	return httpChannelBinding(peer)
+}
+
+func (t *httpTransport) OwnChannelBinding(peer Peer) []byte {
+	return httpChannelBinding(peer)
+}
+
+func httpChannelBinding(peer Peer) []byte {
+	p, is := peer.(*httpPeer)
+	if !is {
+		return nil
+	} else if p.requestHost != "" {
+		return []byte(p.requestHost)
+	}
+	u, err := url.Parse(p.reachableAt)
+	if err != nil {
+		return nil
+	}
+	return []byte(u.Host)
+}
+
+// IsSelf returns true if the given peer is reachable at this transport's own URL.
+func (t *httpTransport) IsSelf(peer Peer) bool {
+	_, is := peer.ReachableAt()[t.ownURL]
+	return is
+}
+
 var altSvcRegexp1 = regexp.MustCompile(`\s*(\w+)="([^"]+)"\s*(;[^,]*)?`)
 var altSvcRegexp2 = regexp.MustCompile(`\s*;\s*(\w+)=(\w+)`)
 
@@ -192,6 +267,20 @@ func forEachAltSvcHeaderPeer(header string, fn func(transportName, reachableAt s
 func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	// Health checks come from load balancers and the like, which don't authenticate or
+	// take part in peer discovery
+	if r.Method == "GET" && r.URL.Path == "/__health" {
+		t.serveHealth(w, r)
+		return
+	}
+
+	// Debug info lists our peers and where they can be reached, so it's only served to
+	// clients on this machine
+	if r.Method == "GET" && r.URL.Path == "/__debug" {
+		t.serveDebug(w, r)
+		return
+	}
+
 	sessionID, err := t.ensureSessionIDCookie(w, r)
 	if err != nil {
 		t.Errorf("error reading sessionID cookie: %v", err)
@@ -224,8 +313,12 @@ func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "AUTHORIZE":
 		// Address verification requests (2 kinds)
 		if challengeMsgHex := r.Header.Get("Challenge"); challengeMsgHex != "" {
-			// 1. Remote node is reaching out to us with a challenge, and we respond
+			// 1a. Remote node is reaching out to us with a challenge, and we respond
+			// with a counter-challenge of our own
 			t.serveAuthorizeSelf(w, r, address, challengeMsgHex)
+		} else if r.Header.Get("Counter-Challenge-Response") == "true" {
+			// 1b. Remote node is answering the counter-challenge that we sent in 1a
+			t.serveAuthorizeSelfCheckCounterResponse(w, r)
 		} else {
 			responseHex := r.Header.Get("Response")
 			if responseHex == "" {
@@ -239,7 +332,18 @@ func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	case "GET":
 		if r.Header.Get("Subscribe") != "" {
+			if !t.subscriptionLimiter.allow(clientIP(r)) {
+				http.Error(w, "too many subscriptions", http.StatusTooManyRequests)
+				return
+			}
 			t.serveSubscription(w, r, address)
+		} else if r.Header.Get("Fetch-History") != "" {
+			// Replaying history costs about as much as opening a subscription does
+			if !t.subscriptionLimiter.allow(clientIP(r)) {
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			t.serveFetchHistory(w, r, address)
 		} else {
 			if r.URL.Path == "/braid.js" {
 				// @@TODO: this is hacky
@@ -255,6 +359,11 @@ func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		t.serveAck(w, r, address)
 
 	case "PUT":
+		if !t.putLimiter.allow(clientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
 		if r.Header.Get("Private") == "true" {
 			t.servePostPrivateTx(w, r, address)
 
@@ -277,14 +386,109 @@ func (t *httpTransport) serveAuthorizeSelf(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	peer := &httpPeer{address: address, t: t, Writer: w}
+	flusher, _ := w.(http.Flusher)
+	peer := &httpPeer{address: address, t: t, Writer: w, Flusher: flusher, requestHost: r.Host}
 	err = t.verifyAddressHandler([]byte(challengeMsg), peer)
-	if err != nil {
+	if err != nil && peer.state == httpPeerState_VerifyingAddress {
+		// We've already answered, so the remote node has heard whatever it's going to
+		t.Errorf("error verifying peer address: %v", err)
+		return
+	} else if errors.Cause(err) == ErrTooManyPendingChallenges {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// httpCounterChallengeResponse is a remote node's answer to our counter-challenge.  It
+// arrives in its own AUTHORIZE request, which is handed over to the request that sent the
+// counter-challenge so that the rest of the handshake can be written to it.
+type httpCounterChallengeResponse struct {
+	resp VerifyAddressResponse
+	w    http.ResponseWriter
+	done chan struct{}
+}
+
+func (t *httpTransport) serveAuthorizeSelfCheckCounterResponse(w http.ResponseWriter, r *http.Request) {
+	var resp VerifyAddressResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A counter-challenge can only be answered once.  It's handed over while we hold the
+	// lock so that the request waiting on it can tell whether it's coming.
+	done := make(chan struct{})
+	t.pendingCounterChallengesMu.Lock()
+	ch, exists := t.pendingCounterChallenges[hex.EncodeToString(resp.Challenge)]
+	delete(t.pendingCounterChallenges, hex.EncodeToString(resp.Challenge))
+	if exists {
+		ch <- httpCounterChallengeResponse{resp: resp, w: w, done: done}
+	}
+	t.pendingCounterChallengesMu.Unlock()
+	if !exists {
+		http.Error(w, "no pending counter-challenge", http.StatusBadRequest)
+		return
+	}
+	<-done
+}
+
+// Until it's answered, each counter-challenge that we send holds on to the AUTHORIZE
+// request that it was sent in response to, which anyone can make.  So there's a limit on
+// how many can be waiting at once, and on how long they wait.
+const (
+	MAX_PENDING_COUNTER_CHALLENGES = 256
+	COUNTER_CHALLENGE_TIMEOUT      = 5 * time.Second
+)
+
+var ErrTooManyPendingChallenges = errors.New("too many address verifications underway")
+
+// expectCounterChallengeResponse registers a counter-challenge that we're about to send, so
+// that the answer to it can be routed back to us.
+func (t *httpTransport) expectCounterChallengeResponse(counterChallenge types.ChallengeMsg) (chan httpCounterChallengeResponse, error) {
+	t.pendingCounterChallengesMu.Lock()
+	defer t.pendingCounterChallengesMu.Unlock()
+	if len(t.pendingCounterChallenges) >= MAX_PENDING_COUNTER_CHALLENGES {
+		return nil, errors.WithStack(ErrTooManyPendingChallenges)
+	}
+	ch := make(chan httpCounterChallengeResponse, 1)
+	t.pendingCounterChallenges[hex.EncodeToString(counterChallenge)] = ch
+	return ch, nil
+}
+
+// awaitCounterChallengeResponse waits for the answer to the given counter-challenge until
+// COUNTER_CHALLENGE_TIMEOUT has passed or the counter-challenge expires, whichever is
+// first.
+func (t *httpTransport) awaitCounterChallengeResponse(counterChallenge types.ChallengeMsg, ch chan httpCounterChallengeResponse) (httpCounterChallengeResponse, error) {
+	timeout := time.Until(counterChallenge.Expiry())
+	if timeout > COUNTER_CHALLENGE_TIMEOUT {
+		timeout = COUNTER_CHALLENGE_TIMEOUT
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case answer := <-ch:
+		return answer, nil
+	case <-timer.C:
+	}
+
+	t.pendingCounterChallengesMu.Lock()
+	delete(t.pendingCounterChallenges, hex.EncodeToString(counterChallenge))
+	t.pendingCounterChallengesMu.Unlock()
+
+	// The answer may have been handed over just as we gave up on it
+	select {
+	case answer := <-ch:
+		return answer, nil
+	default:
+		return httpCounterChallengeResponse{}, errors.WithStack(ErrChallengeExpired)
+	}
+}
+
 func (t *httpTransport) serveAuthorizeOtherIssueChallenge(w http.ResponseWriter, r *http.Request, sessionID types.ID) {
 	challenge, err := types.GenerateChallengeMsg()
 	if err != nil {
@@ -292,7 +496,9 @@ func (t *httpTransport) serveAuthorizeOtherIssueChallenge(w http.ResponseWriter,
 		return
 	}
 
+	t.pendingAuthorizationsMu.Lock()
 	t.pendingAuthorizations[sessionID] = challenge
+	t.pendingAuthorizationsMu.Unlock()
 
 	challengeHex := hex.EncodeToString(challenge)
 	_, err = w.Write([]byte(challengeHex))
@@ -303,10 +509,17 @@ func (t *httpTransport) serveAuthorizeOtherIssueChallenge(w http.ResponseWriter,
 }
 
 func (t *httpTransport) serveAuthorizeOtherCheckResponse(w http.ResponseWriter, r *http.Request, sessionID types.ID, responseHex string) {
+	// A challenge can only be answered once
+	t.pendingAuthorizationsMu.Lock()
 	challenge, exists := t.pendingAuthorizations[sessionID]
+	delete(t.pendingAuthorizations, sessionID) // @@TODO: garbage collection for abandoned auths
+	t.pendingAuthorizationsMu.Unlock()
 	if !exists {
 		http.Error(w, "no pending authorization", http.StatusBadRequest)
 		return
+	} else if challenge.IsExpired(time.Now()) {
+		http.Error(w, ErrChallengeExpired.Error(), http.StatusBadRequest)
+		return
 	}
 
 	sig, err := hex.DecodeString(responseHex)
@@ -315,7 +528,7 @@ func (t *httpTransport) serveAuthorizeOtherCheckResponse(w http.ResponseWriter,
 		return
 	}
 
-	sigpubkey, err := RecoverSigningPubkey(types.HashBytes(challenge), sig)
+	sigpubkey, err := RecoverSigningPubkey(types.HashBytes(challenge), sig, t.sigkeys.AddressDerivation())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -327,18 +540,24 @@ func (t *httpTransport) serveAuthorizeOtherCheckResponse(w http.ResponseWriter,
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	delete(t.pendingAuthorizations, sessionID) // @@TODO: expiration/garbage collection for failed auths
 }
 
 func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request, address types.Address) {
 	t.Infof(0, "incoming subscription (address: %v)", address)
 
-	// @@TODO: ensure we actually have this stateURI
 	stateURI := r.Header.Get("State-URI")
 	if stateURI == "" {
 		stateURI = t.defaultStateURI
 	}
 
+	// Don't hold a subscription open for a stateURI that we'll never have any txs for
+	_, err := t.controller.ControllerForStateURI(stateURI)
+	if err != nil {
+		t.Errorf("rejecting subscription: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	// Make sure that the writer supports flushing.
 	f, ok := w.(http.Flusher)
 	if !ok {
@@ -346,6 +565,13 @@ func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	client := clientIP(r)
+	if !t.reserveClientSubscription(client) {
+		http.Error(w, "too many open subscriptions", http.StatusTooManyRequests)
+		return
+	}
+	defer t.releaseClientSubscription(client)
+
 	// Set the headers related to event streaming.
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -353,32 +579,41 @@ func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Transfer-Encoding", "chunked")
 
-	sub := &httpSubscriptionIn{w, f, address, make(chan struct{}), make(chan struct{})}
+	// Subscribers can ask for only the txs touching a particular keypath
+	keypath := tree.Keypath(r.Header.Get("Keypath"))
 
-	t.trackSubscription(stateURI, sub)
+	// The body has to be read before the response starts, after which net/http may close it.
+	// A bad filter just means that the subscriber gets the whole history.
+	var knownTxs *TxBloomFilter
+	if r.Header.Get("Known-Txs") == "body" {
+		knownTxs, err = readKnownTxs(r.Body)
+		if err != nil {
+			t.Errorf("Known-Txs: %v", err)
+			knownTxs = nil
+		}
+	}
 
-	// Listen to the closing of the http connection via the CloseNotifier
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		t.Infof(0, "http connection closed")
-		t.untrackSubscription(stateURI, sub)
-	}()
+	sub := &httpSubscriptionIn{w, f, address, keypath, make(chan struct{}), make(chan struct{})}
+
+	t.trackSubscription(stateURI, sub)
+	defer t.untrackSubscription(stateURI, sub)
 
 	f.Flush()
 
 	parentsHeader := r.Header.Get("Parents")
-	if parentsHeader != "" {
+	if parentsHeader != "" || knownTxs != nil {
 		var parents []types.ID
-		parentStrs := strings.Split(parentsHeader, ",")
-		for _, parentStr := range parentStrs {
-			parent, err := types.IDFromHex(parentStr)
-			if err != nil {
-				// @@TODO: what to do?
-				parents = []types.ID{GenesisTxID}
-				break
+		if parentsHeader != "" {
+			parentStrs := strings.Split(parentsHeader, ",")
+			for _, parentStr := range parentStrs {
+				parent, err := types.IDFromHex(parentStr)
+				if err != nil {
+					// @@TODO: what to do?
+					parents = []types.ID{GenesisTxID}
+					break
+				}
+				parents = append(parents, parent)
 			}
-			parents = append(parents, parent)
 		}
 
 		var toVersion types.ID
@@ -390,7 +625,7 @@ func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request
 			}
 		}
 
-		err := t.fetchHistoryHandler(stateURI, parents, toVersion, &httpPeer{address: address, t: t, Writer: w, Flusher: f})
+		err = t.fetchHistoryHandler(stateURI, keypath, parents, knownTxs, toVersion, &httpPeer{address: address, t: t, Writer: w, Flusher: f})
 		if err != nil {
 			t.Errorf("error fetching history: %v", err)
 			// @@TODO: close subscription?
@@ -399,8 +634,119 @@ func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request
 
 	close(sub.chDoneCatchingUp)
 
-	// Block until the subscription is canceled so that net/http doesn't close the connection
-	<-sub.chDone
+	// Block until the subscription is canceled so that net/http doesn't close the connection.
+	// The request context is canceled when the client disconnects or the server shuts down.
+	select {
+	case <-r.Context().Done():
+		t.Infof(0, "http connection closed")
+	case <-sub.chDone:
+	case <-t.CtxStopping():
+	}
+}
+
+// Subscribers send the filter of the txs they already have in the body of their request
+// (see httpPeer.WriteMsg).  At about a byte per tx, this is enough for a few million txs.
+const MAX_KNOWN_TXS_BYTES = 4 * 1024 * 1024
+
+var ErrKnownTxsTooLarge = errors.New("known txs filter is too large")
+
+func readKnownTxs(body io.Reader) (*TxBloomFilter, error) {
+	text, err := ioutil.ReadAll(io.LimitReader(body, MAX_KNOWN_TXS_BYTES+1))
+	if err != nil {
+		return nil, err
+	} else if len(text) > MAX_KNOWN_TXS_BYTES {
+		return nil, errors.WithStack(ErrKnownTxsTooLarge)
+	}
+	knownTxs := &TxBloomFilter{}
+	err = knownTxs.UnmarshalText(text)
+	if err != nil {
+		return nil, err
+	}
+	return knownTxs, nil
+}
+
+// serveFetchHistory streams the txs between the given parents and version back to the
+// client, and then ends the response.  It's the HTTP counterpart of libp2p's FetchHistory
+// message, which peers use to backfill the missing parents of a tx.
+func (t *httpTransport) serveFetchHistory(w http.ResponseWriter, r *http.Request, address types.Address) {
+	stateURI := r.Header.Get("State-URI")
+	if stateURI == "" {
+		stateURI = t.defaultStateURI
+	}
+
+	_, err := t.controller.ControllerForStateURI(stateURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var parents []types.ID
+	if parentsHeader := r.Header.Get("Parents"); parentsHeader != "" {
+		for _, parentStr := range strings.Split(parentsHeader, ",") {
+			parent, err := types.IDFromHex(parentStr)
+			if err != nil {
+				http.Error(w, "bad Parents header", http.StatusBadRequest)
+				return
+			}
+			parents = append(parents, parent)
+		}
+	}
+
+	var toVersion types.ID
+	if versionHeader := r.Header.Get("Version"); versionHeader != "" {
+		toVersion, err = types.IDFromHex(versionHeader)
+		if err != nil {
+			http.Error(w, "bad Version header", http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	err = t.fetchHistoryHandler(stateURI, nil, parents, nil, toVersion, &httpPeer{address: address, t: t, Writer: w, Flusher: f})
+	if err != nil {
+		t.Errorf("error fetching history: %v", err)
+	}
+}
+
+// reserveClientSubscription counts a new subscription toward the client's limit, or
+// reports that the client already has as many open as it's allowed.
+func (t *httpTransport) reserveClientSubscription(client string) bool {
+	t.clientSubscriptionsMu.Lock()
+	defer t.clientSubscriptionsMu.Unlock()
+
+	if t.limits.MaxSubscriptionsPerClient > 0 && t.clientSubscriptions[client] >= t.limits.MaxSubscriptionsPerClient {
+		return false
+	}
+	t.clientSubscriptions[client]++
+	return true
+}
+
+func (t *httpTransport) releaseClientSubscription(client string) {
+	t.clientSubscriptionsMu.Lock()
+	defer t.clientSubscriptionsMu.Unlock()
+
+	t.clientSubscriptions[client]--
+	if t.clientSubscriptions[client] <= 0 {
+		delete(t.clientSubscriptions, client)
+	}
+}
+
+// clientIP returns the IP address that the request came from, which is what the
+// transport's limits are keyed by.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func (t *httpTransport) serveBraidJS(w http.ResponseWriter, r *http.Request) {
@@ -442,14 +788,59 @@ func (t *httpTransport) serveGetTx(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, tx)
 }
 
-func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
+// HealthInfo is the body of a response to a health check.
+type HealthInfo struct {
+	State      string
+	Address    types.Address
+	Uptime     Duration
+	NumPeers   int // The number of verified peers
+	MempoolLen int
+	StateURIs  int
+}
 
-	keypathStrs := filterEmptyStrings(strings.Split(r.URL.Path[1:], "/"))
+// serveHealth responds with 200 once the transport has started, and 503 while it's still
+// starting or is shutting down.
+func (t *httpTransport) serveHealth(w http.ResponseWriter, r *http.Request) {
+	state := t.State()
+	health := HealthInfo{State: state.String(), Address: t.address}
 
-	stateURI := r.Header.Get("State-URI")
-	if stateURI == "" {
-		stateURI = strings.Join([]string{t.defaultStateURI, keypathStrs[0]}, "/")
-		keypathStrs = keypathStrs[1:]
+	if state != ctx.LifecycleState_Running {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(health)
+		return
+	}
+
+	health.Uptime = Duration(time.Since(t.startedAt))
+	for _, peer := range t.peerStore.Peers() {
+		if peer.Verified {
+			health.NumPeers++
+		}
+	}
+	health.MempoolLen = t.controller.MempoolLen()
+	health.StateURIs = len(t.controller.KnownStateURIs())
+	respondJSON(w, health)
+}
+
+// serveDebug responds with the host's subscriptions and peers (see DebugInfo).  Only
+// loopback clients are answered.
+func (t *httpTransport) serveDebug(w http.ResponseWriter, r *http.Request) {
+	if ip := net.ParseIP(clientIP(r)); ip == nil || !ip.IsLoopback() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	} else if t.debugInfoHandler == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, t.debugInfoHandler())
+}
+
+func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
+
+	stateURI, keypathStrs, ok := t.stateURIFromGetRequest(r)
+	if !ok {
+		http.Error(w, "missing stateURI", http.StatusNotFound)
+		return
 	}
 
 	keypathStr := strings.Join(keypathStrs, string(tree.KeypathSeparator))
@@ -472,18 +863,15 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 	}
 	keypath = tree.JoinKeypaths(newParts, []byte("/"))
 
-	var version *types.ID
-	if vstr := r.Header.Get("Version"); vstr != "" {
-		v, err := types.IDFromHex(vstr)
-		if err != nil {
-			http.Error(w, "bad Version header", http.StatusBadRequest)
-			return
-		}
-		version = &v
+	version, err := parseVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	var rng *tree.Range
-	if rstr := r.Header.Get("Range"); rstr != "" {
+	// Byte ranges ("Range: bytes=...") are handled by http.ServeContent when serving refs
+	if rstr := r.Header.Get("Range"); rstr != "" && !strings.HasPrefix(rstr, "bytes=") {
 		// Range: -10:-5
 		// @@TODO: real json Range parsing
 		parts := strings.SplitN(rstr, "=", 2)
@@ -512,30 +900,23 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 		rng = &tree.Range{start, end}
 	}
 
-	// Add the "Parents" header
+	// Add the "Leaves" and "State-URI" headers.  The leaves are the current tips of the
+	// stateURI's DAG, which a tx has to name as its parents in order to build on the state
+	// being served.
 	{
 		leaves, err := t.controller.Leaves(stateURI)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("%+v", err), http.StatusNotFound)
 			return
 		}
-		var leaf types.ID
-		for vid := range leaves {
-			leaf = vid
-			break
-		}
-		tx, err := t.controller.FetchTx(stateURI, leaf)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("can't fetch tx %v: %+v", leaf, err.Error()), http.StatusNotFound)
-			return
-		}
-		parents := tx.Parents
 
-		var parentStrs []string
-		for _, pid := range parents {
-			parentStrs = append(parentStrs, pid.Hex())
+		leafStrs := make([]string, 0, len(leaves))
+		for leafID := range leaves {
+			leafStrs = append(leafStrs, leafID.Hex())
 		}
-		w.Header().Add("Parents", strings.Join(parentStrs, ","))
+		sort.Strings(leafStrs)
+		w.Header().Set("Leaves", strings.Join(leafStrs, ","))
+		w.Header().Set("State-URI", stateURI)
 	}
 
 	indexName, indexArg := parseIndexParams(r)
@@ -551,7 +932,7 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 	if indexName != "" {
 		// Index query
 		state, err = t.controller.QueryIndex(stateURI, version, keypath, tree.Keypath(indexName), tree.Keypath(indexArg), rng)
-		if errors.Cause(err) == types.Err404 {
+		if errors.Is(err, types.Err404) {
 			http.Error(w, fmt.Sprintf("not found: %+v", err), http.StatusNotFound)
 			return
 		} else if err != nil {
@@ -582,7 +963,7 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 			}
 
 			state, err = state.CopyToMemory(keypath, rng)
-			if errors.Cause(err) == types.Err404 {
+			if errors.Is(err, types.Err404) {
 				http.Error(w, fmt.Sprintf("not found: %+v", err), http.StatusNotFound)
 				return
 			} else if err != nil {
@@ -620,7 +1001,11 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 	} else {
 		val, exists, err = state.Value(nil, nil)
 	}
-	if err != nil {
+	if errors.Is(err, nelson.ErrRefNotAvailable) {
+		// The keypath exists, but what it links to hasn't been fetched from our peers yet
+		http.Error(w, fmt.Sprintf("ref not yet available: %+v", err), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("error: %+v", err), http.StatusBadRequest)
 		return
 	} else if !exists {
@@ -628,6 +1013,17 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refs are served with http.ServeContent so that byte Range requests (used by
+	// browsers and media players to seek) and conditional requests are honored.
+	if readSeeker, isReadSeeker := val.(io.ReadSeeker); isReadSeeker && !anyMissing {
+		if closer, isCloser := val.(io.Closer); isCloser {
+			defer closer.Close()
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Time{}, readSeeker)
+		return
+	}
+
 	respBuf, ok := nelson.GetReadCloser(val)
 	if !ok {
 		contentType = "application/json"
@@ -636,6 +1032,8 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 			panic(err)
 		}
 		respBuf = ioutil.NopCloser(bytes.NewBuffer(j))
+		// The length of the value in the state tree isn't the length of its JSON encoding
+		contentLength = int64(len(j))
 	}
 	defer respBuf.Close()
 
@@ -711,7 +1109,7 @@ func (t *httpTransport) servePostRef(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	hash, err := t.refStore.StoreObject(file, header.Header.Get("Content-Type"))
+	hash, _, err := t.refStore.StoreObject(file, header.Header.Get("Content-Type"))
 	if err != nil {
 		t.Errorf("error storing ref: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
@@ -801,16 +1199,99 @@ func (t *httpTransport) servePostTx(w http.ResponseWriter, r *http.Request, addr
 	}
 
 	// @@TODO: remove .From entirely
-	pubkey, err := RecoverSigningPubkey(tx.Hash(), sig)
+	pubkey, err := RecoverSigningPubkey(tx.Hash(), sig, t.sigkeys.AddressDerivation())
 	if err != nil {
-		panic("bad sig")
+		http.Error(w, "bad Signature header", http.StatusBadRequest)
+		return
 	}
 	tx.From = pubkey.Address()
 	////////////////////////////////
 
+	// If the client has authenticated via AUTHORIZE, its session is bound to that
+	// address and it may only submit txs signed by it.  Unauthenticated clients are
+	// refused on stateURIs that declare a Validator.
+	if address != (types.Address{}) {
+		if tx.From != address {
+			http.Error(w, "tx signer does not match authenticated address", http.StatusForbidden)
+			return
+		}
+	} else {
+		permissioned, err := t.isPermissionedStateURI(stateURI)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("internal server error: %v", err), http.StatusInternalServerError)
+			return
+		} else if permissioned {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	t.txHandler(tx, &httpPeer{address: address, t: t, Writer: w})
 }
 
+func (t *httpTransport) isPermissionedStateURI(stateURI string) (bool, error) {
+	state, err := t.controller.StateAtVersion(stateURI, nil)
+	if errors.Is(err, ErrNoController) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer state.Close()
+
+	return state.Exists(ValidatorKeypath)
+}
+
+// stateURIFromGetRequest determines which stateURI a GET request targets and
+// returns the remaining path components (which form the keypath).  The rules are:
+//  1. If a State-URI header is present, it names the stateURI and the whole path is the keypath.
+//  2. Otherwise, the first path component is the stateURI's final segment, and its host is:
+//     a. the request's Host (without port) if any known stateURI lives under that host, or
+//     b. the transport's default stateURI host.
+func (t *httpTransport) stateURIFromGetRequest(r *http.Request) (string, []string, bool) {
+	keypathStrs := filterEmptyStrings(strings.Split(r.URL.Path[1:], "/"))
+
+	if stateURI := r.Header.Get("State-URI"); stateURI != "" {
+		return stateURI, keypathStrs, true
+	} else if len(keypathStrs) == 0 {
+		return "", nil, false
+	}
+
+	host := t.defaultStateURI
+	if reqHost := hostnameFromRequest(r); reqHost != "" {
+		for _, known := range t.controller.KnownStateURIs() {
+			if strings.HasPrefix(known, reqHost+"/") {
+				host = reqHost
+				break
+			}
+		}
+	}
+	return host + "/" + keypathStrs[0], keypathStrs[1:], true
+}
+
+func hostnameFromRequest(r *http.Request) string {
+	if i := strings.LastIndexByte(r.Host, ':'); i > -1 && !strings.HasSuffix(r.Host, "]") {
+		return r.Host[:i]
+	}
+	return r.Host
+}
+
+// parseVersion reads the requested state version from either the Version
+// header or the ?version= query param.  A nil version means "current".
+func parseVersion(r *http.Request) (*types.ID, error) {
+	vstr := r.Header.Get("Version")
+	if vstr == "" {
+		vstr = r.URL.Query().Get("version")
+	}
+	if vstr == "" {
+		return nil, nil
+	}
+	v, err := types.IDFromHex(vstr)
+	if err != nil {
+		return nil, errors.New("bad Version header")
+	}
+	return &v, nil
+}
+
 func parseRawParam(r *http.Request) (bool, error) {
 	rawStr := r.URL.Query().Get("raw")
 	if rawStr == "" {
@@ -882,6 +1363,10 @@ func (t *httpTransport) SetFetchRefHandler(handler FetchRefHandler) {
 	t.fetchRefHandler = handler
 }
 
+func (t *httpTransport) SetDebugInfoHandler(handler DebugInfoHandler) {
+	t.debugInfoHandler = handler
+}
+
 func (t *httpTransport) GetPeerByConnStrings(ctx context.Context, reachableAt StringSet) (Peer, error) {
 	if len(reachableAt) != 1 {
 		panic("weird")
@@ -900,7 +1385,12 @@ func (t *httpTransport) ForEachProviderOfStateURI(ctx context.Context, theURL st
 
 	u.Path = path.Join(u.Path, "providers")
 
-	resp, err := http.Get(u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != 200 {
@@ -925,6 +1415,7 @@ func (t *httpTransport) ForEachProviderOfStateURI(ctx context.Context, theURL st
 			select {
 			case ch <- &httpPeer{t: t, reachableAt: providerURL}:
 			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -935,8 +1426,8 @@ func (t *httpTransport) ForEachProviderOfRef(ctx context.Context, refHash types.
 	return nil, errors.New("unimplemented")
 }
 
-func (t *httpTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Peer, error) {
-	ch := make(chan Peer)
+func (t *httpTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Subscriber, error) {
+	ch := make(chan Subscriber)
 	go func() {
 		t.subscriptionsInMu.RLock()
 		defer t.subscriptionsInMu.RUnlock()
@@ -949,7 +1440,7 @@ func (t *httpTransport) ForEachSubscriberToStateURI(ctx context.Context, stateUR
 		for sub := range t.subscriptionsIn[stateURI] {
 			<-sub.chDoneCatchingUp
 			select {
-			case ch <- &httpPeer{t: t, Writer: sub.Writer, Flusher: sub.Flusher}:
+			case ch <- Subscriber{&httpPeer{t: t, Writer: sub.Writer, Flusher: sub.Flusher}, sub.keypath}:
 			case <-ctx.Done():
 			}
 		}
@@ -984,13 +1475,19 @@ func (t *httpTransport) setSessionIDCookie(w http.ResponseWriter) (types.ID, err
 	return sessionID, err
 }
 
-func (t *httpTransport) setSignedCookie(w http.ResponseWriter, name string, value []byte) error {
-	w.Header().Del("Set-Cookie")
+// cookieMAC returns the HMAC-SHA256 of a cookie's name and value, keyed with
+// the transport's cookie secret.  Including the name prevents a valid cookie
+// from being replayed under a different name (e.g. sessionid -> address).
+func (t *httpTransport) cookieMAC(name string, value []byte) []byte {
+	mac := hmac.New(sha256.New, t.cookieSecret[:])
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(value)
+	return mac.Sum(nil)
+}
 
-	sig, err := t.sigkeys.SignHash(types.HashBytes(append(value, t.cookieSecret[:]...)))
-	if err != nil {
-		return err
-	}
+func (t *httpTransport) setSignedCookie(w http.ResponseWriter, name string, value []byte) error {
+	sig := t.cookieMAC(name, value)
 
 	http.SetCookie(w, &http.Cookie{
 		Name:    name,
@@ -1019,7 +1516,7 @@ func (t *httpTransport) signedCookie(r *http.Request, name string) ([]byte, erro
 	sig, err := hex.DecodeString(parts[1])
 	if err != nil {
 		return nil, errors.Wrapf(ErrBadCookie, "cookie '%v' bad hex signature: %v", name, err)
-	} else if !t.sigkeys.VerifySignature(types.HashBytes(append(value, t.cookieSecret[:]...)), sig) {
+	} else if !hmac.Equal(sig, t.cookieMAC(name, value)) {
 		return nil, errors.Wrapf(ErrBadCookie, "cookie '%v' has invalid signature (value: %0x)", name, value)
 	}
 	return value, nil
@@ -1037,6 +1534,9 @@ type httpPeer struct {
 	t       *httpTransport
 	address types.Address
 
+	// The host that the remote node addressed its request to, if it reached out to us
+	requestHost string
+
 	// stream
 	reachableAt string
 	sync.Mutex
@@ -1045,6 +1545,14 @@ type httpPeer struct {
 	http.Flusher
 
 	state httpPeerState
+
+	// Set while we're reading the txs sent back by a FetchHistory request
+	historyReader *bufio.Reader
+
+	// Set while we're waiting on the remote node to answer our counter-challenge
+	counterChallenge           types.ChallengeMsg
+	chCounterChallengeResponse chan httpCounterChallengeResponse
+	counterChallengeDone       chan struct{}
 }
 
 type httpPeerState int
@@ -1053,6 +1561,8 @@ const (
 	httpPeerState_Unknown = iota
 	httpPeerState_ServingSubscription
 	httpPeerState_VerifyingAddress
+	httpPeerState_RefusedVerification
+	httpPeerState_FetchingHistory
 )
 
 func (p *httpPeer) Transport() Transport {
@@ -1060,6 +1570,10 @@ func (p *httpPeer) Transport() Transport {
 }
 
 func (p *httpPeer) ReachableAt() StringSet {
+	if p.reachableAt == "" {
+		// Peers that reach out to us can't be reached in turn
+		return NewStringSet(nil)
+	}
 	return NewStringSet([]string{p.reachableAt})
 }
 
@@ -1067,8 +1581,9 @@ func (p *httpPeer) Address() types.Address {
 	return p.address
 }
 
-func (p *httpPeer) SetAddress(addr types.Address) {
+func (p *httpPeer) SetAddress(addr types.Address) error {
 	p.address = addr
+	return nil
 }
 
 func (p *httpPeer) EnsureConnected(ctx context.Context) error {
@@ -1081,17 +1596,34 @@ func (p *httpPeer) WriteMsg(msg Msg) error {
 
 	switch msg.Type {
 	case MsgType_Subscribe:
-		stateURI, ok := msg.Payload.(string)
+		subMsg, ok := msg.Payload.(SubscribeMsg)
 		if !ok {
 			return errors.WithStack(ErrProtocol)
 		}
 
+		// The filter of known txs grows with the state's history, so it goes in the body
+		// rather than in a header, which servers and proxies tend to cap at about 8KB
+		var body io.Reader
+		if subMsg.KnownTxs != nil {
+			knownTxs, err := subMsg.KnownTxs.MarshalText()
+			if err != nil {
+				return err
+			}
+			body = bytes.NewReader(knownTxs)
+		}
+
 		var client http.Client
-		req, err := http.NewRequest("GET", p.reachableAt, nil)
+		req, err := http.NewRequest("GET", p.reachableAt, body)
 		if err != nil {
 			return err
 		}
-		req.Header.Set("State-URI", stateURI)
+		req.Header.Set("State-URI", subMsg.StateURI)
+		if subMsg.Keypath != "" {
+			req.Header.Set("Keypath", subMsg.Keypath)
+		}
+		if body != nil {
+			req.Header.Set("Known-Txs", "body")
+		}
 		req.Header.Set("Cache-Control", "no-cache")
 		req.Header.Set("Accept", "text/event-stream")
 		req.Header.Set("Connection", "keep-alive")
@@ -1209,12 +1741,36 @@ func (p *httpPeer) WriteMsg(msg Msg) error {
 			return errors.WithStack(ErrProtocol)
 		}
 
+		if p.Writer == nil {
+			// We're the initiator, answering the remote node's counter-challenge
+			return p.sendCounterChallengeResponse(verifyAddressResponse)
+		}
+
+		if len(verifyAddressResponse.CounterChallenge) > 0 {
+			ch, err := p.t.expectCounterChallengeResponse(verifyAddressResponse.CounterChallenge)
+			if err != nil {
+				return err
+			}
+			p.counterChallenge = verifyAddressResponse.CounterChallenge
+			p.chCounterChallengeResponse = ch
+			p.state = httpPeerState_VerifyingAddress
+		}
+
 		err := json.NewEncoder(p.Writer).Encode(verifyAddressResponse)
 		if err != nil {
 			http.Error(p.Writer.(http.ResponseWriter), err.Error(), http.StatusInternalServerError)
 			panic(err)
 			return err
 		}
+		if p.Flusher != nil {
+			p.Flusher.Flush()
+		}
+
+	case MsgType_Error:
+		if p.Writer == nil {
+			return errors.Errorf("%v messages can only be sent in response to a request over http", msg.Type)
+		}
+		http.Error(p.Writer.(http.ResponseWriter), fmt.Sprintf("%v", msg.Payload), http.StatusForbidden)
 
 	case MsgType_Private:
 		encPut, ok := msg.Payload.(EncryptedTx)
@@ -1242,15 +1798,91 @@ func (p *httpPeer) WriteMsg(msg Msg) error {
 		}
 		defer resp.Body.Close()
 
+	case MsgType_FetchHistory:
+		fetchHistory, ok := msg.Payload.(FetchHistoryMsg)
+		if !ok {
+			return errors.WithStack(ErrProtocol)
+		}
+
+		req, err := http.NewRequest("GET", p.reachableAt, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("State-URI", fetchHistory.StateURI)
+		req.Header.Set("Fetch-History", "true")
+		if len(fetchHistory.Parents) > 0 {
+			var parentStrs []string
+			for _, parent := range fetchHistory.Parents {
+				parentStrs = append(parentStrs, parent.Hex())
+			}
+			req.Header.Set("Parents", strings.Join(parentStrs, ","))
+		}
+		if fetchHistory.ToVersion != (types.ID{}) {
+			req.Header.Set("Version", fetchHistory.ToVersion.Hex())
+		}
+
+		client := http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		} else if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return errors.Errorf("error fetching history from peer: (%v) %v", resp.StatusCode, resp.Status)
+		}
+
+		p.state = httpPeerState_FetchingHistory
+		p.ReadCloser = resp.Body
+		p.historyReader = bufio.NewReader(resp.Body)
+
 	default:
 		panic("unimplemented")
 	}
 	return nil
 }
 
+func (p *httpPeer) sendCounterChallengeResponse(verifyAddressResponse VerifyAddressResponse) error {
+	bs, err := json.Marshal(verifyAddressResponse)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{}
+	req, err := http.NewRequest("AUTHORIZE", p.reachableAt, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Counter-Challenge-Response", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if p.ReadCloser != nil {
+		p.ReadCloser.Close()
+	}
+	p.ReadCloser = resp.Body
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		p.state = httpPeerState_VerifyingAddress
+	case http.StatusForbidden:
+		p.state = httpPeerState_RefusedVerification
+	default:
+		resp.Body.Close()
+		return errors.Errorf("error verifying peer address: (%v) %v", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
 func (p *httpPeer) ReadMsg() (Msg, error) {
 	switch p.state {
 	case httpPeerState_VerifyingAddress:
+		if p.Writer != nil {
+			// We're the responder, waiting on the answer to our counter-challenge
+			return p.readCounterChallengeResponse()
+		}
+
 		var verifyResp VerifyAddressResponse
 		err := json.NewDecoder(p.ReadCloser).Decode(&verifyResp)
 		if err != nil {
@@ -1258,6 +1890,38 @@ func (p *httpPeer) ReadMsg() (Msg, error) {
 		}
 		return Msg{Type: MsgType_VerifyAddressResponse, Payload: verifyResp}, nil
 
+	case httpPeerState_RefusedVerification:
+		bs, err := ioutil.ReadAll(p.ReadCloser)
+		if err != nil {
+			return Msg{}, err
+		}
+		return Msg{Type: MsgType_Error, Payload: strings.TrimSpace(string(bs))}, nil
+
+	case httpPeerState_FetchingHistory:
+		// The txs arrive as server-sent events, and the response ends (with io.EOF) once
+		// they've all been sent
+		for {
+			line, err := p.historyReader.ReadBytes(byte('\n'))
+			if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+				err = nil
+			} else if err != nil {
+				return Msg{}, err
+			}
+
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			line = bytes.TrimPrefix(line, []byte("data:"))
+
+			var tx Tx
+			err = json.Unmarshal(bytes.TrimSpace(line), &tx)
+			if err != nil {
+				return Msg{}, err
+			}
+			return Msg{Type: MsgType_Put, Payload: tx}, nil
+		}
+
 	case httpPeerState_ServingSubscription:
 		var tx Tx
 		r := bufio.NewReader(p.ReadCloser)
@@ -1281,7 +1945,31 @@ func (p *httpPeer) ReadMsg() (Msg, error) {
 	}
 }
 
+func (p *httpPeer) readCounterChallengeResponse() (Msg, error) {
+	if p.chCounterChallengeResponse == nil {
+		return Msg{}, errors.Wrap(ErrProtocol, "no counter-challenge has been sent")
+	}
+
+	answer, err := p.t.awaitCounterChallengeResponse(p.counterChallenge, p.chCounterChallengeResponse)
+	if err != nil {
+		return Msg{}, err
+	}
+	p.chCounterChallengeResponse = nil
+
+	// The rest of the handshake is written in response to the request that brought us
+	// the answer
+	flusher, _ := answer.w.(http.Flusher)
+	p.Writer = answer.w
+	p.Flusher = flusher
+	p.counterChallengeDone = answer.done
+	return Msg{Type: MsgType_VerifyAddressResponse, Payload: answer.resp}, nil
+}
+
 func (p *httpPeer) CloseConn() error {
+	if p.counterChallengeDone != nil {
+		close(p.counterChallengeDone)
+		p.counterChallengeDone = nil
+	}
 	if p.ReadCloser != nil {
 		return p.ReadCloser.Close()
 	}
@@ -0,0 +1,882 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+type mockMetacontroller struct {
+	Metacontroller
+	states         map[string]tree.Node
+	versions       map[types.ID]tree.Node
+	leaves         map[string][]types.ID
+	refStore       RefStore
+	unseekableRefs bool
+}
+
+func (m *mockMetacontroller) StateAtVersion(stateURI string, version *types.ID) (tree.Node, error) {
+	state, exists := m.states[stateURI]
+	if !exists {
+		return nil, ErrNoController
+	}
+	if version != nil {
+		state, exists = m.versions[*version]
+		if !exists {
+			return nil, types.Err404
+		}
+	}
+	return state, nil
+}
+
+func (m *mockMetacontroller) KnownStateURIs() []string {
+	var stateURIs []string
+	for stateURI := range m.states {
+		stateURIs = append(stateURIs, stateURI)
+	}
+	return stateURIs
+}
+
+func (m *mockMetacontroller) ControllerForStateURI(stateURI string) (Controller, error) {
+	if _, exists := m.states[stateURI]; !exists {
+		return nil, ErrNoController
+	}
+	return nil, nil
+}
+
+func (m *mockMetacontroller) MempoolLen() int {
+	return 3
+}
+
+func (m *mockMetacontroller) Leaves(stateURI string) (map[types.ID]struct{}, error) {
+	if _, exists := m.states[stateURI]; !exists {
+		return nil, ErrNoController
+	}
+	leaves := make(map[types.ID]struct{})
+	for _, leaf := range m.leaves[stateURI] {
+		leaves[leaf] = struct{}{}
+	}
+	if len(leaves) == 0 {
+		leaves[GenesisTxID] = struct{}{}
+	}
+	return leaves, nil
+}
+
+func (m *mockMetacontroller) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
+	return &Tx{ID: txID, URL: stateURI}, nil
+}
+
+func (m *mockMetacontroller) RefObjectReader(refHash types.Hash) (io.ReadCloser, int64, error) {
+	reader, size, err := m.refStore.Object(refHash)
+	if err != nil || !m.unseekableRefs {
+		return reader, size, err
+	}
+	// Hide the file's Seek method, like a ref store that streams from elsewhere would
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, reader}, size, nil
+}
+
+func (m *mockMetacontroller) RefObjectContentType(refHash types.Hash) (string, error) {
+	return m.refStore.ContentType(refHash)
+}
+
+func newTestHTTPTransport(t *testing.T, controller Metacontroller) *httpTransport {
+	sigkeys, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	var cookieSecret [32]byte
+	copy(cookieSecret[:], "super secret cookie secret value")
+
+	tpt, err := NewHTTPTransport(sigkeys.Address(), ":0", "localhost", controller, nil, NewPeerStore(sigkeys.Address()), sigkeys, cookieSecret, "", "", DefaultHTTPLimits)
+	require.NoError(t, err)
+	return tpt.(*httpTransport)
+}
+
+func authorizeTestClient(t *testing.T, tpt *httpTransport, client *SigningKeypair) []*http.Cookie {
+	req := httptest.NewRequest("AUTHORIZE", "/", nil)
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	cookies := resp.Result().Cookies()
+	challenge, err := hex.DecodeString(resp.Body.String())
+	require.NoError(t, err)
+
+	sig, err := client.SignHash(types.HashBytes(challenge))
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("AUTHORIZE", "/", nil)
+	req.Header.Set("Response", hex.EncodeToString(sig))
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp = httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	return append(cookies, resp.Result().Cookies()...)
+}
+
+func newTestPutRequest(t *testing.T, client *SigningKeypair, stateURI string, cookies []*http.Cookie) *http.Request {
+	patch, err := ParsePatch([]byte(`.foo = "bar"`))
+	require.NoError(t, err)
+
+	tx := Tx{ID: types.RandomID(), URL: stateURI, Patches: []Patch{patch}}
+	sig, err := client.SignHash(tx.Hash())
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("PUT", "/", strings.NewReader(patch.String()))
+	req.Header.Set("State-URI", stateURI)
+	req.Header.Set("Version", tx.ID.Hex())
+	req.Header.Set("Signature", hex.EncodeToString(sig))
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestHTTPTransport_AuthenticatedPut(t *testing.T) {
+	permissioned := tree.NewMemoryNode()
+	err := permissioned.Set(ValidatorKeypath, nil, map[string]interface{}{"Content-Type": "permissions"})
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": permissioned}}
+	tpt := newTestHTTPTransport(t, controller)
+
+	var received []Tx
+	tpt.SetTxHandler(func(tx Tx, peer Peer) { received = append(received, tx) })
+
+	client, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	t.Run("verify then PUT with a valid cookie succeeds", func(t *testing.T) {
+		cookies := authorizeTestClient(t, tpt, client)
+
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, newTestPutRequest(t, client, "localhost/chat", cookies))
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Len(t, received, 1)
+		require.Equal(t, client.Address(), received[0].From)
+	})
+
+	t.Run("forged address cookie is rejected", func(t *testing.T) {
+		received = nil
+		cookies := authorizeTestClient(t, tpt, client)
+
+		forger, err := GenerateSigningKeypair()
+		require.NoError(t, err)
+
+		for _, c := range cookies {
+			if c.Name == "address" {
+				parts := strings.Split(c.Value, ":")
+				forgerAddr := forger.Address()
+				c.Value = hex.EncodeToString(forgerAddr[:]) + ":" + parts[1]
+			}
+		}
+
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, newTestPutRequest(t, forger, "localhost/chat", cookies))
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		require.Len(t, received, 0)
+	})
+
+	t.Run("unauthenticated PUT to a permissioned stateURI is rejected", func(t *testing.T) {
+		received = nil
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, newTestPutRequest(t, client, "localhost/chat", nil))
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		require.Len(t, received, 0)
+	})
+
+	t.Run("PUT signed by a different key than the session is rejected", func(t *testing.T) {
+		received = nil
+		cookies := authorizeTestClient(t, tpt, client)
+
+		other, err := GenerateSigningKeypair()
+		require.NoError(t, err)
+
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, newTestPutRequest(t, other, "localhost/chat", cookies))
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.Len(t, received, 0)
+	})
+}
+
+func TestHTTPTransport_GetRefLink(t *testing.T) {
+	refStoreRoot, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(refStoreRoot)
+
+	refStore := NewRefStore(refStoreRoot, "")
+	blob := []byte("<html><body>hello</body></html>")
+	hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(blob)), "text/html")
+	require.NoError(t, err)
+
+	state := tree.NewMemoryNode()
+	err = state.Set(tree.Keypath("talk0/index"), nil, map[string]interface{}{
+		"Content-Type": "link",
+		"value":        "ref:" + hash.Hex(),
+	})
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{
+		states:   map[string]tree.Node{"localhost/shrugisland": state},
+		refStore: refStore,
+	}
+	tpt := newTestHTTPTransport(t, controller)
+
+	req := httptest.NewRequest("GET", "/shrugisland/talk0/index", nil)
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "text/html", resp.Header().Get("Content-Type"))
+	require.Equal(t, blob, resp.Body.Bytes())
+}
+
+func TestHTTPTransport_GetMissingRefLink(t *testing.T) {
+	refStoreRoot, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(refStoreRoot)
+
+	refStore := NewRefStore(refStoreRoot, "")
+	missing := types.HashBytes([]byte("not fetched yet"))
+
+	state := tree.NewMemoryNode()
+	err = state.Set(nil, nil, map[string]interface{}{
+		"talk0": map[string]interface{}{
+			"video": map[string]interface{}{
+				"Content-Type": "link",
+				"value":        "ref:" + missing.Hex(),
+			},
+			"title": "hello",
+		},
+	})
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{
+		states:   map[string]tree.Node{"localhost/shrugisland": state},
+		refStore: refStore,
+	}
+	tpt := newTestHTTPTransport(t, controller)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("link target not fetched yet", func(t *testing.T) {
+		resp := get("/shrugisland/talk0/video")
+		require.Equal(t, http.StatusServiceUnavailable, resp.Code)
+		require.Contains(t, resp.Body.String(), "ref not yet available")
+	})
+
+	t.Run("keypath doesn't exist", func(t *testing.T) {
+		resp := get("/shrugisland/talk0/audio")
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("enclosing document", func(t *testing.T) {
+		resp := get("/shrugisland/talk0")
+		require.Equal(t, http.StatusPartialContent, resp.Code)
+		require.Contains(t, resp.Body.String(), "ref:"+missing.Hex())
+		require.Contains(t, resp.Body.String(), "hello")
+	})
+}
+
+func TestHTTPTransport_GetSetsContentLength(t *testing.T) {
+	refStoreRoot, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(refStoreRoot)
+
+	refStore := NewRefStore(refStoreRoot, "")
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(blob)), "video/mp4")
+	require.NoError(t, err)
+
+	state := tree.NewMemoryNode()
+	err = state.Set(nil, nil, map[string]interface{}{
+		"video": map[string]interface{}{
+			"Content-Type": "link",
+			"value":        "ref:" + hash.Hex(),
+		},
+		"title": "hello",
+		"tags":  []interface{}{"one", "two", "three"},
+	})
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{
+		states:   map[string]tree.Node{"localhost/media": state},
+		refStore: refStore,
+	}
+	tpt := newTestHTTPTransport(t, controller)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		return resp
+	}
+
+	t.Run("ref", func(t *testing.T) {
+		resp := get("/media/video")
+		require.Equal(t, strconv.Itoa(len(blob)), resp.Header().Get("Content-Length"))
+		require.Equal(t, blob, resp.Body.Bytes())
+	})
+
+	t.Run("unseekable ref", func(t *testing.T) {
+		controller.unseekableRefs = true
+		defer func() { controller.unseekableRefs = false }()
+
+		resp := get("/media/video")
+		require.Equal(t, strconv.Itoa(len(blob)), resp.Header().Get("Content-Length"))
+		require.Equal(t, blob, resp.Body.Bytes())
+	})
+
+	t.Run("JSON values", func(t *testing.T) {
+		for _, path := range []string{"/media/title", "/media/tags"} {
+			resp := get(path)
+			require.Equal(t, strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
+		}
+	})
+}
+
+func TestHTTPTransport_SubscriptionCleanedUpOnDisconnect(t *testing.T) {
+	controller := &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	tpt := newTestHTTPTransport(t, controller)
+
+	numSubscribers := func() int {
+		tpt.subscriptionsInMu.RLock()
+		defer tpt.subscriptionsInMu.RUnlock()
+		return len(tpt.subscriptionsIn["localhost/chat"])
+	}
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+	req.Header.Set("Subscribe", "keep-alive")
+	req.Header.Set("State-URI", "localhost/chat")
+
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		tpt.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	require.Eventually(t, func() bool { return numSubscribers() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case <-chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription handler did not return after the client disconnected")
+	}
+	require.Equal(t, 0, numSubscribers())
+}
+
+func TestHTTPTransport_SubscribeToUnhostedStateURIIsRejected(t *testing.T) {
+	controller := &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	tpt := newTestHTTPTransport(t, controller)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Subscribe", "keep-alive")
+	req.Header.Set("State-URI", "localhost/elsewhere")
+
+	chDone := make(chan struct{})
+	resp := httptest.NewRecorder()
+	go func() {
+		defer close(chDone)
+		tpt.ServeHTTP(resp, req)
+	}()
+
+	select {
+	case <-chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription to an unhosted stateURI was left open")
+	}
+	require.Equal(t, http.StatusNotFound, resp.Code)
+
+	tpt.subscriptionsInMu.RLock()
+	defer tpt.subscriptionsInMu.RUnlock()
+	require.Empty(t, tpt.subscriptionsIn)
+}
+
+func TestHTTPTransport_SubscriptionSendsKnownTxsInTheBody(t *testing.T) {
+	controller := &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	tpt := newTestHTTPTransport(t, controller)
+
+	// Big enough that it wouldn't fit in a header
+	knownTxs := NewTxBloomFilter(100000)
+	knownTxs.Add(types.IDFromString("one"))
+	text, err := knownTxs.MarshalText()
+	require.NoError(t, err)
+	require.True(t, len(text) > 64*1024)
+
+	chReceived := make(chan *TxBloomFilter, 1)
+	tpt.SetFetchHistoryHandler(func(stateURI string, keypath tree.Keypath, parents []types.ID, knownTxs *TxBloomFilter, toVersion types.ID, peer Peer) error {
+		chReceived <- knownTxs
+		return nil
+	})
+	server := httptest.NewServer(tpt)
+	defer server.Close()
+
+	peer := &httpPeer{t: tpt, reachableAt: server.URL}
+	err = peer.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: SubscribeMsg{StateURI: "localhost/chat", KnownTxs: knownTxs}})
+	require.NoError(t, err)
+	defer peer.CloseConn()
+
+	select {
+	case received := <-chReceived:
+		require.Equal(t, knownTxs, received)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the provider never got the subscriber's known txs")
+	}
+
+	t.Run("a filter that's too large is ignored", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", strings.NewReader("7:"+strings.Repeat("A", MAX_KNOWN_TXS_BYTES)))
+		req.Header.Set("Subscribe", "keep-alive")
+		req.Header.Set("State-URI", "localhost/chat")
+		req.Header.Set("Known-Txs", "body")
+		req.Header.Set("Parents", GenesisTxID.Hex())
+		reqCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go tpt.ServeHTTP(httptest.NewRecorder(), req.WithContext(reqCtx))
+
+		select {
+		case received := <-chReceived:
+			require.Nil(t, received)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the provider never served the subscription")
+		}
+	})
+}
+
+func TestHTTPTransport_GetStateLeavesAndVersion(t *testing.T) {
+	current := tree.NewMemoryNode()
+	err := current.Set(tree.Keypath("messages"), nil, []interface{}{"hi", "there"})
+	require.NoError(t, err)
+
+	old := tree.NewMemoryNode()
+	err = old.Set(tree.Keypath("messages"), nil, []interface{}{"hi"})
+	require.NoError(t, err)
+
+	leaf1 := types.IDFromString("leaf1")
+	leaf2 := types.IDFromString("leaf2")
+	oldVersion := types.IDFromString("old")
+
+	controller := &mockMetacontroller{
+		states:   map[string]tree.Node{"localhost/chat": current},
+		versions: map[types.ID]tree.Node{oldVersion: old},
+		leaves:   map[string][]types.ID{"localhost/chat": {leaf2, leaf1}},
+	}
+	tpt := newTestHTTPTransport(t, controller)
+
+	t.Run("leaves and stateURI are reported", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/chat/messages", nil)
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, "localhost/chat", resp.Header().Get("State-URI"))
+		require.Equal(t, leaf1.Hex()+","+leaf2.Hex(), resp.Header().Get("Leaves"))
+		require.JSONEq(t, `["hi","there"]`, resp.Body.String())
+	})
+
+	t.Run("version query param reads a historical snapshot", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/chat/messages?version="+oldVersion.Hex(), nil)
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.JSONEq(t, `["hi"]`, resp.Body.String())
+	})
+}
+
+func TestHTTPTransport_GetStateReportsAllLeavesAfterConcurrentTxs(t *testing.T) {
+	m, _ := newTestMetacontroller(t)
+	tpt := newTestHTTPTransport(t, m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Two siblings, each unaware of the other
+	a := types.IDFromString("a")
+	b := types.IDFromString("b")
+	for _, tx := range []*Tx{
+		{ID: GenesisTxID, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("x"), Val: "genesis"}}},
+		{ID: a, Parents: []types.ID{GenesisTxID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("x"), Val: "a"}}},
+		{ID: b, Parents: []types.ID{GenesisTxID}, URL: "localhost/chat", Patches: []Patch{{Keypath: tree.Keypath("y"), Val: "b"}}},
+	} {
+		err := m.AddTxAndWait(ctx, signTestTx(t, tx))
+		require.NoError(t, err)
+	}
+
+	expectedLeaves := []types.ID{a, b}
+	if b.Hex() < a.Hex() {
+		expectedLeaves = []types.ID{b, a}
+	}
+
+	req := httptest.NewRequest("GET", "/chat/x", nil)
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, expectedLeaves[0].Hex()+","+expectedLeaves[1].Hex(), resp.Header().Get("Leaves"))
+	require.Empty(t, resp.Header().Get("Parents"))
+
+	// Clients get back every leaf, so that their txs build on all of them
+	server := httptest.NewServer(tpt)
+	defer server.Close()
+
+	sigkeys, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	client, err := NewHTTPClient(server.URL, sigkeys)
+	require.NoError(t, err)
+
+	body, _, leaves, err := client.Get("localhost/chat", nil, tree.Keypath("x"), nil, false)
+	require.NoError(t, err)
+	defer body.Close()
+	require.Equal(t, expectedLeaves, leaves)
+}
+
+func TestHTTPTransport_GetRefByteRange(t *testing.T) {
+	refStoreRoot, err := ioutil.TempDir("", "redwood-test-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(refStoreRoot)
+
+	refStore := NewRefStore(refStoreRoot, "")
+	blob := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	hash, _, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(blob)), "video/mp4")
+	require.NoError(t, err)
+
+	state := tree.NewMemoryNode()
+	err = state.Set(tree.Keypath("video"), nil, map[string]interface{}{
+		"Content-Type": "link",
+		"value":        "ref:" + hash.Hex(),
+	})
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{
+		states:   map[string]tree.Node{"localhost/media": state},
+		refStore: refStore,
+	}
+	tpt := newTestHTTPTransport(t, controller)
+
+	req := httptest.NewRequest("GET", "/media/video", nil)
+	req.Header.Set("Range", "bytes=10-15")
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+
+	require.Equal(t, http.StatusPartialContent, resp.Code)
+	require.Equal(t, "video/mp4", resp.Header().Get("Content-Type"))
+	require.Equal(t, "bytes 10-15/36", resp.Header().Get("Content-Range"))
+	require.Equal(t, "6", resp.Header().Get("Content-Length"))
+	require.Equal(t, blob[10:16], resp.Body.Bytes())
+}
+
+func TestHTTPTransport_GetRoutesByHost(t *testing.T) {
+	stateA := tree.NewMemoryNode()
+	err := stateA.Set(tree.Keypath("topic"), nil, "from a")
+	require.NoError(t, err)
+
+	stateB := tree.NewMemoryNode()
+	err = stateB.Set(tree.Keypath("topic"), nil, "from b")
+	require.NoError(t, err)
+
+	controller := &mockMetacontroller{states: map[string]tree.Node{
+		"a.example/room": stateA,
+		"b.example/room": stateB,
+	}}
+	tpt := newTestHTTPTransport(t, controller)
+
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"a.example", "from a"},
+		{"b.example:8080", "from b"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/room/topic", nil)
+		req.Host = c.host
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, c.expected, strings.TrimSpace(resp.Body.String()))
+	}
+
+	// Unknown hosts fall back to the default stateURI host
+	req := httptest.NewRequest("GET", "/room/topic", nil)
+	req.Host = "unknown.example"
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHTTPTransport_Debug(t *testing.T) {
+	tpt := newTestHTTPTransport(t, nil)
+
+	newDebugRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "/__debug", nil)
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	// Without a host to ask, there's nothing to show
+	resp := httptest.NewRecorder()
+	tpt.ServeHTTP(resp, newDebugRequest("127.0.0.1:1234"))
+	require.Equal(t, http.StatusNotFound, resp.Code)
+
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := DebugInfo{
+		Address: types.Address{0x1},
+		Subscriptions: []SubscriptionInfo{
+			{StateURI: "localhost/test", Keypath: "messages", PeerAddress: types.Address{0xa}, Transport: "libp2p", ReachableAt: []string{"/alice"}, Since: since},
+		},
+		Peers: []PeerInfo{
+			{Address: types.Address{0xa}, Verified: true, ReachableAt: map[string][]string{"libp2p": {"/alice"}}},
+			{ReachableAt: map[string][]string{"http": {"unverified:8080"}}},
+		},
+	}
+	tpt.SetDebugInfoHandler(func() DebugInfo { return info })
+
+	resp = httptest.NewRecorder()
+	tpt.ServeHTTP(resp, newDebugRequest("[::1]:1234"))
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var decoded DebugInfo
+	err := json.Unmarshal(resp.Body.Bytes(), &decoded)
+	require.NoError(t, err)
+	require.Equal(t, info, decoded)
+
+	// Remote clients aren't told anything
+	resp = httptest.NewRecorder()
+	tpt.ServeHTTP(resp, newDebugRequest("192.0.2.1:1234"))
+	require.Equal(t, http.StatusForbidden, resp.Code)
+	require.NotContains(t, resp.Body.String(), "alice")
+}
+
+func TestHTTPTransport_Health(t *testing.T) {
+	controller := &mockMetacontroller{states: map[string]tree.Node{
+		"localhost/foo": tree.NewMemoryNode(),
+		"localhost/bar": tree.NewMemoryNode(),
+	}}
+	tpt := newTestHTTPTransport(t, controller)
+	tpt.peerStore.AddVerifiedCredentials("http", NewStringSet([]string{"peer:8080"}), types.Address{0xa}, nil, nil)
+	tpt.peerStore.AddReachableAddresses("http", NewStringSet([]string{"unverified:8080"}))
+
+	checkHealth := func(expectedCode int) HealthInfo {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, httptest.NewRequest("GET", "/__health", nil))
+		require.Equal(t, expectedCode, resp.Code)
+		require.Empty(t, resp.Result().Cookies())
+
+		var health HealthInfo
+		err := json.Unmarshal(resp.Body.Bytes(), &health)
+		require.NoError(t, err)
+		require.Equal(t, tpt.address, health.Address)
+		return health
+	}
+
+	health := checkHealth(http.StatusServiceUnavailable)
+	require.Equal(t, "idle", health.State)
+
+	// Start the transport without its listener, which needs a TLS cert
+	err := tpt.CtxStart(func() error {
+		health := checkHealth(http.StatusServiceUnavailable)
+		require.Equal(t, "starting", health.State)
+		tpt.startedAt = time.Now()
+		return nil
+	}, nil, nil, nil)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	health = checkHealth(http.StatusOK)
+	require.Equal(t, "running", health.State)
+	require.True(t, time.Duration(health.Uptime) >= 10*time.Millisecond)
+	require.Equal(t, 1, health.NumPeers)
+	require.Equal(t, 3, health.MempoolLen)
+	require.Equal(t, 2, health.StateURIs)
+
+	tpt.CtxStop("test finished", nil)
+	health = checkHealth(http.StatusServiceUnavailable)
+	require.Contains(t, []string{"stopping", "stopped"}, health.State)
+}
+
+func TestHTTPTransport_RateLimits(t *testing.T) {
+	controller := &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	tpt := newTestHTTPTransport(t, controller)
+	tpt.limits = HTTPLimits{PutsPerSecond: 0.001, PutBurst: 3, SubscriptionsPerSecond: 0.001, SubscriptionBurst: 4, MaxSubscriptionsPerClient: 2}
+	tpt.putLimiter = newRateLimiter(tpt.limits.PutsPerSecond, tpt.limits.PutBurst)
+	tpt.subscriptionLimiter = newRateLimiter(tpt.limits.SubscriptionsPerSecond, tpt.limits.SubscriptionBurst)
+	tpt.SetTxHandler(func(tx Tx, peer Peer) {})
+
+	client, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	const flooder = "10.0.0.1:1234"
+	const wellBehaved = "10.0.0.2:1234"
+
+	put := func(remoteAddr string) int {
+		req := newTestPutRequest(t, client, "localhost/chat", nil)
+		req.RemoteAddr = remoteAddr
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	subscribe := func(remoteAddr string) (code func() int, cancel func()) {
+		reqCtx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+		req.Header.Set("Subscribe", "keep-alive")
+		req.Header.Set("State-URI", "localhost/chat")
+		req.RemoteAddr = remoteAddr
+
+		resp := httptest.NewRecorder()
+		chDone := make(chan struct{})
+		go func() {
+			defer close(chDone)
+			tpt.ServeHTTP(resp, req)
+		}()
+		t.Cleanup(cancel)
+
+		return func() int {
+			select {
+			case <-chDone:
+				return resp.Code
+			case <-time.After(100 * time.Millisecond):
+				return 0 // Still open
+			}
+		}, cancel
+	}
+
+	t.Run("PUTs", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusOK, put(flooder))
+		}
+		require.Equal(t, http.StatusTooManyRequests, put(flooder))
+		require.Equal(t, http.StatusTooManyRequests, put(flooder))
+
+		require.Equal(t, http.StatusOK, put(wellBehaved))
+	})
+
+	t.Run("subscriptions", func(t *testing.T) {
+		code1, cancel1 := subscribe(flooder)
+		code2, _ := subscribe(flooder)
+		require.Zero(t, code1())
+		require.Zero(t, code2())
+
+		// Only two can be open at once
+		code3, _ := subscribe(flooder)
+		require.Equal(t, http.StatusTooManyRequests, code3())
+
+		codeOther, _ := subscribe(wellBehaved)
+		require.Zero(t, codeOther())
+
+		// Closing one makes room for another, until the rate limit kicks in
+		cancel1()
+		require.Equal(t, http.StatusOK, code1())
+		code4, _ := subscribe(flooder)
+		require.Zero(t, code4())
+		code5, _ := subscribe(flooder)
+		require.Equal(t, http.StatusTooManyRequests, code5())
+	})
+}
+
+func TestHTTPTransport_VerifyAddressIsMutual(t *testing.T) {
+	initiator := newTestHostWithEncryptingKeypair(t)
+	responder := newTestHostWithEncryptingKeypair(t)
+
+	tptInitiator := newTestHTTPTransport(t, nil)
+	tptResponder := newTestHTTPTransport(t, nil)
+	var responderPeer Peer
+	tptResponder.SetVerifyAddressHandler(func(challengeMsg types.ChallengeMsg, peer Peer) error {
+		responderPeer = peer
+		return responder.onVerifyAddressReceived(challengeMsg, peer)
+	})
+	server := httptest.NewServer(tptResponder)
+	defer server.Close()
+
+	peer := &httpPeer{t: tptInitiator, reachableAt: server.URL}
+	sigpubkey, encpubkey, err := initiator.requestPeerCredentials(context.Background(), peer, tptInitiator)
+	require.NoError(t, err)
+	require.Equal(t, responder.Address(), sigpubkey.Address())
+	require.Equal(t, responder.encryptingKeypair.EncryptingPublicKey.Bytes(), encpubkey.Bytes())
+	require.Equal(t, initiator.Address(), responderPeer.Address())
+
+	t.Run("an initiator that can't prove its address is refused", func(t *testing.T) {
+		peer := &httpPeer{t: tptInitiator, reachableAt: server.URL}
+		challengeMsg, err := types.GenerateChallengeMsg()
+		require.NoError(t, err)
+		err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddress, Payload: challengeMsg})
+		require.NoError(t, err)
+		defer peer.CloseConn()
+
+		resp, err := readVerifyAddressResponse(peer)
+		require.NoError(t, err)
+		require.Empty(t, resp.EncryptingPublicKey)
+
+		// Answer the counter-challenge without a signature
+		err = peer.WriteMsg(Msg{Type: MsgType_VerifyAddressResponse, Payload: VerifyAddressResponse{
+			EncryptingPublicKey: initiator.encryptingKeypair.EncryptingPublicKey.Bytes(),
+			Challenge:           resp.CounterChallenge,
+		}})
+		require.NoError(t, err)
+
+		_, err = readVerifyAddressResponse(peer)
+		require.Equal(t, ErrUnauthenticatedPeer, errors.Cause(err))
+	})
+}
+
+func TestHTTPTransport_PendingCounterChallengesAreLimited(t *testing.T) {
+	responder := newTestHostWithEncryptingKeypair(t)
+	tpt := newTestHTTPTransport(t, nil)
+	tpt.SetVerifyAddressHandler(responder.onVerifyAddressReceived)
+
+	authorize := func() int {
+		challengeMsg, err := types.GenerateChallengeMsg()
+		require.NoError(t, err)
+		req := httptest.NewRequest("AUTHORIZE", "/", nil)
+		req.Header.Set("Challenge", hex.EncodeToString(challengeMsg))
+		resp := httptest.NewRecorder()
+		tpt.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// Nobody answers the counter-challenge, so the request gives up on it
+	start := time.Now()
+	require.Equal(t, http.StatusOK, authorize())
+	require.Less(t, int64(time.Since(start)), int64(COUNTER_CHALLENGE_TIMEOUT+time.Second))
+	require.Empty(t, tpt.pendingCounterChallenges)
+
+	for i := 0; i < MAX_PENDING_COUNTER_CHALLENGES; i++ {
+		_, err := tpt.expectCounterChallengeResponse(types.ChallengeMsg(fmt.Sprintf("challenge %v", i)))
+		require.NoError(t, err)
+	}
+	require.Equal(t, http.StatusServiceUnavailable, authorize())
+}
@@ -3,6 +3,7 @@ package redwood
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 	dstore "github.com/ipfs/go-datastore"
 	dsync "github.com/ipfs/go-datastore/sync"
 	libp2p "github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
 	cryptop2p "github.com/libp2p/go-libp2p-crypto"
 	p2phost "github.com/libp2p/go-libp2p-host"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -26,10 +28,12 @@ import (
 	peerstore "github.com/libp2p/go-libp2p-peerstore"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 	protocol "github.com/libp2p/go-libp2p-protocol"
+	routing "github.com/libp2p/go-libp2p-routing"
 	ma "github.com/multiformats/go-multiaddr"
 	multihash "github.com/multiformats/go-multihash"
 
 	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
@@ -40,8 +44,10 @@ type libp2pTransport struct {
 	dht        *dht.IpfsDHT
 	peerID     peer.ID
 	*metrics.BandwidthCounter
-	port   uint
-	p2pKey cryptop2p.PrivKey
+	port           uint
+	p2pKey         cryptop2p.PrivKey
+	bootstrapPeers []string
+	relayConfig    Libp2pRelayConfig
 
 	address types.Address
 
@@ -55,29 +61,85 @@ type libp2pTransport struct {
 	subscriptionsIn   map[string]map[*libp2pSubscriptionIn]struct{}
 	subscriptionsInMu sync.RWMutex
 
+	writeStreams   map[peer.ID]*libp2pWriteStream
+	writeStreamsMu sync.Mutex
+
+	// Once a peer has proven that it holds an address's signing key, that address is
+	// bound to the peer's libp2p identity
+	addressesByPeerID map[peer.ID]types.Address
+	peerIDsByAddress  map[types.Address]peer.ID
+	peerBindingsMu    sync.RWMutex
+
+	// Refs and stateURIs are announced by the host whenever it fetches them, and by
+	// periodicallyAnnounceContent every few seconds, so most announcements repeat one that
+	// was just made.  This is when each key was last announced (see announce).
+	announced         map[string]time.Time
+	lastAnnounceSweep time.Time
+	announcedMu       sync.Mutex
+
 	metacontroller Metacontroller
 	refStore       RefStore
 	peerStore      PeerStore
 }
 
+// Libp2pRelayConfig controls how the libp2p transport reaches (and is reached by) peers
+// that are behind a NAT.  Circuit relay dialing is always enabled; these options add
+// relays to fall back on and allow the node to serve as one.  Hole-punching (DCUtR) is
+// not supported by the version of libp2p that we're using.
+type Libp2pRelayConfig struct {
+	// RelayPeers are the full /p2p multiaddrs of relay nodes.  We stay connected to them
+	// so that peers who can't dial us directly can reach us through them, and we fall
+	// back to them when we can't dial a peer directly.
+	RelayPeers []string
+	// EnableHop allows other peers to relay their connections through this node.
+	EnableHop bool
+	// EnableAutoRelay uses AutoNAT to detect when this node is not publicly reachable,
+	// and if so, discovers relays via the DHT and advertises relayed addresses.
+	EnableAutoRelay bool
+}
+
 type libp2pSubscriptionIn struct {
 	stateURI string
+	keypath  tree.Keypath
 	stream   netp2p.Stream
+	writeMu  sync.Mutex // Held while the history is written, so that broadcasts come after it
+}
+
+// libp2pWriteStream is a long-lived outbound stream to a single remote peer.  One-way
+// messages (see isOneWayMsgType) are multiplexed over it rather than each opening a
+// fresh stream.  Request/response exchanges still get a dedicated stream.
+type libp2pWriteStream struct {
+	netp2p.Stream
+	sync.Mutex
 }
 
 const (
 	PROTO_MAIN protocol.ID = "/redwood/main/1.0.0"
+
+	// Announcing the same ref or stateURI to the DHT again within this long is a no-op
+	ANNOUNCE_TTL = 5 * time.Minute
+
+	// How long to wait when opening a pooled stream to a peer
+	POOLED_STREAM_DIAL_TIMEOUT = 10 * time.Second
 )
 
-func NewLibp2pTransport(addr types.Address, port uint, metacontroller Metacontroller, refStore RefStore, peerStore PeerStore) (Transport, error) {
+var ErrPeerIDMismatch = errors.New("libp2p peer ID does not match the one bound to this address")
+
+func NewLibp2pTransport(addr types.Address, port uint, bootstrapPeers []string, relayConfig Libp2pRelayConfig, metacontroller Metacontroller, refStore RefStore, peerStore PeerStore) (Transport, error) {
 	t := &libp2pTransport{
-		Context:         &ctx.Context{},
-		port:            port,
-		address:         addr,
-		subscriptionsIn: make(map[string]map[*libp2pSubscriptionIn]struct{}),
-		metacontroller:  metacontroller,
-		refStore:        refStore,
-		peerStore:       peerStore,
+		Context:           &ctx.Context{},
+		port:              port,
+		bootstrapPeers:    bootstrapPeers,
+		relayConfig:       relayConfig,
+		address:           addr,
+		subscriptionsIn:   make(map[string]map[*libp2pSubscriptionIn]struct{}),
+		writeStreams:      make(map[peer.ID]*libp2pWriteStream),
+		addressesByPeerID: make(map[peer.ID]types.Address),
+		peerIDsByAddress:  make(map[types.Address]peer.ID),
+		announced:         make(map[string]time.Time),
+		metacontroller:    metacontroller,
+		refStore:          refStore,
+		peerStore:         peerStore,
 	}
 	return t, nil
 }
@@ -102,25 +164,25 @@ func (t *libp2pTransport) Start() error {
 
 			t.BandwidthCounter = metrics.NewBandwidthCounter()
 
-			// Initialize the libp2p host
-			libp2pHost, err := libp2p.New(t.Ctx(),
-				libp2p.ListenAddrStrings(
-					fmt.Sprintf("/ip4/0.0.0.0/tcp/%v", t.port),
-				),
-				libp2p.Identity(t.p2pKey),
-				libp2p.BandwidthReporter(t.BandwidthCounter),
-				libp2p.NATPortMap(),
-			)
+			// Initialize the libp2p host (and the DHT, via the routing option)
+			libp2pHost, err := libp2p.New(t.Ctx(), t.libp2pOptions()...)
 			if err != nil {
 				return errors.Wrap(err, "could not initialize libp2p host")
 			}
 			t.libp2pHost = libp2pHost
 
-			// Initialize the DHT
-			t.dht = dht.NewDHT(t.Ctx(), t.libp2pHost, dsync.MutexWrap(dstore.NewMapDatastore()))
-			t.dht.Validator = blankValidator{} // Set a pass-through validator
-
 			t.libp2pHost.SetStreamHandler(PROTO_MAIN, t.handleIncomingStream)
+			t.libp2pHost.Network().Notify(&netp2p.NotifyBundle{DisconnectedF: t.onPeerDisconnected})
+
+			// Join the wider network via the bootstrap peers so that DHT lookups can find
+			// providers we've never connected to directly.  Staying connected to our relays
+			// lets peers that can't dial us reach us through them.
+			t.connectToPeers("bootstrap", t.bootstrapPeers)
+			t.connectToPeers("relay", t.relayConfig.RelayPeers)
+			err = t.dht.Bootstrap(t.Ctx())
+			if err != nil {
+				return errors.Wrap(err, "could not bootstrap DHT")
+			}
 
 			go t.periodicallyAnnounceContent()
 			go t.periodicallyUpdatePeerStore()
@@ -134,6 +196,32 @@ func (t *libp2pTransport) Start() error {
 	)
 }
 
+func (t *libp2pTransport) libp2pOptions() []libp2p.Option {
+	var relayOpts []circuit.RelayOpt
+	if t.relayConfig.EnableHop {
+		relayOpts = append(relayOpts, circuit.OptHop)
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(
+			fmt.Sprintf("/ip4/0.0.0.0/tcp/%v", t.port),
+		),
+		libp2p.Identity(t.p2pKey),
+		libp2p.BandwidthReporter(t.BandwidthCounter),
+		libp2p.NATPortMap(),
+		libp2p.EnableRelay(relayOpts...),
+		libp2p.Routing(func(h p2phost.Host) (routing.PeerRouting, error) {
+			t.dht = dht.NewDHT(t.Ctx(), h, dsync.MutexWrap(dstore.NewMapDatastore()))
+			t.dht.Validator = blankValidator{} // Set a pass-through validator
+			return t.dht, nil
+		}),
+	}
+	if t.relayConfig.EnableAutoRelay {
+		opts = append(opts, libp2p.EnableAutoRelay())
+	}
+	return opts
+}
+
 func (t *libp2pTransport) Name() string {
 	return "libp2p"
 }
@@ -150,6 +238,26 @@ func (t *libp2pTransport) ListenAddrs() []string {
 	return addrs
 }
 
+// IsSelf returns true if the given peer is this transport's own libp2p host.
+func (t *libp2pTransport) IsSelf(peer Peer) bool {
+	p, is := peer.(*libp2pPeer)
+	return is && p.pinfo.ID == t.libp2pHost.ID()
+}
+
+// PeerChannelBinding and OwnChannelBinding bind the verify address handshake to the
+// libp2p peer IDs at either end of the connection, which libp2p authenticates.
+func (t *libp2pTransport) PeerChannelBinding(peer Peer) []byte {
+	p, is := peer.(*libp2pPeer)
+	if !is {
+		return nil
+	}
+	return []byte(p.pinfo.ID)
+}
+
+func (t *libp2pTransport) OwnChannelBinding(peer Peer) []byte {
+	return []byte(t.libp2pHost.ID())
+}
+
 func (t *libp2pTransport) Peers() []pstore.PeerInfo {
 	return pstore.PeerInfos(t.libp2pHost.Peerstore(), t.libp2pHost.Peerstore().Peers())
 }
@@ -178,41 +286,43 @@ func (t *libp2pTransport) SetFetchRefHandler(handler FetchRefHandler) {
 	t.fetchRefHandler = handler
 }
 
-func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
-	var msg Msg
-	err := ReadMsg(stream, &msg)
-	if err != nil {
-		panic(err)
+// isOneWayMsgType returns true for messages that don't expect a response on the
+// stream they're sent over.  These may share a pooled stream with other messages.
+func isOneWayMsgType(msgType MsgType) bool {
+	switch msgType {
+	case MsgType_Put, MsgType_Ack, MsgType_AdvertisePeers:
+		return true
+	default:
+		return false
 	}
+}
 
-	switch msg.Type {
-	case MsgType_Subscribe:
-		stateURI, ok := msg.Payload.(string)
-		if !ok {
-			t.Errorf("Subscribe message: bad payload: (%T) %v", msg.Payload, msg.Payload)
+func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
+	// A stream carries either a sequence of one-way messages (if it's a remote peer's
+	// pooled stream) or a single request followed by its response.
+	for {
+		var msg Msg
+		err := ReadMsg(stream, &msg)
+		if err == io.EOF {
+			stream.Close()
+			return
+		} else if err != nil {
+			t.Errorf("error reading from stream: %v", err)
+			stream.Reset()
 			return
 		}
 
-		t.subscriptionsInMu.Lock()
-		defer t.subscriptionsInMu.Unlock()
-		if _, exists := t.subscriptionsIn[stateURI]; !exists {
-			t.subscriptionsIn[stateURI] = make(map[*libp2pSubscriptionIn]struct{})
-		}
-		sub := &libp2pSubscriptionIn{stateURI, stream}
-		t.subscriptionsIn[stateURI][sub] = struct{}{}
-
-		parents := []types.ID{}
-		toVersion := types.ID{}
-		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
-		err := t.fetchHistoryHandler(stateURI, parents, toVersion, &libp2pPeer{t: t, pinfo: pinfo, stream: stream})
-		if err != nil {
-			t.Errorf("error fetching history: %v", err)
-			// @@TODO: close subscription?
+		if !isOneWayMsgType(msg.Type) {
+			t.handleIncomingRequest(stream, msg)
+			return
 		}
+		t.handleIncomingOneWayMsg(stream, msg)
+	}
+}
 
+func (t *libp2pTransport) handleIncomingOneWayMsg(stream netp2p.Stream, msg Msg) {
+	switch msg.Type {
 	case MsgType_Put:
-		defer stream.Close()
-
 		tx, ok := msg.Payload.(Tx)
 		if !ok {
 			t.Errorf("Put message: bad payload: (%T) %v", msg.Payload, msg.Payload)
@@ -220,7 +330,7 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 		}
 
 		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
-		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: nil} // nil so that we open a new stream
+		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: nil} // nil so that we reply over our own pooled stream
 		err := peer.EnsureConnected(context.TODO())
 		if err != nil {
 			t.Errorf("can't connect to peer %v", pinfo.ID)
@@ -230,8 +340,6 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 		t.txHandler(tx, peer)
 
 	case MsgType_Ack:
-		defer stream.Close()
-
 		txID, ok := msg.Payload.(types.ID)
 		if !ok {
 			t.Errorf("Ack message: bad payload: (%T) %v", msg.Payload, msg.Payload)
@@ -239,7 +347,8 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 		}
 
 		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
-		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: nil}
+		address, _ := t.AddressForPeerID(pinfo.ID)
+		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: nil, address: address}
 		err := peer.EnsureConnected(context.TODO())
 		if err != nil {
 			t.Errorf("can't connect to peer %v", pinfo.ID)
@@ -248,6 +357,64 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 
 		t.ackHandler(txID, peer)
 
+	case MsgType_AdvertisePeers:
+		tuples, ok := msg.Payload.([]peerTuple)
+		if !ok {
+			t.Errorf("Advertise peers: bad payload: (%T) %v", msg.Payload, msg.Payload)
+			return
+		}
+		for _, tuple := range tuples {
+			t.peerStore.AddReachableAddresses(tuple.TransportName, NewStringSet([]string{tuple.ReachableAt}))
+		}
+	}
+}
+
+func (t *libp2pTransport) handleIncomingRequest(stream netp2p.Stream, msg Msg) {
+	switch msg.Type {
+	case MsgType_Subscribe:
+		subMsg, ok := msg.Payload.(SubscribeMsg)
+		if !ok {
+			t.Errorf("Subscribe message: bad payload: (%T) %v", msg.Payload, msg.Payload)
+			return
+		}
+		stateURI := subMsg.StateURI
+		keypath := tree.Keypath(subMsg.Keypath)
+
+		// Don't hold a subscription open for a stateURI that we'll never have any txs for
+		_, err := t.metacontroller.ControllerForStateURI(stateURI)
+		if err != nil {
+			t.Errorf("rejecting subscription: %v", err)
+			err = WriteMsg(stream, Msg{Type: MsgType_Error, Payload: err.Error()})
+			if err != nil {
+				t.Errorf("error writing subscription rejection: %v", err)
+			}
+			stream.Close()
+			return
+		}
+
+		sub := &libp2pSubscriptionIn{stateURI: stateURI, keypath: keypath, stream: stream}
+
+		sub.writeMu.Lock()
+		t.subscriptionsInMu.Lock()
+		if _, exists := t.subscriptionsIn[stateURI]; !exists {
+			t.subscriptionsIn[stateURI] = make(map[*libp2pSubscriptionIn]struct{})
+		}
+		t.subscriptionsIn[stateURI][sub] = struct{}{}
+		t.subscriptionsInMu.Unlock()
+
+		// The subscriber can send us txs while its history is still on the way
+		go t.readSubscriptionStream(sub)
+
+		parents := []types.ID{}
+		toVersion := types.ID{}
+		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
+		err = t.fetchHistoryHandler(stateURI, keypath, parents, subMsg.KnownTxs, toVersion, &libp2pPeer{t: t, pinfo: pinfo, stream: stream})
+		sub.writeMu.Unlock()
+		if err != nil {
+			t.Errorf("error fetching history: %v", err)
+			// @@TODO: close subscription?
+		}
+
 	case MsgType_VerifyAddress:
 		defer stream.Close()
 
@@ -265,10 +432,26 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 			return
 		}
 
+	case MsgType_FetchHistory:
+		defer stream.Close()
+
+		fetchHistory, ok := msg.Payload.(FetchHistoryMsg)
+		if !ok {
+			t.Errorf("FetchHistory message: bad payload: (%T) %v", msg.Payload, msg.Payload)
+			return
+		}
+
+		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
+		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: stream}
+		err := t.fetchHistoryHandler(fetchHistory.StateURI, nil, fetchHistory.Parents, nil, fetchHistory.ToVersion, peer)
+		if err != nil {
+			t.Errorf("error fetching history: %v", err)
+		}
+
 	case MsgType_FetchRef:
 		defer stream.Close()
 
-		refHash, ok := msg.Payload.(types.Hash)
+		fetchRef, ok := msg.Payload.(FetchRefMsg)
 		if !ok {
 			t.Errorf("FetchRef message: bad payload: (%T) %v", msg.Payload, msg.Payload)
 			return
@@ -276,7 +459,7 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 
 		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
 		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: stream}
-		t.fetchRefHandler(refHash, peer)
+		t.fetchRefHandler(fetchRef.Ref, fetchRef.Offset, fetchRef.Length, peer)
 
 	case MsgType_Private:
 		encryptedTx, ok := msg.Payload.(EncryptedTx)
@@ -286,21 +469,95 @@ func (t *libp2pTransport) handleIncomingStream(stream netp2p.Stream) {
 		}
 
 		pinfo := t.libp2pHost.Peerstore().PeerInfo(stream.Conn().RemotePeer())
-		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: stream}
+		address, _ := t.AddressForPeerID(pinfo.ID)
+		peer := &libp2pPeer{t: t, pinfo: pinfo, stream: stream, address: address}
 		t.privateTxHandler(encryptedTx, peer)
 
-	case MsgType_AdvertisePeers:
-		tuples, ok := msg.Payload.([]peerTuple)
-		if !ok {
-			t.Errorf("Advertise peers: bad payload: (%T) %v", msg.Payload, msg.Payload)
-			return
+	default:
+		t.Errorf("protocol error: unexpected message type %v", msg.Type)
+		stream.Reset()
+	}
+}
+
+// writeToPooledStream sends a one-way message over the shared outbound stream to the
+// given peer, opening it if necessary.  If the pooled stream turns out to be broken,
+// it's discarded and the write is retried once over a fresh stream.
+func (t *libp2pTransport) writeToPooledStream(ctx context.Context, peerID peer.ID, msg Msg) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var ws *libp2pWriteStream
+		ws, err = t.pooledStream(ctx, peerID)
+		if err != nil {
+			return err
 		}
-		for _, tuple := range tuples {
-			t.peerStore.AddReachableAddresses(tuple.TransportName, NewStringSet([]string{tuple.ReachableAt}))
+
+		ws.Lock()
+		err = WriteMsg(ws.Stream, msg)
+		ws.Unlock()
+		if err == nil {
+			return nil
 		}
+		t.Warnf("pooled stream to %v broken, reopening: %v", peerID, err)
+		t.discardPooledStream(peerID, ws)
+	}
+	return err
+}
 
-	default:
-		panic("protocol error")
+func (t *libp2pTransport) pooledStream(ctx context.Context, peerID peer.ID) (*libp2pWriteStream, error) {
+	t.writeStreamsMu.Lock()
+	ws, exists := t.writeStreams[peerID]
+	t.writeStreamsMu.Unlock()
+	if exists {
+		return ws, nil
+	}
+
+	// The stream is opened without holding writeStreamsMu so that dialing a slow peer
+	// doesn't hold up writes to every other peer
+	ctx, cancel := context.WithTimeout(ctx, POOLED_STREAM_DIAL_TIMEOUT)
+	defer cancel()
+
+	stream, err := t.libp2pHost.NewStream(ctx, peerID, PROTO_MAIN)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	t.writeStreamsMu.Lock()
+	defer t.writeStreamsMu.Unlock()
+
+	// Another writer may have opened a stream to the same peer in the meantime
+	if existing, exists := t.writeStreams[peerID]; exists {
+		stream.Close()
+		return existing, nil
+	}
+	ws = &libp2pWriteStream{Stream: stream}
+	t.writeStreams[peerID] = ws
+	return ws, nil
+}
+
+func (t *libp2pTransport) discardPooledStream(peerID peer.ID, ws *libp2pWriteStream) {
+	t.writeStreamsMu.Lock()
+	defer t.writeStreamsMu.Unlock()
+
+	if t.writeStreams[peerID] == ws {
+		delete(t.writeStreams, peerID)
+	}
+	ws.Reset()
+}
+
+// onPeerDisconnected drops the pooled stream to a peer once we no longer have any
+// connection to it.
+func (t *libp2pTransport) onPeerDisconnected(network netp2p.Network, conn netp2p.Conn) {
+	peerID := conn.RemotePeer()
+	if network.Connectedness(peerID) == netp2p.Connected {
+		return
+	}
+
+	t.writeStreamsMu.Lock()
+	defer t.writeStreamsMu.Unlock()
+
+	if ws, exists := t.writeStreams[peerID]; exists {
+		delete(t.writeStreams, peerID)
+		ws.Reset()
 	}
 }
 
@@ -387,25 +644,66 @@ func (t *libp2pTransport) ForEachProviderOfRef(ctx context.Context, refHash type
 				select {
 				case ch <- &libp2pPeer{t: t, pinfo: pinfo, stream: nil}:
 				case <-ctx.Done():
+					return
 				}
 			}
+			time.Sleep(1 * time.Second) // @@TODO: make configurable?
 		}
 	}()
 	return ch, nil
 }
 
-func (t *libp2pTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Peer, error) {
-	ch := make(chan Peer)
+// readSubscriptionStream reads the ACKs that a subscriber sends back over its subscription
+// stream, so that they don't back up and block the txs that we write to it.  Once the
+// subscriber closes the stream, the subscription is removed.
+func (t *libp2pTransport) readSubscriptionStream(sub *libp2pSubscriptionIn) {
+	defer func() {
+		t.subscriptionsInMu.Lock()
+		defer t.subscriptionsInMu.Unlock()
+		delete(t.subscriptionsIn[sub.stateURI], sub)
+		if len(t.subscriptionsIn[sub.stateURI]) == 0 {
+			delete(t.subscriptionsIn, sub.stateURI)
+		}
+	}()
+
+	for {
+		var msg Msg
+		err := ReadMsg(sub.stream, &msg)
+		if err == io.EOF {
+			sub.stream.Close()
+			return
+		} else if err != nil {
+			t.Errorf("error reading from subscription stream: %v", err)
+			sub.stream.Reset()
+			return
+		} else if !isOneWayMsgType(msg.Type) {
+			t.Errorf("unexpected %v message on subscription stream", msg.Type)
+			continue
+		}
+		t.handleIncomingOneWayMsg(sub.stream, msg)
+	}
+}
+
+func (t *libp2pTransport) ForEachSubscriberToStateURI(ctx context.Context, stateURI string) (<-chan Subscriber, error) {
+	ch := make(chan Subscriber)
 	go func() {
-		t.subscriptionsInMu.RLock()
-		defer t.subscriptionsInMu.RUnlock()
 		defer close(ch)
+
+		// Writing to a subscriber waits until its history has been sent, so we don't
+		// hold the lock while handing them out
+		t.subscriptionsInMu.RLock()
+		var subs []*libp2pSubscriptionIn
 		for sub := range t.subscriptionsIn[stateURI] {
+			subs = append(subs, sub)
+		}
+		t.subscriptionsInMu.RUnlock()
+
+		for _, sub := range subs {
 			peerID := sub.stream.Conn().RemotePeer()
 			pinfo := t.libp2pHost.Peerstore().PeerInfo(peerID)
 
 			select {
-			case ch <- &libp2pPeer{t: t, pinfo: pinfo, stream: sub.stream}:
+			case ch <- Subscriber{&libp2pPeer{t: t, pinfo: pinfo, stream: sub.stream, writeMu: &sub.writeMu}, sub.keypath}:
 			case <-ctx.Done():
 			}
 		}
@@ -428,6 +726,9 @@ func (t *libp2pTransport) PeersClaimingAddress(ctx context.Context, address type
 		for pinfo := range t.dht.FindProvidersAsync(ctx, addrCid, 8) {
 			if pinfo.ID == t.libp2pHost.ID() {
 				continue
+			} else if boundPeerID, known := t.PeerIDForAddress(address); known && boundPeerID != pinfo.ID {
+				t.Warnf("ignoring peer %v claiming address %v (bound to %v)", pinfo.ID, address, boundPeerID)
+				continue
 			}
 
 			select {
@@ -443,8 +744,50 @@ func (t *libp2pTransport) PeersClaimingAddress(ctx context.Context, address type
 	return ch, nil
 }
 
+// AddressForPeerID returns the verified redwood address of the given libp2p peer, if any.
+func (t *libp2pTransport) AddressForPeerID(peerID peer.ID) (types.Address, bool) {
+	t.peerBindingsMu.RLock()
+	defer t.peerBindingsMu.RUnlock()
+	address, exists := t.addressesByPeerID[peerID]
+	return address, exists
+}
+
+// PeerIDForAddress returns the libp2p peer that has proven that it holds the given
+// redwood address, if any.
+func (t *libp2pTransport) PeerIDForAddress(address types.Address) (peer.ID, bool) {
+	t.peerBindingsMu.RLock()
+	defer t.peerBindingsMu.RUnlock()
+	peerID, exists := t.peerIDsByAddress[address]
+	return peerID, exists
+}
+
+// bindPeerAddress records that the given libp2p peer has proven that it holds the given
+// address.  A different peer ID later claiming a bound address is refused.  A bound peer
+// ID may prove a different address, though, which replaces its old binding: a node that
+// rotates its signing key keeps its libp2p key, and has still proven that it holds the
+// new one.
+func (t *libp2pTransport) bindPeerAddress(peerID peer.ID, address types.Address) error {
+	t.peerBindingsMu.Lock()
+	defer t.peerBindingsMu.Unlock()
+
+	if boundPeerID, exists := t.peerIDsByAddress[address]; exists && boundPeerID != peerID {
+		return errors.Wrapf(ErrPeerIDMismatch, "address %v is bound to peer %v, not %v", address, boundPeerID, peerID)
+	} else if boundAddress, exists := t.addressesByPeerID[peerID]; exists && boundAddress != address {
+		t.Infof(0, "peer %v has moved from address %v to %v", peerID, boundAddress, address)
+		delete(t.peerIDsByAddress, boundAddress)
+	}
+	t.peerIDsByAddress[address] = peerID
+	t.addressesByPeerID[peerID] = address
+	return nil
+}
+
 func (t *libp2pTransport) ensureConnected(ctx context.Context, pinfo peerstore.PeerInfo) error {
 	if len(t.libp2pHost.Network().ConnsToPeer(pinfo.ID)) == 0 {
+		// The swarm dials all of a peer's addresses at once, so also offering it the
+		// relayed addresses means that it falls back to a relay when the peer can't be
+		// dialed directly.
+		pinfo.Addrs = append(pinfo.Addrs, t.relayedAddrsForPeer(pinfo.ID)...)
+
 		err := t.libp2pHost.Connect(ctx, pinfo)
 		if err != nil {
 			return errors.Wrapf(err, "could not connect to peer %v", pinfo.ID)
@@ -467,19 +810,9 @@ func (t *libp2pTransport) periodicallyAnnounceContent() {
 		// Announce the URLs we're serving
 		for _, url := range t.metacontroller.KnownStateURIs() {
 			go func(url string) {
-				ctxInner, cancel := context.WithTimeout(t.Ctx(), 10*time.Second)
-				defer cancel()
-
-				c, err := cidForString("serve:" + url)
+				err := t.AnnounceStateURI(url)
 				if err != nil {
-					t.Errorf("announce: error creating cid: %v", err)
-					return
-				}
-
-				err = t.dht.Provide(ctxInner, c, true)
-				if err != nil && err != kbucket.ErrLookupFailure {
-					t.Errorf(`announce: could not dht.Provide url "%v": %v`, url, err)
-					return
+					t.Errorf("announce: error: %v", err)
 				}
 			}(url)
 		}
@@ -500,18 +833,9 @@ func (t *libp2pTransport) periodicallyAnnounceContent() {
 
 		// Advertise our address (for exchanging private txs)
 		go func() {
-			ctxInner, cancel := context.WithTimeout(t.Ctx(), 10*time.Second)
-			defer cancel()
-
-			c, err := cidForString("addr:" + t.address.String())
+			err := t.announce("addr:" + t.address.String())
 			if err != nil {
-				t.Errorf("announce: error creating cid: %v", err)
-				return
-			}
-
-			err = t.dht.Provide(ctxInner, c, true)
-			if err != nil && err != kbucket.ErrLookupFailure {
-				t.Errorf(`announce: could not dht.Provide pubkey: %v`, err)
+				t.Errorf("announce: error: %v", err)
 			}
 		}()
 
@@ -565,29 +889,140 @@ func (t *libp2pTransport) periodicallyUpdatePeerStore() {
 	}
 }
 
+func (t *libp2pTransport) connectToPeers(kind string, addrStrs []string) {
+	var wg sync.WaitGroup
+	for _, addrStr := range addrStrs {
+		addr, err := ma.NewMultiaddr(addrStr)
+		if err != nil {
+			t.Errorf("bad %v peer multiaddr '%v': %v", kind, addrStr, err)
+			continue
+		}
+		pinfo, err := pstore.InfoFromP2pAddr(addr)
+		if err != nil {
+			t.Errorf("bad %v peer multiaddr '%v': %v", kind, addrStr, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(t.Ctx(), 10*time.Second)
+			defer cancel()
+
+			err := t.libp2pHost.Connect(ctx, *pinfo)
+			if err != nil {
+				t.Warnf("could not connect to %v peer %v: %v", kind, pinfo.ID, err)
+				return
+			}
+			t.Infof(0, "connected to %v peer %v", kind, pinfo.ID)
+		}()
+	}
+	wg.Wait()
+}
+
+// relayedAddrsForPeer returns a circuit address for reaching the given peer through each
+// of our configured relays.
+func (t *libp2pTransport) relayedAddrsForPeer(peerID peer.ID) []ma.Multiaddr {
+	var addrs []ma.Multiaddr
+	for _, addrStr := range t.relayConfig.RelayPeers {
+		relayAddr, err := ma.NewMultiaddr(addrStr)
+		if err != nil {
+			continue
+		}
+		relayInfo, err := pstore.InfoFromP2pAddr(relayAddr)
+		if err != nil || relayInfo.ID == peerID {
+			continue
+		}
+		circuitAddr, err := ma.NewMultiaddr("/p2p-circuit")
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, relayAddr.Encapsulate(circuitAddr))
+	}
+	return addrs
+}
+
+// AnnounceStateURI advertises to the DHT that we're a provider of the given stateURI.
+func (t *libp2pTransport) AnnounceStateURI(stateURI string) error {
+	return t.announce("serve:" + stateURI)
+}
+
+// AnnounceRef advertises to the DHT that we're a provider of the given ref.
 func (t *libp2pTransport) AnnounceRef(refHash types.Hash) error {
+	return t.announce("ref:" + refHash.String())
+}
+
+// announce provides the given key to the DHT, unless it was already provided within the
+// last ANNOUNCE_TTL.  A failed announcement isn't remembered, so that the next attempt
+// goes through.
+func (t *libp2pTransport) announce(key string) error {
+	now := time.Now()
+
+	t.announcedMu.Lock()
+	if announcedAt, exists := t.announced[key]; exists && now.Sub(announcedAt) < ANNOUNCE_TTL {
+		t.announcedMu.Unlock()
+		return nil
+	}
+	// Claim the key before announcing, so that concurrent callers don't announce it too
+	t.announced[key] = now
+	t.sweepAnnounced(now)
+	t.announcedMu.Unlock()
+
+	err := t.provide(key)
+	if err != nil {
+		t.announcedMu.Lock()
+		if t.announced[key] == now {
+			delete(t.announced, key)
+		}
+		t.announcedMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// sweepAnnounced forgets the keys whose TTL has run out, at most once per TTL.  It must be
+// called with t.announcedMu held.
+func (t *libp2pTransport) sweepAnnounced(now time.Time) {
+	if now.Sub(t.lastAnnounceSweep) < ANNOUNCE_TTL {
+		return
+	}
+	for key, announcedAt := range t.announced {
+		if now.Sub(announcedAt) >= ANNOUNCE_TTL {
+			delete(t.announced, key)
+		}
+	}
+	t.lastAnnounceSweep = now
+}
+
+func (t *libp2pTransport) provide(key string) error {
 	ctxInner, cancel := context.WithTimeout(t.Ctx(), 10*time.Second)
 	defer cancel()
 
-	c, err := cidForString("ref:" + refHash.String())
+	c, err := cidForString(key)
 	if err != nil {
 		return err
 	}
 
 	err = t.dht.Provide(ctxInner, c, true)
 	if err != nil && err != kbucket.ErrLookupFailure {
-		t.Errorf(`announce: could not dht.Provide refHash "%v": %v`, refHash.String(), err)
+		t.Errorf(`announce: could not dht.Provide "%v": %v`, key, err)
 		return err
 	}
-
 	return nil
 }
 
+// libp2pPeer opens its own stream for anything that expects a response, like a
+// subscription.  libp2p multiplexes every stream to a given node over the same
+// connection, so subscribing to many stateURIs with one node only costs a stream apiece.
 type libp2pPeer struct {
 	t       *libp2pTransport
 	pinfo   peerstore.PeerInfo
 	stream  netp2p.Stream
 	address types.Address
+
+	// Set if the stream is shared with others, such as an incoming subscription's
+	writeMu *sync.Mutex
 }
 
 func (p *libp2pPeer) Transport() Transport {
@@ -610,40 +1045,62 @@ func (p *libp2pPeer) Address() types.Address {
 	return p.address
 }
 
-func (p *libp2pPeer) SetAddress(addr types.Address) {
+func (p *libp2pPeer) SetAddress(addr types.Address) error {
+	err := p.t.bindPeerAddress(p.pinfo.ID, addr)
+	if err != nil {
+		return err
+	}
 	p.address = addr
+	return nil
 }
 
+// EnsureConnected ensures that there's a connection to the peer.  Streams are opened
+// lazily by WriteMsg: one-way messages reuse the transport's pooled stream to the peer,
+// while anything else opens a dedicated stream for the request/response exchange.
 func (p *libp2pPeer) EnsureConnected(ctx context.Context) error {
 	if p.stream == nil {
-		err := p.t.ensureConnected(ctx, p.pinfo)
-		if err != nil {
-			return err
+		return p.t.ensureConnected(ctx, p.pinfo)
+	}
+	return nil
+}
+
+func (p *libp2pPeer) WriteMsg(msg Msg) error {
+	if p.stream == nil {
+		if isOneWayMsgType(msg.Type) {
+			return p.t.writeToPooledStream(context.TODO(), p.pinfo.ID, msg)
 		}
 
-		stream, err := p.t.libp2pHost.NewStream(ctx, p.pinfo.ID, PROTO_MAIN)
+		stream, err := p.t.libp2pHost.NewStream(context.TODO(), p.pinfo.ID, PROTO_MAIN)
 		if err != nil {
-			return err
+			return errors.WithStack(err)
 		}
-
 		p.stream = stream
 	}
-
-	return nil
-}
-
-func (p *libp2pPeer) WriteMsg(msg Msg) error {
+	if p.writeMu != nil {
+		p.writeMu.Lock()
+		defer p.writeMu.Unlock()
+	}
 	return WriteMsg(p.stream, msg)
 }
 
 func (p *libp2pPeer) ReadMsg() (Msg, error) {
+	if p.stream == nil {
+		return Msg{}, errors.Wrap(ErrProtocol, "no open stream to read from")
+	}
 	var msg Msg
 	err := ReadMsg(p.stream, &msg)
 	return msg, err
 }
 
+// CloseConn closes the peer's stream, if it has one.  The next request to the peer opens
+// a new one.
 func (p *libp2pPeer) CloseConn() error {
-	return p.stream.Close()
+	if p.stream == nil {
+		return nil
+	}
+	err := p.stream.Close()
+	p.stream = nil
+	return err
 }
 
 func obtainP2PKey(addr types.Address) (cryptop2p.PrivKey, error) {
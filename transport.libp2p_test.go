@@ -0,0 +1,536 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dstore "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	libp2p "github.com/libp2p/go-libp2p"
+	cryptop2p "github.com/libp2p/go-libp2p-crypto"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	metrics "github.com/libp2p/go-libp2p-metrics"
+	netp2p "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// newMocknetTransports returns libp2p transports (each with its own DHT) over libp2p's
+// in-memory mock network.  All of the peers are linked, but none are connected.
+func newMocknetTransports(t *testing.T, n int) (mocknet.Mocknet, []*libp2pTransport) {
+	mn, err := mocknet.FullMeshLinked(context.Background(), n)
+	require.NoError(t, err)
+
+	var transports []*libp2pTransport
+	for _, libp2pHost := range mn.Hosts() {
+		tpt := &libp2pTransport{
+			Context:           &ctx.Context{},
+			libp2pHost:        libp2pHost,
+			peerID:            libp2pHost.ID(),
+			subscriptionsIn:   make(map[string]map[*libp2pSubscriptionIn]struct{}),
+			writeStreams:      make(map[peer.ID]*libp2pWriteStream),
+			addressesByPeerID: make(map[peer.ID]types.Address),
+			peerIDsByAddress:  make(map[types.Address]peer.ID),
+			announced:         make(map[string]time.Time),
+			peerStore:         NewPeerStore(types.Address{}),
+		}
+		err := tpt.CtxStart(func() error { return nil }, nil, nil, nil)
+		require.NoError(t, err)
+
+		tpt.dht = dht.NewDHT(tpt.Ctx(), libp2pHost, dsync.MutexWrap(dstore.NewMapDatastore()))
+		tpt.dht.Validator = blankValidator{}
+
+		libp2pHost.SetStreamHandler(PROTO_MAIN, tpt.handleIncomingStream)
+		libp2pHost.Network().Notify(&netp2p.NotifyBundle{DisconnectedF: tpt.onPeerDisconnected})
+		tpt.SetTxHandler(func(tx Tx, peer Peer) {})
+		tpt.SetAckHandler(func(txID types.ID, peer Peer) {})
+		transports = append(transports, tpt)
+	}
+	return mn, transports
+}
+
+func TestLibp2pTransport_OneWayMessagesReuseStream(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	sender, receiver := transports[0], transports[1]
+	_, err := mn.ConnectPeers(sender.libp2pHost.ID(), receiver.libp2pHost.ID())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var received []types.ID
+	receiver.SetTxHandler(func(tx Tx, peer Peer) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, tx.ID)
+	})
+
+	pinfo := sender.libp2pHost.Peerstore().PeerInfo(receiver.libp2pHost.ID())
+
+	const numTxs = 5
+	for i := 0; i < numTxs; i++ {
+		p := &libp2pPeer{t: sender, pinfo: pinfo}
+		err = p.EnsureConnected(context.Background())
+		require.NoError(t, err)
+
+		err = p.WriteMsg(Msg{Type: MsgType_Put, Payload: Tx{ID: types.RandomID(), URL: "localhost/foo"}})
+		require.NoError(t, err)
+
+		err = p.CloseConn()
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == numTxs
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conns := sender.libp2pHost.Network().ConnsToPeer(receiver.libp2pHost.ID())
+	require.Len(t, conns, 1)
+
+	var numStreams int
+	for _, s := range conns[0].GetStreams() {
+		if s.Protocol() == PROTO_MAIN {
+			numStreams++
+		}
+	}
+	require.Equal(t, 1, numStreams)
+	require.Len(t, sender.writeStreams, 1)
+}
+
+func TestLibp2pTransport_SubscribeToUnhostedStateURIIsRejected(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	provider, subscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(provider.libp2pHost.ID(), subscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	provider.metacontroller = &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	provider.SetFetchHistoryHandler(func(stateURI string, keypath tree.Keypath, parents []types.ID, knownTxs *TxBloomFilter, toVersion types.ID, peer Peer) error {
+		return nil
+	})
+
+	numSubscribers := func(stateURI string) int {
+		provider.subscriptionsInMu.RLock()
+		defer provider.subscriptionsInMu.RUnlock()
+		return len(provider.subscriptionsIn[stateURI])
+	}
+
+	pinfo := subscriber.libp2pHost.Peerstore().PeerInfo(provider.libp2pHost.ID())
+	p := &libp2pPeer{t: subscriber, pinfo: pinfo}
+	defer p.CloseConn()
+	err = p.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: SubscribeMsg{StateURI: "localhost/elsewhere"}})
+	require.NoError(t, err)
+
+	msg, err := p.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, MsgType_Error, msg.Type)
+	require.Contains(t, msg.Payload, "no controller")
+	require.Equal(t, 0, numSubscribers("localhost/elsewhere"))
+
+	// A hosted stateURI is still served
+	p2 := &libp2pPeer{t: subscriber, pinfo: pinfo}
+	defer p2.CloseConn()
+	err = p2.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: SubscribeMsg{StateURI: "localhost/chat"}})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return numSubscribers("localhost/chat") == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pTransport_HistoryDoesntHoldUpTheSubscription(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	provider, subscriber := transports[0], transports[1]
+	_, err := mn.ConnectPeers(provider.libp2pHost.ID(), subscriber.libp2pHost.ID())
+	require.NoError(t, err)
+
+	history := []Tx{{ID: types.RandomID()}, {ID: types.RandomID()}}
+	chReleaseHistory := make(chan struct{})
+	provider.metacontroller = &mockMetacontroller{states: map[string]tree.Node{"localhost/chat": tree.NewMemoryNode()}}
+	provider.SetFetchHistoryHandler(func(stateURI string, keypath tree.Keypath, parents []types.ID, knownTxs *TxBloomFilter, toVersion types.ID, peer Peer) error {
+		require.NoError(t, peer.WriteMsg(Msg{Type: MsgType_Put, Payload: history[0]}))
+		<-chReleaseHistory
+		return peer.WriteMsg(Msg{Type: MsgType_Put, Payload: history[1]})
+	})
+	chReceived := make(chan types.ID, 1)
+	provider.SetTxHandler(func(tx Tx, peer Peer) { chReceived <- tx.ID })
+
+	pinfo := subscriber.libp2pHost.Peerstore().PeerInfo(provider.libp2pHost.ID())
+	p := &libp2pPeer{t: subscriber, pinfo: pinfo}
+	defer p.CloseConn()
+	err = p.WriteMsg(Msg{Type: MsgType_Subscribe, Payload: SubscribeMsg{StateURI: "localhost/chat"}})
+	require.NoError(t, err)
+	msg, err := p.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, history[0].ID, msg.Payload.(Tx).ID)
+
+	// While the history is on its way, the subscriber can send us txs, and we can start
+	// broadcasting to it
+	sent := Tx{ID: types.RandomID()}
+	require.NoError(t, p.WriteMsg(Msg{Type: MsgType_Put, Payload: sent}))
+	select {
+	case txID := <-chReceived:
+		require.Equal(t, sent.ID, txID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tx from subscriber wasn't read")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	subs, err := provider.ForEachSubscriberToStateURI(ctx, "localhost/chat")
+	require.NoError(t, err)
+	sub, ok := <-subs
+	require.True(t, ok)
+
+	broadcast := Tx{ID: types.RandomID()}
+	chBroadcastErr := make(chan error, 1)
+	go func() { chBroadcastErr <- sub.WriteMsg(Msg{Type: MsgType_Put, Payload: broadcast}) }()
+
+	// The broadcast tx only arrives after the rest of the history
+	close(chReleaseHistory)
+	for _, expected := range []types.ID{history[1].ID, broadcast.ID} {
+		msg, err := p.ReadMsg()
+		require.NoError(t, err)
+		require.Equal(t, expected, msg.Payload.(Tx).ID)
+	}
+	require.NoError(t, <-chBroadcastErr)
+}
+
+func TestLibp2pTransport_BrokenPooledStreamIsReopened(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	sender, receiver := transports[0], transports[1]
+	_, err := mn.ConnectPeers(sender.libp2pHost.ID(), receiver.libp2pHost.ID())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var received int
+	receiver.SetTxHandler(func(tx Tx, peer Peer) {
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+	})
+
+	pinfo := sender.libp2pHost.Peerstore().PeerInfo(receiver.libp2pHost.ID())
+	p := &libp2pPeer{t: sender, pinfo: pinfo}
+
+	numReceived := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+
+	err = p.WriteMsg(Msg{Type: MsgType_Put, Payload: Tx{ID: types.RandomID()}})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return numReceived() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Break the pooled stream out from under the transport
+	broken := sender.writeStreams[receiver.libp2pHost.ID()]
+	require.NotNil(t, broken)
+	broken.Reset()
+
+	err = p.WriteMsg(Msg{Type: MsgType_Put, Payload: Tx{ID: types.RandomID()}})
+	require.NoError(t, err)
+	require.NotEqual(t, broken, sender.writeStreams[receiver.libp2pHost.ID()])
+	require.Eventually(t, func() bool { return numReceived() == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pTransport_PooledStreamIsDroppedOnDisconnect(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	sender, receiver := transports[0], transports[1]
+	_, err := mn.ConnectPeers(sender.libp2pHost.ID(), receiver.libp2pHost.ID())
+	require.NoError(t, err)
+
+	numPooledStreams := func() int {
+		sender.writeStreamsMu.Lock()
+		defer sender.writeStreamsMu.Unlock()
+		return len(sender.writeStreams)
+	}
+
+	pinfo := sender.libp2pHost.Peerstore().PeerInfo(receiver.libp2pHost.ID())
+	p := &libp2pPeer{t: sender, pinfo: pinfo}
+	err = p.WriteMsg(Msg{Type: MsgType_Put, Payload: Tx{ID: types.RandomID()}})
+	require.NoError(t, err)
+	require.Equal(t, 1, numPooledStreams())
+
+	err = mn.DisconnectPeers(sender.libp2pHost.ID(), receiver.libp2pHost.ID())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return numPooledStreams() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pTransport_FetchRefDiscoveredViaDHT(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	tptA, tptB, tptC := transports[0], transports[1], transports[2]
+
+	// A and C only know about B
+	_, err := mn.ConnectPeers(tptA.libp2pHost.ID(), tptB.libp2pHost.ID())
+	require.NoError(t, err)
+	_, err = mn.ConnectPeers(tptC.libp2pHost.ID(), tptB.libp2pHost.ID())
+	require.NoError(t, err)
+	require.Len(t, tptC.libp2pHost.Network().ConnsToPeer(tptA.libp2pHost.ID()), 0)
+
+	// Only A has the ref
+	hostA := &host{Context: &ctx.Context{}, refStore: newTestRefStore(t)}
+	tptA.SetFetchRefHandler(hostA.onFetchRefReceived)
+
+	blob := []byte("a ref that only node A has")
+	refHash, _, err := hostA.refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(blob)), "text/plain")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return tptA.dht.RoutingTable().Size() > 0 && tptC.dht.RoutingTable().Size() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = tptA.AnnounceRef(refHash)
+	require.NoError(t, err)
+
+	hostC := &host{
+		Context:    &ctx.Context{},
+		transports: map[string]Transport{"libp2p": tptC},
+		refStore:   newTestRefStore(t),
+	}
+	hostC.refAnnouncer = newRefAnnouncer(REF_ANNOUNCE_WINDOW, hostC.announceRefs)
+	err = hostC.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+
+	err = hostC.fetchRef(refHash)
+	require.NoError(t, err)
+
+	reader, _, err := hostC.refStore.Object(refHash)
+	require.NoError(t, err)
+	defer reader.Close()
+	fetched, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, blob, fetched)
+}
+
+// newTCPTransport returns a libp2p transport listening on a random local TCP port.  Unlike
+// the mocknet transports, these support circuit relay.
+func newTCPTransport(t *testing.T, relayConfig Libp2pRelayConfig) *libp2pTransport {
+	p2pKey, _, err := cryptop2p.GenerateKeyPair(cryptop2p.Secp256k1, 0)
+	require.NoError(t, err)
+
+	tpt := &libp2pTransport{
+		Context:           &ctx.Context{},
+		p2pKey:            p2pKey,
+		relayConfig:       relayConfig,
+		BandwidthCounter:  metrics.NewBandwidthCounter(),
+		subscriptionsIn:   make(map[string]map[*libp2pSubscriptionIn]struct{}),
+		writeStreams:      make(map[peer.ID]*libp2pWriteStream),
+		addressesByPeerID: make(map[peer.ID]types.Address),
+		peerIDsByAddress:  make(map[types.Address]peer.ID),
+		peerStore:         NewPeerStore(types.Address{}),
+	}
+	err = tpt.CtxStart(func() error { return nil }, nil, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { tpt.CtxStop("test finished", nil) })
+
+	libp2pHost, err := libp2p.New(tpt.Ctx(), tpt.libp2pOptions()...)
+	require.NoError(t, err)
+	t.Cleanup(func() { libp2pHost.Close() })
+
+	tpt.libp2pHost = libp2pHost
+	tpt.peerID = libp2pHost.ID()
+	libp2pHost.SetStreamHandler(PROTO_MAIN, tpt.handleIncomingStream)
+	tpt.SetTxHandler(func(tx Tx, peer Peer) {})
+	tpt.SetAckHandler(func(txID types.ID, peer Peer) {})
+	return tpt
+}
+
+func TestLibp2pTransport_ConnectsThroughRelayWhenUnreachable(t *testing.T) {
+	relay := newTCPTransport(t, Libp2pRelayConfig{EnableHop: true})
+
+	var relayAddr string
+	for _, addr := range relay.ListenAddrs() {
+		if strings.HasPrefix(addr, "/ip4/127.0.0.1/") {
+			relayAddr = addr
+		}
+	}
+	require.NotEmpty(t, relayAddr)
+
+	sender := newTCPTransport(t, Libp2pRelayConfig{RelayPeers: []string{relayAddr}})
+	unreachable := newTCPTransport(t, Libp2pRelayConfig{RelayPeers: []string{relayAddr}})
+
+	// The unreachable peer keeps a connection open to its relay so that it can be reached
+	unreachable.connectToPeers("relay", unreachable.relayConfig.RelayPeers)
+	require.Len(t, unreachable.libp2pHost.Network().ConnsToPeer(relay.peerID), 1)
+
+	var mu sync.Mutex
+	var received []types.ID
+	unreachable.SetTxHandler(func(tx Tx, peer Peer) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, tx.ID)
+	})
+
+	// The only direct address the sender knows for the peer is one that nothing listens on
+	deadAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	require.NoError(t, err)
+	pinfo := pstore.PeerInfo{ID: unreachable.peerID, Addrs: []ma.Multiaddr{deadAddr}}
+
+	p := &libp2pPeer{t: sender, pinfo: pinfo}
+	err = p.EnsureConnected(context.Background())
+	require.NoError(t, err)
+
+	conns := sender.libp2pHost.Network().ConnsToPeer(unreachable.peerID)
+	require.Len(t, conns, 1)
+	require.Contains(t, conns[0].RemoteMultiaddr().String(), "p2p-circuit")
+
+	txID := types.RandomID()
+	err = p.WriteMsg(Msg{Type: MsgType_Put, Payload: Tx{ID: txID, URL: "localhost/foo"}})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1 && received[0] == txID
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pTransport_BindsPeerIDToVerifiedAddress(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	tptA, tptB, tptImpostor := transports[0], transports[1], transports[2]
+	err := mn.ConnectAllButSelf()
+	require.NoError(t, err)
+
+	signingKeypairB, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	encryptingKeypairB, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	// The impostor has a different libp2p identity, but signs with B's key
+	for _, tpt := range []*libp2pTransport{tptB, tptImpostor} {
+		h := &host{Context: &ctx.Context{}, signingKeypair: signingKeypairB, encryptingKeypair: encryptingKeypairB, peerStore: NewPeerStore(signingKeypairB.Address())}
+		tpt.SetVerifyAddressHandler(h.onVerifyAddressReceived)
+	}
+
+	signingKeypairA, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	encryptingKeypairA, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	hostA := &host{Context: &ctx.Context{}, signingKeypair: signingKeypairA, encryptingKeypair: encryptingKeypairA, peerStore: NewPeerStore(signingKeypairA.Address())}
+
+	pinfoB := tptA.libp2pHost.Peerstore().PeerInfo(tptB.peerID)
+	sigpubkey, _, err := hostA.requestPeerCredentials(context.Background(), &libp2pPeer{t: tptA, pinfo: pinfoB}, tptA)
+	require.NoError(t, err)
+	require.Equal(t, signingKeypairB.Address(), sigpubkey.Address())
+
+	address, ok := tptA.AddressForPeerID(tptB.peerID)
+	require.True(t, ok)
+	require.Equal(t, signingKeypairB.Address(), address)
+
+	peerID, ok := tptA.PeerIDForAddress(signingKeypairB.Address())
+	require.True(t, ok)
+	require.Equal(t, tptB.peerID, peerID)
+
+	pinfoImpostor := tptA.libp2pHost.Peerstore().PeerInfo(tptImpostor.peerID)
+	_, _, err = hostA.requestPeerCredentials(context.Background(), &libp2pPeer{t: tptA, pinfo: pinfoImpostor}, tptA)
+	require.Equal(t, ErrPeerIDMismatch, errors.Cause(err))
+
+	_, ok = tptA.AddressForPeerID(tptImpostor.peerID)
+	require.False(t, ok)
+	peerID, _ = tptA.PeerIDForAddress(signingKeypairB.Address())
+	require.Equal(t, tptB.peerID, peerID)
+}
+
+func TestLibp2pTransport_RotatedPeerCanRebind(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 3)
+	tptA, tptB, tptImpostor := transports[0], transports[1], transports[2]
+	err := mn.ConnectAllButSelf()
+	require.NoError(t, err)
+
+	oldKeypairB, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	newKeypairB, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	encryptingKeypairB, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	hostB := &host{Context: &ctx.Context{}, signingKeypair: oldKeypairB, encryptingKeypair: encryptingKeypairB, peerStore: NewPeerStore(oldKeypairB.Address())}
+	tptB.SetVerifyAddressHandler(hostB.onVerifyAddressReceived)
+	// The impostor has a different libp2p identity, but signs with B's old key
+	hostImpostor := &host{Context: &ctx.Context{}, signingKeypair: oldKeypairB, encryptingKeypair: encryptingKeypairB, peerStore: NewPeerStore(oldKeypairB.Address())}
+	tptImpostor.SetVerifyAddressHandler(hostImpostor.onVerifyAddressReceived)
+
+	signingKeypairA, err := GenerateSigningKeypair()
+	require.NoError(t, err)
+	encryptingKeypairA, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	hostA := &host{Context: &ctx.Context{}, signingKeypair: signingKeypairA, encryptingKeypair: encryptingKeypairA, peerStore: NewPeerStore(signingKeypairA.Address())}
+
+	pinfoB := tptA.libp2pHost.Peerstore().PeerInfo(tptB.peerID)
+	_, _, err = hostA.requestPeerCredentials(context.Background(), &libp2pPeer{t: tptA, pinfo: pinfoB}, tptA)
+	require.NoError(t, err)
+
+	// B rotates its signing key, but keeps its libp2p identity, and reconnects
+	hostB.signingKeypair = newKeypairB
+	sigpubkey, _, err := hostA.requestPeerCredentials(context.Background(), &libp2pPeer{t: tptA, pinfo: pinfoB}, tptA)
+	require.NoError(t, err)
+	require.Equal(t, newKeypairB.Address(), sigpubkey.Address())
+
+	address, ok := tptA.AddressForPeerID(tptB.peerID)
+	require.True(t, ok)
+	require.Equal(t, newKeypairB.Address(), address)
+	peerID, ok := tptA.PeerIDForAddress(newKeypairB.Address())
+	require.True(t, ok)
+	require.Equal(t, tptB.peerID, peerID)
+	_, ok = tptA.PeerIDForAddress(oldKeypairB.Address())
+	require.False(t, ok)
+
+	// Another peer can't take over B's new address
+	hostImpostor.signingKeypair = newKeypairB
+	pinfoImpostor := tptA.libp2pHost.Peerstore().PeerInfo(tptImpostor.peerID)
+	_, _, err = hostA.requestPeerCredentials(context.Background(), &libp2pPeer{t: tptA, pinfo: pinfoImpostor}, tptA)
+	require.Equal(t, ErrPeerIDMismatch, errors.Cause(err))
+}
+
+func TestLibp2pTransport_RepeatedAnnouncementsAreDropped(t *testing.T) {
+	mn, transports := newMocknetTransports(t, 2)
+	tpt, other := transports[0], transports[1]
+	_, err := mn.ConnectPeers(tpt.libp2pHost.ID(), other.libp2pHost.ID())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return tpt.dht.RoutingTable().Size() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	announcedAt := func(key string) time.Time {
+		tpt.announcedMu.Lock()
+		defer tpt.announcedMu.Unlock()
+		return tpt.announced[key]
+	}
+
+	refHash := types.HashBytes([]byte("announce me"))
+	refKey := "ref:" + refHash.String()
+	stateURIKey := "serve:localhost/test"
+
+	require.NoError(t, tpt.AnnounceRef(refHash))
+	require.NoError(t, tpt.AnnounceStateURI("localhost/test"))
+	firstRef, firstStateURI := announcedAt(refKey), announcedAt(stateURIKey)
+	require.False(t, firstRef.IsZero())
+	require.False(t, firstStateURI.IsZero())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, tpt.AnnounceRef(refHash))
+		require.NoError(t, tpt.AnnounceStateURI("localhost/test"))
+	}
+	require.Equal(t, firstRef, announcedAt(refKey))
+	require.Equal(t, firstStateURI, announcedAt(stateURIKey))
+
+	// Once the TTL runs out, the next announcement goes through
+	tpt.announcedMu.Lock()
+	tpt.announced[refKey] = time.Now().Add(-ANNOUNCE_TTL)
+	tpt.announcedMu.Unlock()
+
+	require.NoError(t, tpt.AnnounceRef(refHash))
+	require.NoError(t, tpt.AnnounceStateURI("localhost/test"))
+	require.True(t, announcedAt(refKey).After(firstRef))
+	require.Equal(t, firstStateURI, announcedAt(stateURIKey))
+}
@@ -0,0 +1,348 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The conformance tests apply the same operations to every Node implementation and
+// require that all of them can be observed to end up in the same state.  Scenarios that
+// one backend doesn't support yet are listed with a skip reason rather than removed, so
+// that the gap stays visible.
+
+type conformanceBackend struct {
+	name    string
+	newNode func(T *testing.T) (Node, func())
+}
+
+var conformanceBackends = []conformanceBackend{
+	{"MemoryNode", func(T *testing.T) (Node, func()) {
+		return NewMemoryNode(), func() {}
+	}},
+	{"DBNode", func(T *testing.T) (Node, func()) {
+		tree := mustNewDBTree(T)
+		node := tree.StateAtVersion(nil, true)
+		return node, func() {
+			node.Close()
+			tree.DeleteDB()
+		}
+	}},
+}
+
+type conformanceOp struct {
+	delete  bool
+	keypath Keypath
+	rng     *Range
+	val     interface{}
+}
+
+func setOp(keypath Keypath, rng *Range, val interface{}) conformanceOp {
+	return conformanceOp{keypath: keypath, rng: rng, val: val}
+}
+
+func deleteOp(keypath Keypath, rng *Range) conformanceOp {
+	return conformanceOp{delete: true, keypath: keypath, rng: rng}
+}
+
+type conformanceQuery struct {
+	keypath Keypath
+	rng     *Range
+}
+
+type conformanceObservation struct {
+	Keypath      string
+	Value        interface{}
+	ValueExists  bool
+	ValueErr     bool
+	Exists       bool
+	NodeType     NodeType
+	ValueType    ValueType
+	Length       uint64
+	NodeInfoErr  bool
+	Subkeys      []string
+	IterKeypaths []string
+	Dump         string
+}
+
+func observeNode(T *testing.T, root Node, query conformanceQuery) conformanceObservation {
+	obs := conformanceObservation{Keypath: query.keypath.String()}
+
+	val, exists, err := root.Value(query.keypath, query.rng)
+	obs.Value, obs.ValueExists, obs.ValueErr = val, exists, err != nil
+
+	obs.Exists, err = root.Exists(query.keypath)
+	require.NoError(T, err)
+
+	node := root.AtKeypath(query.keypath, nil)
+	obs.NodeType, obs.ValueType, obs.Length, err = node.NodeInfo()
+	obs.NodeInfoErr = err != nil
+
+	for _, subkey := range node.Subkeys() {
+		obs.Subkeys = append(obs.Subkeys, subkey.String())
+	}
+	sort.Strings(obs.Subkeys)
+
+	// A read-write badger transaction only allows one open iterator, so close this one
+	// before anything else iterates
+	iter := root.DepthFirstIterator(query.keypath, false, 0)
+	for {
+		n := iter.Next()
+		if n == nil {
+			break
+		}
+		obs.IterKeypaths = append(obs.IterKeypaths, n.Keypath().RelativeTo(root.Keypath()).String())
+	}
+	iter.Close()
+
+	if !obs.NodeInfoErr {
+		obs.Dump, err = node.Dump()
+		require.NoError(T, err)
+	}
+	return obs
+}
+
+func sortedDiffKeypaths(keypaths map[string]struct{}) []string {
+	var sorted []string
+	for kp := range keypaths {
+		sorted = append(sorted, kp)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare([]byte(sorted[i]), []byte(sorted[j])) < 0 })
+	return sorted
+}
+
+func TestNode_Conformance(T *testing.T) {
+	tests := []struct {
+		name      string
+		atKeypath Keypath
+		ops       []conformanceOp
+		queries   []conformanceQuery
+		expected  interface{}
+		skip      map[string]string
+	}{
+		{
+			name: "set map at root",
+			ops:  []conformanceOp{setOp(nil, nil, testVal1)},
+			queries: []conformanceQuery{
+				{keypath: nil},
+				{keypath: Keypath("flox")},
+				{keypath: Keypath("flox").PushIndex(1)},
+				{keypath: Keypath("flox").PushIndex(1).Push(Keypath("yup"))},
+				{keypath: Keypath("hello/xyzzy")},
+				{keypath: Keypath("missing")},
+			},
+		},
+		{
+			name: "set scalar values",
+			ops: []conformanceOp{
+				setOp(Keypath("str"), nil, "hello"),
+				setOp(Keypath("float"), nil, float64(1.5)),
+				setOp(Keypath("uint"), nil, uint64(7)),
+				setOp(Keypath("bool"), nil, true),
+				setOp(Keypath("nil"), nil, nil),
+			},
+			queries: []conformanceQuery{
+				{keypath: nil},
+				{keypath: Keypath("str")},
+				{keypath: Keypath("float")},
+				{keypath: Keypath("uint")},
+				{keypath: Keypath("bool")},
+				{keypath: Keypath("nil")},
+			},
+		},
+		{
+			name: "set creates intermediate maps",
+			ops:  []conformanceOp{setOp(Keypath("a/b/c"), nil, "deep")},
+			queries: []conformanceQuery{
+				{keypath: nil},
+				{keypath: Keypath("a")},
+				{keypath: Keypath("a/b")},
+				{keypath: Keypath("a/b/c")},
+			},
+		},
+		{
+			name: "set replaces a value with a map",
+			ops: []conformanceOp{
+				setOp(Keypath("a"), nil, "x"),
+				setOp(Keypath("a/b"), nil, "y"),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("a")}},
+		},
+		{
+			name: "set replaces a map with a value",
+			ops: []conformanceOp{
+				setOp(Keypath("a"), nil, M{"b": M{"c": "x"}, "d": []interface{}{"y"}}),
+				setOp(Keypath("a"), nil, float64(3)),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("a")}, {keypath: Keypath("a/b")}},
+		},
+		{
+			name: "set replaces a slice with a shorter slice",
+			ops: []conformanceOp{
+				setOp(Keypath("s"), nil, []interface{}{"a", "b", M{"c": "d"}}),
+				setOp(Keypath("s"), nil, []interface{}{"z"}),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("s")}, {keypath: Keypath("s").PushIndex(2)}},
+		},
+		{
+			name: "set does not disturb siblings sharing a key prefix",
+			ops: []conformanceOp{
+				setOp(nil, nil, M{"foo": M{"a": "1"}, "foobar": "2", "foo!": "3"}),
+				setOp(Keypath("foo"), nil, M{"b": "4"}),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("foo")}},
+		},
+		{
+			name:      "set at a non-root node",
+			atKeypath: Keypath("foo/bar"),
+			ops: []conformanceOp{
+				setOp(nil, nil, testVal2),
+				setOp(Keypath("extra"), nil, "x"),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("eee")}, {keypath: Keypath("extra")}},
+		},
+		{
+			name: "delete map subtree",
+			ops: []conformanceOp{
+				setOp(nil, nil, testVal1),
+				deleteOp(Keypath("flox"), nil),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("flox")}, {keypath: Keypath("flox").PushIndex(1)}},
+		},
+		{
+			name: "delete value",
+			ops: []conformanceOp{
+				setOp(nil, nil, testVal1),
+				deleteOp(Keypath("hello/xyzzy"), nil),
+			},
+			queries: []conformanceQuery{{keypath: nil}, {keypath: Keypath("hello")}, {keypath: Keypath("hello/xyzzy")}},
+		},
+		{
+			name: "delete missing keypath",
+			ops: []conformanceOp{
+				setOp(nil, nil, testVal1),
+				deleteOp(Keypath("nope/nope"), nil),
+			},
+			queries: []conformanceQuery{{keypath: nil}},
+		},
+		{
+			name: "delete does not disturb siblings sharing a key prefix",
+			ops: []conformanceOp{
+				setOp(nil, nil, M{"foo": M{"a": "1"}, "foobar": "2", "foo!": "3"}),
+				deleteOp(Keypath("foo"), nil),
+			},
+			queries: []conformanceQuery{{keypath: nil}},
+		},
+		{
+			name: "value of a slice range",
+			ops:  []conformanceOp{setOp(Keypath("s"), nil, []interface{}{"a", M{"b": "c"}, "d", "e"})},
+			queries: []conformanceQuery{
+				{keypath: Keypath("s"), rng: &Range{1, 3}},
+				{keypath: Keypath("s"), rng: &Range{0, 4}},
+				{keypath: Keypath("s"), rng: &Range{3, 1}},
+			},
+		},
+		{
+			name: "value of a range over a non-slice",
+			ops:  []conformanceOp{setOp(nil, nil, testVal1)},
+			queries: []conformanceQuery{
+				{keypath: Keypath("hello"), rng: &Range{0, 1}},
+				{keypath: Keypath("flo"), rng: &Range{0, 1}},
+			},
+		},
+		{
+			name: "delete slice range",
+			ops: []conformanceOp{
+				setOp(Keypath("s"), nil, []interface{}{"a", M{"b": "c"}, "d", "e"}),
+				deleteOp(Keypath("s"), &Range{1, 3}),
+			},
+			queries:  []conformanceQuery{{keypath: nil}, {keypath: Keypath("s")}},
+			expected: M{"s": []interface{}{"a", "e"}},
+		},
+		{
+			name: "delete string range",
+			ops: []conformanceOp{
+				setOp(Keypath("str"), nil, "hello world"),
+				deleteOp(Keypath("str"), &Range{5, 11}),
+			},
+			queries:  []conformanceQuery{{keypath: nil}, {keypath: Keypath("str")}},
+			expected: M{"str": "hello"},
+		},
+		{
+			name: "set string range",
+			ops: []conformanceOp{
+				setOp(Keypath("str"), nil, "hello world"),
+				setOp(Keypath("str"), &Range{6, 11}, "there"),
+			},
+			queries:  []conformanceQuery{{keypath: nil}, {keypath: Keypath("str")}},
+			expected: M{"str": "hello there"},
+			skip:     map[string]string{"MemoryNode": "MemoryNode doesn't support Set with a range yet"},
+		},
+		{
+			name: "set slice range",
+			ops: []conformanceOp{
+				setOp(Keypath("s"), nil, []interface{}{"a", "b", "c"}),
+				setOp(Keypath("s"), &Range{1, 2}, []interface{}{"x", M{"y": "z"}}),
+			},
+			queries:  []conformanceQuery{{keypath: nil}, {keypath: Keypath("s")}},
+			expected: M{"s": []interface{}{"a", "x", M{"y": "z"}, "c"}},
+			skip:     map[string]string{"MemoryNode": "MemoryNode doesn't support Set with a range yet"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		T.Run(test.name, func(T *testing.T) {
+			var (
+				results     [][]conformanceObservation
+				diffAdded   [][]string
+				diffRemoved [][]string
+				backends    []string
+			)
+			for _, backend := range conformanceBackends {
+				if reason, skip := test.skip[backend.name]; skip {
+					T.Logf("skipping %v: %v", backend.name, reason)
+					continue
+				}
+
+				root, cleanup := backend.newNode(T)
+				defer cleanup()
+				state := root.AtKeypath(test.atKeypath, nil)
+
+				for i, op := range test.ops {
+					var err error
+					if op.delete {
+						err = state.Delete(op.keypath, op.rng)
+					} else {
+						err = state.Set(op.keypath, op.rng, op.val)
+					}
+					require.NoError(T, err, fmt.Sprintf("%v: op %v", backend.name, i))
+				}
+
+				if test.expected != nil {
+					val, _, err := state.Value(nil, nil)
+					require.NoError(T, err)
+					require.Equal(T, test.expected, val, backend.name)
+				}
+
+				var observations []conformanceObservation
+				for _, query := range test.queries {
+					observations = append(observations, observeNode(T, state, query))
+				}
+				results = append(results, observations)
+				diffAdded = append(diffAdded, sortedDiffKeypaths(state.Diff().Added))
+				diffRemoved = append(diffRemoved, sortedDiffKeypaths(state.Diff().Removed))
+				backends = append(backends, backend.name)
+			}
+
+			for i := 1; i < len(results); i++ {
+				require.Equal(T, results[0], results[i], fmt.Sprintf("%v vs. %v", backends[0], backends[i]))
+				require.Equal(T, diffAdded[0], diffAdded[i], fmt.Sprintf("%v vs. %v: diff added", backends[0], backends[i]))
+				require.Equal(T, diffRemoved[0], diffRemoved[i], fmt.Sprintf("%v vs. %v: diff removed", backends[0], backends[i]))
+			}
+		})
+	}
+}
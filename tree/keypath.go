@@ -2,6 +2,9 @@ package tree
 
 import (
 	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
 )
 
 type Keypath []byte
@@ -13,6 +16,9 @@ func (k Keypath) Equals(other Keypath) bool {
 }
 
 func (k Keypath) Copy() Keypath {
+	if k == nil {
+		return nil
+	}
 	k2 := make(Keypath, len(k))
 	copy(k2, k)
 	return k2
@@ -37,6 +43,33 @@ func (k Keypath) String() string {
 	//return strings.Join(partStrings, string(KeypathSeparator))
 }
 
+// AppendBinary appends the keypath's compact binary encoding to buf: its length as a
+// uvarint, followed by its bytes exactly as they are.  Unlike the dotted form that patches
+// are written in, it needs no quoting, so keys with any bytes at all in them survive it.
+func (k Keypath) AppendBinary(buf []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(k)))
+	buf = append(buf, lenBuf[:n]...)
+	return append(buf, k...)
+}
+
+// ReadKeypathBinary decodes a keypath written by AppendBinary from the front of buf, and
+// returns it along with the rest of buf.
+func ReadKeypathBinary(buf []byte) (Keypath, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, nil, errors.New("bad keypath length")
+	}
+	buf = buf[n:]
+	if uint64(len(buf)) < length {
+		return nil, nil, errors.New("keypath is truncated")
+	}
+	if length == 0 {
+		return nil, buf, nil
+	}
+	return Keypath(buf[:length]).Copy(), buf[length:], nil
+}
+
 func (k Keypath) LengthAsParent() int {
 	if len(k) != 0 {
 		return len(k) + 1
@@ -119,6 +152,28 @@ func (k Keypath) Pop() (rest Keypath, top Keypath) {
 	return k[:kpIdx], k[kpIdx+1:]
 }
 
+// Parent returns the keypath with its last part removed.  The parent of a single-part
+// keypath (and of the root keypath) is the root keypath.
+func (k Keypath) Parent() Keypath {
+	parent, _ := k.Pop()
+	return parent
+}
+
+// Join returns the keypath with each of the given parts pushed onto it in turn.  Empty
+// parts are skipped.
+func (k Keypath) Join(parts ...string) Keypath {
+	for _, part := range parts {
+		k = k.Push(Keypath(part))
+	}
+	return k
+}
+
+// IsAncestorOf returns true if other lies strictly beneath k.  The root keypath is an
+// ancestor of every other keypath, and no keypath is an ancestor of itself.
+func (k Keypath) IsAncestorOf(other Keypath) bool {
+	return len(other) > len(k) && other.StartsWith(k)
+}
+
 func (k Keypath) NumParts() int {
 	if len(k) == 0 {
 		return 0
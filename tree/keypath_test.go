@@ -152,3 +152,97 @@ func TestKeypathStartsWith(T *testing.T) {
 		require.Equal(T, test.expected, does)
 	}
 }
+
+func TestKeypathParent(T *testing.T) {
+	tests := []struct {
+		input    Keypath
+		expected Keypath
+	}{
+		{Keypath("foo/bar/baz"), Keypath("foo/bar")},
+		{Keypath("foo"), nil},
+		{Keypath(""), nil},
+		{nil, nil},
+		{Keypath("foo").PushIndex(3), Keypath("foo")},
+		{Keypath("foo").PushIndex(3).Push(Keypath("bar")), Keypath("foo").PushIndex(3)},
+	}
+
+	for _, test := range tests {
+		out := test.input.Parent()
+		require.Equal(T, test.expected, out)
+	}
+}
+
+func TestKeypathJoin(T *testing.T) {
+	tests := []struct {
+		input    Keypath
+		parts    []string
+		expected Keypath
+	}{
+		{Keypath("foo"), []string{"bar", "baz"}, Keypath("foo/bar/baz")},
+		{Keypath("foo"), []string{"bar", "", "baz"}, Keypath("foo/bar/baz")},
+		{Keypath("foo"), nil, Keypath("foo")},
+		{nil, []string{"foo", "bar"}, Keypath("foo/bar")},
+		{Keypath(""), []string{"foo"}, Keypath("foo")},
+		{nil, nil, nil},
+		{Keypath("foo").PushIndex(3), []string{"bar"}, Keypath("foo").PushIndex(3).Push(Keypath("bar"))},
+	}
+
+	for _, test := range tests {
+		out := test.input.Join(test.parts...)
+		require.Equal(T, test.expected, out)
+	}
+}
+
+func TestKeypathIsAncestorOf(T *testing.T) {
+	tests := []struct {
+		input    Keypath
+		other    Keypath
+		expected bool
+	}{
+		{Keypath("foo"), Keypath("foo/bar"), true},
+		{Keypath("foo"), Keypath("foo/bar/baz"), true},
+		{Keypath("foo/bar"), Keypath("foo"), false},
+		{Keypath("foo"), Keypath("foo"), false},
+		{Keypath("foo"), Keypath("foox/bar"), false},
+		{Keypath("fo"), Keypath("foo"), false},
+		{nil, Keypath("foo"), true},
+		{Keypath(""), Keypath("foo"), true},
+		{nil, nil, false},
+		{Keypath("foo"), nil, false},
+		{Keypath("foo"), Keypath("foo").PushIndex(3), true},
+		{Keypath("foo").PushIndex(3), Keypath("foo").PushIndex(3).Push(Keypath("bar")), true},
+		{Keypath("foo").PushIndex(3), Keypath("foo").PushIndex(4), false},
+	}
+
+	for _, test := range tests {
+		is := test.input.IsAncestorOf(test.other)
+		require.Equal(T, test.expected, is, "%v %v", test.input, test.other)
+	}
+}
+
+func TestKeypathBinaryRoundTrip(T *testing.T) {
+	tests := []Keypath{
+		nil,
+		Keypath("foo"),
+		Keypath("foo/bar/baz"),
+		Keypath("with.dots/and spaces/and \"quotes\"]"),
+		Keypath("nul\x00byte/\xff\xfe/[\"x\"]"),
+		Keypath("foo").PushIndex(3),
+	}
+
+	var buf []byte
+	for _, test := range tests {
+		buf = test.AppendBinary(buf)
+	}
+	for _, test := range tests {
+		var keypath Keypath
+		var err error
+		keypath, buf, err = ReadKeypathBinary(buf)
+		require.NoError(T, err)
+		require.Equal(T, test, keypath)
+	}
+	require.Empty(T, buf)
+
+	_, _, err := ReadKeypathBinary(Keypath("foo/bar").AppendBinary(nil)[:4])
+	require.Error(T, err)
+}
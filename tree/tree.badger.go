@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	badgerpb "github.com/dgraph-io/badger/v2/pb"
@@ -19,14 +20,98 @@ type DBTree struct {
 	filename string
 }
 
-func NewDBTree(dbFilename string) (*DBTree, error) {
-	opts := badger.DefaultOptions(dbFilename)
+// DBTreeOptions tunes the Badger DB beneath a DBTree.  The zero value uses Badger's
+// defaults.
+type DBTreeOptions struct {
+	// InMemory keeps the whole DB in memory, and never touches the filesystem.  Everything
+	// in the DB is lost once it's closed, so it's mostly useful for tests.
+	InMemory bool
+
+	ValueLogFileSize int64 // The maximum size of each value log file, in bytes
+	MaxTableSize     int64 // The maximum size of each LSM table (and memtable), in bytes
+	MaxCacheSize     int64 // The size of the block cache, in bytes
+
+	// GCInterval is how often the value log is garbage collected (see
+	// CollectValueLogGarbage).  Zero disables it.  It's up to whoever owns the DB to
+	// schedule it.
+	GCInterval time.Duration
+	// GCDiscardRatio is the fraction of a value log file that has to be garbage before the
+	// file is rewritten.  Zero means DefaultGCDiscardRatio.
+	GCDiscardRatio float64
+}
+
+const DefaultGCDiscardRatio = 0.5
+
+// BadgerOptions returns the Badger options for a DB at the given path.  The path is
+// ignored for in-memory DBs.
+func (o DBTreeOptions) BadgerOptions(dbFilename string) badger.Options {
+	var opts badger.Options
+	if o.InMemory {
+		opts = badger.DefaultOptions("").WithInMemory(true)
+	} else {
+		opts = badger.DefaultOptions(dbFilename)
+	}
+	if o.ValueLogFileSize > 0 {
+		opts = opts.WithValueLogFileSize(o.ValueLogFileSize)
+	}
+	if o.MaxTableSize > 0 {
+		opts = opts.WithMaxTableSize(o.MaxTableSize)
+	}
+	if o.MaxCacheSize > 0 {
+		opts = opts.WithMaxCacheSize(o.MaxCacheSize)
+	}
 	opts.Logger = nil
+	return opts
+}
+
+// CollectValueLogGarbage has Badger rewrite the DB's value log files until none of them
+// have enough garbage left in them to be worth it, and returns how many were rewritten.
+// Badger never reclaims the space taken up by overwritten and deleted values otherwise.
+func CollectValueLogGarbage(db *badger.DB, discardRatio float64) (int, error) {
+	if discardRatio <= 0 {
+		discardRatio = DefaultGCDiscardRatio
+	}
+	var rewritten int
+	for {
+		err := db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected || err == badger.ErrGCInMemoryMode {
+			return rewritten, nil
+		} else if err != nil {
+			return rewritten, errors.WithStack(err)
+		}
+		rewritten++
+	}
+}
+
+func (t *DBTree) CollectValueLogGarbage(discardRatio float64) (int, error) {
+	return CollectValueLogGarbage(t.db, discardRatio)
+}
+
+func NewDBTree(dbFilename string) (*DBTree, error) {
+	return NewDBTreeWithOptions(dbFilename, DBTreeOptions{})
+}
+
+func NewDBTreeWithOptions(dbFilename string, options DBTreeOptions) (*DBTree, error) {
+	return openDBTree(dbFilename, options, false)
+}
+
+// OpenDBTreeReadOnly opens an existing DBTree for reading only.  It fails if the tree
+// doesn't exist, or if another DBTree already has it open for writing.
+func OpenDBTreeReadOnly(dbFilename string) (*DBTree, error) {
+	return openDBTree(dbFilename, DBTreeOptions{}, true)
+}
+
+func openDBTree(dbFilename string, options DBTreeOptions, readOnly bool) (*DBTree, error) {
+	opts := options.BadgerOptions(dbFilename)
+	opts.ReadOnly = readOnly
 
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
 	}
+	if options.InMemory {
+		dbFilename = ""
+	}
 	return &DBTree{db, dbFilename}, nil
 }
 
@@ -38,6 +123,8 @@ func (t *DBTree) DeleteDB() error {
 	err := t.Close()
 	if err != nil {
 		return err
+	} else if t.filename == "" {
+		return nil
 	}
 	return os.RemoveAll(t.filename)
 }
@@ -66,6 +153,10 @@ func (t *DBTree) makeIndexKeyPrefix(version types.ID, keypath Keypath, indexName
 	return bytes.Join([][]byte{[]byte("i"), version[:], keypath, indexName}, []byte(":"))
 }
 
+// StateAtVersion opens a DB transaction on the state at the given version (or the current
+// state, if version is nil).  Each transaction sees a consistent snapshot of the DB as of
+// when it was opened, and a mutable one's writes only become visible to others, all at
+// once, when it's saved.
 func (t *DBTree) StateAtVersion(version *types.ID, mutable bool) *DBNode {
 	if version == nil {
 		version = &CurrentVersion
@@ -124,13 +215,25 @@ func (tx *DBNode) AtKeypath(keypath Keypath, rng *Range) Node {
 	return &DBNode{tx: tx.tx, rootKeypath: tx.rootKeypath.Push(keypath), rng: tx.rng, keyPrefix: tx.keyPrefix, diff: tx.diff}
 }
 
+// descendantKeyPrefix returns the prefix shared by the DB keys of all of the descendants
+// of the node stored under the given DB key.  Scanning with the node's bare key as the
+// prefix would also catch siblings whose keys share it.  At the root of the tree, this is
+// just the key prefix, which also matches the root node's own key.
+func (tx *DBNode) descendantKeyPrefix(prefixedKeypath Keypath) Keypath {
+	prefix := prefixedKeypath.Copy()
+	if len(prefix) == len(tx.keyPrefix) {
+		return prefix
+	}
+	return append(prefix, KeypathSeparator[0])
+}
+
 func (tx *DBNode) Subkeys() []Keypath {
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchSize = 10
 	iter := tx.tx.NewIterator(opts)
 	defer iter.Close()
 
-	startKeypath := append(tx.addKeyPrefix(tx.rootKeypath), KeypathSeparator[0])
+	startKeypath := tx.descendantKeyPrefix(tx.addKeyPrefix(tx.rootKeypath))
 
 	var keypaths []Keypath
 	keypathsMap := make(map[string]struct{})
@@ -140,13 +243,49 @@ func (tx *DBNode) Subkeys() []Keypath {
 		subkey := tx.rmKeyPrefix(absKeypath).RelativeTo(tx.rootKeypath).Part(0)
 		_, exists := keypathsMap[string(subkey)]
 		if !exists && len(subkey) > 0 {
-			keypaths = append(keypaths, subkey)
+			// Badger reuses the key's buffer once the iterator moves on
+			keypaths = append(keypaths, subkey.Copy())
 			keypathsMap[string(subkey)] = struct{}{}
 		}
 	}
 	return keypaths
 }
 
+// SubkeysAfter returns up to limit of the node's subkeys, in byte-wise order, starting
+// with the first subkey that sorts after the given one (or with the very first subkey, if
+// after is nil).  hasMore is true if there are further subkeys beyond those returned.
+func (tx *DBNode) SubkeysAfter(after Keypath, limit int) (subkeys []Keypath, hasMore bool) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	iter := tx.tx.NewIterator(opts)
+	defer iter.Close()
+
+	prefix := tx.descendantKeyPrefix(tx.addKeyPrefix(tx.rootKeypath))
+	startKeypath := prefix
+	if after != nil {
+		startKeypath = append(prefix.Copy(), after...)
+	}
+
+	// Every child node has its own key, which sorts before any of that child's
+	// descendants, so subkeys are first encountered in order.
+	seen := make(map[string]struct{})
+	for iter.Seek(startKeypath); iter.ValidForPrefix(prefix); iter.Next() {
+		subkey := tx.rmKeyPrefix(Keypath(iter.Item().Key())).RelativeTo(tx.rootKeypath).Part(0)
+		if len(subkey) == 0 || (after != nil && bytes.Compare(subkey, after) <= 0) {
+			// Descendants of earlier subkeys can sort after other subkeys (for example,
+			// "m1/a" sorts after "m1!"), so skip anything we've already passed
+			continue
+		} else if _, exists := seen[string(subkey)]; exists {
+			continue
+		} else if len(subkeys) == limit {
+			return subkeys, true
+		}
+		seen[string(subkey)] = struct{}{}
+		subkeys = append(subkeys, subkey.Copy())
+	}
+	return subkeys, false
+}
+
 func (tx *DBNode) NodeInfo() (NodeType, ValueType, uint64, error) {
 	item, err := tx.tx.Get(tx.addKeyPrefix(tx.rootKeypath))
 	if err == badger.ErrKeyNotFound {
@@ -203,10 +342,9 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 	goValues := make(map[string]interface{})
 
 	item, err := tx.tx.Get(keypathPrefix)
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			err = errors.Wrapf(types.Err404, "(keypath: %v)", keypathPrefix)
-		}
+	if err == badger.ErrKeyNotFound {
+		return nil, false, nil
+	} else if err != nil {
 		return nil, false, errors.WithStack(err)
 	}
 
@@ -229,6 +367,8 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 		return v, true, nil
 	}
 
+	scanPrefix := tx.descendantKeyPrefix(keypathPrefix)
+
 	var startKeypath Keypath
 	var endKeypathPrefix Keypath
 
@@ -236,7 +376,7 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 		if rng != nil {
 			return nil, false, errors.WithStack(ErrRangeOverNonSlice)
 		}
-		startKeypath = keypathPrefix
+		startKeypath = scanPrefix
 
 	} else if rootNodeType == NodeTypeSlice {
 		if rng != nil {
@@ -247,31 +387,38 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 			startKeypath = keypathPrefix.PushIndex(startIdx)
 			endKeypathPrefix = keypathPrefix.PushIndex(endIdx)
 		} else {
-			startKeypath = keypathPrefix
+			startKeypath = scanPrefix
 		}
 	}
 
+	root, err := decodeGoValue(rootNodeType, valueType, length, rng, data)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	goValues[""] = root
+
 	var valueBuf []byte
-	var validPrefix = keypathPrefix
-	for iter.Seek(startKeypath); iter.ValidForPrefix(validPrefix); iter.Next() {
+	for iter.Seek(startKeypath); iter.ValidForPrefix(scanPrefix); iter.Next() {
 		item := iter.Item()
 		absKeypath := Keypath(item.Key())
 
-		// If we're ranging over a slice, and we find the first keypath of the final element,
-		// swap the keypath prefix the iterator is checking against (which WAS the root node
-		// keypath) with the keypath of the final element.  The iterator will then stop after
-		// the final keypath for that final element.
+		// If we're ranging over a slice, stop at the first element past the end of the range
 		if rng != nil && absKeypath.Equals(endKeypathPrefix) {
-			validPrefix = append(endKeypathPrefix, KeypathSeparator[0])
+			break
 		}
 
 		relKeypath := absKeypath.RelativeTo(keypathPrefix)
+		if len(relKeypath) == 0 {
+			// When scanning from the root of the tree, the scan prefix also matches the
+			// root node, which was already decoded above
+			continue
+		}
 
 		// If we're ranging over a slice, transpose its indices to start from 0.
-		if len(relKeypath) > 0 && rootNodeType == NodeTypeSlice && rng != nil {
+		if rootNodeType == NodeTypeSlice && rng != nil {
 			relKeypath = relKeypath.Copy()
 			oldIdx := DecodeSliceIndex(relKeypath[:8])
-			newIdx := uint64(int64(oldIdx) - rng[0])
+			newIdx := uint64(int64(oldIdx) - rng.Start())
 			copy(relKeypath[:8], EncodeSliceIndex(newIdx))
 		}
 
@@ -289,13 +436,7 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 				return nil, false, err
 			}
 
-			// Only apply the passed range to the root value
-			var thisRng *Range
-			if len(relKeypath) == 0 {
-				thisRng = rng
-			}
-
-			val, err = decodeGoValue(nodeType, valueType, length, thisRng, data)
+			val, err = decodeGoValue(nodeType, valueType, length, nil, data)
 			if err != nil {
 				return nil, false, errors.WithStack(err)
 			}
@@ -303,21 +444,12 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 			switch val.(type) {
 			case map[string]interface{}, []interface{}:
 				goValues[string(relKeypath)] = val
-			default:
-				if len(relKeypath) == 0 {
-					return val, true, nil
-				}
 			}
 		}
 
 		// Insert the decoded value into its parent
 		{
 			parentKeypath, key := relKeypath.Pop()
-			if len(key) == 0 {
-				// This keypath is the root keypath (nil), so there's no parent to insert it into
-				continue
-			}
-
 			parent := goValues[string(parentKeypath)]
 			switch p := parent.(type) {
 			case map[string]interface{}:
@@ -330,8 +462,7 @@ func (tx *DBNode) value(keypathPrefix Keypath, rng *Range, iter *badger.Iterator
 		}
 	}
 
-	root, exists := goValues[""]
-	return root, exists, nil
+	return root, true, nil
 }
 
 func (tx *DBNode) UintValue(keypath Keypath) (uint64, bool, error) {
@@ -432,14 +563,25 @@ func (tx *DBNode) ContentLength() (int64, error) {
 	}
 }
 
-func (tx *DBNode) Set(absKeypath Keypath, rng *Range, val interface{}) error {
+// SetMany calls Set with each of the patches in turn.
+func (tx *DBNode) SetMany(patches []Patch) error {
+	for _, patch := range patches {
+		err := tx.Set(patch.Keypath, patch.Range, patch.Val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *DBNode) Set(keypath Keypath, rng *Range, val interface{}) error {
 	if rng == nil {
 		rng = tx.rng
 	} else if rng != nil && tx.rng != nil {
 		panic("unsupported")
 	}
 
-	absKeypath = tx.rootKeypath.Push(absKeypath)
+	absKeypath := tx.rootKeypath.Push(keypath)
 
 	if rng != nil {
 		if !rng.Valid() {
@@ -451,7 +593,7 @@ func (tx *DBNode) Set(absKeypath Keypath, rng *Range, val interface{}) error {
 			// @@TODO: ??
 			//return errors.WithStack(ErrRangeOverNonSlice)
 		} else if err != nil {
-			return errors.Errorf("error fetching keypath %v while setting range", absKeypath)
+			return errors.Wrapf(err, "error fetching keypath %v while setting range", absKeypath)
 		}
 
 		var encodedVal []byte
@@ -464,18 +606,18 @@ func (tx *DBNode) Set(absKeypath Keypath, rng *Range, val interface{}) error {
 
 		switch spliceVal := val.(type) {
 		case string:
-			return tx.setRangeString(absKeypath, rng, encodedVal, spliceVal)
+			return tx.setRangeString(keypath, rng, encodedVal, spliceVal)
 		case []interface{}:
-			return tx.setRangeSlice(absKeypath, rng, encodedVal, spliceVal)
+			return tx.setRangeSlice(keypath, rng, encodedVal, spliceVal)
 		default:
 			return errors.New("wrong type for splice")
 		}
 	} else {
-		return tx.setNoRange(absKeypath, val)
+		return tx.setNoRange(keypath, val)
 	}
 }
 
-func (tx *DBNode) setRangeString(absKeypath Keypath, rng *Range, encodedVal []byte, spliceVal string) error {
+func (tx *DBNode) setRangeString(keypath Keypath, rng *Range, encodedVal []byte, spliceVal string) error {
 	if len(encodedVal) == 0 {
 		encodedVal = []byte("vs")
 	}
@@ -497,10 +639,10 @@ func (tx *DBNode) setRangeString(absKeypath Keypath, rng *Range, encodedVal []by
 	copy(newVal[2:], oldVal[:startIdx])
 	copy(newVal[2+startIdx:], []byte(spliceVal))
 	copy(newVal[2+startIdx+uint64(len(spliceVal)):], oldVal[endIdx:])
-	return tx.tx.Set(tx.addKeyPrefix(tx.rootKeypath.Push(absKeypath)), newVal)
+	return tx.tx.Set(tx.addKeyPrefix(tx.rootKeypath.Push(keypath)), newVal)
 }
 
-func (tx *DBNode) setRangeSlice(absKeypath Keypath, rng *Range, encodedVal []byte, spliceVal []interface{}) error {
+func (tx *DBNode) setRangeSlice(keypath Keypath, rng *Range, encodedVal []byte, spliceVal []interface{}) error {
 	nodeType, _, oldLen, _, err := decodeNode(encodedVal)
 	if err != nil {
 		return err
@@ -510,7 +652,7 @@ func (tx *DBNode) setRangeSlice(absKeypath Keypath, rng *Range, encodedVal []byt
 		return errors.WithStack(ErrInvalidRange)
 	}
 
-	absKeypath = tx.addKeyPrefix(tx.rootKeypath.Push(absKeypath))
+	absKeypath := tx.addKeyPrefix(tx.rootKeypath.Push(keypath))
 
 	newLen := oldLen - rng.Size() + uint64(len(spliceVal))
 	shrink := newLen < oldLen
@@ -643,41 +785,56 @@ func (tx *DBNode) setRangeSlice(absKeypath Keypath, rng *Range, encodedVal []byt
 	return err
 }
 
-func (tx *DBNode) setNoRange(absKeypath Keypath, value interface{}) error {
-	err := tx.Delete(absKeypath, nil)
+func (tx *DBNode) setNoRange(keypath Keypath, value interface{}) error {
+	err := tx.Delete(keypath, nil)
 	if err != nil {
 		return err
 	}
 
-	absKeypath = tx.rootKeypath.Push(absKeypath)
-
-	// Set value types for intermediate keypaths in case they don't exist
-	partialKeypath, _ := absKeypath.Pop()
-	partialKeypath = tx.addKeyPrefix(partialKeypath)
-	for {
-		item, err := tx.tx.Get(partialKeypath)
-		if err == badger.ErrKeyNotFound {
-			err = tx.tx.Set(partialKeypath, []byte("m"))
-			if err != nil {
-				return err
-			}
-		} else if err != nil {
-			return err
-		} else {
-			val, err := item.ValueCopy(nil)
-			if val[0] == 'v' {
-				err = tx.tx.Set(partialKeypath, []byte("m"))
+	absKeypath := tx.rootKeypath.Push(keypath)
+
+	// Set value types for intermediate keypaths in case they don't exist, all the way up to
+	// the root of the tree.  The key prefix is added at each level rather than walking up
+	// the prefixed keypath, because the prefix can itself contain separator bytes (for
+	// example, inside the version ID).
+	if len(absKeypath) > 0 {
+		treeRoot := &DBNode{tx: tx.tx, keyPrefix: tx.keyPrefix, diff: tx.diff}
+		partialKeypath := absKeypath.Parent()
+		for {
+			prefixedKeypath := tx.addKeyPrefix(partialKeypath)
+			item, err := tx.tx.Get(prefixedKeypath)
+			if err == badger.ErrKeyNotFound {
+				err = tx.tx.Set(prefixedKeypath, []byte("m"))
 				if err != nil {
 					return err
 				}
+			} else if err != nil {
+				return err
+			} else {
+				val, err := item.ValueCopy(nil)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if val[0] != 'm' {
+					// Values and slices are replaced (along with any slice elements) by a map
+					err = treeRoot.Delete(partialKeypath, nil)
+					if err != nil {
+						return err
+					}
+					err = tx.tx.Set(prefixedKeypath, []byte("m"))
+					if err != nil {
+						return err
+					}
+				}
 			}
-		}
-		if len(partialKeypath) == len(tx.keyPrefix)+len(tx.rootKeypath) {
-			break
-		}
-		partialKeypath, _ = partialKeypath.Pop()
-		if partialKeypath == nil {
-			partialKeypath = tx.addKeyPrefix(partialKeypath)
+
+			// Ancestors are changed by the Set, whether or not they already existed
+			tx.diff.Add(partialKeypath)
+
+			if len(partialKeypath) == 0 {
+				break
+			}
+			partialKeypath = partialKeypath.Parent()
 		}
 	}
 
@@ -747,8 +904,12 @@ func (tx *DBNode) Delete(keypathPrefix Keypath, rng *Range) error {
 			s := v.(string)
 			s = s[:startIdx] + s[endIdx:]
 
-			tx.diff.Remove(tx.rmKeyPrefix(keypathPrefix))
-			return tx.Set(keypathPrefix, nil, s)
+			encoded, err := encodeGoValue(s)
+			if err != nil {
+				return err
+			}
+			tx.diff.Add(tx.rmKeyPrefix(keypathPrefix))
+			return tx.tx.Set(keypathPrefix, encoded)
 		}
 
 		tx.diff.Remove(tx.rmKeyPrefix(keypathPrefix))
@@ -759,19 +920,26 @@ func (tx *DBNode) Delete(keypathPrefix Keypath, rng *Range) error {
 	var startKeypath Keypath
 	var endKeypathPrefix Keypath
 
-	if rootNodeType == NodeTypeMap {
-		if rng != nil {
-			return errors.WithStack(ErrRangeOverNonSlice)
+	if rootNodeType == NodeTypeMap && rng != nil {
+		return errors.WithStack(ErrRangeOverNonSlice)
+
+	} else if rng == nil {
+		// Delete the map or slice node itself here, and its descendants below.  Iterating
+		// over the node's bare keypath as a prefix would also catch siblings whose keys
+		// share it.
+		err := tx.tx.Delete(keypathPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "can't delete keypath %v", keypathPrefix)
 		}
-		startKeypath = keypathPrefix
+		tx.diff.Remove(tx.rmKeyPrefix(keypathPrefix))
 
-	} else if rootNodeType == NodeTypeSlice {
-		if rng != nil {
-			if !rng.ValidForLength(length) {
-				return errors.WithStack(ErrInvalidRange)
-			}
-			startIdx, endIdx = rng.IndicesForLength(length)
+		startKeypath = tx.descendantKeyPrefix(keypathPrefix)
+
+	} else {
+		if !rng.ValidForLength(length) {
+			return errors.WithStack(ErrInvalidRange)
 		}
+		startIdx, endIdx = rng.IndicesForLength(length)
 		startKeypath = keypathPrefix.PushIndex(startIdx)
 		endKeypathPrefix = keypathPrefix.PushIndex(endIdx)
 	}
@@ -784,16 +952,13 @@ func (tx *DBNode) Delete(keypathPrefix Keypath, rng *Range) error {
 		iter := tx.tx.NewIterator(opts)
 		defer iter.Close()
 
-		var validPrefix = startKeypath
-		for iter.Seek(startKeypath); iter.ValidForPrefix(validPrefix); iter.Next() {
-			absKeypath := Keypath(iter.Item().Key())
+		scanPrefix := tx.descendantKeyPrefix(keypathPrefix)
+		for iter.Seek(startKeypath); iter.ValidForPrefix(scanPrefix); iter.Next() {
+			absKeypath := Keypath(iter.Item().KeyCopy(nil))
 
-			// If we're ranging over a slice, and we find the first keypath of the final element,
-			// swap the keypath prefix the iterator is checking against (which WAS the root node
-			// keypath) with the keypath of the final element.  The iterator will then stop after
-			// the final keypath for that final element.
+			// If we're ranging over a slice, stop at the first element past the end of the range
 			if rng != nil && absKeypath.Equals(endKeypathPrefix) {
-				validPrefix = append(endKeypathPrefix, KeypathSeparator[0])
+				break
 			}
 
 			err := tx.tx.Delete(absKeypath)
@@ -816,7 +981,7 @@ func (tx *DBNode) Delete(keypathPrefix Keypath, rng *Range) error {
 
 		startKeypath := keypathPrefix.PushIndex(endIdx)
 		endKeypathPrefix := keypathPrefix.PushIndex(length)
-		validPrefix := keypathPrefix
+		validPrefix := tx.descendantKeyPrefix(keypathPrefix)
 		delta := -int64(rng.Size())
 		keypathLengthAsParent := len(tx.keyPrefix) + tx.rmKeyPrefix(keypathPrefix).LengthAsParent()
 
@@ -892,7 +1057,7 @@ func (tx *DBNode) CopyToMemory(keypath Keypath, rng *Range) (n Node, err error)
 	keypath = tx.addKeyPrefix(tx.rootKeypath.Push(keypath))
 
 	item, err := tx.tx.Get(keypath)
-	if err != nil && errors.Cause(err) == badger.ErrKeyNotFound {
+	if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
 		return nil, types.Err404
 	} else if err != nil {
 		return nil, err
@@ -978,7 +1143,7 @@ func (tx *DBNode) CopyToMemory(keypath Keypath, rng *Range) (n Node, err error)
 			// Transpose its indices so that they start from 0
 			if len(relKeypath) > 0 && rootNodeType == NodeTypeSlice {
 				relKeypath = relKeypath.Copy()
-				newIdx := uint64(int64(idx) - rng[0])
+				newIdx := uint64(int64(idx) - rng.Start())
 				copy(relKeypath[:8], EncodeSliceIndex(newIdx))
 			}
 		}
@@ -1007,11 +1172,13 @@ func (tx *DBNode) CopyToMemory(keypath Keypath, rng *Range) (n Node, err error)
 			return nil, err
 		}
 
+		// relKeypath is a fresh copy, so the memory node can keep it
 		newKeypaths = append(newKeypaths, relKeypath)
-		mNode.values[string(relKeypath)] = decoded
-		mNode.nodeTypes[string(relKeypath)] = nodeType
+		key := keypathString(relKeypath)
+		mNode.values[key] = decoded
+		mNode.nodeTypes[key] = nodeType
 		if nodeType == NodeTypeSlice {
-			mNode.sliceLengths[string(relKeypath)] = int(length)
+			mNode.sliceLengths[key] = int(length)
 		}
 	}
 	mNode.addKeypaths(newKeypaths)
@@ -1019,6 +1186,11 @@ func (tx *DBNode) CopyToMemory(keypath Keypath, rng *Range) (n Node, err error)
 	return mNode, nil
 }
 
+// CopyInto copies the node's subtree into dst at the given keypath (see CopyInto).
+func (tx *DBNode) CopyInto(dst Node, atKeypath Keypath) error {
+	return CopyInto(tx, dst, atKeypath)
+}
+
 func (tx *DBNode) DebugPrint() {
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchValues = true
@@ -1047,6 +1219,10 @@ func (tx *DBNode) DebugPrint() {
 	}
 }
 
+func (tx *DBNode) Dump() (string, error) {
+	return Dump(tx)
+}
+
 func (t *DBTree) CopyVersion(dstVersion, srcVersion types.ID) error {
 	return t.db.Update(func(tx *badger.Txn) error {
 		stream := t.db.NewStream()
@@ -1082,8 +1258,8 @@ func (t *DBTree) DebugPrint(keypathPrefix Keypath, rng *Range) ([]Keypath, []int
 		startKeypath := keypathPrefix
 		var endKeypath Keypath
 		if rng != nil {
-			startKeypath = keypathPrefix.PushIndex(uint64(rng[0]))
-			endKeypath = keypathPrefix.PushIndex(uint64(rng[1]))
+			startKeypath = keypathPrefix.PushIndex(uint64(rng.Start()))
+			endKeypath = keypathPrefix.PushIndex(uint64(rng.End()))
 		}
 
 		for iter.Seek(startKeypath); iter.ValidForPrefix(keypathPrefix); iter.Next() {
@@ -1133,7 +1309,7 @@ func (tx *DBNode) DepthFirstIterator(keypath Keypath, prefetchValues bool, prefe
 		scanPrefix: scanPrefix,
 		tx:         tx,
 		iterNode: &dbDepthFirstIteratorItem{
-			DBNode:     &DBNode{tx: tx.tx},
+			DBNode:     &DBNode{tx: tx.tx, keyPrefix: tx.keyPrefix},
 			badgerItem: nil,
 		},
 	}
@@ -1145,6 +1321,7 @@ type dbDepthFirstIterator struct {
 	scanPrefix Keypath
 	tx         *DBNode
 	iterNode   *dbDepthFirstIteratorItem
+	started    bool
 	done       bool
 }
 
@@ -1159,39 +1336,72 @@ type dbDepthFirstIteratorItem struct {
 	*DBNode
 }
 
+// Next returns the descendants of the iterator's keypath, deepest and last first, and then
+// the node at the keypath itself.  The returned node is reused by subsequent calls.
 func (iter *dbDepthFirstIterator) Next() Node {
-	iter.iter.Next()
-	if !iter.iter.ValidForPrefix(iter.scanPrefix) {
-		if !iter.done {
-			iter.done = true
+	if iter.done {
+		return nil
+	}
 
-			item, err := iter.tx.tx.Get(iter.absKeypath)
-			if err != nil {
-				// @@TODO: add an `err` field to the iterator?
-				return nil
-			}
+	// The iterator is already positioned at the first item by the initial Seek
+	if iter.started {
+		iter.iter.Next()
+	}
+	iter.started = true
 
-			iter.iterNode.rootKeypath = item.KeyCopy(iter.iterNode.rootKeypath)
-			iter.iterNode.badgerItem = item
-			return iter.iterNode
+	// When iterating from the root, the scan prefix also matches the root node, which is
+	// returned below like any other starting node
+	if iter.iter.ValidForPrefix(iter.scanPrefix) && !Keypath(iter.iter.Item().Key()).Equals(iter.absKeypath) {
+		iter.setItem(iter.iter.Item())
+		return iter.iterNode
+	}
 
-		} else {
-			return nil
-		}
+	iter.done = true
+
+	item, err := iter.tx.tx.Get(iter.absKeypath)
+	if err != nil {
+		// @@TODO: add an `err` field to the iterator?
+		return nil
 	}
+	iter.setItem(item)
+	return iter.iterNode
+}
 
-	item := iter.iter.Item()
-	iter.iterNode.rootKeypath = item.KeyCopy(iter.iterNode.rootKeypath)
+func (iter *dbDepthFirstIterator) setItem(item *badger.Item) {
+	iter.iterNode.rootKeypath = iter.tx.rmKeyPrefix(item.KeyCopy(nil))
 	iter.iterNode.badgerItem = item
-	return iter.iterNode
 }
 
 func (iter *dbDepthFirstIterator) Close() {
 	iter.iter.Close()
 }
 
+// Indexer returns the components of the index key under which a node should be stored.
+// A single component gives a one-dimensional index.  Multiple components give a compound
+// index (see EncodeIndexKey).  Returning no components leaves the node unindexed.
 type Indexer interface {
-	IndexKeyForNode(node Node) (Keypath, error)
+	IndexKeyForNode(node Node) ([]Keypath, error)
+}
+
+var ErrInvalidIndexKey = errors.New("invalid index key")
+
+// EncodeIndexKey encodes the components of an index key as a keypath with one part per
+// component.  Compound indexes are therefore laid out as nested maps:
+//
+//	<component 1>/<component 2>/.../<key of indexed node>
+//
+// ...so that querying the index with the first N components of a key returns every entry
+// sharing that prefix, and querying it with every component returns the exact matches.
+// Components must be non-empty and must not contain the keypath separator.
+func EncodeIndexKey(components []Keypath) (Keypath, error) {
+	for _, c := range components {
+		if len(c) == 0 {
+			return nil, errors.Wrap(ErrInvalidIndexKey, "empty component")
+		} else if c.ContainsSeparator() {
+			return nil, errors.Wrapf(ErrInvalidIndexKey, "component '%v' contains the keypath separator", c)
+		}
+	}
+	return JoinKeypaths(components, KeypathSeparator), nil
 }
 
 func (t *DBTree) BuildIndex(version *types.ID, node *DBNode, indexName Keypath, indexer Indexer) (err error) {
@@ -1217,6 +1427,7 @@ func (t *DBTree) BuildIndex(version *types.ID, node *DBNode, indexName Keypath,
 	}
 
 	var indexKey Keypath
+	var unindexed bool
 	children := make(map[string]map[string]struct{})
 	for iter.Seek(startKeypath); iter.ValidForPrefix(startKeypath); iter.Next() {
 		item := iter.Item()
@@ -1224,21 +1435,34 @@ func (t *DBTree) BuildIndex(version *types.ID, node *DBNode, indexName Keypath,
 		relKeypath := node.rmKeyPrefix(absKeypath).RelativeTo(node.Keypath())
 
 		newRelKeypath := relKeypath.Copy()
-		if absKeypath.NumParts() == node.Keypath().NumParts()+1 {
+		// (Count the parts of the unprefixed keypath, since the version in the key prefix
+		// can contain separator bytes)
+		if relKeypath.NumParts() == 1 {
 			iterNode.DBNode = node.AtKeypath(relKeypath, nil).(*DBNode)
 
-			var err error
-			indexKey, err = indexer.IndexKeyForNode(iterNode)
+			components, err := indexer.IndexKeyForNode(iterNode)
+			if err != nil {
+				return err
+			}
+			indexKey, err = EncodeIndexKey(components)
 			if err != nil {
 				return err
 			}
 
 			iter.Seek(absKeypath)
 
+			// Children without an index key (and their descendants) are left out
+			unindexed = len(components) == 0
+			if unindexed {
+				continue
+			}
+
 			if _, exists := children[string(indexKey)]; !exists {
 				children[string(indexKey)] = make(map[string]struct{})
 			}
 			children[string(indexKey)][string(relKeypath.Part(0))] = struct{}{}
+		} else if unindexed {
+			continue
 		}
 
 		// If it's a slice, we have to renumber its children
@@ -1272,7 +1496,8 @@ func (t *DBTree) BuildIndex(version *types.ID, node *DBNode, indexName Keypath,
 		}
 	}
 
-	// Set the root value of the index to a NodeTypeMap
+	// Set the root value of the index, as well as the intermediate levels of any compound
+	// index keys, to a NodeTypeMap
 	encoded, err := encodeNode(NodeTypeMap, 0, 0, nil)
 	if err != nil {
 		return err
@@ -1281,10 +1506,117 @@ func (t *DBTree) BuildIndex(version *types.ID, node *DBNode, indexName Keypath,
 	if err != nil {
 		return err
 	}
+	for indexKey := range children {
+		prefix, _ := Keypath(indexKey).Pop()
+		for ; len(prefix) > 0; prefix, _ = prefix.Pop() {
+			err = index.tx.Set(index.addKeyPrefix(prefix), encoded)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	return index.Save()
 }
 
+// UpdateIndex incrementally updates an index previously built with BuildIndex over a map
+// node.  Each of the given children of the indexed node is removed from the index using the
+// index key it had in oldNode, and is then re-added using its index key in newNode (unless
+// it no longer exists there).  Index buckets left empty are removed.
+func (t *DBTree) UpdateIndex(version *types.ID, oldNode, newNode *DBNode, indexName Keypath, indexer Indexer, childKeys []Keypath) (err error) {
+	defer annotate(&err, "UpdateIndex")
+
+	index := t.IndexAtVersion(version, newNode.Keypath(), indexName, true)
+	defer index.Close()
+
+	for _, childKey := range childKeys {
+		oldIndexKey, exists, err := indexKeyForChild(oldNode, childKey, indexer)
+		if err != nil {
+			return err
+		} else if exists {
+			err = index.Delete(oldIndexKey.Push(childKey), nil)
+			if err != nil {
+				return err
+			}
+
+			for bucket := oldIndexKey; len(bucket) > 0; bucket, _ = bucket.Pop() {
+				if len(index.AtKeypath(bucket, nil).Subkeys()) > 0 {
+					break
+				}
+				err = index.Delete(bucket, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		newIndexKey, exists, err := indexKeyForChild(newNode, childKey, indexer)
+		if err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		val, exists, err := newNode.Value(childKey, nil)
+		if err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		err = index.Set(newIndexKey.Push(childKey), nil, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	return index.Save()
+}
+
+func indexKeyForChild(node *DBNode, childKey Keypath, indexer Indexer) (Keypath, bool, error) {
+	child := node.AtKeypath(childKey, nil)
+	exists, err := child.Exists(nil)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	components, err := indexer.IndexKeyForNode(child)
+	if err != nil {
+		return nil, false, err
+	} else if len(components) == 0 {
+		return nil, false, nil
+	}
+	indexKey, err := EncodeIndexKey(components)
+	if err != nil {
+		return nil, false, err
+	}
+	return indexKey, true, nil
+}
+
+// DeleteIndex deletes an index so that it can be rebuilt from scratch.
+func (t *DBTree) DeleteIndex(version *types.ID, keypath Keypath, indexName Keypath) error {
+	if version == nil {
+		version = &CurrentVersion
+	}
+
+	txn := t.db.NewTransaction(true)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	prefix := t.makeIndexKeyPrefix(*version, keypath, indexName)
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		err := txn.Delete(iter.Item().KeyCopy(nil))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	iter.Close()
+
+	return errors.WithStack(txn.Commit())
+}
+
 type dbNodeWithIterator struct {
 	*DBNode
 	iter *badger.Iterator
@@ -1,12 +1,15 @@
 package tree
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	"github.com/brynbellomy/redwood/types"
@@ -558,3 +561,411 @@ func prettyJSON(x interface{}) string {
 	j, _ := json.MarshalIndent(x, "", "    ")
 	return string(j)
 }
+
+type senderTimestampIndexer struct{}
+
+func (senderTimestampIndexer) IndexKeyForNode(node Node) ([]Keypath, error) {
+	sender, _, err := node.StringValue(Keypath("sender"))
+	if err != nil {
+		return nil, err
+	}
+	timestamp, _, err := node.StringValue(Keypath("timestamp"))
+	if err != nil {
+		return nil, err
+	}
+	return []Keypath{Keypath(sender), Keypath(timestamp)}, nil
+}
+
+func TestDBTree_BuildIndex_Compound(T *testing.T) {
+	T.Parallel()
+
+	i := rand.Int()
+	tree, err := NewDBTree(fmt.Sprintf("/tmp/tree-badger-test-%v", i))
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	v := types.RandomID()
+
+	msg1 := M{"sender": "alice", "timestamp": "100", "text": "hi"}
+	msg2 := M{"sender": "bob", "timestamp": "100", "text": "hey"}
+	msg3 := M{"sender": "alice", "timestamp": "200", "text": "sup"}
+
+	err = tree.Update(&v, func(tx *DBNode) error {
+		err := tx.Set(Keypath("messages"), nil, M{"m1": msg1, "m2": msg2, "m3": msg3})
+		require.NoError(T, err)
+		return nil
+	})
+	require.NoError(T, err)
+
+	node := tree.StateAtVersion(&v, false).AtKeypath(Keypath("messages"), nil).(*DBNode)
+	err = tree.BuildIndex(&v, node, Keypath("sender-time"), senderTimestampIndexer{})
+	node.Close()
+	require.NoError(T, err)
+
+	index := tree.IndexAtVersion(&v, Keypath("messages"), Keypath("sender-time"), false)
+	defer index.Close()
+
+	// Query by the first part of the key
+	val, exists, err := index.Value(Keypath("alice"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{
+		"100": M{"m1": msg1},
+		"200": M{"m3": msg3},
+	}, val)
+
+	// Query by the full key
+	val, exists, err = index.Value(Keypath("alice/200"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"m3": msg3}, val)
+
+	val, exists, err = index.Value(Keypath("bob/100"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"m2": msg2}, val)
+
+	exists, err = index.Exists(Keypath("bob/200"))
+	require.NoError(T, err)
+	require.False(T, exists)
+}
+
+func TestDBTree_VersionContainingSeparator(T *testing.T) {
+	T.Parallel()
+
+	i := rand.Int()
+	tree, err := NewDBTree(fmt.Sprintf("/tmp/tree-badger-test-%v", i))
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	// Versions are random bytes, so they sometimes contain the keypath separator
+	v := types.RandomID()
+	v[3] = KeypathSeparator[0]
+	v[20] = KeypathSeparator[0]
+
+	msg1 := M{"sender": "alice", "timestamp": "100", "text": "hi"}
+	msg2 := M{"sender": "bob", "timestamp": "100", "text": "hey"}
+
+	err = tree.Update(&v, func(tx *DBNode) error {
+		err := tx.Set(Keypath("foo/messages"), nil, M{"m1": msg1, "m2": msg2})
+		require.NoError(T, err)
+		return nil
+	})
+	require.NoError(T, err)
+
+	// Every key that was written belongs to the version
+	keypaths, _, err := tree.DebugPrint(nil, nil)
+	require.NoError(T, err)
+	for _, kp := range keypaths {
+		require.True(T, bytes.HasPrefix(kp, tree.makeStateKeyPrefix(v)), "stray key %v", kp)
+	}
+
+	node := tree.StateAtVersion(&v, false).AtKeypath(Keypath("foo/messages"), nil).(*DBNode)
+	err = tree.BuildIndex(&v, node, Keypath("sender-time"), senderTimestampIndexer{})
+	node.Close()
+	require.NoError(T, err)
+
+	index := tree.IndexAtVersion(&v, Keypath("foo/messages"), Keypath("sender-time"), false)
+	defer index.Close()
+
+	val, exists, err := index.Value(Keypath("alice"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"100": M{"m1": msg1}}, val)
+}
+
+func TestEncodeIndexKey(T *testing.T) {
+	key, err := EncodeIndexKey([]Keypath{Keypath("alice"), Keypath("100")})
+	require.NoError(T, err)
+	require.Equal(T, Keypath("alice/100"), key)
+
+	key, err = EncodeIndexKey(nil)
+	require.NoError(T, err)
+	require.Nil(T, key)
+
+	_, err = EncodeIndexKey([]Keypath{Keypath("a/b")})
+	require.Equal(T, ErrInvalidIndexKey, errors.Cause(err))
+
+	_, err = EncodeIndexKey([]Keypath{Keypath("a"), nil})
+	require.Equal(T, ErrInvalidIndexKey, errors.Cause(err))
+}
+
+func TestDBTree_UpdateIndex(T *testing.T) {
+	T.Parallel()
+
+	i := rand.Int()
+	tree, err := NewDBTree(fmt.Sprintf("/tmp/tree-badger-test-%v", i))
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	msg1 := M{"sender": "alice", "timestamp": "100"}
+	msg10 := M{"sender": "alice", "timestamp": "100"}
+	msg2 := M{"sender": "bob", "timestamp": "100"}
+	msg3 := M{"sender": "carol", "timestamp": "300"}
+
+	err = tree.Update(nil, func(tx *DBNode) error {
+		err := tx.Set(Keypath("messages"), nil, M{"m1": msg1, "m10": msg10, "m2": msg2})
+		require.NoError(T, err)
+		return nil
+	})
+	require.NoError(T, err)
+
+	node := tree.StateAtVersion(nil, false).AtKeypath(Keypath("messages"), nil).(*DBNode)
+	err = tree.BuildIndex(nil, node, Keypath("sender-time"), senderTimestampIndexer{})
+	node.Close()
+	require.NoError(T, err)
+
+	// Delete m1 and m2, and add m3
+	oldState := tree.StateAtVersion(nil, false)
+	defer oldState.Close()
+
+	err = tree.Update(nil, func(tx *DBNode) error {
+		err := tx.Delete(Keypath("messages/m1"), nil)
+		require.NoError(T, err)
+		err = tx.Delete(Keypath("messages/m2"), nil)
+		require.NoError(T, err)
+		err = tx.Set(Keypath("messages/m3"), nil, msg3)
+		require.NoError(T, err)
+		return nil
+	})
+	require.NoError(T, err)
+
+	newState := tree.StateAtVersion(nil, false)
+	defer newState.Close()
+
+	err = tree.UpdateIndex(nil,
+		oldState.AtKeypath(Keypath("messages"), nil).(*DBNode),
+		newState.AtKeypath(Keypath("messages"), nil).(*DBNode),
+		Keypath("sender-time"),
+		senderTimestampIndexer{},
+		[]Keypath{Keypath("m1"), Keypath("m2"), Keypath("m3")},
+	)
+	require.NoError(T, err)
+
+	index := tree.IndexAtVersion(nil, Keypath("messages"), Keypath("sender-time"), false)
+	defer index.Close()
+
+	// Deleting m1 must not take its sibling m10 with it
+	val, exists, err := index.Value(Keypath("alice"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"100": M{"m10": msg10}}, val)
+
+	// bob's bucket is empty, so it's gone
+	exists, err = index.Exists(Keypath("bob"))
+	require.NoError(T, err)
+	require.False(T, exists)
+
+	val, exists, err = index.Value(Keypath("carol/300"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"m3": msg3}, val)
+}
+
+func TestDBNode_SubkeysAfter(T *testing.T) {
+	T.Parallel()
+
+	i := rand.Int()
+	tree, err := NewDBTree(fmt.Sprintf("/tmp/tree-badger-test-%v", i))
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	// "m1!" sorts between "m1" and the descendants of "m1"
+	err = tree.Update(nil, func(tx *DBNode) error {
+		err := tx.Set(Keypath("foo"), nil, M{
+			"m1":  M{"a": "x", "b": "y"},
+			"m1!": "z",
+			"m10": M{"a": "x"},
+			"m2":  "w",
+		})
+		require.NoError(T, err)
+		return nil
+	})
+	require.NoError(T, err)
+
+	node := tree.StateAtVersion(nil, false).AtKeypath(Keypath("foo"), nil).(*DBNode)
+	defer node.Close()
+
+	subkeys, hasMore := node.SubkeysAfter(nil, 2)
+	require.Equal(T, []Keypath{Keypath("m1"), Keypath("m1!")}, subkeys)
+	require.True(T, hasMore)
+
+	subkeys, hasMore = node.SubkeysAfter(Keypath("m1!"), 2)
+	require.Equal(T, []Keypath{Keypath("m10"), Keypath("m2")}, subkeys)
+	require.False(T, hasMore)
+
+	subkeys, hasMore = node.SubkeysAfter(Keypath("m2"), 2)
+	require.Empty(T, subkeys)
+	require.False(T, hasMore)
+}
+
+func TestNode_Dump(T *testing.T) {
+	T.Parallel()
+
+	val := M{
+		"name":    "redwood",
+		"enabled": true,
+		"nothing": nil,
+		"ratio":   float64(0.5),
+		"items": []interface{}{
+			"first",
+			M{"z": float64(26), "a": float64(1)},
+			[]interface{}{false},
+		},
+		"nested": M{"b": M{"c": "deep"}},
+	}
+
+	expected := `.: Map
+  enabled: Bool true
+  items: Slice (3)
+    [0]: String "first"
+    [1]: Map
+      a: Float 1
+      z: Float 26
+    [2]: Slice (1)
+      [0]: Bool false
+  name: String "redwood"
+  nested: Map
+    b: Map
+      c: String "deep"
+  nothing: Nil null
+  ratio: Float 0.5
+`
+
+	memNode := NewMemoryNode()
+	err := memNode.Set(nil, nil, val)
+	require.NoError(T, err)
+
+	dump, err := memNode.Dump()
+	require.NoError(T, err)
+	require.Equal(T, expected, dump)
+
+	i := rand.Int()
+	tree, err := NewDBTree(fmt.Sprintf("/tmp/tree-badger-test-%v", i))
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	err = tree.Update(nil, func(tx *DBNode) error {
+		return tx.Set(Keypath("foo"), nil, val)
+	})
+	require.NoError(T, err)
+
+	dbNode := tree.StateAtVersion(nil, false)
+	defer dbNode.Close()
+
+	dump, err = dbNode.AtKeypath(Keypath("foo"), nil).Dump()
+	require.NoError(T, err)
+	require.Equal(T, "foo"+expected[1:], dump)
+
+	// Subtrees are dumped the same way regardless of where they're rooted
+	dump, err = memNode.AtKeypath(Keypath("nested"), nil).Dump()
+	require.NoError(T, err)
+	require.Equal(T, "nested: Map\n  b: Map\n    c: String \"deep\"\n", dump)
+
+	_, err = memNode.AtKeypath(Keypath("missing"), nil).Dump()
+	require.Error(T, err)
+}
+
+func TestNode_CopyInto(T *testing.T) {
+	T.Parallel()
+
+	src := NewMemoryNode()
+	err := src.Set(nil, nil, M{
+		"proto": M{
+			"title": "untitled",
+			"tags":  []interface{}{"a", M{"b": "c"}},
+		},
+	})
+	require.NoError(T, err)
+
+	for _, backend := range conformanceBackends {
+		backend := backend
+		T.Run(backend.name, func(T *testing.T) {
+			dst, cleanup := backend.newNode(T)
+			defer cleanup()
+
+			err := dst.Set(nil, nil, M{
+				"existing": M{"title": "old", "stale": "x"},
+				"keep":     "me",
+			})
+			require.NoError(T, err)
+			dst.ResetDiff()
+
+			// Graft a map subtree over an existing one
+			err = src.AtKeypath(Keypath("proto"), nil).CopyInto(dst, Keypath("existing"))
+			require.NoError(T, err)
+
+			val, exists, err := dst.Value(Keypath("existing"), nil)
+			require.NoError(T, err)
+			require.True(T, exists)
+			require.Equal(T, M{"title": "untitled", "tags": []interface{}{"a", M{"b": "c"}}}, val)
+
+			require.Contains(T, dst.Diff().Added, "existing/title")
+			require.Contains(T, dst.Diff().Added, string(Keypath("existing/tags").PushIndex(1).Push(Keypath("b"))))
+			require.Contains(T, dst.Diff().Removed, "existing/stale")
+
+			// Graft a slice subtree
+			err = src.AtKeypath(Keypath("proto/tags"), nil).CopyInto(dst, Keypath("list"))
+			require.NoError(T, err)
+
+			nodeType, _, length, err := dst.AtKeypath(Keypath("list"), nil).NodeInfo()
+			require.NoError(T, err)
+			require.Equal(T, NodeTypeSlice, nodeType)
+			require.Equal(T, uint64(2), length)
+
+			val, _, err = dst.Value(nil, nil)
+			require.NoError(T, err)
+			require.Equal(T, M{
+				"existing": M{"title": "untitled", "tags": []interface{}{"a", M{"b": "c"}}},
+				"list":     []interface{}{"a", M{"b": "c"}},
+				"keep":     "me",
+			}, val)
+
+			// Copy into the root, replacing everything
+			err = src.CopyInto(dst, nil)
+			require.NoError(T, err)
+
+			val, _, err = dst.Value(nil, nil)
+			require.NoError(T, err)
+			require.Equal(T, M{"proto": M{"title": "untitled", "tags": []interface{}{"a", M{"b": "c"}}}}, val)
+
+			// The source must exist
+			err = src.AtKeypath(Keypath("missing"), nil).CopyInto(dst, Keypath("x"))
+			require.Equal(T, types.Err404, errors.Cause(err))
+		})
+	}
+}
+
+func TestDBTree_CollectValueLogGarbage(T *testing.T) {
+	T.Parallel()
+
+	i := rand.Int()
+	tree, err := NewDBTreeWithOptions(fmt.Sprintf("/tmp/tree-badger-test-%v", i), DBTreeOptions{ValueLogFileSize: 1 << 20})
+	require.NoError(T, err)
+	defer tree.DeleteDB()
+
+	// Overwrite the same values over and over, so that most of the value log is garbage
+	big := strings.Repeat("x", 64*1024)
+	for j := 0; j < 100; j++ {
+		err = tree.Update(nil, func(tx *DBNode) error {
+			return tx.Set(Keypath("foo"), nil, fmt.Sprintf("%v-%v", j, big))
+		})
+		require.NoError(T, err)
+	}
+
+	_, err = tree.CollectValueLogGarbage(0)
+	require.NoError(T, err)
+
+	val, exists, err := tree.Value(nil, Keypath("foo"), nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, "99-"+big, val)
+
+	// In-memory DBs have no value log to collect
+	memTree, err := NewDBTreeWithOptions("", DBTreeOptions{InMemory: true})
+	require.NoError(T, err)
+	defer memTree.DeleteDB()
+	rewritten, err := memTree.CollectValueLogGarbage(0)
+	require.NoError(T, err)
+	require.Zero(T, rewritten)
+}
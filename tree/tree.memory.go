@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"unsafe"
 
 	"github.com/pkg/errors"
 
 	"github.com/brynbellomy/redwood/types"
 )
 
+// MemoryNode stores each of its nodes under the node's absolute keypath.  Every keypath
+// is allocated once and then shared by keypaths and by the keys of the maps (see
+// internKeypath), so those keypaths must never be modified in place.
 type MemoryNode struct {
 	keypath Keypath
 	rng     *Range
@@ -75,6 +79,11 @@ func (t *MemoryNode) CopyToMemory(keypath Keypath, rng *Range) (Node, error) {
 	return cpy, nil
 }
 
+// CopyInto copies the node's subtree into dst at the given keypath (see CopyInto).
+func (t *MemoryNode) CopyInto(dst Node, atKeypath Keypath) error {
+	return CopyInto(t, dst, atKeypath)
+}
+
 func (t *MemoryNode) checkCopied() {
 	if !t.copied {
 		return
@@ -93,18 +102,24 @@ func (t *MemoryNode) makeCopy() {
 		end = 0
 	}
 
-	keypaths := make([]Keypath, end-start)
+	keypaths := make([]Keypath, 0, end-start)
 	values := make(map[string]interface{}, end-start)
 	nodeTypes := make(map[string]NodeType, end-start)
 	sliceLengths := make(map[string]int)
 
-	copy(keypaths, t.keypaths[start:end])
-
-	for _, kp := range keypaths {
-		values[string(kp)] = t.values[string(kp)]
-		nodeTypes[string(kp)] = t.nodeTypes[string(kp)]
-		if nodeTypes[string(kp)] == NodeTypeSlice {
-			sliceLengths[string(kp)] = t.sliceLengths[string(kp)]
+	for _, kp := range t.keypaths[start:end] {
+		if !kp.StartsWith(t.keypath) {
+			continue
+		}
+		keypaths = append(keypaths, kp)
+
+		key := keypathString(kp)
+		nodeType := t.nodeTypes[key]
+		nodeTypes[key] = nodeType
+		if nodeType == NodeTypeSlice {
+			sliceLengths[key] = t.sliceLengths[key]
+		} else if val, exists := t.values[key]; exists {
+			values[key] = val
 		}
 	}
 
@@ -181,7 +196,11 @@ func (t *MemoryNode) NodeInfo() (NodeType, ValueType, uint64, error) {
 }
 
 func (t *MemoryNode) Exists(keypath Keypath) (bool, error) {
-	_, exists := t.values[string(t.keypath.Push(keypath))]
+	absKeypath := string(t.keypath.Push(keypath))
+	if _, exists := t.values[absKeypath]; exists {
+		return true, nil
+	}
+	_, exists := t.nodeTypes[absKeypath]
 	return exists, nil
 }
 
@@ -273,6 +292,8 @@ func (t *MemoryNode) Value(keypath Keypath, rng *Range) (interface{}, bool, erro
 
 			if len(relKp) != 0 {
 				switch t.nodeTypes[string(kp)] {
+				case NodeTypeMap:
+					setValueAtKeypath(m, relKp, make(map[string]interface{}), false)
 				case NodeTypeSlice:
 					setValueAtKeypath(m, relKp, make([]interface{}, t.sliceLengths[string(kp)]), false)
 				default:
@@ -284,13 +305,31 @@ func (t *MemoryNode) Value(keypath Keypath, rng *Range) (interface{}, bool, erro
 		return m, true, nil
 
 	case NodeTypeSlice:
-		s := make([]interface{}, t.sliceLengths[string(absKeypath)])
+		length := uint64(t.sliceLengths[string(absKeypath)])
+		var startIdx uint64
+		if rng != nil {
+			if !rng.ValidForLength(length) {
+				return nil, false, errors.WithStack(ErrInvalidRange)
+			}
+			var endIdx uint64
+			startIdx, endIdx = rng.IndicesForLength(length)
+			length = endIdx - startIdx
+		}
+		s := make([]interface{}, length)
 
 		t.scanKeypathsWithPrefix(absKeypath, rng, func(kp Keypath, _ int) error {
 			relKp := kp.RelativeTo(absKeypath)
 
+			// If we're ranging over the slice, transpose its indices to start from 0
+			if len(relKp) != 0 && startIdx > 0 {
+				relKp = relKp.Copy()
+				copy(relKp[:8], EncodeSliceIndex(DecodeSliceIndex(relKp[:8])-startIdx))
+			}
+
 			if len(relKp) != 0 {
 				switch t.nodeTypes[string(kp)] {
+				case NodeTypeMap:
+					setValueAtKeypath(s, relKp, make(map[string]interface{}), false)
 				case NodeTypeSlice:
 					setValueAtKeypath(s, relKp, make([]interface{}, t.sliceLengths[string(kp)]), false)
 				default:
@@ -325,6 +364,33 @@ func (n *MemoryNode) ContentLength() (int64, error) {
 }
 
 func (t *MemoryNode) Set(keypath Keypath, rng *Range, value interface{}) error {
+	var newKeypaths []Keypath
+	err := t.set(keypath, rng, value, &newKeypaths)
+	if err != nil {
+		return err
+	}
+	t.addKeypaths(newKeypaths)
+	return nil
+}
+
+// SetMany is equivalent to calling Set with each of the patches in turn, but only sorts
+// the node's keypaths once at the end (unless a patch overwrites part of the tree).
+func (t *MemoryNode) SetMany(patches []Patch) error {
+	var newKeypaths []Keypath
+	for _, patch := range patches {
+		err := t.set(patch.Keypath, patch.Range, patch.Val, &newKeypaths)
+		if err != nil {
+			return err
+		}
+	}
+	t.addKeypaths(newKeypaths)
+	return nil
+}
+
+// set stores the value without sorting its keypaths into t.keypaths.  Instead, they're
+// appended to pending, which is only flushed when something has to be deleted (because
+// Delete relies on t.keypaths being complete).
+func (t *MemoryNode) set(keypath Keypath, rng *Range, value interface{}, pending *[]Keypath) error {
 	// @@TODO: handle range
 	if rng != nil {
 		panic("unsupported")
@@ -332,13 +398,17 @@ func (t *MemoryNode) Set(keypath Keypath, rng *Range, value interface{}) error {
 
 	t.checkCopied()
 
+	absKeypath := t.keypath.Push(keypath)
+
+	if t.nodeTypes[string(absKeypath)] != NodeTypeInvalid {
+		t.flushKeypaths(pending)
+	}
 	err := t.Delete(keypath, rng)
 	if err != nil {
 		return err
 	}
 
-	absKeypath := t.keypath.Push(keypath)
-	var newKeypaths []Keypath
+	var newKeypaths, changedKeypaths []Keypath
 
 	// Set value types for intermediate keypaths in case they don't exist
 	{
@@ -354,17 +424,23 @@ func (t *MemoryNode) Set(keypath Keypath, rng *Range, value interface{}) error {
 			}
 
 			nt := t.nodeTypes[string(partialKeypath)]
-			if nt == NodeTypeInvalid {
-				t.nodeTypes[string(partialKeypath)] = NodeTypeMap
+			if nt == NodeTypeMap {
+				// Already stored, so it only needs to show up in the diff
+				partialKeypath, _ = t.internKeypath(partialKeypath, false)
+				changedKeypaths = append(changedKeypaths, partialKeypath)
 
-			} else if nt != NodeTypeMap {
-				err := t.Delete(partialKeypath.RelativeTo(keypath), nil)
-				if err != nil {
-					return err
+			} else {
+				if nt != NodeTypeInvalid {
+					t.flushKeypaths(pending)
+					err := t.Delete(partialKeypath.RelativeTo(t.keypath), nil)
+					if err != nil {
+						return err
+					}
 				}
-				t.nodeTypes[string(partialKeypath)] = NodeTypeMap
+				partialKeypath, key := t.internKeypath(partialKeypath, false)
+				t.nodeTypes[key] = NodeTypeMap
+				newKeypaths = append(newKeypaths, partialKeypath)
 			}
-			newKeypaths = append(newKeypaths, partialKeypath)
 
 			if i != 0 {
 				// Only account for the keypath separator after the root (nil) keypath
@@ -373,29 +449,36 @@ func (t *MemoryNode) Set(keypath Keypath, rng *Range, value interface{}) error {
 		}
 	}
 
-	walkGoValue(value, func(nodeKeypath Keypath, nodeValue interface{}) error {
-		absNodeKeypath := absKeypath.Push(nodeKeypath)
+	walkGoValueFrom(absKeypath, value, func(nodeKeypath Keypath, nodeValue interface{}) error {
+		// Only the root keypath might belong to the caller
+		absNodeKeypath, key := t.internKeypath(nodeKeypath, len(nodeKeypath) > len(absKeypath))
 		newKeypaths = append(newKeypaths, absNodeKeypath)
 
 		switch nv := nodeValue.(type) {
 		case map[string]interface{}:
-			t.nodeTypes[string(absNodeKeypath)] = NodeTypeMap
+			t.nodeTypes[key] = NodeTypeMap
 		case []interface{}:
-			t.nodeTypes[string(absNodeKeypath)] = NodeTypeSlice
-			t.sliceLengths[string(absNodeKeypath)] = len(nv)
+			t.nodeTypes[key] = NodeTypeSlice
+			t.sliceLengths[key] = len(nv)
 		default:
-			t.nodeTypes[string(absNodeKeypath)] = NodeTypeValue
-			t.values[string(absNodeKeypath)] = nodeValue
+			t.nodeTypes[key] = NodeTypeValue
+			t.values[key] = nodeValue
 		}
 		return nil
 	})
 
+	t.diff.AddMany(changedKeypaths)
 	t.diff.AddMany(newKeypaths)
-	t.addKeypaths(newKeypaths)
+	*pending = append(*pending, newKeypaths...)
 
 	return nil
 }
 
+func (t *MemoryNode) flushKeypaths(pending *[]Keypath) {
+	t.addKeypaths(*pending)
+	*pending = nil
+}
+
 func (n *MemoryNode) Delete(keypath Keypath, rng *Range) error {
 	if rng == nil {
 		rng = n.rng
@@ -417,16 +500,22 @@ func (n *MemoryNode) Delete(keypath Keypath, rng *Range) error {
 			return ErrInvalidRange
 		}
 
-		switch n.nodeTypes[string(absKeypath)] {
+		internedKeypath, key := n.internKeypath(absKeypath, false)
+
+		switch n.nodeTypes[key] {
 		case NodeTypeSlice:
-			n.sliceLengths[string(absKeypath)] -= int(rng.Size())
+			// The elements are deleted and the trailing ones re-numbered below
+			if !rng.ValidForLength(uint64(n.sliceLengths[key])) {
+				return ErrInvalidRange
+			}
 		case NodeTypeValue:
-			if s, isString := n.values[string(absKeypath)].(string); isString {
+			if s, isString := n.values[key].(string); isString {
 				if !rng.ValidForLength(uint64(len(s))) {
 					return ErrInvalidRange
 				}
 				startIdx, endIdx := rng.IndicesForLength(uint64(len(s)))
-				n.values[string(absKeypath)] = s[:startIdx] + s[endIdx:]
+				n.values[key] = s[:startIdx] + s[endIdx:]
+				n.diff.Add(internedKeypath)
 				return nil
 
 			} else {
@@ -438,27 +527,75 @@ func (n *MemoryNode) Delete(keypath Keypath, rng *Range) error {
 		}
 	}
 
-	startIdx := -1
-	stopIdx := -1
+	var deletedKeypaths []Keypath
+	var deletedIdxs []int
 	n.scanKeypathsWithPrefix(absKeypath, rng, func(keypath Keypath, i int) error {
-		if startIdx == -1 {
-			startIdx = i
-		}
-		stopIdx = i
+		deletedKeypaths = append(deletedKeypaths, keypath)
+		deletedIdxs = append(deletedIdxs, i)
 		delete(n.values, string(keypath))
 		delete(n.nodeTypes, string(keypath))
 		delete(n.sliceLengths, string(keypath))
 		return nil
 	})
-	var deletedKeypaths []Keypath
-	if startIdx > -1 {
-		deletedKeypaths = append(deletedKeypaths, n.keypaths[startIdx:stopIdx+1]...)
-		n.keypaths = append(n.keypaths[:startIdx], n.keypaths[stopIdx+1:]...)
+	if len(deletedIdxs) > 0 {
+		// The deleted keypaths aren't necessarily contiguous, because siblings whose keys
+		// share the deleted node's key as a prefix (e.g. "foo!" for "foo") can sort among
+		// its descendants
+		keypaths := n.keypaths[:deletedIdxs[0]]
+		for j, idx := range deletedIdxs {
+			next := len(n.keypaths)
+			if j+1 < len(deletedIdxs) {
+				next = deletedIdxs[j+1]
+			}
+			keypaths = append(keypaths, n.keypaths[idx+1:next]...)
+		}
+		n.keypaths = keypaths
+	}
+	if rng != nil {
+		n.renumberSliceElements(absKeypath, rng)
 	}
 	n.diff.RemoveMany(deletedKeypaths)
 	return nil
 }
 
+// renumberSliceElements closes the gap left by deleting the given range of the slice's
+// elements, by shifting the elements that followed it (and their descendants) down.
+func (n *MemoryNode) renumberSliceElements(sliceKeypath Keypath, rng *Range) {
+	key := string(sliceKeypath)
+	_, endIdx := rng.IndicesForLength(uint64(n.sliceLengths[key]))
+	delta := rng.Size()
+	idxOffset := sliceKeypath.LengthAsParent()
+
+	// Moving the elements in ascending order means that each one's new keypath has
+	// already been vacated.  Their order relative to every other keypath is unchanged.
+	for i, kp := range n.keypaths {
+		if !kp.StartsWith(sliceKeypath) || len(kp) == len(sliceKeypath) {
+			continue
+		}
+		idx := DecodeSliceIndex(kp[idxOffset : idxOffset+8])
+		if idx < endIdx {
+			continue
+		}
+
+		newKp := kp.Copy()
+		copy(newKp[idxOffset:idxOffset+8], EncodeSliceIndex(idx-delta))
+		oldKey, newKey := string(kp), keypathString(newKp)
+
+		n.nodeTypes[newKey] = n.nodeTypes[oldKey]
+		delete(n.nodeTypes, oldKey)
+		if val, exists := n.values[oldKey]; exists {
+			n.values[newKey] = val
+			delete(n.values, oldKey)
+		}
+		if length, exists := n.sliceLengths[oldKey]; exists {
+			n.sliceLengths[newKey] = length
+			delete(n.sliceLengths, oldKey)
+		}
+		n.keypaths[i] = newKp
+	}
+	n.sliceLengths[key] -= int(delta)
+}
+
 func (n *MemoryNode) Diff() *Diff {
 	return n.diff
 }
@@ -521,12 +658,14 @@ type memoryDepthFirstIterator struct {
 	i           int
 	end         int
 	prevLen     int
+	prefix      Keypath
 	backingNode *MemoryNode
 	iterNode    *MemoryNode
 }
 
 func (t *MemoryNode) DepthFirstIterator(keypath Keypath, prefetchValues bool, prefetchSize int) Iterator {
-	end, i := t.findPrefixRange(t.keypath.Push(keypath))
+	prefix := t.keypath.Push(keypath)
+	end, i := t.findPrefixRange(prefix)
 
 	return &memoryDepthFirstIterator{
 		iterNode:    &MemoryNode{keypaths: t.keypaths, values: t.values, nodeTypes: t.nodeTypes, sliceLengths: t.sliceLengths},
@@ -534,6 +673,7 @@ func (t *MemoryNode) DepthFirstIterator(keypath Keypath, prefetchValues bool, pr
 		i:           i,
 		end:         end,
 		prevLen:     len(t.keypaths),
+		prefix:      prefix,
 	}
 }
 
@@ -549,14 +689,18 @@ func (iter *memoryDepthFirstIterator) SeekTo(keypath Keypath) {
 }
 
 func (iter *memoryDepthFirstIterator) Next() Node {
-	if iter.i == iter.end {
-		return nil
+	for iter.i != iter.end {
+		iter.i--
+		keypath := iter.backingNode.keypaths[iter.i]
+		if !keypath.StartsWith(iter.prefix) {
+			// A sibling sharing the prefix's key (see findPrefixRange)
+			continue
+		}
+		iter.iterNode.keypath = keypath
+		iter.prevLen = len(iter.backingNode.keypaths)
+		return iter.iterNode
 	}
-
-	iter.i--
-	iter.iterNode.keypath = iter.backingNode.keypaths[iter.i]
-	iter.prevLen = len(iter.backingNode.keypaths)
-	return iter.iterNode
+	return nil
 }
 
 func (iter *memoryDepthFirstIterator) Close() {}
@@ -598,6 +742,10 @@ func (s *MemoryNode) findPrefixEnd(n int, prefix Keypath) int {
 	return -1
 }
 
+// findPrefixRange returns the range of s.keypaths containing the prefix and its
+// descendants.  Siblings whose keys have the prefix's last key as their own prefix (e.g.
+// "foo!" for "foo") can sort among those descendants, so callers must skip any keypath in
+// the range that doesn't start with the prefix.
 func (s *MemoryNode) findPrefixRange(prefix Keypath) (int, int) {
 	if len(prefix) == 0 {
 		return 0, len(s.keypaths)
@@ -605,14 +753,12 @@ func (s *MemoryNode) findPrefixRange(prefix Keypath) (int, int) {
 
 	start := -1
 	for i := range s.keypaths {
-		if s.keypaths[i].StartsWith(prefix) {
-			if start == -1 {
+		if start == -1 {
+			if s.keypaths[i].StartsWith(prefix) {
 				start = i
 			}
-		} else {
-			if start != -1 {
-				return start, i
-			}
+		} else if !bytes.HasPrefix(s.keypaths[i], prefix) {
+			return start, i
 		}
 	}
 	if start == -1 {
@@ -624,6 +770,46 @@ func (s *MemoryNode) findPrefixRange(prefix Keypath) (int, int) {
 	}
 }
 
+// internKeypath returns the node's own copy of kp, if it has one, along with a string
+// that shares its bytes.  Otherwise, kp is copied (unless the caller owns it and promises
+// not to modify it) and the copy is returned.  Using the shared string as a map key
+// avoids allocating a new string every time a node is stored.
+func (s *MemoryNode) internKeypath(kp Keypath, owned bool) (Keypath, string) {
+	if len(kp) == 0 {
+		return nil, ""
+	}
+
+	if _, exists := s.nodeTypes[string(kp)]; exists {
+		// s.keypaths is sorted, so binary search for the existing copy
+		lo, hi := 0, len(s.keypaths)
+		for lo < hi {
+			mid := int(uint(lo+hi) >> 1)
+			if bytes.Compare(s.keypaths[mid], kp) < 0 {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo < len(s.keypaths) && s.keypaths[lo].Equals(kp) {
+			return s.keypaths[lo], keypathString(s.keypaths[lo])
+		}
+	}
+
+	if !owned {
+		kp = kp.Copy()
+	}
+	return kp, keypathString(kp)
+}
+
+// keypathString returns a string that shares the keypath's bytes.  The keypath must not
+// be modified for as long as the string is in use.
+func keypathString(kp Keypath) string {
+	if len(kp) == 0 {
+		return ""
+	}
+	return *(*string)(unsafe.Pointer(&kp))
+}
+
 func (s *MemoryNode) addKeypaths(keypaths []Keypath) {
 	if len(keypaths) == 0 {
 		return
@@ -649,18 +835,26 @@ func (s *MemoryNode) scanKeypathsWithPrefix(prefix Keypath, rng *Range, fn func(
 			return ErrRangeOverNonSlice
 		}
 
+		// Only the slice's elements (and their descendants) are in range, not the slice itself
 		startIdx, endIdx := rng.IndicesForLength(uint64(s.sliceLengths[string(prefix)]))
-		startKeypathIdx := s.findPrefixStart(0, prefix.PushIndex(startIdx))
-		if startKeypathIdx == -1 {
-			return nil
-		}
-		endKeypathIdx := s.findPrefixEnd(startKeypathIdx+1, prefix.PushIndex(endIdx))
-		if endKeypathIdx == -1 {
-			panic("bad")
-		}
+		idxOffset := prefix.LengthAsParent()
+		var foundRange bool
+		for i, keypath := range s.keypaths {
+			if !keypath.StartsWith(prefix) || len(keypath) == len(prefix) {
+				if foundRange && !bytes.HasPrefix(keypath, prefix) {
+					return nil
+				}
+				continue
+			}
+			foundRange = true
 
-		for i := startKeypathIdx; i < endKeypathIdx; i++ {
-			err := fn(s.keypaths[i], i)
+			idx := DecodeSliceIndex(keypath[idxOffset : idxOffset+8])
+			if idx < startIdx {
+				continue
+			} else if idx >= endIdx {
+				return nil
+			}
+			err := fn(keypath, i)
 			if err != nil {
 				return err
 			}
@@ -674,7 +868,9 @@ func (s *MemoryNode) scanKeypathsWithPrefix(prefix Keypath, rng *Range, fn func(
 				if err != nil {
 					return err
 				}
-			} else if foundRange {
+			} else if foundRange && !bytes.HasPrefix(keypath, prefix) {
+				// Siblings sharing the prefix's key can sort among its descendants (see
+				// findPrefixRange), so only stop once the keys no longer share it
 				return nil
 			}
 		}
@@ -693,3 +889,7 @@ func (t *MemoryNode) DebugPrint() {
 		}
 	}
 }
+
+func (t *MemoryNode) Dump() (string, error) {
+	return Dump(t)
+}
@@ -66,6 +66,95 @@ func TestMemoryNode_Set(T *testing.T) {
 	}
 }
 
+func TestMemoryNode_SetInternsKeypaths(T *testing.T) {
+	state := NewMemoryNode().(*MemoryNode)
+
+	err := state.Set(Keypath("foo/bar"), nil, M{"a": "x"})
+	require.NoError(T, err)
+	err = state.Set(Keypath("foo/baz"), nil, "y")
+	require.NoError(T, err)
+	err = state.Set(Keypath("foo/bar/b"), nil, "z")
+	require.NoError(T, err)
+
+	// Intermediate keypaths are only stored once, no matter how many times they're set
+	require.Equal(T, []Keypath{
+		nil,
+		Keypath("foo"),
+		Keypath("foo/bar"),
+		Keypath("foo/bar/a"),
+		Keypath("foo/bar/b"),
+		Keypath("foo/baz"),
+	}, state.keypaths)
+
+	// Looking up a stored keypath hands back the node's own copy
+	kp := Keypath("foo/bar/a")
+	interned, key := state.internKeypath(kp, false)
+	require.Equal(T, kp, interned)
+	require.Equal(T, "foo/bar/a", key)
+	require.True(T, &interned[0] == &state.keypaths[3][0])
+
+	// Unowned keypaths that aren't stored yet are copied
+	kp = Keypath("foo/quux")
+	interned, _ = state.internKeypath(kp, false)
+	require.Equal(T, kp, interned)
+	require.False(T, &interned[0] == &kp[0])
+
+	// Copies made with CopyToMemory share the keypaths too
+	copied, err := state.CopyToMemory(Keypath("foo"), nil)
+	require.NoError(T, err)
+	require.True(T, &copied.(*MemoryNode).keypaths[0][0] == &state.keypaths[1][0])
+
+	val, exists, err := copied.Value(nil, nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, M{"bar": M{"a": "x", "b": "z"}, "baz": "y"}, val)
+}
+
+func TestMemoryNode_SetMany(T *testing.T) {
+	patches := []Patch{
+		{Keypath: Keypath("foo/bar"), Val: M{"a": "x", "b": []interface{}{"y", M{"c": "z"}}}},
+		{Keypath: Keypath("foo/baz"), Val: float64(123)},
+		{Keypath: Keypath("quux"), Val: "hi"},
+		// Overwrite part of an earlier patch
+		{Keypath: Keypath("foo/bar/b"), Val: M{"d": true}},
+		// Replace a value with a map
+		{Keypath: Keypath("quux/xyzzy"), Val: nil},
+		{Keypath: Keypath("foo/bar/e/f"), Val: "deep"},
+	}
+
+	sequential := NewMemoryNode().(*MemoryNode)
+	err := sequential.Set(Keypath("existing"), nil, M{"x": "y"})
+	require.NoError(T, err)
+	batched := NewMemoryNode()
+	err = batched.Set(Keypath("existing"), nil, M{"x": "y"})
+	require.NoError(T, err)
+
+	for _, patch := range patches {
+		err := sequential.Set(patch.Keypath, patch.Range, patch.Val)
+		require.NoError(T, err)
+	}
+	err = batched.SetMany(patches)
+	require.NoError(T, err)
+
+	require.Equal(T, sequential.keypaths, batched.(*MemoryNode).keypaths)
+	require.Equal(T, sequential.nodeTypes, batched.(*MemoryNode).nodeTypes)
+	require.Equal(T, sequential.values, batched.(*MemoryNode).values)
+	require.Equal(T, sequential.sliceLengths, batched.(*MemoryNode).sliceLengths)
+	require.Equal(T, sequential.Diff().Added, batched.Diff().Added)
+	require.Equal(T, sequential.Diff().Removed, batched.Diff().Removed)
+
+	val, _, err := batched.Value(nil, nil)
+	require.NoError(T, err)
+	require.Equal(T, M{
+		"existing": M{"x": "y"},
+		"foo": M{
+			"bar": M{"a": "x", "b": M{"d": true}, "e": M{"f": "deep"}},
+			"baz": float64(123),
+		},
+		"quux": M{"xyzzy": nil},
+	}, val)
+}
+
 func TestMemoryNode_Delete(T *testing.T) {
 	tests := []struct {
 		name          string
@@ -232,6 +321,103 @@ func BenchmarkDepthFirstIterator(b *testing.B) {
 	}
 }
 
+// makeBenchmarkTree returns a value that's stored as roughly 100k nodes.
+func makeBenchmarkTree() M {
+	val := make(M, 1000)
+	for i := 0; i < 1000; i++ {
+		item := make(M, 99)
+		for j := 0; j < 99; j++ {
+			item[fmt.Sprintf("field-%v", j)] = fmt.Sprintf("value-%v-%v", i, j)
+		}
+		val[fmt.Sprintf("item-%v", i)] = item
+	}
+	return val
+}
+
+func BenchmarkMemoryNode_Set100k(b *testing.B) {
+	val := makeBenchmarkTree()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		t := NewMemoryNode()
+		err := t.Set(Keypath("data"), nil, val)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMemoryNode_CopyToMemory100k(b *testing.B) {
+	t := NewMemoryNode()
+	err := t.Set(Keypath("data"), nil, makeBenchmarkTree())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := t.CopyToMemory(nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func makeBenchmarkPatches() []Patch {
+	patches := make([]Patch, 1000)
+	for i := range patches {
+		patches[i] = Patch{
+			Keypath: Keypath(fmt.Sprintf("data/item-%v/new", i)),
+			Val:     M{"text": fmt.Sprintf("patch %v", i), "tags": []interface{}{"a", "b"}},
+		}
+	}
+	return patches
+}
+
+func BenchmarkMemoryNode_Apply1000Patches_Set(b *testing.B) {
+	t := NewMemoryNode()
+	err := t.Set(Keypath("data"), nil, makeBenchmarkTree())
+	if err != nil {
+		b.Fatal(err)
+	}
+	patches := makeBenchmarkPatches()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		state, _ := t.CopyToMemory(nil, nil)
+		b.StartTimer()
+
+		for _, patch := range patches {
+			err := state.Set(patch.Keypath, patch.Range, patch.Val)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMemoryNode_Apply1000Patches_SetMany(b *testing.B) {
+	t := NewMemoryNode()
+	err := t.Set(Keypath("data"), nil, makeBenchmarkTree())
+	if err != nil {
+		b.Fatal(err)
+	}
+	patches := makeBenchmarkPatches()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		state, _ := t.CopyToMemory(nil, nil)
+		b.StartTimer()
+
+		err := state.SetMany(patches)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 type M = map[string]interface{}
 
 func BenchmarkDepthFirstNativeGoWalk(b *testing.B) {
@@ -357,3 +543,28 @@ func TestMemoryNode_CopyToMemory_AtKeypath(T *testing.T) {
 	}
 	require.NoError(T, err)
 }
+
+func TestMemoryNode_Value_NestedMaps(T *testing.T) {
+	T.Parallel()
+
+	input := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": map[string]interface{}{"c": 1.0},
+			"d": []interface{}{map[string]interface{}{"e": map[string]interface{}{"f": "g"}}},
+		},
+	}
+
+	node := NewMemoryNode()
+	err := node.Set(nil, nil, input)
+	require.NoError(T, err)
+
+	val, exists, err := node.Value(nil, nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, input, val)
+
+	val, exists, err = node.AtKeypath(Keypath("a/d"), nil).Value(nil, nil)
+	require.NoError(T, err)
+	require.True(T, exists)
+	require.Equal(T, input["a"].(map[string]interface{})["d"], val)
+}
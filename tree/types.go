@@ -16,44 +16,57 @@ var (
 	CurrentVersion = types.EmptyID
 )
 
+// A Range selects the elements [Start, End) of a slice or string.  Negative indices count
+// back from the end, so &Range{-2, 0} selects the last two elements.
 type Range [2]int64
 
+func (rng Range) Start() int64 { return rng[0] }
+func (rng Range) End() int64   { return rng[1] }
+
+// A Patch describes a single call to Set, so that many of them can be applied at once
+// with SetMany.
+type Patch struct {
+	Keypath Keypath
+	Range   *Range
+	Val     interface{}
+}
+
 func (rng *Range) Copy() *Range {
 	if rng == nil {
 		return nil
 	}
-	return &Range{rng[0], rng[1]}
+	return &Range{rng.Start(), rng.End()}
 }
 
 func (rng *Range) Valid() bool {
-	if rng[1] < rng[0] {
+	if rng.End() < rng.Start() {
 		return false
 	}
-	if rng[0] < 0 && rng[1] > 0 {
+	if rng.Start() < 0 && rng.End() > 0 {
 		return false
 	}
 	return true
 }
 
 func (rng *Range) Size() uint64 {
-	if rng[0] < 0 {
-		return uint64(-(rng[0] - rng[1]))
+	if rng.Start() < 0 {
+		return uint64(-(rng.Start() - rng.End()))
 	}
-	return uint64(rng[1] - rng[0])
+	return uint64(rng.End() - rng.Start())
 }
 
 func (rng *Range) ValidForLength(length uint64) bool {
-	if rng[0] < 0 {
-		return uint64(-rng[0]) <= length
+	if rng.Start() < 0 {
+		return uint64(-rng.Start()) <= length
 	}
-	return uint64(rng[1]) <= length
+	return uint64(rng.End()) <= length
 }
 
 func (rng *Range) IndicesForLength(length uint64) (uint64, uint64) {
-	if rng[0] < 0 {
-		return uint64(int64(length) + rng[0]), uint64(int64(length) + rng[1])
+	if rng.Start() < 0 {
+		return uint64(int64(length) + rng.Start()), uint64(int64(length) + rng.End())
 	}
-	return uint64(rng[0]), uint64(rng[1])
+	return uint64(rng.Start()), uint64(rng.End())
 }
 
 type Node interface {
@@ -70,12 +83,15 @@ type Node interface {
 	NodeInfo() (NodeType, ValueType, uint64, error)
 	Exists(keypath Keypath) (bool, error)
 	Set(keypath Keypath, rng *Range, val interface{}) error
+	SetMany(patches []Patch) error
 	Delete(keypath Keypath, rng *Range) error
 	Diff() *Diff
 	ResetDiff()
 	CopyToMemory(keypath Keypath, rng *Range) (Node, error)
+	CopyInto(dst Node, atKeypath Keypath) error
 	DepthFirstIterator(keypath Keypath, prefetchValues bool, prefetchSize int) Iterator
 	DebugPrint()
+	Dump() (string, error)
 }
 
 type NodeType uint8
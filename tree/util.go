@@ -1,10 +1,16 @@
 package tree
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/types"
 )
 
 func EncodeSliceIndex(x uint64) Keypath {
@@ -28,12 +34,18 @@ func DecodeSliceLen(k Keypath) uint64 {
 }
 
 func walkGoValue(tree interface{}, fn func(keypath Keypath, val interface{}) error) error {
+	return walkGoValueFrom(nil, tree, fn)
+}
+
+// walkGoValueFrom is like walkGoValue, but the keypaths passed to fn are prefixed with
+// root.  Every keypath other than root itself is freshly allocated.
+func walkGoValueFrom(root Keypath, tree interface{}, fn func(keypath Keypath, val interface{}) error) error {
 	type item struct {
 		val     interface{}
 		keypath Keypath
 	}
 
-	stack := []item{{val: tree, keypath: nil}}
+	stack := []item{{val: tree, keypath: root}}
 	var current item
 
 	for len(stack) > 0 {
@@ -111,6 +123,84 @@ func setValueAtKeypath(x interface{}, keypath Keypath, val interface{}, clobber
 	return x
 }
 
+// CopyInto sets the value of dst at atKeypath to a copy of the subtree rooted at src,
+// replacing anything already there.  Because it goes through dst.Set, the destination's
+// node types, slice lengths, and diff are updated just as if the value had been set
+// directly.
+func CopyInto(src Node, dst Node, atKeypath Keypath) error {
+	val, exists, err := src.Value(nil, nil)
+	if err != nil {
+		return err
+	} else if !exists {
+		return errors.Wrapf(types.Err404, "copying %v", src.Keypath())
+	}
+	return dst.Set(atKeypath, nil, val)
+}
+
+// Dump renders the subtree rooted at node as indented text, one line per node, giving
+// each node's key, its type, and (for values) its JSON-encoded contents.  Map keys are
+// sorted and slice elements are listed by index, so the output is the same for equal
+// trees regardless of how they're stored.
+func Dump(node Node) (string, error) {
+	var sb strings.Builder
+	label := "."
+	if len(node.Keypath()) > 0 {
+		label = node.Keypath().String()
+	}
+	err := dumpNode(&sb, node, label, 0)
+	if err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func dumpNode(sb *strings.Builder, node Node, label string, depth int) error {
+	nodeType, valueType, length, err := node.NodeInfo()
+	if err != nil {
+		return errors.Wrapf(err, "dumping %v", node.Keypath())
+	}
+	indent := strings.Repeat("  ", depth)
+
+	switch nodeType {
+	case NodeTypeMap:
+		fmt.Fprintf(sb, "%v%v: Map\n", indent, label)
+
+		subkeys := node.Subkeys()
+		sort.Slice(subkeys, func(i, j int) bool { return bytes.Compare(subkeys[i], subkeys[j]) < 0 })
+		for _, subkey := range subkeys {
+			err := dumpNode(sb, node.AtKeypath(subkey, nil), subkey.String(), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+
+	case NodeTypeSlice:
+		fmt.Fprintf(sb, "%v%v: Slice (%v)\n", indent, label, length)
+
+		for i := uint64(0); i < length; i++ {
+			err := dumpNode(sb, node.AtKeypath(EncodeSliceIndex(i), nil), fmt.Sprintf("[%v]", i), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+
+	case NodeTypeValue:
+		val, _, err := node.Value(nil, nil)
+		if err != nil {
+			return errors.Wrapf(err, "dumping %v", node.Keypath())
+		}
+		bs, err := json.Marshal(val)
+		if err != nil {
+			return errors.Wrapf(err, "dumping %v", node.Keypath())
+		}
+		fmt.Fprintf(sb, "%v%v: %v %v\n", indent, label, valueType, string(bs))
+
+	default:
+		return errors.Errorf("dumping %v: bad node type %v", node.Keypath(), nodeType)
+	}
+	return nil
+}
+
 func annotate(err *error, msg string, args ...interface{}) {
 	if *err != nil {
 		*err = errors.Wrapf(*err, msg, args...)
@@ -0,0 +1,73 @@
+package redwood
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/types"
+)
+
+// TrustPolicy is a coarse gate that a host applies to every tx it receives, before the tx
+// ever reaches the controller and its per-keypath permissions.  It's given the tx's author
+// and the address of the peer that relayed it to us.  The relayer's address is the zero
+// address if the peer hasn't proven one.
+type TrustPolicy interface {
+	CheckTx(tx Tx, relayer types.Address) error
+}
+
+var ErrUntrustedAddress = errors.New("address isn't trusted")
+
+type allowAllTrustPolicy struct{}
+
+// AllowAllTrustPolicy leaves every tx to be judged by its permissions alone.  It's the
+// default.
+var AllowAllTrustPolicy TrustPolicy = allowAllTrustPolicy{}
+
+func (allowAllTrustPolicy) CheckTx(tx Tx, relayer types.Address) error { return nil }
+
+type allowlistTrustPolicy struct {
+	allowed map[types.Address]struct{}
+}
+
+// NewAllowlistTrustPolicy returns a TrustPolicy that only accepts txs written by one of
+// the given addresses.  A relayer that has proven its address has to be on the list too,
+// but one that hasn't is let through, since plenty of peers (browsers talking to us over
+// HTTP, for instance) never do.
+func NewAllowlistTrustPolicy(addresses []types.Address) TrustPolicy {
+	allowed := make(map[types.Address]struct{}, len(addresses))
+	for _, addr := range addresses {
+		allowed[addr] = struct{}{}
+	}
+	return &allowlistTrustPolicy{allowed: allowed}
+}
+
+func (p *allowlistTrustPolicy) CheckTx(tx Tx, relayer types.Address) error {
+	if _, exists := p.allowed[tx.From]; !exists {
+		return errors.Wrapf(ErrUntrustedAddress, "tx author %v", tx.From.Hex())
+	} else if _, exists := p.allowed[relayer]; relayer != (types.Address{}) && !exists {
+		return errors.Wrapf(ErrUntrustedAddress, "relayer %v", relayer.Hex())
+	}
+	return nil
+}
+
+type denylistTrustPolicy struct {
+	denied map[types.Address]struct{}
+}
+
+// NewDenylistTrustPolicy returns a TrustPolicy that refuses txs written or relayed by any
+// of the given addresses.
+func NewDenylistTrustPolicy(addresses []types.Address) TrustPolicy {
+	denied := make(map[types.Address]struct{}, len(addresses))
+	for _, addr := range addresses {
+		denied[addr] = struct{}{}
+	}
+	return &denylistTrustPolicy{denied: denied}
+}
+
+func (p *denylistTrustPolicy) CheckTx(tx Tx, relayer types.Address) error {
+	if _, exists := p.denied[tx.From]; exists {
+		return errors.Wrapf(ErrUntrustedAddress, "tx author %v", tx.From.Hex())
+	} else if _, exists := p.denied[relayer]; exists {
+		return errors.Wrapf(ErrUntrustedAddress, "relayer %v", relayer.Hex())
+	}
+	return nil
+}
@@ -2,9 +2,11 @@ package redwood
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
@@ -19,6 +21,25 @@ const (
 	KeypathSeparator = "."
 )
 
+// StateURICreator returns the address of the creator of the given stateURI, if the
+// stateURI names one.  A stateURI names its creator by using the creator's hex-encoded
+// address as its first component (for example, "96216849c49358b10257cb55b28ea603c874b05e/chat"),
+// and only the creator may sign its genesis tx.
+func StateURICreator(stateURI string) (types.Address, bool) {
+	first := stateURI
+	if idx := strings.IndexByte(stateURI, '/'); idx > -1 {
+		first = stateURI[:idx]
+	}
+	if len(first) != 2*len(types.Address{}) {
+		return types.Address{}, false
+	}
+	bs, err := hex.DecodeString(first)
+	if err != nil {
+		return types.Address{}, false
+	}
+	return types.AddressFromBytes(bs), true
+}
+
 type Tx struct {
 	ID         types.ID        `json:"id"`
 	Parents    []types.ID      `json:"parents"`
@@ -29,8 +50,120 @@ type Tx struct {
 	Recipients []types.Address `json:"recipients,omitempty"`
 	Checkpoint bool            `json:"checkpoint"` // @@TODO: probably not ideal
 
+	// Unencrypted marks a private tx that's routed to its recipients like any other, but
+	// sent to them as is rather than sealed for each of them.  It's for txs whose content
+	// isn't secret, and saves the cost of encrypting them.  It's covered by the tx's hash,
+	// and so by its signature.
+	Unencrypted bool `json:"unencrypted,omitempty"`
+
+	// Provenance records the nodes that relayed the tx to us.  It isn't signed or covered
+	// by the tx's hash, so any relay can rewrite it.  It's only meant for diagnostics.
+	Provenance []RelayHop `json:"provenance,omitempty"`
+
 	Valid bool       `json:"valid"`
 	hash  types.Hash `json:"-"`
+
+	formerAddresses []types.Address `json:"-"`
+}
+
+// RelayHop is a step in a tx's Provenance: the node that relayed the tx, and when.
+type RelayHop struct {
+	Address types.Address `json:"address"`
+	At      time.Time     `json:"at"`
+}
+
+// MaxProvenanceLen is the number of relay hops that a tx's Provenance keeps.  Past that,
+// the oldest hops are dropped.
+const MaxProvenanceLen = 16
+
+// AddRelayHop returns a copy of the tx with the given hop at the end of its Provenance.
+func (tx Tx) AddRelayHop(address types.Address, at time.Time) Tx {
+	provenance := append([]RelayHop(nil), tx.Provenance...)
+	provenance = append(provenance, RelayHop{Address: address, At: at})
+	tx.Provenance = provenance
+	return tx.TrimProvenance()
+}
+
+// TrimProvenance returns a copy of the tx whose Provenance keeps no more than the last
+// MaxProvenanceLen hops.  Since any relay can rewrite the Provenance, received txs are
+// trimmed before they're stored or passed on.
+func (tx Tx) TrimProvenance() Tx {
+	if len(tx.Provenance) > MaxProvenanceLen {
+		tx.Provenance = append([]RelayHop(nil), tx.Provenance[len(tx.Provenance)-MaxProvenanceLen:]...)
+	}
+	return tx
+}
+
+// Copy returns a deep copy of the tx, which shares none of its slices or patch values with
+// the original (see Patch.Copy).
+func (tx Tx) Copy() Tx {
+	tx.Parents = append([]types.ID(nil), tx.Parents...)
+	tx.Sig = append(types.Signature(nil), tx.Sig...)
+	tx.Recipients = append([]types.Address(nil), tx.Recipients...)
+	tx.Provenance = append([]RelayHop(nil), tx.Provenance...)
+	tx.formerAddresses = append([]types.Address(nil), tx.formerAddresses...)
+	if tx.Patches != nil {
+		patches := make([]Patch, len(tx.Patches))
+		for i := range tx.Patches {
+			patches[i] = tx.Patches[i].Copy()
+		}
+		tx.Patches = patches
+	}
+	return tx
+}
+
+// privateTxPayload is how a private tx is encoded before it's sealed for each of its
+// recipients.  It only carries what the recipients need to reconstruct the tx that the
+// sender signed, and leaves out fields like Valid that are local to each node.
+type privateTxPayload struct {
+	ID         types.ID        `json:"id"`
+	Parents    []types.ID      `json:"parents"`
+	From       types.Address   `json:"from"`
+	Sig        types.Signature `json:"sig"`
+	URL        string          `json:"url"`
+	Patches    []Patch         `json:"patches"`
+	Recipients []types.Address `json:"recipients"`
+	Checkpoint bool            `json:"checkpoint"`
+	Provenance []RelayHop      `json:"provenance,omitempty"`
+}
+
+func encodePrivateTx(tx Tx) ([]byte, error) {
+	return json.Marshal(privateTxPayload{
+		ID:         tx.ID,
+		Parents:    tx.Parents,
+		From:       tx.From,
+		Sig:        tx.Sig,
+		URL:        tx.URL,
+		Patches:    tx.Patches,
+		Recipients: tx.Recipients,
+		Checkpoint: tx.Checkpoint,
+		Provenance: tx.Provenance,
+	})
+}
+
+func decodePrivateTx(bs []byte) (Tx, error) {
+	var payload privateTxPayload
+	err := json.Unmarshal(bs, &payload)
+	if err != nil {
+		return Tx{}, err
+	}
+	return Tx{
+		ID:         payload.ID,
+		Parents:    payload.Parents,
+		From:       payload.From,
+		Sig:        payload.Sig,
+		URL:        payload.URL,
+		Patches:    payload.Patches,
+		Recipients: payload.Recipients,
+		Checkpoint: payload.Checkpoint,
+		Provenance: payload.Provenance,
+	}, nil
+}
+
+// FormerAddresses returns the addresses that the tx's sender has rotated their key away
+// from, most recent first (see KeyRotationsKeypath).  It's only known to validators.
+func (tx Tx) FormerAddresses() []types.Address {
+	return tx.formerAddresses
 }
 
 func (tx Tx) Hash() types.Hash {
@@ -53,16 +186,41 @@ func (tx Tx) Hash() types.Hash {
 			txBytes = append(txBytes, tx.Recipients[i][:]...)
 		}
 
+		// Otherwise, a relay could strip the flag from an unencrypted tx, or set it on one
+		// that its sender meant to be sealed
+		if tx.Unencrypted {
+			txBytes = append(txBytes, []byte("unencrypted")...)
+		}
+
 		tx.hash = types.HashBytes(txBytes)
 	}
 
 	return tx.hash
 }
 
+// ContentID returns the ID that a content-addressed tx must carry: the hash of the tx
+// with its ID left empty.  Since the ID covers everything that Hash does, two txs with
+// the same content ID can only differ in their signatures.
+func (tx Tx) ContentID() types.ID {
+	tx.ID = types.ID{}
+	tx.hash = types.EmptyHash
+	return types.ID(tx.Hash())
+}
+
 func (tx Tx) IsPrivate() bool {
 	return len(tx.Recipients) > 0
 }
 
+// IsAddressedTo returns true if the given address is one of the tx's recipients.
+func (tx Tx) IsAddressedTo(address types.Address) bool {
+	for _, recipient := range tx.Recipients {
+		if recipient == address {
+			return true
+		}
+	}
+	return false
+}
+
 func PrivateRootKeyForRecipients(recipients []types.Address) string {
 	var bs []byte
 	for _, r := range recipients {
@@ -75,15 +233,31 @@ func (tx Tx) PrivateRootKey() string {
 	return PrivateRootKeyForRecipients(tx.Recipients)
 }
 
+// TouchesKeypath returns true if any of the tx's patches change something at or beneath
+// the given keypath, or replace one of its ancestors.  Every tx touches the root keypath.
+func (tx Tx) TouchesKeypath(keypath tree.Keypath) bool {
+	if len(keypath) == 0 {
+		return true
+	}
+	for _, patch := range tx.Patches {
+		if patch.Keypath.StartsWith(keypath) || keypath.StartsWith(patch.Keypath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patch sets the value at a keypath (or a range of it) to Val, or, if Delete is set,
+// deletes it.  A delete patch has no value, and is written as:
+//
+//	.foo.bar[1:3] delete
+//
+// Deleting a keypath that doesn't exist is a no-op.
 type Patch struct {
 	Keypath tree.Keypath
 	Range   *tree.Range
 	Val     interface{}
-}
-
-type Range struct {
-	Start int64
-	End   int64
+	Delete  bool
 }
 
 func (p Patch) String() string {
@@ -99,10 +273,14 @@ func (p Patch) String() string {
 	s := strings.Join(keypathParts, "")
 
 	if p.Range != nil {
-		s += fmt.Sprintf("[%v:%v]", p.Range[0], p.Range[1])
+		s += fmt.Sprintf("[%v:%v]", p.Range.Start(), p.Range.End())
+	}
+
+	if p.Delete {
+		return s + " delete"
 	}
 
-	val, err := json.Marshal(p.Val)
+	val, err := canonicalJSON(p.Val)
 	if err != nil {
 		panic(err)
 	}
@@ -112,12 +290,29 @@ func (p Patch) String() string {
 	return s
 }
 
+// Copy returns a deep copy of the patch.  Like any value that's been through JSON, the
+// copy's Val is made of maps, slices, strings, numbers, and bools.
 func (p Patch) Copy() Patch {
 	return Patch{
 		Keypath: p.Keypath.Copy(),
 		Range:   p.Range.Copy(),
 		Val:     DeepCopyJSValue(p.Val), // @@TODO?
+		Delete:  p.Delete,
+	}
+}
+
+// Apply sets or deletes the patch's keypath in the given state.
+func (p Patch) Apply(state tree.Node) error {
+	if !p.Delete {
+		return state.Set(p.Keypath, p.Range, p.Val)
 	}
+	exists, err := state.Exists(p.Keypath)
+	if err != nil {
+		return err
+	} else if !exists {
+		return nil
+	}
+	return state.Delete(p.Keypath, p.Range)
 }
 
 func (p *Patch) UnmarshalJSON(bs []byte) error {
@@ -134,10 +329,3 @@ func (p *Patch) UnmarshalJSON(bs []byte) error {
 func (p Patch) MarshalJSON() ([]byte, error) {
 	return json.Marshal(p.String())
 }
-
-func (r *Range) Copy() *Range {
-	if r == nil {
-		return nil
-	}
-	return &Range{r.Start, r.End}
-}
@@ -0,0 +1,346 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestTx_HashSurvivesJSONRoundTrip(t *testing.T) {
+	type profile struct {
+		Name  string  `json:"name"`
+		Age   uint8   `json:"age"`
+		Score float32 `json:"score"`
+	}
+
+	tx := signTestTx(t, &Tx{
+		ID:      types.IDFromString("one"),
+		Parents: []types.ID{GenesisTxID},
+		URL:     "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("counts"), Val: map[string]interface{}{
+				"small":   3,
+				"big":     int64(1<<53 + 1),
+				"nested":  map[string]int{"z": 1, "a": 2},
+				"list":    []int{1, 2, 3},
+				"escaped": "<b>&</b>",
+			}},
+			{Keypath: tree.Keypath("profile"), Val: profile{Name: "alice", Age: 30, Score: 0.1}},
+			{Keypath: tree.Keypath("list"), Range: &tree.Range{1, 2}, Val: []interface{}{uint64(7)}},
+		},
+	})
+
+	bs, err := json.Marshal(tx)
+	require.NoError(t, err)
+	var decoded Tx
+	err = json.Unmarshal(bs, &decoded)
+	require.NoError(t, err)
+
+	// The decoded values are no longer the Go types that the tx was built with
+	require.IsType(t, int64(0), decoded.Patches[0].Val.(map[string]interface{})["small"])
+	require.Equal(t, int64(1<<53+1), decoded.Patches[0].Val.(map[string]interface{})["big"])
+	require.IsType(t, map[string]interface{}{}, decoded.Patches[1].Val)
+
+	require.Equal(t, tx.Hash(), decoded.Hash())
+	require.Equal(t, tx.ContentID(), decoded.ContentID())
+
+	pubkey, err := RecoverSigningPubkey(decoded.Hash(), decoded.Sig, nil)
+	require.NoError(t, err)
+	require.Equal(t, tx.From, pubkey.Address())
+
+	// Round-tripping again changes nothing
+	bs2, err := json.Marshal(decoded)
+	require.NoError(t, err)
+	require.JSONEq(t, string(bs), string(bs2))
+}
+
+func TestTx_UnencryptedIsSigned(t *testing.T) {
+	recipients := []types.Address{{0xa}, {0xb}}
+	tx := signTestTx(t, &Tx{
+		ID:          types.IDFromString("private"),
+		Parents:     []types.ID{GenesisTxID},
+		URL:         "localhost/" + PrivateRootKeyForRecipients(recipients),
+		Recipients:  recipients,
+		Unencrypted: true,
+		Patches:     []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+
+	// A relay that strips the flag invalidates the sender's signature
+	stripped := *tx
+	stripped.hash = types.EmptyHash
+	stripped.Unencrypted = false
+	require.NotEqual(t, tx.Hash(), stripped.Hash())
+
+	pubkey, err := RecoverSigningPubkey(stripped.Hash(), stripped.Sig, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, tx.From, pubkey.Address())
+}
+
+func TestPatch_Copy(t *testing.T) {
+	t.Run("nil keypath, range, and value", func(t *testing.T) {
+		p := Patch{}
+		require.Equal(t, p, p.Copy())
+	})
+
+	t.Run("deep copy", func(t *testing.T) {
+		p := Patch{
+			Keypath: tree.Keypath("foo/bar"),
+			Range:   &tree.Range{1, 3},
+			Val: map[string]interface{}{
+				"list":   []interface{}{1.0, map[string]interface{}{"x": "y"}},
+				"nested": map[string]interface{}{"a": []interface{}{"b"}},
+			},
+		}
+		copied := p.Copy()
+		require.Equal(t, p, copied)
+
+		// Mutating the copy leaves the original alone
+		copied.Keypath[0] = 'X'
+		copied.Range[0] = 0
+		copiedVal := copied.Val.(map[string]interface{})
+		copiedVal["list"].([]interface{})[0] = 2.0
+		copiedVal["list"].([]interface{})[1].(map[string]interface{})["x"] = "z"
+		copiedVal["nested"].(map[string]interface{})["a"].([]interface{})[0] = "c"
+		copiedVal["added"] = true
+
+		require.Equal(t, tree.Keypath("foo/bar"), p.Keypath)
+		require.Equal(t, &tree.Range{1, 3}, p.Range)
+		require.Equal(t, map[string]interface{}{
+			"list":   []interface{}{1.0, map[string]interface{}{"x": "y"}},
+			"nested": map[string]interface{}{"a": []interface{}{"b"}},
+		}, p.Val)
+	})
+}
+
+func TestTx_Copy(t *testing.T) {
+	tx := Tx{
+		ID:         types.IDFromString("tx"),
+		Parents:    []types.ID{GenesisTxID},
+		Sig:        types.Signature{1, 2, 3},
+		URL:        "localhost/test",
+		Patches:    []Patch{{Keypath: tree.Keypath("foo"), Val: map[string]interface{}{"bar": []interface{}{"baz"}}}},
+		Recipients: []types.Address{{0xa}},
+		Provenance: []RelayHop{{Address: types.Address{0xb}}},
+	}
+	hash := tx.Hash()
+
+	copied := tx.Copy()
+	require.Equal(t, tx, copied)
+
+	// Mutating the copy leaves the original alone
+	copied.Parents[0] = types.IDFromString("other")
+	copied.Sig[0] = 9
+	copied.Patches[0].Keypath[0] = 'X'
+	copied.Patches[0].Val.(map[string]interface{})["bar"].([]interface{})[0] = "changed"
+	copied.Recipients[0] = types.Address{0xc}
+	copied.Provenance[0].Address = types.Address{0xd}
+
+	require.Equal(t, []types.ID{GenesisTxID}, tx.Parents)
+	require.Equal(t, types.Signature{1, 2, 3}, tx.Sig)
+	require.Equal(t, []Patch{{Keypath: tree.Keypath("foo"), Val: map[string]interface{}{"bar": []interface{}{"baz"}}}}, tx.Patches)
+	require.Equal(t, []types.Address{{0xa}}, tx.Recipients)
+	require.Equal(t, []RelayHop{{Address: types.Address{0xb}}}, tx.Provenance)
+	tx.hash = types.Hash{}
+	require.Equal(t, hash, tx.Hash())
+}
+
+func TestPatch_RangeRoundTrip(t *testing.T) {
+	for _, rng := range []*tree.Range{nil, {0, 0}, {1, 3}, {-2, 0}, {-5, -1}, {0, 1234567890123}} {
+		p := Patch{Keypath: tree.Keypath("text"), Range: rng, Val: "xyz"}
+
+		parsed, err := ParsePatch([]byte(p.String()))
+		require.NoError(t, err)
+		require.Equal(t, p.Range, parsed.Range)
+		require.Equal(t, p.String(), parsed.String())
+
+		bs, err := json.Marshal(p)
+		require.NoError(t, err)
+		var decoded Patch
+		err = json.Unmarshal(bs, &decoded)
+		require.NoError(t, err)
+		require.Equal(t, p.Range, decoded.Range)
+
+		if rng != nil {
+			require.Equal(t, rng[0], rng.Start())
+			require.Equal(t, rng[1], rng.End())
+		}
+	}
+
+	for _, bad := range []string{".text[1] = 1", ".text[:3] = 1", ".text[1:] = 1", ".text[1:2:3] = 1", ".text[a:b] = 1", ".text[", "text = 1", ".text 1"} {
+		_, err := ParsePatch([]byte(bad))
+		require.True(t, errors.Is(err, ErrBadPatch), bad)
+	}
+}
+
+func TestPatch_Delete(t *testing.T) {
+	for _, p := range []Patch{
+		{Keypath: tree.Keypath("foo/bar"), Delete: true},
+		{Keypath: tree.Keypath("list"), Range: &tree.Range{1, 3}, Delete: true},
+	} {
+		s := p.String()
+		require.True(t, strings.HasSuffix(s, " delete"), s)
+
+		parsed, err := ParsePatch([]byte(s))
+		require.NoError(t, err)
+		require.Equal(t, p, parsed)
+		require.Equal(t, p, p.Copy())
+	}
+
+	// A patch setting a value is still distinct from a delete
+	parsed, err := ParsePatch([]byte(`.foo = null`))
+	require.NoError(t, err)
+	require.False(t, parsed.Delete)
+	parsed, err = ParsePatch([]byte(`.foo = "delete"`))
+	require.NoError(t, err)
+	require.False(t, parsed.Delete)
+	require.Equal(t, "delete", parsed.Val)
+
+	_, err = ParsePatch([]byte(`.foo delete 1`))
+	require.True(t, errors.Is(err, ErrBadPatch))
+}
+
+func TestTx_NumbersKeepTheirTypesOverTheWire(t *testing.T) {
+	tx := signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("nums"), Val: map[string]interface{}{
+			"big":      int64(1<<62 + 1),
+			"negative": int64(-(1<<62 + 1)),
+			"huge":     uint64(1<<63 + 1),
+			"float":    1.5,
+			"list":     []interface{}{int64(1<<53 + 1), 0.25},
+		}}},
+	})
+
+	var buf bytes.Buffer
+	err := WriteMsg(&buf, Msg{Type: MsgType_Put, Payload: *tx})
+	require.NoError(t, err)
+	var msg Msg
+	err = ReadMsg(&buf, &msg)
+	require.NoError(t, err)
+
+	received := msg.Payload.(Tx)
+	require.Equal(t, tx.Hash(), received.Hash())
+	require.Equal(t, map[string]interface{}{
+		"big":      int64(1<<62 + 1),
+		"negative": int64(-(1<<62 + 1)),
+		"huge":     uint64(1<<63 + 1),
+		"float":    1.5,
+		"list":     []interface{}{int64(1<<53 + 1), 0.25},
+	}, received.Patches[0].Val)
+
+	c := newTestController(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = c.AddTxAndWait(ctx, &received)
+	require.NoError(t, err)
+
+	state := c.StateAtVersion(nil)
+	defer state.Close()
+	i, isInt, err := state.IntValue(tree.Keypath("nums/big"))
+	require.NoError(t, err)
+	require.True(t, isInt)
+	require.Equal(t, int64(1<<62+1), i)
+	u, isUint, err := state.UintValue(tree.Keypath("nums/huge"))
+	require.NoError(t, err)
+	require.True(t, isUint)
+	require.Equal(t, uint64(1<<63+1), u)
+	f, isFloat, err := state.FloatValue(tree.Keypath("nums/float"))
+	require.NoError(t, err)
+	require.True(t, isFloat)
+	require.Equal(t, 1.5, f)
+}
+
+func TestTx_AddRelayHop(t *testing.T) {
+	tx := *signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+	})
+	hash := tx.Hash()
+
+	start := time.Now()
+	relayed := tx
+	for i := 0; i < MaxProvenanceLen+3; i++ {
+		relayed = relayed.AddRelayHop(types.Address{byte(i)}, start.Add(time.Duration(i)*time.Second))
+	}
+	require.Empty(t, tx.Provenance)
+
+	// Only the most recent hops are kept
+	require.Len(t, relayed.Provenance, MaxProvenanceLen)
+	require.Equal(t, types.Address{3}, relayed.Provenance[0].Address)
+	require.Equal(t, types.Address{MaxProvenanceLen + 2}, relayed.Provenance[MaxProvenanceLen-1].Address)
+
+	// Provenance isn't part of the signed content
+	relayed.hash = types.Hash{}
+	require.Equal(t, hash, relayed.Hash())
+
+	bs, err := json.Marshal(relayed)
+	require.NoError(t, err)
+	var decoded Tx
+	err = json.Unmarshal(bs, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, hash, decoded.Hash())
+	require.Len(t, decoded.Provenance, MaxProvenanceLen)
+	require.True(t, decoded.Provenance[0].At.Equal(start.Add(3*time.Second)))
+}
+
+func TestTx_PrivatePayloadRoundTrip(t *testing.T) {
+	sender, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	recipient, err := GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	tx := *signTestTx(t, &Tx{
+		ID:         types.IDFromString("private"),
+		Parents:    []types.ID{GenesisTxID, types.IDFromString("other")},
+		URL:        "localhost/" + PrivateRootKeyForRecipients([]types.Address{{0xa}, {0xb}}),
+		Recipients: []types.Address{{0xa}, {0xb}},
+		Checkpoint: true,
+		Patches: []Patch{
+			{Keypath: tree.Keypath("nums"), Val: map[string]interface{}{"big": int64(1<<62 + 1), "float": 0.5}},
+			{Keypath: tree.Keypath("list"), Range: &tree.Range{0, 1}, Val: []interface{}{"x"}},
+			{Keypath: tree.Keypath("gone"), Delete: true},
+		},
+	})
+	tx.Valid = true
+	tx = tx.AddRelayHop(types.Address{0xc}, time.Now())
+
+	bs, err := encodePrivateTx(tx)
+	require.NoError(t, err)
+	sealed, err := sender.SealMessageFor(recipient.EncryptingPublicKey, bs)
+	require.NoError(t, err)
+
+	opened, err := recipient.OpenMessageFrom(sender.EncryptingPublicKey, sealed)
+	require.NoError(t, err)
+	decoded, err := decodePrivateTx(opened)
+	require.NoError(t, err)
+
+	require.Equal(t, tx.ID, decoded.ID)
+	require.Equal(t, tx.Parents, decoded.Parents)
+	require.Equal(t, tx.From, decoded.From)
+	require.Equal(t, tx.Sig, decoded.Sig)
+	require.Equal(t, tx.URL, decoded.URL)
+	require.Equal(t, tx.Patches, decoded.Patches)
+	require.Equal(t, tx.Recipients, decoded.Recipients)
+	require.Equal(t, tx.Checkpoint, decoded.Checkpoint)
+	require.Len(t, decoded.Provenance, 1)
+	require.Equal(t, tx.Hash(), decoded.Hash())
+
+	// Whether the tx is valid is for the recipient to decide
+	require.False(t, decoded.Valid)
+
+	// The encoding is deterministic
+	bs2, err := encodePrivateTx(decoded)
+	require.NoError(t, err)
+	require.Equal(t, bs, bs2)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/brynbellomy/redwood/ctx"
+	"github.com/brynbellomy/redwood/tree"
 	"github.com/brynbellomy/redwood/types"
 )
 
@@ -14,13 +15,20 @@ type badgerTxStore struct {
 	*ctx.Context
 	db         *badger.DB
 	dbFilename string
+	dbOptions  tree.DBTreeOptions
 	address    types.Address
+	chGCDone   <-chan struct{}
 }
 
 func NewBadgerTxStore(dbFilename string, address types.Address) TxStore {
+	return NewBadgerTxStoreWithOptions(dbFilename, address, tree.DBTreeOptions{})
+}
+
+func NewBadgerTxStoreWithOptions(dbFilename string, address types.Address, dbOptions tree.DBTreeOptions) TxStore {
 	return &badgerTxStore{
 		Context:    &ctx.Context{},
 		dbFilename: dbFilename,
+		dbOptions:  dbOptions,
 		address:    address,
 	}
 }
@@ -30,18 +38,30 @@ func (p *badgerTxStore) Start() error {
 		// on startup
 		func() error {
 			p.SetLogLabel(p.address.Pretty() + " store:badger")
-			p.Infof(0, "opening badger store at %v", p.dbFilename)
-			db, err := badger.Open(badger.DefaultOptions(p.dbFilename))
+			if p.dbOptions.InMemory {
+				p.Infof(0, "opening in-memory badger store")
+			} else {
+				p.Infof(0, "opening badger store at %v", p.dbFilename)
+			}
+			db, err := badger.Open(p.dbOptions.BadgerOptions(p.dbFilename))
 			if err != nil {
 				return err
 			}
 			p.db = db
+			p.chGCDone = startValueLogGC(p.Context.Done(), p.dbOptions, func() {
+				collectValueLogGarbage(p, "tx", p.dbOptions, func(discardRatio float64) (int, error) {
+					return tree.CollectValueLogGarbage(p.db, discardRatio)
+				})
+			})
 			return nil
 		},
 		nil,
 		nil,
 		// on shutdown
 		func() {
+			if p.chGCDone != nil {
+				<-p.chGCDone
+			}
 			p.db.Close()
 		},
 	)
@@ -138,7 +158,7 @@ func (p *badgerTxStore) allTxs(prefix string) TxIterator {
 	go func() {
 		defer close(txIter.ch)
 
-		txIter.err = p.db.View(func(txn *badger.Txn) error {
+		err := p.db.View(func(txn *badger.Txn) error {
 			opts := badger.DefaultIteratorOptions
 			opts.PrefetchSize = 10
 			badgerIter := txn.NewIterator(opts)
@@ -171,6 +191,7 @@ func (p *badgerTxStore) allTxs(prefix string) TxIterator {
 			}
 			return nil
 		})
+		txIter.setError(err)
 	}()
 
 	return txIter
@@ -1,6 +1,9 @@
 package redwood
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/brynbellomy/redwood/ctx"
 	"github.com/brynbellomy/redwood/types"
 )
@@ -17,6 +20,9 @@ type TxStore interface {
 	AllTxsForStateURI(stateURI string) TxIterator
 }
 
+// TxIterator yields a sequence of txs.  Next returns nil once the sequence is exhausted
+// or an error has occurred, at which point Error reports the error (if any).  Callers
+// that stop early must call Cancel to release the iterator's resources.
 type TxIterator interface {
 	Next() *Tx
 	Cancel()
@@ -27,6 +33,7 @@ type txIterator struct {
 	ch       chan *Tx
 	chCancel chan struct{}
 	err      error
+	errMu    sync.RWMutex
 }
 
 func (i *txIterator) Next() *Tx {
@@ -42,6 +49,90 @@ func (i *txIterator) Cancel() {
 	close(i.chCancel)
 }
 
+// Error may be called after any call to Next, while the iterator's goroutine is still
+// running, so err is guarded by errMu.
 func (i *txIterator) Error() error {
+	i.errMu.RLock()
+	defer i.errMu.RUnlock()
 	return i.err
 }
+
+func (i *txIterator) setError(err error) {
+	i.errMu.Lock()
+	defer i.errMu.Unlock()
+	i.err = err
+}
+
+// newTopologicalTxIterator reorders the txs from another iterator so that every tx comes
+// after all of its parents.  Txs whose parents don't appear in the source are yielded as
+// soon as their other parents have been, and ties are broken by the source's order.
+// Because any tx could be the parent of a later one, the whole source is read before the
+// first tx is yielded.
+func newTopologicalTxIterator(source TxIterator) TxIterator {
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+
+		var txs []*Tx
+		indices := make(map[types.ID]int)
+		for {
+			select {
+			case <-txIter.chCancel:
+				source.Cancel()
+				return
+			default:
+			}
+
+			tx := source.Next()
+			if source.Error() != nil {
+				txIter.setError(source.Error())
+				return
+			} else if tx == nil {
+				break
+			}
+			indices[tx.ID] = len(txs)
+			txs = append(txs, tx)
+		}
+
+		numPendingParents := make([]int, len(txs))
+		children := make(map[types.ID][]int)
+		var ready []int
+		for i, tx := range txs {
+			for _, parentID := range tx.Parents {
+				if _, exists := indices[parentID]; exists {
+					numPendingParents[i]++
+					children[parentID] = append(children[parentID], i)
+				}
+			}
+			if numPendingParents[i] == 0 {
+				ready = append(ready, i)
+			}
+		}
+
+		for len(ready) > 0 {
+			// Always yield the earliest ready tx so that the order is deterministic
+			sort.Ints(ready)
+			i := ready[0]
+			ready = ready[1:]
+
+			select {
+			case <-txIter.chCancel:
+				return
+			case txIter.ch <- txs[i]:
+			}
+
+			for _, child := range children[txs[i].ID] {
+				numPendingParents[child]--
+				if numPendingParents[child] == 0 {
+					ready = append(ready, child)
+				}
+			}
+		}
+	}()
+
+	return txIter
+}
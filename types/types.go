@@ -1,8 +1,11 @@
 package types
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"math/rand"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/pkg/errors"
@@ -143,12 +146,41 @@ func (sig *Signature) UnmarshalJSON(bs []byte) error {
 	return nil
 }
 
+// ChallengeMsg is sent to a peer to have it prove that it holds an address's keys by
+// signing it.  It starts with the time at which it expires, followed by a random nonce,
+// so that a signature over one challenge is no good for answering any other.
 type ChallengeMsg []byte
 
-func GenerateChallengeMsg() ([]byte, error) {
-	challengeMsg := make([]byte, 128)
-	_, err := rand.Read(challengeMsg)
-	return challengeMsg, err
+// ChallengeMsgTTL is how long a peer has to answer a challenge.
+const ChallengeMsgTTL = 30 * time.Second
+
+const challengeNonceLen = 32
+
+func GenerateChallengeMsg() (ChallengeMsg, error) {
+	return GenerateChallengeMsgWithExpiry(time.Now().Add(ChallengeMsgTTL))
+}
+
+func GenerateChallengeMsgWithExpiry(expiry time.Time) (ChallengeMsg, error) {
+	challengeMsg := make([]byte, 8+challengeNonceLen)
+	binary.BigEndian.PutUint64(challengeMsg, uint64(expiry.UnixNano()))
+	_, err := cryptorand.Read(challengeMsg[8:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return challengeMsg, nil
+}
+
+// Expiry returns the time after which the challenge can no longer be answered.  A
+// malformed challenge has already expired.
+func (c ChallengeMsg) Expiry() time.Time {
+	if len(c) < 8+challengeNonceLen {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(c)))
+}
+
+func (c ChallengeMsg) IsExpired(now time.Time) bool {
+	return now.After(c.Expiry())
 }
 
 func (c ChallengeMsg) MarshalJSON() ([]byte, error) {
@@ -1,12 +1,14 @@
 package redwood
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -303,25 +305,175 @@ func fileExists(filename string) bool {
 	return !os.IsNotExist(err)
 }
 
+// PrettyJSONOptions controls how PrettyJSON abbreviates values for logging.
+type PrettyJSONOptions struct {
+	MaxStringLen     int  // Strings longer than this are replaced with "<N bytes>" (0 means no limit)
+	RedactPrivateTxs bool // Hide the patch values of private txs, which are only meant for their recipients
+}
+
+var DefaultPrettyJSONOptions = PrettyJSONOptions{
+	MaxStringLen:     256,
+	RedactPrivateTxs: true,
+}
+
 func PrettyJSON(x interface{}) string {
+	return PrettyJSONWithOptions(x, DefaultPrettyJSONOptions)
+}
+
+func PrettyJSONWithOptions(x interface{}, opts PrettyJSONOptions) string {
+	switch v := x.(type) {
+	case *Tx:
+		if v != nil {
+			x = abbreviateTx(*v, opts)
+		}
+	case Tx:
+		x = abbreviateTx(v, opts)
+	default:
+		x = abbreviateJSONValue(x, opts)
+	}
 	j, _ := json.MarshalIndent(x, "", "    ")
 	return string(j)
 }
 
-// @@TODO: everything about this is horrible
+// abbreviateTx abbreviates the values of the tx's patches.  The patches themselves are
+// serialized as single strings, so abbreviating after serialization would hide their
+// keypaths too.
+func abbreviateTx(tx Tx, opts PrettyJSONOptions) Tx {
+	patches := make([]Patch, len(tx.Patches))
+	for i, patch := range tx.Patches {
+		patches[i] = Patch{Keypath: patch.Keypath, Range: patch.Range, Delete: patch.Delete}
+		if patch.Delete {
+			continue
+		} else if opts.RedactPrivateTxs && tx.IsPrivate() {
+			patches[i].Val = "<redacted>"
+		} else {
+			patches[i].Val = abbreviateJSONValue(patch.Val, opts)
+		}
+	}
+	tx.Patches = patches
+	return tx
+}
+
+func abbreviateJSONValue(x interface{}, opts PrettyJSONOptions) interface{} {
+	if opts.MaxStringLen <= 0 {
+		return x
+	}
+
+	// Work on a generic copy so that we don't touch the caller's value
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return x
+	}
+	var copied interface{}
+	err = json.Unmarshal(bs, &copied)
+	if err != nil {
+		return x
+	}
+
+	abbreviated, err := mapTree(copied, func(keypath []string, val interface{}) (interface{}, error) {
+		if s, isString := val.(string); isString && len(s) > opts.MaxStringLen {
+			return fmt.Sprintf("<%v bytes>", len(s)), nil
+		}
+		return val, nil
+	})
+	if err != nil {
+		return x
+	}
+	return abbreviated
+}
+
+// DeepCopyJSValue copies a value made of maps, slices, and primitives, keeping the types of
+// its numbers.  Anything else is copied by way of JSON.
 func DeepCopyJSValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key := range v {
+			copied[key] = DeepCopyJSValue(v[key])
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i := range v {
+			copied[i] = DeepCopyJSValue(v[i])
+		}
+		return copied
+	case nil, bool, string, int64, uint64, float64:
+		return v
+	}
+
+	// @@TODO: everything about this is horrible
 	bs, err := json.Marshal(val)
 	if err != nil {
 		panic(err)
 	}
-	var copied interface{}
-	err = json.Unmarshal(bs, &copied)
+	copied, err := decodeJSONValue(bs)
 	if err != nil {
 		panic(err)
 	}
 	return copied
 }
 
+// canonicalJSON encodes val the way it would be encoded after a trip through JSON, so that
+// a value built in Go (with ints, structs, and so on) and the same value decoded from JSON
+// (with maps and the numbers produced by decodeJSONValue) encode identically.  Tx hashes
+// depend on this.
+func canonicalJSON(val interface{}) ([]byte, error) {
+	bs, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeJSONValue(bs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
+
+// decodeJSONValue is like json.Unmarshal into an interface{}, except that numbers keep
+// their precision.  Integers become int64s (or uint64s, if they're too big for an int64),
+// and everything else becomes a float64.  The tree stores each of these as a distinct
+// value type.
+func decodeJSONValue(bs []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+
+	var val interface{}
+	err := dec.Decode(&val)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return convertJSONNumbers(val), nil
+}
+
+func convertJSONNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = convertJSONNumbers(v[key])
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = convertJSONNumbers(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
 type StringSet map[string]struct{}
 
 func NewStringSet(vals []string) StringSet {
@@ -340,6 +492,16 @@ func (s StringSet) Remove(val string) {
 	delete(s, val)
 }
 
+// Slice returns the set's values in sorted order.
+func (s StringSet) Slice() []string {
+	vals := make([]string, 0, len(s))
+	for val := range s {
+		vals = append(vals, val)
+	}
+	sort.Strings(vals)
+	return vals
+}
+
 func SniffContentType(filename string, data io.Reader) (string, error) {
 	// Only the first 512 bytes are used to sniff the content type.
 	buffer := make([]byte, 512)
@@ -0,0 +1,67 @@
+package redwood
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func TestPrettyJSON_ElidesLongStrings(t *testing.T) {
+	html := "<html>" + strings.Repeat("x", 10000) + "</html>"
+
+	tx := &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{{
+			Keypath: tree.Keypath("index.html"),
+			Val: map[string]interface{}{
+				"Content-Type": "text/html",
+				"value":        html,
+			},
+		}},
+	}
+
+	out := PrettyJSON(tx)
+	require.NotContains(t, out, "xxxxxxxx")
+
+	// The tx and the patch are still intact apart from the elided string
+	var decoded Tx
+	err := json.Unmarshal([]byte(out), &decoded)
+	require.NoError(t, err)
+	require.Equal(t, tx.ID, decoded.ID)
+	require.Equal(t, "localhost/test", decoded.URL)
+	require.Len(t, decoded.Patches, 1)
+	require.Equal(t, tree.Keypath("index.html"), decoded.Patches[0].Keypath)
+	require.Equal(t, map[string]interface{}{
+		"Content-Type": "text/html",
+		"value":        "<10013 bytes>",
+	}, decoded.Patches[0].Val)
+
+	// The original tx isn't touched
+	require.Equal(t, html, tx.Patches[0].Val.(map[string]interface{})["value"])
+
+	// Values that aren't txs are abbreviated too
+	out = PrettyJSON(map[string]interface{}{"short": "hi", "long": html})
+	require.JSONEq(t, `{"short": "hi", "long": "<10013 bytes>"}`, out)
+}
+
+func TestPrettyJSON_RedactsPrivateTxs(t *testing.T) {
+	tx := Tx{
+		ID:         GenesisTxID,
+		URL:        "localhost/test",
+		Recipients: []types.Address{{0x1}, {0x2}},
+		Patches:    []Patch{{Keypath: tree.Keypath("secret"), Val: "the password is hunter2"}},
+	}
+
+	out := PrettyJSON(tx)
+	require.NotContains(t, out, "hunter2")
+	require.Contains(t, out, "secret")
+
+	out = PrettyJSONWithOptions(tx, PrettyJSONOptions{MaxStringLen: 256})
+	require.Contains(t, out, "hunter2")
+}
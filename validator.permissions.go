@@ -11,6 +11,9 @@ import (
 	"github.com/brynbellomy/redwood/types"
 )
 
+// Ensure permissionsValidator implements the Validator interface
+var _ Validator = (*permissionsValidator)(nil)
+
 type permissionsValidator struct {
 	permissions map[string]interface{}
 }
@@ -33,42 +36,65 @@ func NewPermissionsValidator(config tree.Node) (Validator, error) {
 var senderRegexp = regexp.MustCompile("\\${sender}")
 
 func (v *permissionsValidator) ValidateTx(state tree.Node, tx *Tx) error {
-	perms, exists := v.permissions[tx.From.Hex()]
-	if !exists {
-		perms, exists = v.permissions["*"]
+	// A rotated key keeps the permissions granted to the keys that it replaced
+	senders := append([]types.Address{tx.From}, tx.FormerAddresses()...)
+
+	var permsMaps []map[string]interface{}
+	for _, sender := range senders {
+		perms, exists := v.permissions[sender.Hex()]
 		if !exists {
-			return errors.WithStack(errors.Wrapf(types.Err403, "permissions key for user '%v' does not exist", tx.From.Hex()))
+			continue
 		}
+		permsMap, isMap := perms.(map[string]interface{})
+		if !isMap {
+			return errors.WithStack(errors.Wrapf(types.Err403, "permissions key for user '%v' does not contain a map", sender.Hex()))
+		}
+		permsMaps = append(permsMaps, permsMap)
 	}
-	permsMap, isMap := perms.(map[string]interface{})
-	if !isMap {
-		return errors.WithStack(errors.Wrapf(types.Err403, "permissions key for user '%v' does not contain a map", tx.From.Hex()))
+	if len(permsMaps) == 0 {
+		perms, exists := v.permissions["*"]
+		if !exists {
+			return errors.WithStack(errors.Wrapf(types.Err403, "permissions key for user '%v' does not exist", tx.From.Hex()))
+		}
+		permsMap, isMap := perms.(map[string]interface{})
+		if !isMap {
+			return errors.WithStack(errors.Wrapf(types.Err403, "permissions key for user '%v' does not contain a map", tx.From.Hex()))
+		}
+		permsMaps = append(permsMaps, permsMap)
 	}
 
 	for _, patch := range tx.Patches {
-		var valid bool
+		valid, err := v.canWrite(permsMaps, senders, patch)
+		if err != nil {
+			return err
+		} else if !valid {
+			return errors.Wrapf(types.Err403, "could not find a matching rule (user: %v, patch: %v)", tx.From.String(), patch.String())
+		}
+	}
 
-		// @@TODO: hacky
-		keypath := KeypathSeparator + string(bytes.ReplaceAll(patch.Keypath, tree.KeypathSeparator, []byte(KeypathSeparator)))
+	return nil
+}
+
+func (v *permissionsValidator) canWrite(permsMaps []map[string]interface{}, senders []types.Address, patch Patch) (bool, error) {
+	// @@TODO: hacky
+	keypath := KeypathSeparator + string(bytes.ReplaceAll(patch.Keypath, tree.KeypathSeparator, []byte(KeypathSeparator)))
+	for _, permsMap := range permsMaps {
 		for pattern := range permsMap {
-			expandedPattern := string(senderRegexp.ReplaceAll([]byte(pattern), []byte(tx.From.Hex())))
-			matched, err := regexp.MatchString(expandedPattern, keypath)
-			if err != nil {
-				return errors.Wrapf(types.Err403, "error executing regex")
-			}
+			for _, sender := range senders {
+				expandedPattern := string(senderRegexp.ReplaceAll([]byte(pattern), []byte(sender.Hex())))
+				matched, err := regexp.MatchString(expandedPattern, keypath)
+				if err != nil {
+					return false, errors.Wrapf(types.Err403, "error executing regex")
+				}
 
-			if matched {
-				canWrite, _ := getValue(permsMap, []string{pattern, "write"})
-				if canWrite == true {
-					valid = true
-					break
+				if matched {
+					canWrite, _ := getValue(permsMap, []string{pattern, "write"})
+					if canWrite == true {
+						return true, nil
+					}
 				}
 			}
 		}
-		if !valid {
-			return errors.Wrapf(types.Err403, "could not find a matching rule (user: %v, patch: %v)", tx.From.String(), patch.String())
-		}
 	}
-
-	return nil
+	return false, nil
 }
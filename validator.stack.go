@@ -1,53 +1,126 @@
 package redwood
 
-// import (
-// 	"github.com/pkg/errors"
-// )
-
-// type stackValidator struct {
-// 	validators []Validator
-// }
-
-// func NewStackValidator(params map[string]interface{}) (Validator, error) {
-// 	children, exists := M(params).GetSlice("children")
-// 	if !exists {
-// 		return nil, errors.New("stack validator needs an array 'children' param")
-// 	}
-
-// 	var validators []Validator
-// 	for i := range children {
-// 		config, is := children[i].(map[string]interface{})
-// 		if !is {
-// 			return nil, errors.New("stack validator found something that didn't look like a validator config")
-// 		}
-
-// 		validator, err := initValidatorFromConfig(config)
-// 		if err != nil {
-// 			return nil, err
-// 		}
-
-// 		validators = append(validators, validator)
-// 	}
-
-// 	return &stackValidator{validators: validators}, nil
-// }
-
-// func (v *stackValidator) ValidateFetch(state interface{}, keypath []string, requester Address) error {
-// 	for i := range v.validators {
-// 		err := v.validators[i].ValidateFetch(state, keypath, requester)
-// 		if err != nil {
-// 			return err
-// 		}
-// 	}
-// 	return nil
-// }
-
-// func (v *stackValidator) ValidateTx(state interface{}, txs, validTxs map[ID]*Tx, tx Tx) error {
-// 	for i := range v.validators {
-// 		err := v.validators[i].ValidateTx(state, txs, validTxs, tx)
-// 		if err != nil {
-// 			return err
-// 		}
-// 	}
-// 	return nil
-// }
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/brynbellomy/redwood/nelson"
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+// Ensure stackValidator implements the Validator interface
+var _ Validator = (*stackValidator)(nil)
+
+type stackValidator struct {
+	validators []Validator
+	mode       stackValidatorMode
+}
+
+type stackValidatorMode string
+
+const (
+	// StackValidatorModeFailFast stops at the first child validator that rejects a tx.
+	StackValidatorModeFailFast stackValidatorMode = "first"
+	// StackValidatorModeAll runs every child validator and reports all of their
+	// failures together as ValidationErrors.
+	StackValidatorModeAll stackValidatorMode = "all"
+)
+
+// NewStackValidator runs a tx through a list of child validators.  Its config looks like:
+//
+//	{
+//	    "mode": "all",          // optional, defaults to "first"
+//	    "children": [
+//	        { "Content-Type": "validator/permissions", "value": { ... } },
+//	        ...
+//	    ]
+//	}
+func NewStackValidator(config tree.Node) (Validator, error) {
+	mode, exists, err := config.StringValue(tree.Keypath("mode"))
+	if err != nil && !errors.Is(err, types.Err404) {
+		return nil, err
+	} else if !exists {
+		mode = string(StackValidatorModeFailFast)
+	}
+
+	switch stackValidatorMode(mode) {
+	case StackValidatorModeFailFast, StackValidatorModeAll:
+	default:
+		return nil, errors.Errorf("stack validator has unknown mode '%v'", mode)
+	}
+
+	children := config.AtKeypath(tree.Keypath("children"), nil)
+	nodeType, _, numChildren, err := children.NodeInfo()
+	if err != nil && !errors.Is(err, types.Err404) {
+		return nil, err
+	} else if err != nil || nodeType != tree.NodeTypeSlice {
+		return nil, errors.New("stack validator needs an array 'children' param")
+	}
+
+	var validators []Validator
+	for i := uint64(0); i < numChildren; i++ {
+		validator, err := initValidatorFromConfig(children.AtKeypath(tree.EncodeSliceIndex(i), nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "stack validator child %v", i)
+		}
+		validators = append(validators, validator)
+	}
+
+	return &stackValidator{validators: validators, mode: stackValidatorMode(mode)}, nil
+}
+
+// initValidatorFromConfig constructs a validator from a NelSON-style config node with a
+// validator "Content-Type" and a "value" containing the validator's own config.
+func initValidatorFromConfig(config tree.Node) (Validator, error) {
+	contentType, err := nelson.GetContentType(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctor, exists := validatorRegistry[contentType]
+	if !exists {
+		return nil, errors.Errorf("unknown validator type '%v'", contentType)
+	}
+	return ctor(config.AtKeypath(nelson.ValueKey, nil))
+}
+
+func (v *stackValidator) ValidateTx(state tree.Node, tx *Tx) error {
+	var errs []error
+	for i := range v.validators {
+		err := v.validators[i].ValidateTx(state, tx)
+		if err == nil {
+			continue
+		} else if v.mode != StackValidatorModeAll {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return ValidationErrors{errs}
+	}
+	return nil
+}
+
+// ValidationErrors is returned by a stack validator in "all" mode and carries every
+// failure reported by its children.
+type ValidationErrors struct {
+	errs []error
+}
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i := range e.errs {
+		msgs[i] = e.errs[i].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) Errors() []error {
+	return e.errs
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	return e.errs
+}
@@ -0,0 +1,161 @@
+package redwood
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brynbellomy/redwood/tree"
+	"github.com/brynbellomy/redwood/types"
+)
+
+func newTestStackValidator(t *testing.T, mode string) Validator {
+	t.Helper()
+
+	// Each child only permits writes under a single key
+	stackConfig := map[string]interface{}{
+		"children": []interface{}{
+			map[string]interface{}{
+				"Content-Type": "validator/permissions",
+				"value": map[string]interface{}{
+					"*": map[string]interface{}{"^\\.foo": map[string]interface{}{"write": true}},
+				},
+			},
+			map[string]interface{}{
+				"Content-Type": "validator/permissions",
+				"value": map[string]interface{}{
+					"*": map[string]interface{}{"^\\.bar": map[string]interface{}{"write": true}},
+				},
+			},
+		},
+	}
+	if mode != "" {
+		stackConfig["mode"] = mode
+	}
+
+	config := tree.NewMemoryNode()
+	err := config.Set(nil, nil, stackConfig)
+	require.NoError(t, err)
+
+	validator, err := NewStackValidator(config)
+	require.NoError(t, err)
+	return validator
+}
+
+func newTxViolatingBothRules() *Tx {
+	return &Tx{
+		ID:   types.RandomID(),
+		From: types.Address{0x1},
+		Patches: []Patch{
+			{Keypath: tree.Keypath("foo"), Val: "x"},
+			{Keypath: tree.Keypath("bar"), Val: "y"},
+		},
+	}
+}
+
+func TestStackValidator_FailFastByDefault(t *testing.T) {
+	validator := newTestStackValidator(t, "")
+
+	err := validator.ValidateTx(tree.NewMemoryNode(), newTxViolatingBothRules())
+	require.Error(t, err)
+	require.Equal(t, types.Err403, errors.Cause(err))
+
+	_, isMulti := err.(ValidationErrors)
+	require.False(t, isMulti)
+}
+
+func TestStackValidator_CollectAll(t *testing.T) {
+	validator := newTestStackValidator(t, "all")
+
+	err := validator.ValidateTx(tree.NewMemoryNode(), newTxViolatingBothRules())
+	require.Error(t, err)
+
+	multi, isMulti := err.(ValidationErrors)
+	require.True(t, isMulti)
+	require.Len(t, multi.Errors(), 2)
+	for _, err := range multi.Errors() {
+		require.Equal(t, types.Err403, errors.Cause(err))
+	}
+	require.Contains(t, err.Error(), "patch: .bar")
+	require.Contains(t, err.Error(), "patch: .foo")
+}
+
+func TestStackValidator_ValidTxPassesInBothModes(t *testing.T) {
+	for _, mode := range []string{"", "first", "all"} {
+		validator := newTestStackValidator(t, mode)
+
+		tx := newTxViolatingBothRules()
+		tx.Patches = tx.Patches[:0]
+
+		err := validator.ValidateTx(tree.NewMemoryNode(), tx)
+		require.NoError(t, err)
+	}
+}
+
+func TestStackValidator_UnknownModeIsRejected(t *testing.T) {
+	config := tree.NewMemoryNode()
+	err := config.Set(nil, nil, map[string]interface{}{"mode": "some", "children": []interface{}{}})
+	require.NoError(t, err)
+
+	_, err = NewStackValidator(config)
+	require.Error(t, err)
+}
+
+func TestStackValidator_ThroughController(t *testing.T) {
+	c := newTestController(t)
+
+	// This is the same shape that the validator config takes in the state tree
+	config := tree.NewMemoryNode()
+	err := config.Set(nil, nil, map[string]interface{}{
+		"Content-Type": "validator/stack",
+		"value": map[string]interface{}{
+			"mode": "all",
+			"children": []interface{}{
+				map[string]interface{}{
+					"Content-Type": "validator/permissions",
+					"value": map[string]interface{}{
+						"*": map[string]interface{}{"^\\.(foo|baz)": map[string]interface{}{"write": true}},
+					},
+				},
+				map[string]interface{}{
+					"Content-Type": "validator/permissions",
+					"value": map[string]interface{}{
+						"*": map[string]interface{}{"^\\.(bar|baz)": map[string]interface{}{"write": true}},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	validator, err := initValidatorFromConfig(config)
+	require.NoError(t, err)
+	c.BehaviorTree().addValidator(tree.Keypath(nil), validator)
+
+	invalidTx := signTestTx(t, &Tx{
+		ID:  GenesisTxID,
+		URL: "localhost/test",
+		Patches: []Patch{
+			{Keypath: tree.Keypath("foo"), Val: "x"},
+			{Keypath: tree.Keypath("bar"), Val: "y"},
+		},
+	})
+	err = c.(*controller).processMempoolTx(invalidTx)
+	multi, isMulti := errors.Cause(err).(ValidationErrors)
+	require.True(t, isMulti)
+	require.Len(t, multi.Errors(), 2)
+
+	validTx := signTestTx(t, &Tx{
+		ID:      GenesisTxID,
+		URL:     "localhost/test",
+		Patches: []Patch{{Keypath: tree.Keypath("baz"), Val: "z"}},
+	})
+	err = c.(*controller).processMempoolTx(validTx)
+	require.NoError(t, err)
+
+	val, exists, err := c.StateAtVersion(nil).Value(tree.Keypath("baz"), nil)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, "z", val)
+}
@@ -30,11 +30,61 @@ const (
 	MsgType_FetchRef              MsgType = "fetch ref"
 	MsgType_FetchRefResponse      MsgType = "fetch ref response"
 	MsgType_AdvertisePeers        MsgType = "advertise peers"
+	MsgType_FetchHistory          MsgType = "fetch history"
 )
 
+// SubscribeMsg is the payload of a subscribe message.  If Keypath is set, the subscriber
+// only receives txs that touch it (see Tx.TouchesKeypath).  If KnownTxs is set, the
+// provider leaves the txs in it out of the history that it sends when the subscription
+// opens.  Providers that don't know about KnownTxs simply send the whole history.
+type SubscribeMsg struct {
+	StateURI string         `json:"stateURI"`
+	Keypath  string         `json:"keypath,omitempty"`
+	KnownTxs *TxBloomFilter `json:"knownTxs,omitempty"`
+}
+
+// FetchHistoryMsg is the payload of a fetch history message.  The provider responds with a
+// put message for each tx that is an ancestor of ToVersion (or ToVersion itself) but not
+// an ancestor of any of Parents, oldest first, and then closes the stream.  The requester
+// sets Parents to the leaves that it already has so that it's only sent what it's missing.
+type FetchHistoryMsg struct {
+	StateURI  string     `json:"stateURI"`
+	Parents   []types.ID `json:"parents,omitempty"`
+	ToVersion types.ID   `json:"toVersion"`
+}
+
+// VerifyAddressResponse is sent in both directions of the verify address handshake, in
+// which each side proves that it holds its address by signing the other's challenge:
+//
+//  1. The initiator sends a verify address message with its challenge.
+//  2. The responder signs it, and sends back the signature along with a CounterChallenge.
+//  3. The initiator signs the counter-challenge, and sends back the signature along with
+//     its EncryptingPublicKey.
+//  4. The responder sends its own EncryptingPublicKey, signed along with the initiator's
+//     challenge once more, or an error message if the initiator's signature didn't check
+//     out.
+//
+// So neither side shares its encrypting key until it knows who it's sharing it with.  Each
+// signature also covers the connection that it was sent over (see verifyAddressMessage),
+// so a node that relays the handshake between two others can't pass as either of them.
+// Challenge is the challenge that was signed.  If it's set, the verifier checks it against
+// the one that it sent, which turns away a replayed response early.  Older nodes leave it
+// out, and their responses are checked against the challenge that was sent to them.
 type VerifyAddressResponse struct {
-	Signature           []byte `json:"signature"`
-	EncryptingPublicKey []byte `json:"encryptingPublicKey"`
+	Signature           []byte             `json:"signature,omitempty"`
+	EncryptingPublicKey []byte             `json:"encryptingPublicKey,omitempty"`
+	Challenge           types.ChallengeMsg `json:"challenge,omitempty"`
+	CounterChallenge    types.ChallengeMsg `json:"counterChallenge,omitempty"`
+}
+
+// FetchRefMsg is the payload of a fetch ref message.  If Offset is set, the provider
+// skips that many bytes of the ref, which lets an interrupted fetch pick up where it left
+// off.  If Length is set, the provider sends at most that many bytes, which lets a ref be
+// fetched in pieces from several providers at once.
+type FetchRefMsg struct {
+	Ref    types.Hash `json:"ref"`
+	Offset int64      `json:"offset,omitempty"`
+	Length int64      `json:"length,omitempty"`
 }
 
 type FetchRefResponse struct {
@@ -42,7 +92,15 @@ type FetchRefResponse struct {
 	Body   *FetchRefResponseBody   `json:"body,omitempty"`
 }
 
-type FetchRefResponseHeader struct{}
+// FetchRefResponseHeader opens the response to a fetch ref message.  Offset is where the
+// provider starts sending the ref from.  Older providers ignore the requested offset and
+// always send the whole ref, in which case it's zero.  Size and ContentType describe the
+// whole ref, and older providers leave them unset.
+type FetchRefResponseHeader struct {
+	Offset      int64  `json:"offset,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
 
 type FetchRefResponseBody struct {
 	Data []byte `json:"data"`
@@ -53,10 +111,17 @@ type StoreRefResponse struct {
 	Hash types.Hash `json:"hash"`
 }
 
+// EncryptedTx is the payload of a private message.  Recipient is the address that the
+// payload is sealed for, which lets a store-and-forward relay hold it for them without
+// being able to read it.  Older peers leave it unset.  Relays only take deposits that the
+// sender has signed (see EncryptedTx.message).
 type EncryptedTx struct {
 	TxID             types.ID `json:"txID"`
 	EncryptedPayload []byte   `json:"encryptedPayload"`
 	SenderPublicKey  []byte   `json:"senderPublicKey"`
+
+	Recipient types.Address   `json:"recipient"`
+	Sig       types.Signature `json:"sig,omitempty"`
 }
 
 func WriteMsg(w io.Writer, msg Msg) error {
@@ -137,8 +202,20 @@ func (msg *Msg) UnmarshalJSON(bs []byte) error {
 
 	switch msg.Type {
 	case MsgType_Subscribe:
-		url := string(m.PayloadBytes)
-		msg.Payload = url[1 : len(url)-1] // remove quotes
+		var sub SubscribeMsg
+		if len(m.PayloadBytes) > 0 && m.PayloadBytes[0] == '"' {
+			// Older peers send just the stateURI
+			err := json.Unmarshal(m.PayloadBytes, &sub.StateURI)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := json.Unmarshal(m.PayloadBytes, &sub)
+			if err != nil {
+				return err
+			}
+		}
+		msg.Payload = sub
 
 	case MsgType_Put:
 		var tx Tx
@@ -148,6 +225,14 @@ func (msg *Msg) UnmarshalJSON(bs []byte) error {
 		}
 		msg.Payload = tx
 
+	case MsgType_Error:
+		var errMsg string
+		err := json.Unmarshal(m.PayloadBytes, &errMsg)
+		if err != nil {
+			return err
+		}
+		msg.Payload = errMsg
+
 	case MsgType_Ack:
 		var hash types.Hash
 		bs := []byte(m.PayloadBytes[1 : len(m.PayloadBytes)-1]) // remove quotes
@@ -180,12 +265,20 @@ func (msg *Msg) UnmarshalJSON(bs []byte) error {
 		msg.Payload = resp
 
 	case MsgType_FetchRef:
-		var hash types.Hash
-		err := json.Unmarshal([]byte(m.PayloadBytes), &hash)
-		if err != nil {
-			return err
+		var fetchRef FetchRefMsg
+		if len(m.PayloadBytes) > 0 && m.PayloadBytes[0] == '"' {
+			// Older peers send just the ref's hash
+			err := json.Unmarshal(m.PayloadBytes, &fetchRef.Ref)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := json.Unmarshal(m.PayloadBytes, &fetchRef)
+			if err != nil {
+				return err
+			}
 		}
-		msg.Payload = hash
+		msg.Payload = fetchRef
 
 	case MsgType_FetchRefResponse:
 		var resp FetchRefResponse
@@ -195,6 +288,14 @@ func (msg *Msg) UnmarshalJSON(bs []byte) error {
 		}
 		msg.Payload = resp
 
+	case MsgType_FetchHistory:
+		var fetchHistory FetchHistoryMsg
+		err := json.Unmarshal(m.PayloadBytes, &fetchHistory)
+		if err != nil {
+			return err
+		}
+		msg.Payload = fetchHistory
+
 	case MsgType_AdvertisePeers:
 		var peerTuples []peerTuple
 		err := json.Unmarshal([]byte(m.PayloadBytes), &peerTuples)